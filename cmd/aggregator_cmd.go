@@ -1,9 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/gargath/pleiades/pkg/aggregator"
-	"github.com/gargath/pleiades/pkg/aggregator/file"
-	"github.com/gargath/pleiades/pkg/aggregator/kafka"
+	"github.com/gargath/pleiades/pkg/anomaly"
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/project"
+	"github.com/gargath/pleiades/pkg/revert"
+	"github.com/gargath/pleiades/pkg/risk"
 	"github.com/gargath/pleiades/pkg/util"
 
 	"github.com/spf13/cobra"
@@ -20,40 +26,188 @@ var (
 
 	redis            string
 	redisUseSentinel bool
+	rulesFile        string
+	projectsFile     string
+	resolutions      []string
+	timezone         string
+	rollups          []string
+	retention        map[string]string
+	rollupDelay      time.Duration
+	detectAnomalies  bool
+	anomalyOpts      anomaly.Opts
+	alertSinks       []string
+	alertWebhook     string
+	alertSecret      string
+	alertBroker      string
+	alertTopic       string
+	detectReverts    bool
+	revertOpts       revert.Opts
+	revertSinks      []string
+	scoreRisk        bool
+	riskOpts         risk.Opts
 )
 
 func init() { //TODO: Use Sentinels
 	cmdAgg.Flags().StringVar(&redis, "redis-addr", "localhost:6379", "the Redis server to write aggregated stats to")
 	cmdAgg.Flags().BoolVar(&redisUseSentinel, "redis-use-sentinel", false, "should Redis use Sentinel for connect")
+	cmdAgg.Flags().StringSliceVar(&resolutions, "aggregator.resolutions", []string{bucket.Day.Name}, "the time resolutions to aggregate counters at (1m, 1h, 1d)")
+	cmdAgg.Flags().StringVar(&timezone, "aggregator.timezone", "UTC", "the time zone whose day boundaries counters follow")
+	cmdAgg.Flags().StringSliceVar(&rollups, "aggregator.rollups", []string{}, "the time resolutions to compute from the next finer resolution rather than aggregate")
+	cmdAgg.Flags().StringToStringVar(&retention, "aggregator.retention", map[string]string{bucket.Minute.Name: "48h", bucket.Hour.Name: "2160h"}, "how long to keep the counters of each resolution for (resolutions not listed are kept forever)")
+	cmdAgg.Flags().DurationVar(&rollupDelay, "aggregator.rollupDelay", 5*time.Minute, "how long to wait for late events before rolling up a bucket")
+	cmdAgg.Flags().StringVar(&rulesFile, "aggregator.rules", "", "a YAML file declaring the counters to aggregate (defaults to the built-in rules)")
+	cmdAgg.Flags().StringVar(&projectsFile, "aggregator.projects", "", "a YAML file mapping wikis to project families and languages, extending the built-in table")
+	cmdAgg.Flags().BoolVar(&detectAnomalies, "anomaly.enable", false, "enable detecting anomalies in the counters")
+	cmdAgg.Flags().StringVar(&anomalyOpts.Resolution, "anomaly.resolution", bucket.Minute.Name, "the aggregated resolution whose buckets are checked for anomalies")
+	cmdAgg.Flags().StringSliceVar(&anomalyOpts.Counters, "anomaly.counters", []string{"pleiades_total", "pleiades_wiki_*", "pleiades_type_*", "pleiades_bot"}, "the patterns of the counters to check for anomalies")
+	cmdAgg.Flags().Float64Var(&anomalyOpts.Alpha, "anomaly.alpha", 0.05, "the weight of every bucket in the moving averages counters are compared with")
+	cmdAgg.Flags().Float64Var(&anomalyOpts.Threshold, "anomaly.threshold", 5, "the number of standard deviations a counter must deviate from its average by to be an anomaly")
+	cmdAgg.Flags().Int64Var(&anomalyOpts.Warmup, "anomaly.warmup", 60, "the number of buckets a counter's average must have seen before it raises alerts")
+	cmdAgg.Flags().Float64Var(&anomalyOpts.MinCount, "anomaly.minCount", 10, "the smallest count (when spiking) or average (when dropping) that raises alerts")
+	cmdAgg.Flags().DurationVar(&anomalyOpts.Delay, "anomaly.delay", 2*time.Minute, "how long to wait for late events before checking a bucket")
+	cmdAgg.Flags().StringSliceVar(&alertSinks, "anomaly.sinks", []string{anomaly.SinkLog}, "where to send alerts (log, webhook, kafka)")
+	cmdAgg.Flags().StringVar(&alertWebhook, "anomaly.webhook", "", "the URL to POST alerts to")
+	cmdAgg.Flags().StringVar(&alertSecret, "anomaly.webhookSecret", "", "the secret to sign alerts POSTed to the webhook with")
+	cmdAgg.Flags().StringVar(&alertBroker, "anomaly.broker", "localhost:9092", "the kafka broker to write alerts to")
+	cmdAgg.Flags().StringVar(&alertTopic, "anomaly.topic", "pleiades-alerts", "the kafka topic to write alerts to")
+	cmdAgg.Flags().BoolVar(&detectReverts, "reverts.enable", false, "enable detecting reverts and edit wars")
+	cmdAgg.Flags().DurationVar(&revertOpts.Window, "reverts.window", time.Hour, "how long to keep the edits of a page for and count reverts in")
+	cmdAgg.Flags().Int64Var(&revertOpts.History, "reverts.history", 50, "the maximum number of edits to keep per page")
+	cmdAgg.Flags().IntVar(&revertOpts.MinReverts, "reverts.minReverts", 3, "the number of reverts in a window that makes an edit war")
+	cmdAgg.Flags().IntVar(&revertOpts.MinUsers, "reverts.minUsers", 2, "the number of users reverting each other in a window that makes an edit war")
+	cmdAgg.Flags().StringSliceVar(&revertSinks, "reverts.sinks", []string{}, "where to send edit war alerts (log, webhook, kafka), configured like anomaly alerts")
+	cmdAgg.Flags().BoolVar(&scoreRisk, "risk.enable", false, "enable scoring the vandalism risk of edits")
+	cmdAgg.Flags().StringVar(&riskOpts.File, "risk.rules", "", "a YAML file weighing the factors of the risk of edits, reloaded when it changes (defaults to the built-in rules)")
+	cmdAgg.Flags().DurationVar(&riskOpts.ReloadInterval, "risk.reloadInterval", 30*time.Second, "how often to check the risk rules file for changes")
 }
 
 func startAggregator(cmd *cobra.Command, args []string) error {
 	logger.Info("Aggregation server starting...")
 
-	var a aggregator.Server
-	var aggErr error
-	redisOpts := &util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel}
-	if fileOn {
-		a, aggErr = file.NewAggregator(redisOpts, &file.Opts{
-			Source: fileDir,
-		})
+	source, cfg, err := enabledSource(cmd)
+	if err != nil {
+		return err
+	}
+	rules := aggregator.MustCompileDefaultRules()
+	if rulesFile != "" {
+		rules, err = aggregator.LoadRules(rulesFile)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Loaded counter rules from %s", rulesFile)
+	}
+	if projectsFile != "" {
+		projects, err := project.Load(projectsFile)
+		if err != nil {
+			return err
+		}
+		rules.SetProjects(projects)
+		logger.Infof("Loaded project table from %s", projectsFile)
+	}
+	buckets, err := bucket.NewConfig(&bucket.Opts{
+		Resolutions: resolutions,
+		Rollups:     rollups,
+		Retention:   retention,
+		Timezone:    timezone,
+	})
+	if err != nil {
+		return err
+	}
+	r, err := util.NewValidatedRedisClient(&util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel})
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis at %s: %v", redis, err)
 	}
-	if kafkaOn {
-		a, aggErr = kafka.NewAggregator(redisOpts, &kafka.Opts{
-			Broker: kafkaBroker,
-			Topic:  kafkaTopic,
-		})
+	engine := aggregator.NewEngine(r, rules, buckets)
+	err = engine.RecordHalfLives()
+	if err != nil {
+		return err
 	}
-	if aggErr != nil {
-		return aggErr
+	if detectReverts {
+		sinks, err := newAlertSinks(revertSinks)
+		if err != nil {
+			return err
+		}
+		d, err := revert.NewDetector(r, &revertOpts, sinks)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		engine.SetReverts(d)
+	}
+	if scoreRisk {
+		h, err := risk.NewHeuristic(r, &riskOpts)
+		if err != nil {
+			return err
+		}
+		h.Start()
+		defer h.Stop()
+		engine.SetScorer(h)
+	}
+	a, err := source.New(cfg, engine)
+	if err != nil {
+		return err
+	}
+
+	if len(buckets.Rollups) > 0 {
+		ru, err := aggregator.NewRollup(r, buckets, &aggregator.RollupOpts{Delay: rollupDelay})
+		if err != nil {
+			return err
+		}
+		err = ru.Start()
+		if err != nil {
+			return err
+		}
+		defer ru.Stop()
+	}
+
+	if detectAnomalies {
+		sinks, err := newAlertSinks(alertSinks)
+		if err != nil {
+			return err
+		}
+		d, err := anomaly.NewDetector(r, buckets, &anomalyOpts, sinks)
+		if err != nil {
+			return err
+		}
+		err = d.Start()
+		if err != nil {
+			return err
+		}
+		defer d.Stop()
 	}
 
 	registerShutdownHook(a)
 
-	err := a.Start()
+	err = a.Start()
 	if err != nil {
 		return err
 	}
 	logger.Info("Aggregation shutdown complete")
 	return nil
 }
+
+// newAlertSinks returns the sinks named, configured by the --anomaly flags
+func newAlertSinks(names []string) ([]anomaly.Sink, error) {
+	var sinks []anomaly.Sink
+	for _, name := range names {
+		switch name {
+		case anomaly.SinkLog:
+			sinks = append(sinks, anomaly.NewLogSink())
+		case anomaly.SinkWebhook:
+			s, err := anomaly.NewWebhookSink(alertWebhook, alertSecret)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		case anomaly.SinkKafka:
+			s, err := anomaly.NewKafkaSink(alertBroker, alertTopic)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		default:
+			return nil, fmt.Errorf("unknown alert sink %s (use %s, %s or %s)", name, anomaly.SinkLog, anomaly.SinkWebhook, anomaly.SinkKafka)
+		}
+	}
+	return sinks, nil
+}
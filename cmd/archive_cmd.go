@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/plugin"
+	"github.com/gargath/pleiades/pkg/sink"
+	"github.com/gargath/pleiades/pkg/sink/s3"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdArchive = &cobra.Command{
+		Use:   "archive",
+		Short: "Starts Pleiades S3 archiver",
+		Long: `The archive command starts the S3 archiver.
+	It will consume events from kafka and write them as compressed, hourly partitioned objects
+	to S3-compatible object storage. Offsets are committed only after a batch has been archived.`,
+		RunE: startArchiver,
+	}
+
+	archiveGroupID       string
+	archiveBatchSize     int
+	archiveFlushInterval time.Duration
+)
+
+func init() {
+	cmdArchive.Flags().StringVar(&archiveGroupID, "archive.groupID", "pleiades-archiver-group", "the kafka consumer group to use for archiving")
+	cmdArchive.Flags().IntVar(&archiveBatchSize, "archive.batchSize", 10000, "the maximum number of events per batch")
+	cmdArchive.Flags().DurationVar(&archiveFlushInterval, "archive.flushInterval", 5*time.Minute, "the maximum time to wait before archiving an incomplete batch")
+	plugin.BindFlags(cmdArchive.Flags(), s3.Options)
+}
+
+func startArchiver(cmd *cobra.Command, args []string) error {
+	logger.Info("Archiver starting...")
+
+	k := kafka.OptsFromConfig(backendConfig(cmd, kafka.Options))
+	s, err := s3.NewSink(s3.OptsFromConfig(backendConfig(cmd, s3.Options)))
+	if err != nil {
+		return err
+	}
+	c, err := sink.NewConsumer(s, &sink.ConsumerOpts{
+		Broker:         k.Broker,
+		Topic:          k.Topic,
+		GroupID:        archiveGroupID,
+		BatchSize:      archiveBatchSize,
+		FlushInterval:  archiveFlushInterval,
+		SchemaRegistry: k.SchemaRegistry,
+	})
+	if err != nil {
+		return err
+	}
+
+	registerShutdownHook(c)
+
+	err = c.Start()
+	if err != nil {
+		return err
+	}
+	logger.Info("Archiver shutdown complete")
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/avro"
+	kafkapub "github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/plugin"
+	"github.com/gargath/pleiades/pkg/sink/s3"
+	"github.com/segmentio/kafka-go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdBackfill = &cobra.Command{
+		Use:   "backfill",
+		Short: "Republishes archived events to kafka",
+		Long: `The backfill command reads events from the S3 archive and publishes them to the kafka topic.
+	This can be used to rebuild aggregated stats for a time range after data loss.`,
+		RunE: startBackfill,
+	}
+
+	backfillFrom string
+	backfillTo   string
+	backfillWiki string
+)
+
+func init() {
+	cmdBackfill.Flags().StringVar(&backfillFrom, "backfill.from", "", "the start of the time range to backfill (RFC3339, required)")
+	cmdBackfill.Flags().StringVar(&backfillTo, "backfill.to", "", "the end of the time range to backfill (RFC3339, defaults to now)")
+	cmdBackfill.Flags().StringVar(&backfillWiki, "backfill.wiki", "", "only backfill events from this wiki")
+	plugin.BindFlags(cmdBackfill.Flags(), s3.Options)
+}
+
+func startBackfill(cmd *cobra.Command, args []string) error {
+	from, err := time.Parse(time.RFC3339, backfillFrom)
+	if err != nil {
+		return fmt.Errorf("invalid --backfill.from: %v", err)
+	}
+	to := time.Now()
+	if backfillTo != "" {
+		to, err = time.Parse(time.RFC3339, backfillTo)
+		if err != nil {
+			return fmt.Errorf("invalid --backfill.to: %v", err)
+		}
+	}
+	logger.Infof("Backfilling events between %s and %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+	s, err := s3.NewSink(s3.OptsFromConfig(backendConfig(cmd, s3.Options)))
+	if err != nil {
+		return err
+	}
+	k := kafkapub.OptsFromConfig(backendConfig(cmd, kafkapub.Options))
+	w := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:   []string{k.Broker},
+		Topic:     k.Topic,
+		BatchSize: 100,
+		Balancer:  kafka.Murmur2Balancer{},
+	})
+	defer w.Close()
+
+	var serializer *avro.Serializer
+	if k.Encoding == kafkapub.EncodingAvro {
+		if k.SchemaRegistry == "" {
+			return kafkapub.ErrNoRegistry
+		}
+		serializer, err = avro.NewSerializer(avro.NewRegistry(k.SchemaRegistry), avro.SubjectFor(k.Topic), avro.EventSchema())
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.Replay(from, to, backfillWiki, func(id string, data []byte) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if serializer != nil {
+			data, err = serializer.Serialize(data)
+			if err != nil {
+				return err
+			}
+		}
+		return w.WriteMessages(ctx, kafka.Message{Key: []byte(id), Value: data})
+	})
+	if err != nil {
+		return fmt.Errorf("backfill aborted after %d events: %v", n, err)
+	}
+	logger.Infof("Backfill complete, %d events published", n)
+	return nil
+}
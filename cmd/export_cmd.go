@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/avro"
+	kafkapub "github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/parquet"
+	"github.com/segmentio/kafka-go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdExport = &cobra.Command{
+		Use:   "export",
+		Short: "Exports events from kafka to Parquet files",
+		Long: `The export command reads all events currently held in the kafka topic and writes them to Parquet files.
+	Files are rolled once they reach the configured number of rows. The command exits once it has caught up with the topic.`,
+		RunE: startExport,
+	}
+
+	exportDir         string
+	exportFrom        string
+	exportMaxRows     int64
+	exportCompression string
+)
+
+func init() {
+	cmdExport.Flags().StringVar(&exportDir, "export.dir", "./export", "the directory to write Parquet files to")
+	cmdExport.Flags().StringVar(&exportFrom, "export.from", "", "only export events published after this time (RFC3339)")
+	cmdExport.Flags().Int64Var(&exportMaxRows, "export.maxRows", 1000000, "the maximum number of events per file")
+	cmdExport.Flags().StringVar(&exportCompression, "export.compression", parquet.CodecGzip, "the page compression to use ('gzip' or 'none')")
+}
+
+func startExport(cmd *cobra.Command, args []string) error {
+	var from time.Time
+	if exportFrom != "" {
+		var err error
+		from, err = time.Parse(time.RFC3339, exportFrom)
+		if err != nil {
+			return fmt.Errorf("invalid --export.from: %v", err)
+		}
+	}
+
+	k := kafkapub.OptsFromConfig(backendConfig(cmd, kafkapub.Options))
+	w, err := parquet.NewFileWriter(&parquet.FileWriterOpts{
+		Dir:         exportDir,
+		Prefix:      k.Topic,
+		MaxRows:     exportMaxRows,
+		Compression: exportCompression,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := kafka.DialLeader(ctx, "tcp", k.Broker, k.Topic, 0)
+	if err != nil {
+		return fmt.Errorf("error connecting to kafka: %v", err)
+	}
+	partitions, err := conn.ReadPartitions(k.Topic)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("error reading partitions: %v", err)
+	}
+
+	var registry *avro.Registry
+	if k.SchemaRegistry != "" {
+		registry = avro.NewRegistry(k.SchemaRegistry)
+	}
+	decoder := avro.NewDeserializer(registry)
+
+	var total int64
+	for _, p := range partitions {
+		n, err := exportPartition(k, p.ID, from, decoder, w)
+		total += n
+		if err != nil {
+			w.Close()
+			return fmt.Errorf("export of partition %d failed after %d events: %v", p.ID, n, err)
+		}
+		logger.Infof("Exported %d events from partition %d", n, p.ID)
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Export complete, %d events written to %s", total, exportDir)
+	return nil
+}
+
+// exportPartition writes all messages of a partition up to its current end offset, from the first one written at or
+// after from unless it is zero. It returns at once if there are none.
+func exportPartition(k *kafkapub.Opts, partition int, from time.Time, decoder *avro.Deserializer, w *parquet.FileWriter) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := kafka.DialLeader(ctx, "tcp", k.Broker, k.Topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	first, last, err := conn.ReadOffsets()
+	offset := first
+	if err == nil && !from.IsZero() {
+		// the end of the partition if every message is older than from
+		offset, err = conn.ReadOffset(from)
+	}
+	conn.Close()
+	if err != nil {
+		return 0, err
+	}
+	if offset >= last {
+		return 0, nil
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   []string{k.Broker},
+		Topic:     k.Topic,
+		Partition: partition,
+		MinBytes:  1,
+		MaxBytes:  10e6,
+	})
+	defer r.Close()
+	err = r.SetOffset(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		m, err := r.ReadMessage(ctx)
+		cancel()
+		if err != nil {
+			return count, err
+		}
+		data, err := decoder.Deserialize(m.Value)
+		if err == nil {
+			err = w.Write(data)
+		}
+		if err != nil {
+			logger.Errorf("Skipping event at offset %d: %v", m.Offset, err)
+		} else {
+			count++
+		}
+		if m.Offset >= last-1 {
+			return count, nil
+		}
+	}
+}
@@ -21,17 +21,20 @@ var (
 	frontendRedis            string
 	frontendRedisUseSentinel bool
 	listenAddr               string
+	frontendTimezone         string
 )
 
 func init() { //TODO: Use Sentinels
 	cmdFront.Flags().StringVar(&frontendRedis, "frontend-redis-addr", "localhost:6379", "the Redis server to write aggregated stats to")
 	cmdFront.Flags().BoolVar(&frontendRedisUseSentinel, "frontend-redis-use-sentinel", false, "should Redis use Sentinel for connect")
 	cmdFront.Flags().StringVar(&listenAddr, "listen-addr", ":8080", "the address to listen on")
+	cmdFront.Flags().StringVar(&frontendTimezone, "frontend.timezone", "UTC", "the time zone the aggregator was configured with")
 }
 
 func startFrontend(cmd *cobra.Command, args []string) error {
 	f, err := web.NewFrontend(&web.Opts{
 		ListenAddr: listenAddr,
+		Timezone:   frontendTimezone,
 		Redis: &util.RedisOpts{
 			RedisAddr:        frontendRedis,
 			RedisUseSentinel: frontendRedisUseSentinel,
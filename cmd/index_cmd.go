@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/sink"
+	"github.com/gargath/pleiades/pkg/sink/elastic"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdIndex = &cobra.Command{
+		Use:   "index",
+		Short: "Starts Pleiades Elasticsearch indexer",
+		Long: `The index command starts the Elasticsearch indexer.
+	It will consume events from kafka and bulk-index them into Elasticsearch or OpenSearch.
+	Offsets are committed only after a batch has been indexed.`,
+		RunE: startIndexer,
+	}
+
+	indexGroupID string
+)
+
+func init() {
+	cmdIndex.Flags().StringVar(&indexGroupID, "index.groupID", "pleiades-indexer-group", "the kafka consumer group to use for indexing")
+}
+
+func startIndexer(cmd *cobra.Command, args []string) error {
+	logger.Info("Indexer starting...")
+
+	opts := elastic.OptsFromConfig(backendConfig(cmd, elastic.Options))
+	k := kafka.OptsFromConfig(backendConfig(cmd, kafka.Options))
+	s, err := elastic.NewSink(opts)
+	if err != nil {
+		return err
+	}
+	c, err := sink.NewConsumer(s, &sink.ConsumerOpts{
+		Broker:         k.Broker,
+		Topic:          k.Topic,
+		GroupID:        indexGroupID,
+		BatchSize:      opts.BatchSize,
+		FlushInterval:  opts.FlushInterval,
+		SchemaRegistry: k.SchemaRegistry,
+	})
+	if err != nil {
+		return err
+	}
+
+	registerShutdownHook(c)
+
+	err = c.Start()
+	if err != nil {
+		return err
+	}
+	logger.Info("Indexer shutdown complete")
+	return nil
+}
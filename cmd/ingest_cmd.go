@@ -1,9 +1,10 @@
 package main
 
 import (
+	"os"
+
 	"github.com/gargath/pleiades/pkg/ingester"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/file"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/transform"
 	"github.com/spf13/cobra"
 )
 
@@ -16,32 +17,38 @@ It will begin consuming the WMF stream and publish received events to the config
 		RunE: startIngest,
 	}
 
-	c      *ingester.Coordinator
-	resume bool
+	c               *ingester.Coordinator
+	resume          bool
+	transforms      []string
+	transformSecret string
 )
 
 func init() {
 	cmdIngest.Flags().BoolVarP(&resume, "resume", "r", true, "try to resume from last seen event ID")
+	cmdIngest.Flags().StringArrayVar(&transforms, "transform", []string{}, "transform to apply to events before publishing, in order (repeatable, e.g. drop:comment,parsedcomment or hash-user)")
+	cmdIngest.Flags().StringVar(&transformSecret, "transform.secret", "", "the key to hash usernames with (defaults to $PLEIADES_TRANSFORM_SECRET)")
 }
 
 func startIngest(cmd *cobra.Command, args []string) error {
 
 	logger.Info("Ingest server starting...")
 
-	c = &ingester.Coordinator{
-		Resume: resume,
+	name, cfg, err := enabledPublisher(cmd)
+	if err != nil {
+		return err
 	}
-
-	if fileOn {
-		c.File = &file.Opts{
-			Destination: fileDir,
-		}
+	if transformSecret == "" {
+		transformSecret = os.Getenv("PLEIADES_TRANSFORM_SECRET")
 	}
-	if kafkaOn {
-		c.Kafka = &kafka.Opts{
-			Broker: kafkaBroker,
-			Topic:  kafkaTopic,
-		}
+	chain, err := transform.NewChain(transforms, &transform.Opts{Secret: transformSecret})
+	if err != nil {
+		return err
+	}
+	c = &ingester.Coordinator{
+		Resume:          resume,
+		Publisher:       name,
+		PublisherConfig: cfg,
+		Transforms:      chain,
 	}
 
 	registerShutdownHook(c)
@@ -3,12 +3,16 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/op/go-logging"
 
 	"github.com/spf13/cobra"
 
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
 	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/plugin"
 )
 
 const moduleName = "main"
@@ -18,11 +22,6 @@ var (
 	verbose     bool
 	quiet       bool
 	metricsPort string
-	fileOn      bool
-	kafkaOn     bool
-	fileDir     string
-	kafkaBroker string
-	kafkaTopic  string
 )
 
 func main() {
@@ -39,12 +38,25 @@ func main() {
 			} else {
 				log.InitLogLevel(log.DEFAULT)
 			}
-			if cmd.Use != "frontend" {
-				if fileOn && kafkaOn {
-					return fmt.Errorf("Can only specify either --file.enable or --kafka.enable")
-
-				} else if !fileOn && !kafkaOn {
-					return fmt.Errorf("No queue backend specified (use either --file.enable or --kafka.enable)")
+			var backends []string
+			switch cmd.Use {
+			case "ingest":
+				backends = publisherNames()
+			case "aggregate":
+				backends = sourceNames()
+			}
+			if backends != nil {
+				var enabled, flags []string
+				for _, name := range backends {
+					flags = append(flags, "--"+plugin.EnableFlag(name))
+					if on, _ := cmd.Flags().GetBool(plugin.EnableFlag(name)); on {
+						enabled = append(enabled, "--"+plugin.EnableFlag(name))
+					}
+				}
+				if len(enabled) > 1 {
+					return fmt.Errorf("Can only specify one of %s", strings.Join(enabled, ", "))
+				} else if len(enabled) == 0 {
+					return fmt.Errorf("No queue backend specified (use one of %s)", strings.Join(flags, ", "))
 				}
 			}
 			initMetrics(metricsPort)
@@ -58,15 +70,16 @@ func main() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "suppress all output except for errors")
 	rootCmd.PersistentFlags().StringVar(&metricsPort, "metricsPort", "9000", "the port to serve Prometheus metrics on")
-	rootCmd.PersistentFlags().BoolVar(&fileOn, "file.enable", false, "enable the filesystem publisher")
-	rootCmd.PersistentFlags().StringVar(&fileDir, "file.publishDir", "./events", "the directory to publish events to")
-	rootCmd.PersistentFlags().BoolVar(&kafkaOn, "kafka.enable", false, "enable the kafka publisher")
-	rootCmd.PersistentFlags().StringVar(&kafkaBroker, "kafka.broker", "localhost:9092", "the kafka broker to connect to")
-	rootCmd.PersistentFlags().StringVar(&kafkaTopic, "kafka.topic", "pleiades-events", "the kafka topic to publish to")
+	bindBackendFlags(rootCmd)
 
 	rootCmd.AddCommand(cmdIngest)
 	rootCmd.AddCommand(cmdAgg)
 	rootCmd.AddCommand(cmdFront)
+	rootCmd.AddCommand(cmdIndex)
+	rootCmd.AddCommand(cmdArchive)
+	rootCmd.AddCommand(cmdBackfill)
+	rootCmd.AddCommand(cmdExport)
+	rootCmd.AddCommand(cmdStore)
 
 	logger = log.MustGetLogger(moduleName)
 	logger.Infof("Pleiades %s\n", version())
@@ -76,3 +89,19 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func publisherNames() []string {
+	var names []string
+	for _, p := range publisher.Plugins() {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func sourceNames() []string {
+	var names []string
+	for _, s := range aggregator.Sources() {
+		names = append(names, s.Name)
+	}
+	return names
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/plugin"
+	"github.com/spf13/cobra"
+
+	// publishers and aggregator sources register themselves when linked into the binary
+	_ "github.com/gargath/pleiades/pkg/aggregator/file"
+	_ "github.com/gargath/pleiades/pkg/aggregator/kafka"
+	_ "github.com/gargath/pleiades/pkg/ingester/publisher/file"
+	_ "github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	_ "github.com/gargath/pleiades/pkg/ingester/publisher/webhook"
+	_ "github.com/gargath/pleiades/pkg/sink/elastic"
+	_ "github.com/gargath/pleiades/pkg/sink/sqldb"
+)
+
+// bindBackendFlags adds the enable flag and options of every registered publisher and aggregator source
+// to the persistent flags of the command given
+func bindBackendFlags(cmd *cobra.Command) {
+	fs := cmd.PersistentFlags()
+	for _, p := range publisher.Plugins() {
+		plugin.BindFlags(fs, []plugin.Option{{Name: plugin.EnableFlag(p.Name), Usage: "enable the " + p.Description, Default: false}})
+		plugin.BindFlags(fs, p.Options)
+	}
+	for _, s := range aggregator.Sources() {
+		plugin.BindFlags(fs, []plugin.Option{{Name: plugin.EnableFlag(s.Name), Usage: "enable the " + s.Description, Default: false}})
+		plugin.BindFlags(fs, s.Options)
+	}
+}
+
+// enabledPublisher returns the name of the publisher enabled on the command line and its configuration
+func enabledPublisher(cmd *cobra.Command) (string, plugin.Config, error) {
+	for _, p := range publisher.Plugins() {
+		if on, _ := cmd.Flags().GetBool(plugin.EnableFlag(p.Name)); !on {
+			continue
+		}
+		cfg, err := plugin.FromFlags(cmd.Flags(), p.Options)
+		return p.Name, cfg, err
+	}
+	return "", nil, fmt.Errorf("no publisher enabled")
+}
+
+// enabledSource returns the aggregator source enabled on the command line and its configuration
+func enabledSource(cmd *cobra.Command) (*aggregator.SourcePlugin, plugin.Config, error) {
+	for _, s := range aggregator.Sources() {
+		if on, _ := cmd.Flags().GetBool(plugin.EnableFlag(s.Name)); !on {
+			continue
+		}
+		cfg, err := plugin.FromFlags(cmd.Flags(), s.Options)
+		return s, cfg, err
+	}
+	return nil, nil, fmt.Errorf("no aggregator source enabled")
+}
+
+// backendConfig reads the values of a backend's options from the command's flags
+func backendConfig(cmd *cobra.Command, options []plugin.Option) plugin.Config {
+	cfg, err := plugin.FromFlags(cmd.Flags(), options)
+	if err != nil {
+		// all backend options are registered on the root command, so this is a programming error
+		panic(err)
+	}
+	return cfg
+}
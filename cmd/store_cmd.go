@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/sink"
+	"github.com/gargath/pleiades/pkg/sink/sqldb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdStore = &cobra.Command{
+		Use:   "store",
+		Short: "Starts Pleiades SQL store",
+		Long: `The store command starts the SQL store.
+	It will consume events from kafka and insert them into a PostgreSQL or SQLite database.
+	Offsets are committed only after a batch has been inserted.`,
+		RunE: startStore,
+	}
+
+	storeGroupID string
+)
+
+func init() {
+	cmdStore.Flags().StringVar(&storeGroupID, "store.groupID", "pleiades-store-group", "the kafka consumer group to use for storing events")
+}
+
+func startStore(cmd *cobra.Command, args []string) error {
+	logger.Info("SQL store starting...")
+
+	opts := sqldb.OptsFromConfig(backendConfig(cmd, sqldb.Options))
+	k := kafka.OptsFromConfig(backendConfig(cmd, kafka.Options))
+	s, err := sqldb.NewSink(opts)
+	if err != nil {
+		return err
+	}
+	c, err := sink.NewConsumer(s, &sink.ConsumerOpts{
+		Broker:         k.Broker,
+		Topic:          k.Topic,
+		GroupID:        storeGroupID,
+		BatchSize:      opts.BatchSize,
+		FlushInterval:  opts.FlushInterval,
+		SchemaRegistry: k.SchemaRegistry,
+	})
+	if err != nil {
+		return err
+	}
+
+	registerShutdownHook(c)
+
+	err = c.Start()
+	if err != nil {
+		return err
+	}
+	logger.Info("SQL store shutdown complete")
+	return nil
+}
@@ -5,10 +5,13 @@ go 1.14
 require (
 	astuart.co/go-sse v0.0.0-20170313210228-b4959b80efe5
 	github.com/a-h/generate v0.0.0-20190312091541-e59c34d33fb3 // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-co-op/gocron v0.3.0
 	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/go-redis/redis/v8 v8.0.0-beta.7
 	github.com/gorilla/mux v1.7.4
+	github.com/lib/pq v1.7.0
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/onsi/ginkgo v1.14.0
 	github.com/onsi/gomega v1.10.1
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
@@ -20,4 +23,5 @@ require (
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.0
+	gopkg.in/yaml.v2 v2.3.0
 )
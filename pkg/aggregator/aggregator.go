@@ -1,7 +1,6 @@
 package aggregator
 
 import (
-	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -28,43 +27,6 @@ var (
 	)
 )
 
-// CountersFromEventData parses an event body and generates the Redis counters to increment for it
-func CountersFromEventData(data []byte) ([]string, int64, error) { //TODO: This should return a set of counters and increments to allow for more than just +1
-	var lendiff int64 = 0
-	var counters = []string{"pleiades_total"}
-	var event MediawikiRecentchange
-	err := json.Unmarshal(data, &event)
-	if err != nil {
-		logger.Debugf("failed to parse event data line: %s", string(data))
-		return counters, 0, fmt.Errorf("failed to parse event data: %v", err)
-	}
-	if event.Wiki != "" {
-		counters = append(counters, "pleiades_wiki_"+event.Wiki)
-	} else {
-		logger.Info("Encountered event without a Wiki: %+v", event)
-	}
-	if event.Type != "" {
-		counters = append(counters, "pleiades_type_"+event.Type)
-	} else {
-		logger.Info("Encountered event without Type: %+v", event)
-	}
-	if event.Bot {
-		counters = append(counters, "pleiades_bot")
-	}
-	if event.Minor {
-		counters = append(counters, "pleiades_minor")
-	}
-	if event.Length != nil {
-		if event.Length.Old < event.Length.New {
-			counters = append(counters, "pleiades_length_inc")
-		} else {
-			counters = append(counters, "pleiades_length_dec")
-		}
-		lendiff = event.Length.New - event.Length.Old
-	}
-	return counters, lendiff, nil
-}
-
 // RecordLag parses the timestamp from a event ID and observes the lag as Prometheus metrics
 func RecordLag(id string) {
 	timeStamp, err := ParseTimestamp(id)
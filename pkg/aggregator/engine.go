@@ -0,0 +1,470 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/histogram"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reasonDuplicate marks events skipped because they were applied before
+const reasonDuplicate = "duplicate"
+
+// halfLivesKey is the hash of the key templates of the decaying sorted sets of the rules and their half-lives, so that
+// readers can decay their scores
+const halfLivesKey = "pleiades_half_lives"
+
+// editorsSuffix ends the keys of the sets of the members of a decaying sorted set and their editors
+const editorsSuffix = "_editors"
+
+// applyOps is the part of the scripts applying ops. The ops are on the KEYS from k on, and their kind, increment,
+// member or hash field, expiry and cap (0 for none) are the ARGV from base on. An op adding an editor to a set of the
+// editors of a decaying sorted set sets the weight of the increment of the op following it: 1 if the editor is new,
+// or the increment of the editor op if it is repeated.
+const applyOps = `
+local weight = 1
+for i = k, #KEYS do
+	local a = 5 * (i - k) + base
+	if ARGV[a] == 'c' then
+		redis.call('INCRBY', KEYS[i], ARGV[a + 1])
+	elseif ARGV[a] == 'z' then
+		redis.call('ZINCRBY', KEYS[i], ARGV[a + 1], ARGV[a + 2])
+	elseif ARGV[a] == 'e' then
+		if redis.call('SADD', KEYS[i], ARGV[a + 2]) == 1 then
+			weight = 1
+		else
+			weight = tonumber(ARGV[a + 1])
+		end
+	elseif ARGV[a] == 'w' then
+		redis.call('ZINCRBY', KEYS[i], tonumber(ARGV[a + 1]) * weight, ARGV[a + 2])
+	elseif ARGV[a] == 's' then
+		redis.call('SADD', KEYS[i], ARGV[a + 2])
+	elseif ARGV[a] == 'h' then
+		redis.call('PFADD', KEYS[i], ARGV[a + 2])
+	else
+		redis.call('HINCRBY', KEYS[i], ARGV[a + 2], ARGV[a + 1])
+	end
+	local expiry = tonumber(ARGV[a + 3])
+	if expiry > 0 then
+		redis.call('EXPIREAT', KEYS[i], expiry)
+	end
+	local cap = tonumber(ARGV[a + 4])
+	if cap > 0 then
+		redis.call('ZREMRANGEBYRANK', KEYS[i], 0, -cap - 1)
+	end
+end
+`
+
+var (
+	// incrBy applies the ops of a batch, see applyOps.
+	incrBy = redis.NewScript(`
+local k, base = 1, 1
+` + applyOps + `
+return 0
+`)
+
+	// fencedIncrBy applies the ops of a batch unless the fence in KEYS[1] shows that the batch has been applied before.
+	// ARGV[1] and ARGV[2] are the offsets of the first and last event of the batch, the remaining KEYS and ARGV are the
+	// ops, see applyOps.
+	// It returns -1 once the batch is applied, or the offset of the last event applied before if it overlaps the batch,
+	// in which case nothing is written.
+	fencedIncrBy = redis.NewScript(`
+local last = redis.call('GET', KEYS[1])
+if last and tonumber(last) >= tonumber(ARGV[1]) then
+	return tonumber(last)
+end
+local k, base = 2, 3
+` + applyOps + `
+redis.call('SET', KEYS[1], ARGV[2])
+return -1
+`)
+
+	eventsAggregated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_event_count_total",
+			Help: "Number of events processed",
+		},
+	)
+
+	eventsSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_events_skipped_total",
+			Help: "Number of events not aggregated, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	writeTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_redis_write_duration_seconds",
+			Help:    "Time taken to apply the increments of a batch of events to Redis",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+		},
+	)
+
+	batchSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_batch_size",
+			Help:    "Number of events applied to Redis in a single batch",
+			Buckets: []float64{1, 10, 50, 100, 500, 1000},
+		},
+	)
+)
+
+// NewEngine returns an Engine that applies the counters produced by rules to the Redis client given,
+// in the time buckets given by buckets
+func NewEngine(r *redis.Client, rules *Rules, buckets *bucket.Config) *Engine {
+	return &Engine{r: r, rules: rules, buckets: buckets}
+}
+
+// Apply aggregates a batch of events.
+// Every counter is incremented both in total and for the bucket of each resolution the event was received in,
+// e.g. day_<julian day>_<key>. Sorted sets, HyperLogLogs and histograms are only kept per bucket, and sorted sets are
+// trimmed to their cap once incremented. Decaying sorted sets are only kept in the generation the event was received in,
+// e.g. trend_<generation>_<key>. Rate counters are only kept in the rate slot the event was received in,
+// e.g. rate_<slot>_<key>, unless it was received too long ago to count towards any rate.
+// Increments of the same key are summed, and all of them are written by a single run of the incrBy script, which Redis
+// executes atomically, so that a batch is not applied partially if Redis cannot be reached and can be retried if an
+// error is returned.
+// Events that cannot be aggregated are skipped and returned, so that sources can set them aside.
+func (e *Engine) Apply(events []Event) ([]Skipped, error) {
+	b, skipped, err := e.aggregate(events)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.ops) > 0 {
+		keys, args := b.scriptArgs()
+		timer := prometheus.NewTimer(writeTime)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := incrBy.Run(ctx, e.r, keys, args...).Err()
+		cancel()
+		timer.ObserveDuration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply %d increments to Redis: %v", len(b.ops), err)
+		}
+	}
+	e.storePercentiles(b)
+	e.applied(events, skipped)
+	return skipped, nil
+}
+
+// ApplyFenced aggregates a batch of consecutive events from a single partition of a source like Apply, and records the
+// offset of the last event in the fence key in the same atomic step. Events at or below the offset already recorded
+// have been applied before and are skipped, so that a batch can safely be applied again after a crash.
+func (e *Engine) ApplyFenced(fence string, events []Event) ([]Skipped, error) {
+	for len(events) > 0 {
+		b, skipped, err := e.aggregate(events)
+		if err != nil {
+			return nil, err
+		}
+		keys, args := b.scriptArgs()
+		keys = append([]string{fence}, keys...)
+		args = append([]interface{}{events[0].Offset, events[len(events)-1].Offset}, args...)
+
+		timer := prometheus.NewTimer(writeTime)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		last, err := fencedIncrBy.Run(ctx, e.r, keys, args...).Int64()
+		cancel()
+		timer.ObserveDuration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply %d increments to Redis: %v", len(b.ops), err)
+		}
+		if last < 0 {
+			e.storePercentiles(b)
+			e.applied(events, skipped)
+			return skipped, nil
+		}
+
+		// the batch overlaps events applied before, so apply the remainder only
+		i := 0
+		for i < len(events) && events[i].Offset <= last {
+			i++
+		}
+		eventsSkipped.WithLabelValues(reasonDuplicate).Add(float64(i))
+		logger.Debugf("Skipping %d events already applied up to offset %d of %s", i, last, fence)
+		events = events[i:]
+	}
+	return nil, nil
+}
+
+// RecordHalfLives records the half-lives of the decaying sorted sets of the rules in Redis, by their key template
+func (e *Engine) RecordHalfLives() error {
+	halfLives := e.rules.HalfLives()
+	if len(halfLives) == 0 {
+		return nil
+	}
+	fields := make([]interface{}, 0, 2*len(halfLives))
+	for template, halfLife := range halfLives {
+		fields = append(fields, template, halfLife.String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := e.r.HSet(ctx, halfLivesKey, fields...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to record half-lives in %s: %v", halfLivesKey, err)
+	}
+	return nil
+}
+
+// FenceOffset returns the offset of the last event applied with the fence key given, or -1 if there is none
+func (e *Engine) FenceOffset(fence string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offset, err := e.r.Get(ctx, fence).Int64()
+	if err == redis.Nil {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read offset from %s: %v", fence, err)
+	}
+	return offset, nil
+}
+
+// Validate returns the events of a batch that Apply would skip because they cannot be aggregated, without writing
+// anything, so that sources can set them aside before the batch is applied.
+func (e *Engine) Validate(events []Event) []Skipped {
+	_, skipped := e.parse(events)
+	return skipped
+}
+
+// parse parses the events of a batch along with the time they were received, and returns those that cannot be parsed
+// as skipped
+func (e *Engine) parse(events []Event) ([]receivedEvent, []Skipped) {
+	var skipped []Skipped
+	var received []receivedEvent
+	for _, ev := range events {
+		event, err := e.rules.Parse(ev.Data)
+		if err != nil {
+			skipped = append(skipped, Skipped{Event: ev, Reason: ReasonParse, Err: err})
+			continue
+		}
+		ts, err := ParseTimestamp(ev.ID)
+		if err != nil {
+			skipped = append(skipped, Skipped{Event: ev, Reason: ReasonTimestamp, Err: err})
+			continue
+		}
+		received = append(received, receivedEvent{event: event, t: time.Unix(0, ts*int64(time.Millisecond))})
+	}
+	return received, skipped
+}
+
+// aggregate sums the increments of a batch of events per counter, in the order the counters first occur
+func (e *Engine) aggregate(events []Event) (*batch, []Skipped, error) {
+	b := &batch{index: make(map[string]*op), histograms: make(map[string]int64)}
+	add := func(key string, inc Increment, expiry time.Time, weight float64) {
+		o, ok := b.index[key+"\x00"+inc.Member+"\x00"+inc.Field]
+		if !ok {
+			o = &op{key: key, kind: kindCounter, cap: inc.Cap}
+			switch {
+			case inc.Field != "":
+				o.kind, o.member = kindHash, inc.Field
+			case inc.Distinct:
+				o.kind, o.member = kindHyperLogLog, inc.Member
+			case inc.Member != "":
+				o.kind, o.member = kindSortedSet, inc.Member
+			}
+			if !expiry.IsZero() {
+				o.expiry = expiry.Unix()
+			}
+			b.index[key+"\x00"+inc.Member+"\x00"+inc.Field] = o
+			b.ops = append(b.ops, o)
+		}
+		o.delta += inc.Delta
+		o.score += float64(inc.Delta) * weight
+	}
+	// addEdited adds the ops of an increment of a decaying member by an editor. They are not summed with others, so that
+	// the script can tell for each increment whether its editor is repeated.
+	addEdited := func(key string, inc Increment, expiry time.Time, weight float64) {
+		b.ops = append(b.ops,
+			&op{key: key + editorsSuffix, kind: kindEditors, member: inc.Member + "\x00" + inc.Editor, score: RepeatWeight, expiry: expiry.Unix()},
+			&op{key: key, kind: kindEditedSortedSet, member: inc.Member, score: float64(inc.Delta) * weight, expiry: expiry.Unix(), cap: inc.Cap})
+	}
+
+	// addBins adds every bin of the histogram of an increment to its key once, so that the bounds of empty bins are
+	// known when estimating percentiles
+	addBins := func(key string, inc Increment, expiry time.Time) {
+		if _, ok := b.histograms[key]; ok {
+			return
+		}
+		b.histograms[key] = 0
+		if !expiry.IsZero() {
+			b.histograms[key] = expiry.Unix()
+		}
+		for _, bound := range inc.Bounds {
+			add(key, Increment{Field: strconv.FormatInt(bound, 10)}, expiry, 1)
+		}
+		add(key, Increment{Field: InfBound}, expiry, 1)
+	}
+
+	// markRolledUp marks the bucket of a rolled up resolution an event falls into, so that it is rolled up again if it
+	// has been rolled up before
+	markRolledUp := func(r bucket.Resolution, n int64) {
+		key, member := dirtyKey(r), strconv.FormatInt(n, 10)
+		if _, ok := b.index[key+"\x00"+member+"\x00"]; ok {
+			return
+		}
+		o := &op{key: key, kind: kindSet, member: member}
+		b.index[key+"\x00"+member+"\x00"] = o
+		b.ops = append(b.ops, o)
+	}
+
+	now := time.Now()
+	received, skipped := e.parse(events)
+	if e.reverts != nil {
+		err := e.detectReverts(received)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if e.scorer != nil {
+		err := e.scoreRisk(received)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := range received {
+		received[i].incs = e.rules.EventIncrements(received[i].event)
+	}
+
+	for _, ev := range received {
+		if len(ev.incs) > 0 {
+			for _, r := range e.buckets.Rollups {
+				markRolledUp(r, e.buckets.Index(r, ev.t))
+			}
+		}
+		for _, inc := range ev.incs {
+			if inc.Rate {
+				// events received before the longest window no longer count towards any rate
+				n := bucket.RateIndex(ev.t)
+				if expiry := bucket.RateExpiry(n); expiry.After(now) {
+					add(bucket.Prefix(bucket.RateSlot, n)+inc.Key, inc, expiry, 1)
+				}
+				continue
+			}
+			if inc.HalfLife > 0 {
+				d := bucket.Decay{HalfLife: inc.HalfLife}
+				n := d.Index(ev.t)
+				if d.Expiry(n).Before(now) {
+					continue
+				}
+				weight := d.Weight(n, ev.t)
+				if inc.Editor != "" {
+					addEdited(bucket.Prefix(d.Generation(), n)+inc.Key, inc, d.Expiry(n), weight)
+					continue
+				}
+				add(bucket.Prefix(d.Generation(), n)+inc.Key, inc, d.Expiry(n), weight)
+				continue
+			}
+			if inc.Member == "" && inc.Field == "" {
+				add(inc.Key, inc, time.Time{}, 1)
+			}
+			for _, r := range e.buckets.Resolutions {
+				n := e.buckets.Index(r, ev.t)
+				key := bucket.Prefix(r, n) + inc.Key
+				if inc.Bounds != nil {
+					addBins(key, inc, e.buckets.Expiry(r, n))
+				}
+				add(key, inc, e.buckets.Expiry(r, n), 1)
+			}
+		}
+	}
+
+	// expire and trim each key once, after its last increment
+	last := make(map[string]bool)
+	for i := len(b.ops) - 1; i >= 0; i-- {
+		o := b.ops[i]
+		if last[o.key] {
+			o.expiry, o.cap = 0, 0
+		}
+		last[o.key] = true
+	}
+	return b, skipped, nil
+}
+
+// storePercentiles estimates the percentiles of the histograms a batch incremented and stores them in a hash next to
+// each histogram, e.g. day_18484_pleiades_edit_size_percentiles. They are estimated from the whole histogram, so a
+// failure is only logged: the percentiles are stored again with the next batch incrementing the histogram.
+func (e *Engine) storePercentiles(b *batch) {
+	if len(b.histograms) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hashes := make(map[string]*redis.StringStringMapCmd)
+	_, err := e.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for key := range b.histograms {
+			hashes[key] = p.HGetAll(ctx, key)
+		}
+		return nil
+	})
+	if err == nil {
+		_, err = e.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+			for key, expiry := range b.histograms {
+				counts := make(map[string]int64)
+				for bound, v := range hashes[key].Val() {
+					n, err := strconv.ParseInt(v, 10, 64)
+					if err != nil {
+						return fmt.Errorf("bin %s of histogram %s is not a number: %s", bound, key, v)
+					}
+					counts[bound] = n
+				}
+				percentiles := histogram.Percentiles(histogram.Bins(counts))
+				if percentiles == nil {
+					continue
+				}
+				fields := make([]interface{}, 0, 2*len(percentiles))
+				for name, v := range percentiles {
+					fields = append(fields, name, v)
+				}
+				p.HSet(ctx, key+histogram.PercentilesSuffix, fields...)
+				if expiry > 0 {
+					p.ExpireAt(ctx, key+histogram.PercentilesSuffix, time.Unix(expiry, 0))
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		logger.Errorf("Failed to store the percentiles of %d histograms: %v", len(b.histograms), err)
+	}
+}
+
+// applied records the metrics of a batch once it has been written
+func (e *Engine) applied(events []Event, skipped []Skipped) {
+	for _, ev := range events {
+		RecordLag(ev.ID)
+	}
+	for _, s := range skipped {
+		eventsSkipped.WithLabelValues(s.Reason).Inc()
+		logger.Errorf("Skipping event %s: %v", s.Event.ID, s.Err)
+	}
+	count := len(events) - len(skipped)
+	batchSize.Observe(float64(count))
+	eventsAggregated.Add(float64(count))
+}
+
+// scriptArgs returns the KEYS and ARGV of the ops of a batch, as applied by applyOps
+func (b *batch) scriptArgs() ([]string, []interface{}) {
+	keys := make([]string, 0, len(b.ops))
+	args := make([]interface{}, 0, 5*len(b.ops))
+	for _, o := range b.ops {
+		keys = append(keys, o.key)
+		args = append(args, o.kind, o.increment(), o.member, o.expiry, o.cap)
+	}
+	return keys, args
+}
+
+// increment returns the amount an op increments its key or member by
+func (o *op) increment() interface{} {
+	switch o.kind {
+	case kindSortedSet, kindEditors, kindEditedSortedSet:
+		return o.score
+	}
+	return o.delta
+}
@@ -0,0 +1,472 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/revert"
+	"github.com/gargath/pleiades/pkg/risk"
+	"github.com/gargath/pleiades/pkg/transform"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testID    = `[{"topic":"eqiad.mediawiki.recentchange","partition":0,"timestamp":1597056638001}]`
+	testDay   = "day_18484_"
+	testEvent = `{"wiki":"enwiki","type":"edit","bot":false,"minor":false,"length":{"old":100,"new":150}}`
+)
+
+// receivedAt returns the ID of an event received at t
+func receivedAt(t time.Time) string {
+	return fmt.Sprintf(`[{"topic":"eqiad.mediawiki.recentchange","partition":0,"timestamp":%d}]`, t.UnixNano()/int64(time.Millisecond))
+}
+
+var _ = Describe("Aggregation engine", func() {
+	var (
+		m *miniredis.Miniredis
+		e *Engine
+	)
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), MustCompileDefaultRules(), bucket.UTCDays())
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	counter := func(key string) string {
+		v, err := m.Get(key)
+		Expect(err).NotTo(HaveOccurred())
+		return v
+	}
+
+	It("writes every counter in total and for the day of the event", func() {
+		skipped, err := e.Apply([]Event{{ID: testID, Data: []byte(testEvent)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(skipped).To(BeEmpty())
+		for _, k := range []string{"pleiades_total", "pleiades_wiki_enwiki", "pleiades_type_edit", "pleiades_length_inc"} {
+			Expect(counter(k)).To(Equal("1"))
+			Expect(counter(testDay + k)).To(Equal("1"))
+		}
+		Expect(counter("pleiades_growth")).To(Equal("50"))
+		Expect(m.Exists("pleiades_bot")).To(BeFalse())
+	})
+
+	It("writes a counter for every resolution", func() {
+		buckets, err := bucket.NewConfig(&bucket.Opts{Resolutions: []string{"1m", "1h", "1d"}})
+		Expect(err).NotTo(HaveOccurred())
+		e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), MustCompileDefaultRules(), buckets)
+		_, err = e.Apply([]Event{{ID: testID, Data: []byte(testEvent)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counter("min_26617610_pleiades_total")).To(Equal("1"))
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("1"))
+		Expect(counter(testDay + "pleiades_total")).To(Equal("1"))
+		Expect(counter("pleiades_total")).To(Equal("1"))
+	})
+
+	It("sums the increments of a batch", func() {
+		events := []Event{
+			{ID: testID, Data: []byte(testEvent)},
+			{ID: testID, Data: []byte(testEvent)},
+			{ID: testID, Data: []byte(`{"wiki":"dewiki","type":"log"}`)},
+		}
+		skipped, err := e.Apply(events)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(skipped).To(BeEmpty())
+		Expect(counter("pleiades_total")).To(Equal("3"))
+		Expect(counter("pleiades_wiki_enwiki")).To(Equal("2"))
+		Expect(counter("pleiades_growth")).To(Equal("100"))
+		Expect(counter(testDay + "pleiades_wiki_dewiki")).To(Equal("1"))
+	})
+
+	It("skips events that cannot be aggregated", func() {
+		events := []Event{
+			{ID: testID, Data: []byte(`{"wiki":`)},
+			{ID: `[{"topic":"eqiad.mediawiki.recentchange","partition":0}]`, Data: []byte(testEvent)},
+			{ID: testID, Data: []byte(testEvent)},
+		}
+		skipped, err := e.Apply(events)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(skipped).To(HaveLen(2))
+		Expect(skipped[0].Reason).To(Equal(ReasonParse))
+		Expect(skipped[1].Reason).To(Equal(ReasonTimestamp))
+		Expect(skipped[1].Event).To(Equal(events[1]))
+		Expect(counter("pleiades_total")).To(Equal("1"))
+	})
+
+	It("records the half-lives of the decaying sorted sets", func() {
+		Expect(e.RecordHalfLives()).To(Succeed())
+		Expect(m.HKeys(halfLivesKey)).To(Equal([]string{"pleiades_trending_{wiki}"}))
+		Expect(m.HGet(halfLivesKey, "pleiades_trending_{wiki}")).To(Equal("1h0m0s"))
+	})
+
+	Context("with sorted sets", func() {
+		const rules = `
+counters:
+  - key: top_{wiki}
+    member: "{title}"
+    cap: 2
+`
+		edit := func(title string) Event {
+			return Event{ID: testID, Data: []byte(`{"wiki":"enwiki","title":"` + title + `"}`)}
+		}
+
+		BeforeEach(func() {
+			r, err := CompileRules([]byte(rules))
+			Expect(err).NotTo(HaveOccurred())
+			e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), r, bucket.UTCDays())
+		})
+
+		It("ranks members per bucket and trims them to the cap", func() {
+			_, err := e.Apply([]Event{edit("A"), edit("B"), edit("A"), edit("C"), edit("C"), edit("A")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.ZMembers(testDay + "top_enwiki")).To(Equal([]string{"C", "A"}))
+			Expect(m.ZScore(testDay+"top_enwiki", "A")).To(Equal(3.0))
+			Expect(m.Exists("top_enwiki")).To(BeFalse())
+		})
+
+		It("ranks members with a fence", func() {
+			_, err := e.ApplyFenced("fence", []Event{edit("A"), edit("B"), edit("B")})
+			Expect(err).NotTo(HaveOccurred())
+			events := []Event{edit("C"), edit("C"), edit("C")}
+			for i := range events {
+				events[i].Offset = int64(i + 3)
+			}
+			_, err = e.ApplyFenced("fence", events)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.ZMembers(testDay + "top_enwiki")).To(Equal([]string{"B", "C"}))
+			Expect(m.ZScore(testDay+"top_enwiki", "C")).To(Equal(3.0))
+		})
+	})
+
+	Context("with HyperLogLogs", func() {
+		const rules = `
+counters:
+  - key: users_{wiki}
+    member: "{user}"
+    distinct: true
+`
+		edit := func(user string, offset int64) Event {
+			return Event{ID: testID, Data: []byte(`{"wiki":"enwiki","user":"` + user + `"}`), Offset: offset}
+		}
+
+		BeforeEach(func() {
+			r, err := CompileRules([]byte(rules))
+			Expect(err).NotTo(HaveOccurred())
+			e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), r, bucket.UTCDays())
+		})
+
+		It("counts distinct members per bucket", func() {
+			_, err := e.Apply([]Event{edit("A", 0), edit("B", 0), edit("A", 0)})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.ApplyFenced("fence", []Event{edit("C", 1), edit("A", 2)})
+			Expect(err).NotTo(HaveOccurred())
+			n, err := redis.NewClient(&redis.Options{Addr: m.Addr()}).PFCount(context.Background(), testDay+"users_enwiki").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(3)))
+			Expect(m.Exists("users_enwiki")).To(BeFalse())
+		})
+	})
+
+	It("counts events per histogram bin", func() {
+		r, err := CompileRules([]byte(`{counters: [{key: size, histogram: [0, 100], delta: {field: length.new, minus: length.old}}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), r, bucket.UTCDays())
+		size := func(old, new int, offset int64) Event {
+			return Event{ID: testID, Data: []byte(fmt.Sprintf(`{"length":{"old":%d,"new":%d}}`, old, new)), Offset: offset}
+		}
+		_, err = e.Apply([]Event{size(100, 50, 0), size(100, 150, 0), size(100, 150, 0)})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = e.ApplyFenced("fence", []Event{size(0, 5000, 1)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.HGet(testDay+"size", "0")).To(Equal("1"))
+		Expect(m.HGet(testDay+"size", "100")).To(Equal("2"))
+		Expect(m.HGet(testDay+"size", InfBound)).To(Equal("1"))
+		Expect(m.Exists("size")).To(BeFalse())
+	})
+
+	It("counts the empty bins of histograms and stores their percentiles", func() {
+		r, err := CompileRules([]byte(`{counters: [{key: size, histogram: [0, 10, 100], delta: {field: length.new, minus: length.old}}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), r, bucket.UTCDays())
+		size := func(old, new int) Event {
+			return Event{ID: testID, Data: []byte(fmt.Sprintf(`{"length":{"old":%d,"new":%d}}`, old, new))}
+		}
+		_, err = e.Apply([]Event{size(100, 50), size(100, 150), size(100, 150), size(0, 5000)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.HKeys(testDay + "size")).To(ConsistOf("0", "10", "100", InfBound))
+		Expect(m.HGet(testDay+"size", "10")).To(Equal("0"))
+		Expect(m.HGet(testDay+"size_percentiles", "p50")).To(Equal("55"))
+		Expect(m.HGet(testDay+"size_percentiles", "p99")).To(Equal("100"))
+	})
+
+	It("counts recent events in rate slots", func() {
+		now := time.Now()
+		id := receivedAt(now)
+		_, err := e.Apply([]Event{
+			{ID: id, Data: []byte(testEvent)},
+			{ID: id, Data: []byte(`{"wiki":"dewiki","type":"log"}`)},
+			{ID: testID, Data: []byte(testEvent)},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		slot := bucket.Prefix(bucket.RateSlot, bucket.RateIndex(now))
+		Expect(counter(slot + "pleiades_rate")).To(Equal("2"))
+		Expect(m.HGet(slot+"pleiades_rate_wikis", "enwiki")).To(Equal("1"))
+		Expect(m.HGet(slot+"pleiades_rate_wikis", "dewiki")).To(Equal("1"))
+		Expect(m.TTL(slot + "pleiades_rate")).To(BeNumerically(">", 15*time.Minute))
+		Expect(m.Exists("pleiades_rate")).To(BeFalse())
+		Expect(m.Exists(testDay + "pleiades_rate")).To(BeFalse())
+
+		// the event received in 2020 is too old to count
+		Expect(counter("pleiades_total")).To(Equal("3"))
+		for _, k := range m.Keys() {
+			if k != slot+"pleiades_rate" && k != slot+"pleiades_rate_wikis" {
+				Expect(k).NotTo(HavePrefix(bucket.RateSlot.Prefix))
+			}
+		}
+	})
+
+	It("decays sorted sets and weights repeated editors", func() {
+		r, err := CompileRules([]byte(`{counters: [{key: trending, member: "{title}", editor: "{user}", halfLife: 1h}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), r, bucket.UTCDays())
+		now := time.Now().Truncate(time.Millisecond)
+		edit := func(title, user string, offset int64) Event {
+			return Event{ID: receivedAt(now), Data: []byte(`{"title":"` + title + `","user":"` + user + `"}`), Offset: offset}
+		}
+		_, err = e.Apply([]Event{edit("Berlin", "A", 0), edit("Berlin", "A", 0), edit("Paris", "B", 0), edit("Berlin", "B", 0)})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = e.ApplyFenced("fence", []Event{edit("Paris", "B", 1), {ID: testID, Data: []byte(`{"title":"Rome","user":"C"}`), Offset: 2}})
+		Expect(err).NotTo(HaveOccurred())
+
+		d := bucket.Decay{HalfLife: time.Hour}
+		n := d.Index(now)
+		key := bucket.Prefix(d.Generation(), n) + "trending"
+		w := d.Weight(n, now)
+		Expect(m.ZScore(key, "Berlin")).To(BeNumerically("~", 2.1*w, 1e-6*w))
+		Expect(m.ZScore(key, "Paris")).To(BeNumerically("~", 1.1*w, 1e-6*w))
+		Expect(m.ZMembers(key)).To(HaveLen(2))
+		Expect(m.SMembers(key + "_editors")).To(ConsistOf("Berlin\x00A", "Berlin\x00B", "Paris\x00B"))
+		Expect(m.TTL(key)).To(BeNumerically(">", 32*time.Hour))
+		Expect(m.TTL(key + "_editors")).To(BeNumerically("~", m.TTL(key), time.Second))
+		Expect(m.Exists(testDay + "trending")).To(BeFalse())
+	})
+
+	It("weights the editors of a batch applied again once", func() {
+		r, err := CompileRules([]byte(`{counters: [{key: trending, member: "{title}", editor: "{user}", halfLife: 1h}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		e = NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), r, bucket.UTCDays())
+		now := time.Now().Truncate(time.Millisecond)
+		edit := func(title string, offset int64) Event {
+			return Event{ID: receivedAt(now), Data: []byte(`{"title":"` + title + `","user":"A"}`), Offset: offset}
+		}
+		_, err = e.ApplyFenced("fence", []Event{edit("Berlin", 0)})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = e.ApplyFenced("fence", []Event{edit("Berlin", 0), edit("Paris", 1)})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = e.ApplyFenced("fence", []Event{edit("Berlin", 0), edit("Paris", 1)})
+		Expect(err).NotTo(HaveOccurred())
+
+		d := bucket.Decay{HalfLife: time.Hour}
+		n := d.Index(now)
+		key := bucket.Prefix(d.Generation(), n) + "trending"
+		w := d.Weight(n, now)
+		Expect(m.ZScore(key, "Berlin")).To(BeNumerically("~", w, 1e-6*w))
+		Expect(m.ZScore(key, "Paris")).To(BeNumerically("~", w, 1e-6*w))
+	})
+
+	It("counts reverts and edit wars once reverts are detected", func() {
+		r := redis.NewClient(&redis.Options{Addr: m.Addr()})
+		d, err := revert.NewDetector(r, &revert.Opts{Window: time.Hour, History: 10, MinReverts: 3, MinUsers: 2}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		e.SetReverts(d)
+		edit := func(user string, rev int, old int, length int) Event {
+			return Event{ID: testID, Data: []byte(fmt.Sprintf(`{"wiki":"enwiki","type":"edit","title":"Berlin","user":"%s",`+
+				`"revision":{"old":%d,"new":%d},"length":{"old":%d,"new":%d}}`, user, rev-1, rev, old, length))}
+		}
+		_, err = e.Apply([]Event{edit("A", 10, 0, 100), edit("B", 11, 100, 150), edit("A", 12, 150, 100), edit("B", 13, 100, 150)})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = e.Apply([]Event{edit("A", 14, 150, 100), {ID: testID, Data: []byte(`{"wiki":"enwiki","type":"log"}`)}})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(counter("pleiades_reverts_enwiki")).To(Equal("3"))
+		Expect(counter(testDay + "pleiades_reverts")).To(Equal("3"))
+		Expect(m.ZScore(testDay+"pleiades_hotspots_enwiki", "Berlin")).To(Equal(3.0))
+		Expect(m.ZScore(testDay+"pleiades_edit_wars_enwiki", "Berlin")).To(Equal(1.0))
+	})
+
+	It("lists risky edits once their risk is scored", func() {
+		h, err := risk.NewHeuristic(redis.NewClient(&redis.Options{Addr: m.Addr()}), &risk.Opts{})
+		Expect(err).NotTo(HaveOccurred())
+		e.SetScorer(h)
+		_, err = e.Apply([]Event{
+			{ID: testID, Data: []byte(`{"wiki":"enwiki","type":"edit","title":"Berlin","user":"192.0.2.1","namespace":0,` +
+				`"revision":{"old":1,"new":2},"length":{"old":1000,"new":10}}`)},
+			{ID: testID, Data: []byte(`{"wiki":"enwiki","type":"new","title":"Paris","user":"Example","namespace":0,"comment":"stub",` +
+				`"revision":{"new":3},"length":{"new":10}}`)},
+			{ID: testID, Data: []byte(`{"wiki":"enwiki","type":"log","user":"192.0.2.1"}`)},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(counter("pleiades_risky_edits_enwiki")).To(Equal("1"))
+		Expect(counter(testDay + "pleiades_risky_edits")).To(Equal("1"))
+		Expect(m.ZMembers(testDay + "pleiades_risk_feed_enwiki")).To(Equal([]string{"2|anonymous+removal+empty_comment|192.0.2.1|Berlin"}))
+		Expect(m.ZScore(testDay+"pleiades_risk_feed_enwiki", "2|anonymous+removal+empty_comment|192.0.2.1|Berlin")).To(Equal(70.0))
+		Expect(m.ZScore(testDay+"pleiades_risky_users_enwiki", "192.0.2.1")).To(Equal(1.0))
+	})
+
+	It("counts and scores anonymous edits whose IP address was hashed before publishing", func() {
+		h, err := risk.NewHeuristic(redis.NewClient(&redis.Options{Addr: m.Addr()}), &risk.Opts{})
+		Expect(err).NotTo(HaveOccurred())
+		e.SetScorer(h)
+		chain, err := transform.NewChain([]string{"hash-user"}, &transform.Opts{Secret: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+		data, err := chain.Process([]byte(`{"wiki":"enwiki","type":"edit","title":"Berlin","user":"192.0.2.1","namespace":0,` +
+			`"revision":{"old":1,"new":2},"length":{"old":1000,"new":10}}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = e.Apply([]Event{{ID: testID, Data: data}})
+		Expect(err).NotTo(HaveOccurred())
+
+		n, err := redis.NewClient(&redis.Options{Addr: m.Addr()}).PFCount(context.Background(), testDay+"pleiades_unique_ips_enwiki").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(1)))
+		feed, err := m.ZMembers(testDay + "pleiades_risk_feed_enwiki")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(feed).To(HaveLen(1))
+		Expect(feed[0]).To(HavePrefix("2|anonymous+removal+empty_comment|" + transform.AnonymousPrefix))
+		Expect(feed[0]).NotTo(ContainSubstring("192.0.2.1"))
+	})
+
+	Context("with a fence", func() {
+		batch := func(first, last int64) []Event {
+			var events []Event
+			for o := first; o <= last; o++ {
+				events = append(events, Event{ID: testID, Data: []byte(testEvent), Offset: o})
+			}
+			return events
+		}
+
+		It("records the offset of the last event applied", func() {
+			Expect(e.FenceOffset("fence")).To(Equal(int64(-1)))
+			_, err := e.ApplyFenced("fence", batch(10, 14))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counter("pleiades_total")).To(Equal("5"))
+			Expect(e.FenceOffset("fence")).To(Equal(int64(14)))
+		})
+
+		It("does not apply a batch twice", func() {
+			_, err := e.ApplyFenced("fence", batch(10, 14))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.ApplyFenced("fence", batch(10, 14))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.ApplyFenced("fence", batch(3, 8))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counter("pleiades_total")).To(Equal("5"))
+			Expect(counter(testDay + "pleiades_total")).To(Equal("5"))
+		})
+
+		It("applies only the events of a batch that were not applied before", func() {
+			_, err := e.ApplyFenced("fence", batch(10, 14))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.ApplyFenced("fence", batch(12, 19))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counter("pleiades_total")).To(Equal("10"))
+			Expect(e.FenceOffset("fence")).To(Equal(int64(19)))
+		})
+
+		It("advances the fence past events that cannot be aggregated", func() {
+			skipped, err := e.ApplyFenced("fence", []Event{{ID: testID, Data: []byte(`{"wiki":`), Offset: 3}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(skipped).To(HaveLen(1))
+			Expect(e.FenceOffset("fence")).To(Equal(int64(3)))
+		})
+
+		It("keeps fences separate", func() {
+			_, err := e.ApplyFenced("fence", batch(10, 14))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.ApplyFenced("other", batch(10, 11))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counter("pleiades_total")).To(Equal("7"))
+		})
+	})
+
+	It("does not apply a batch partially when Redis fails", func() {
+		m.SetError("ERR unavailable")
+		_, err := e.Apply([]Event{{ID: testID, Data: []byte(testEvent)}})
+		Expect(err).To(HaveOccurred())
+		m.SetError("")
+		Expect(m.Keys()).To(BeEmpty())
+	})
+})
+
+func benchmarkEvents(n int) []Event {
+	events := make([]Event, n)
+	for i := range events {
+		events[i] = Event{
+			ID:   testID,
+			Data: []byte(fmt.Sprintf(`{"wiki":"wiki%d","type":"edit","bot":false,"minor":false,"length":{"old":100,"new":150}}`, i%20)),
+		}
+	}
+	return events
+}
+
+// BenchmarkIncrBy writes every increment with its own command, as the aggregators did before the engine
+func BenchmarkIncrBy(b *testing.B) {
+	m, err := miniredis.Run()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+	r := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	rules := MustCompileDefaultRules()
+	events := benchmarkEvents(100)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ev := range events {
+			incs, err := rules.Increments(ev.Data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, inc := range incs {
+				if err := r.IncrBy(ctx, inc.Key, inc.Delta).Err(); err != nil {
+					b.Fatal(err)
+				}
+				if err := r.IncrBy(ctx, testDay+inc.Key, inc.Delta).Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkEngine writes the same events in batches of 100
+func BenchmarkEngine(b *testing.B) {
+	m, err := miniredis.Run()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+	e := NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), MustCompileDefaultRules(), bucket.UTCDays())
+	events := benchmarkEvents(100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Apply(events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package file
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -17,7 +16,12 @@ import (
 	"github.com/gargath/pleiades/pkg/util"
 )
 
-const moduleName = "file-agg"
+const (
+	moduleName = "file-agg"
+
+	// batchSize is the number of files aggregated in a single Redis transaction
+	batchSize = 100
+)
 
 var (
 	// ErrNoSrc is returned when an Aggregator is created without a source directory
@@ -26,7 +30,7 @@ var (
 	procTime = promauto.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "pleiades_aggregator_file_process_duration_milliseconds",
-			Help:    "Time taken to process files",
+			Help:    "Time taken to process a batch of files",
 			Buckets: []float64{5, 10, 100, 500},
 		},
 	)
@@ -36,7 +40,7 @@ var (
 )
 
 // NewAggregator returns a Aggregator initialized with the source path provided
-func NewAggregator(redisOpts *util.RedisOpts, opts *Opts) (*Aggregator, error) {
+func NewAggregator(engine *aggregator.Engine, opts *Opts) (*Aggregator, error) {
 	a := &Aggregator{}
 	src := opts.Source
 	if src == "" {
@@ -50,14 +54,8 @@ func NewAggregator(redisOpts *util.RedisOpts, opts *Opts) (*Aggregator, error) {
 		return nil, fmt.Errorf("source path %s exists as file", src)
 	}
 
-	r, err := util.NewValidatedRedisClient(redisOpts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", redisOpts.RedisAddr, err)
-	}
-
-	a.r = r
+	a.engine = engine
 	a.File = opts
-	a.Redis = redisOpts
 	a.stop = make(chan (bool))
 
 	return a, nil
@@ -127,91 +125,84 @@ func (a *Aggregator) run() error {
 				return nil
 			default:
 				logger.Info("No files in source directory - will try again in 5 seconds")
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				a.r.Ping(ctx)
 				time.Sleep(5 * time.Second)
 			}
 		} else {
-			for _, f := range files {
+			for len(files) > 0 {
+				n := len(files)
+				if n > batchSize {
+					n = batchSize
+				}
 				select {
 				case <-a.stop:
 					return nil
 				default:
-					err := a.processFile(a.File.Source + "/" + f.Name())
+					err := a.processBatch(files[:n])
 					if err != nil {
-						logger.Errorf("Error processing file %s: %v", f.Name(), err)
+						logger.Errorf("Error processing batch: %v", err)
 					}
 				}
+				files = files[n:]
 			}
 		}
 	}
 }
 
-func (a *Aggregator) processFile(filename string) error {
+// processBatch aggregates a batch of files and deletes them once their counters have been written.
+// Files that cannot be read are left in place.
+func (a *Aggregator) processBatch(files []os.FileInfo) error {
 	defer func(start time.Time) {
 		procTime.Observe(float64(time.Since(start).Milliseconds()))
 	}(time.Now())
 
-	fh, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("unreadable file %s: %v", filename, err)
-	}
-	scanner := bufio.NewScanner(fh)
-	if !scanner.Scan() {
-		return fmt.Errorf("premature end of file while reading %s", filename)
-	}
-	msgID := scanner.Text()
-	if !scanner.Scan() {
-		return fmt.Errorf("premature end of file while reading %s", filename)
-	}
-	eventData := scanner.Bytes()
-	if scerr := scanner.Err(); scerr != nil {
-		return fmt.Errorf("failed to read data from file %s: %v", filename, scerr)
+	var events []aggregator.Event
+	var names []string
+	for _, f := range files {
+		filename := a.File.Source + "/" + f.Name()
+		ev, err := readFile(filename)
+		if err != nil {
+			logger.Errorf("Error reading file %s: %v", f.Name(), err)
+			continue
+		}
+		events = append(events, ev)
+		names = append(names, filename)
 	}
-	fh.Close()
-
-	counters, lendiff, err := aggregator.CountersFromEventData(eventData)
-	aggregator.RecordLag(msgID)
-	if err != nil {
-		return fmt.Errorf("error processing file %s: %v", filename, err)
+	if len(events) == 0 {
+		return nil
 	}
-	// TODO: this is duplicatede between the two aggregators. Should refactor.
 
-	eventTimestamp, err := aggregator.ParseTimestamp(string(msgID))
+	_, err := a.engine.Apply(events)
 	if err != nil {
-		return fmt.Errorf("failed to parse timestamp from message: %s: %v", string(msgID), err)
+		return err
 	}
-	var julianDay int64 = eventTimestamp / 86400000
-	julianPrefix := fmt.Sprintf("day_%d_", julianDay)
 
-	for _, counter := range counters {
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		err := a.r.Incr(ctx, counter).Err()
+	for _, filename := range names {
+		err = os.Remove(filename)
 		if err != nil {
-			return fmt.Errorf("failed to increment Redis counter %s: %v", counter, err)
-		}
-		err = a.r.Incr(ctx, julianPrefix+counter).Err()
-		if err != nil {
-			return fmt.Errorf("failed to increment Redis counter %s: %v", julianPrefix+counter, err)
+			logger.Errorf("failed to delete source file %s: %v", filename, err)
 		}
 	}
-	// TODO: remove that duplication below once the return from CountersFromEventData() is less stupid
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	err = a.r.IncrBy(ctx, "pleiades_growth", lendiff).Err()
+	return nil
+}
+
+func readFile(filename string) (aggregator.Event, error) {
+	var ev aggregator.Event
+	fh, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("failed to increment Redis growth counter: %v", err)
+		return ev, fmt.Errorf("unreadable file %s: %v", filename, err)
 	}
-	err = a.r.IncrBy(ctx, julianPrefix+"pleiades_growth", lendiff).Err()
-	if err != nil {
-		return fmt.Errorf("failed to increment historic Redis growth counter: %v", err)
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	if !scanner.Scan() {
+		return ev, fmt.Errorf("premature end of file while reading %s", filename)
 	}
-
-	err = os.Remove(filename)
-	if err != nil {
-		return fmt.Errorf("failed to delete source file %s: %v", filename, err)
+	ev.ID = scanner.Text()
+	if !scanner.Scan() {
+		return ev, fmt.Errorf("premature end of file while reading %s", filename)
 	}
-	return nil
+	ev.Data = append([]byte(nil), scanner.Bytes()...)
+	if scerr := scanner.Err(); scerr != nil {
+		return ev, fmt.Errorf("failed to read data from file %s: %v", filename, scerr)
+	}
+	return ev, nil
 }
@@ -0,0 +1,27 @@
+package file
+
+import (
+	"fmt"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	filepub "github.com/gargath/pleiades/pkg/ingester/publisher/file"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Options are the configuration values of the file aggregator.
+// They are those of the file publisher, so that both can be pointed at the same directory.
+var Options = []plugin.Option{filepub.DirOption, filepub.FormatOption}
+
+func init() {
+	aggregator.RegisterSource(&aggregator.SourcePlugin{
+		Name:        "file",
+		Description: "file aggregator",
+		Options:     Options,
+		New: func(cfg plugin.Config, engine *aggregator.Engine) (aggregator.Server, error) {
+			if f := cfg.String(filepub.FormatOption.Name); f != filepub.FormatDat {
+				return nil, fmt.Errorf("the file aggregator only supports --%s=%s, not %s", filepub.FormatOption.Name, filepub.FormatDat, f)
+			}
+			return NewAggregator(engine, &Opts{Source: cfg.String(filepub.DirOption.Name)})
+		},
+	})
+}
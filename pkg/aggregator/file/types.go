@@ -1,16 +1,15 @@
 package file
 
 import (
+	"github.com/gargath/pleiades/pkg/aggregator"
 	"github.com/gargath/pleiades/pkg/util"
-	"github.com/go-redis/redis/v8"
 )
 
 // Aggregator is an aggregator implementation that reads from the filesystem
 type Aggregator struct {
 	File    *Opts
 	stop    chan (bool)
-	Redis   *util.RedisOpts
-	r       *redis.Client
+	engine  *aggregator.Engine
 	spinner *util.Spinner
 }
 
@@ -3,10 +3,12 @@ package kafka
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/avro"
 	"github.com/gargath/pleiades/pkg/log"
 	"github.com/gargath/pleiades/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,7 +16,23 @@ import (
 	"github.com/segmentio/kafka-go"
 )
 
-const moduleName = "kafka-agg"
+const (
+	moduleName = "kafka-agg"
+
+	groupID = "pleiades-aggregator-group"
+
+	// reasonDecode marks messages that could not be decoded
+	reasonDecode = "decode"
+)
+
+// Headers of messages in the dead letter topic
+const (
+	HeaderReason    = "pleiades-reason"
+	HeaderError     = "pleiades-error"
+	HeaderTopic     = "pleiades-topic"
+	HeaderPartition = "pleiades-partition"
+	HeaderOffset    = "pleiades-offset"
+)
 
 var (
 	wg sync.WaitGroup
@@ -25,52 +43,103 @@ var (
 	// ErrNoSrc is returned when an Aggregator is created without a kafka source
 	ErrNoSrc = fmt.Errorf("No source kafka details provided")
 
-	procTime = promauto.NewHistogram(
+	flushTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_kafka_flush_duration_seconds",
+			Help:    "Time taken to aggregate a batch of messages from kafka, including retries",
+			Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+		},
+	)
+
+	flushSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_kafka_batch_messages",
+			Help:    "Number of messages from kafka aggregated in a single batch",
+			Buckets: []float64{1, 10, 50, 100, 500, 1000, 5000},
+		},
+	)
+
+	queued = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_kafka_queued_messages",
+			Help: "Number of messages fetched from kafka and waiting to be aggregated",
+		},
+	)
+
+	flushWait = promauto.NewHistogram(
 		prometheus.HistogramOpts{
-			Name:    "pleiades_aggregator_kafka_process_duration_milliseconds",
-			Help:    "Time taken to process event from kafka",
-			Buckets: []float64{5, 10, 100, 500},
+			Name:    "pleiades_aggregator_kafka_flush_wait_seconds",
+			Help:    "Time a batch waited for a free worker before being flushed",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5},
 		},
 	)
 
-	msgTotal = promauto.NewCounter(
+	aggErrors = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "pleiades_aggregator_event_count_total",
-			Help: "Number of events processed",
+			Name: "pleiades_aggregator_kafka_errors_total",
+			Help: "Number of errors encountered while aggregating events from kafka",
 		},
+		[]string{"type"},
 	)
 
-	retries int
+	deadLetters = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_kafka_dead_letters_total",
+			Help: "Number of events written to the dead letter topic, by reason",
+		},
+		[]string{"reason"},
+	)
 )
 
 // NewAggregator returns a Aggregator initialized with the kafka details provided
-func NewAggregator(redisOpts *util.RedisOpts, opts *Opts) (*Aggregator, error) {
+func NewAggregator(engine *aggregator.Engine, opts *Opts) (*Aggregator, error) {
 	a := &Aggregator{}
 	broker := opts.Broker
 	topic := opts.Topic
 	if (broker == "") || (topic == "") {
 		return nil, ErrNoSrc
 	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = time.Second
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
 
-	k := kafka.NewReader(kafka.ReaderConfig{
+	g, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:                    groupID,
 		Brokers:               []string{broker},
-		GroupID:               "pleiades-aggregator-group",
-		Topic:                 topic,
-		CommitInterval:        time.Second,
+		Topics:                []string{topic},
 		ErrorLogger:           &crudErrorLogger{},
 		Logger:                newCrudLogger(),
 		WatchPartitionChanges: true,
 	})
-
-	r, err := util.NewValidatedRedisClient(redisOpts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", redisOpts.RedisAddr, err)
+		return nil, fmt.Errorf("failed to create consumer group: %v", err)
+	}
+
+	if opts.DeadLetterTopic != "" {
+		a.dlq = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{broker},
+			Topic:    opts.DeadLetterTopic,
+			Balancer: kafka.Murmur2Balancer{},
+		})
 	}
 
-	a.r = r
+	a.engine = engine
 	a.Kafka = opts
-	a.Redis = redisOpts
-	a.k = k
+	a.group = g
+	a.workers = make(chan struct{}, opts.Workers)
+	a.decoder = avro.NewDeserializer(nil)
+	if opts.SchemaRegistry != "" {
+		a.decoder = avro.NewDeserializer(avro.NewRegistry(opts.SchemaRegistry))
+	}
 	a.stop = make(chan (bool))
 
 	return a, nil
@@ -90,11 +159,8 @@ func (a *Aggregator) Start() error {
 			default:
 				err := a.run()
 				if err != nil {
-					retries = retries + 1
 					logger.Errorf("Aggregator exited with error: %v", err)
-				}
-				if retries > 5 {
-					logger.Fatalf("Bailing after 5 failed restarts")
+					time.Sleep(5 * time.Second)
 				}
 			}
 		}
@@ -123,82 +189,306 @@ func (a *Aggregator) Start() error {
 	return nil
 }
 
-// Stop shuts down the aggregation server
+// Stop shuts down the aggregation server, leaving the consumer group once all partitions have stopped
 func (a *Aggregator) Stop() {
 	close(a.stop)
+	if err := a.group.Close(); err != nil {
+		logger.Errorf("Error leaving consumer group: %v", err)
+	}
 	wg.Wait()
+	if a.dlq != nil {
+		if err := a.dlq.Close(); err != nil {
+			logger.Errorf("Error closing dead letter writer: %v", err)
+		}
+	}
 }
 
+// run consumes the partitions assigned to this Aggregator, one generation of the consumer group at a time.
+// Each partition is read by its own reader, starting at the offset after the last event applied to Redis.
 func (a *Aggregator) run() error {
 	for {
-		select {
-		case <-a.stop:
+		gen, err := a.group.Next(context.Background())
+		if err == kafka.ErrGroupClosed {
 			return nil
-		default:
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			msg, err := a.k.ReadMessage(ctx)
-			if ctx.Err() == context.DeadlineExceeded {
-				cancel()
-				logger.Debug("No new messages on topic for 5 seconds. Will try again")
+		}
+		if err != nil {
+			aggErrors.WithLabelValues("group").Inc()
+			return fmt.Errorf("failed to join consumer group: %v", err)
+		}
+		for _, p := range gen.Assignments[a.Kafka.Topic] {
+			partition := p.ID
+			offset := a.startOffset(partition, p.Offset)
+			gen.Start(func(ctx context.Context) {
+				r := kafka.NewReader(kafka.ReaderConfig{
+					Brokers:     []string{a.Kafka.Broker},
+					Topic:       a.Kafka.Topic,
+					Partition:   partition,
+					ErrorLogger: &crudErrorLogger{},
+					Logger:      newCrudLogger(),
+				})
+				defer r.Close()
+				if err := r.SetOffset(offset); err != nil {
+					logger.Errorf("Failed to seek partition %d to offset %d: %v", partition, offset, err)
+					return
+				}
+				a.consume(ctx, r, partition, func(offset int64) error {
+					return gen.CommitOffsets(map[string]map[int]int64{a.Kafka.Topic: {partition: offset}})
+				})
+			})
+		}
+	}
+}
+
+// startOffset returns the offset to start reading a partition at. This is the offset committed to the consumer group,
+// unless Redis records that events beyond it have already been applied.
+func (a *Aggregator) startOffset(partition int, committed int64) int64 {
+	applied, err := a.engine.FenceOffset(fenceKey(a.Kafka.Topic, partition))
+	if err != nil {
+		// events applied before are still skipped when they are read again
+		logger.Errorf("Failed to read offset of partition %d from Redis, starting at committed offset: %v", partition, err)
+		return committed
+	}
+	if applied >= 0 && (committed < 0 || applied+1 > committed) {
+		logger.Infof("Starting partition %d at offset %d applied to Redis, ahead of committed offset %d", partition, applied+1, committed)
+		return applied + 1
+	}
+	return committed
+}
+
+// consume aggregates the events of a single partition until ctx is done.
+// Messages are fetched ahead into a queue holding up to one batch while the previous batch is flushed; once it is full,
+// fetching pauses until the batch has been written. A batch is flushed when it is full or FlushInterval has passed, and
+// its offset is committed to the consumer group afterwards, so batches of a partition are applied and committed in order.
+// Since Redis records which events have been applied, the committed offset only serves as a starting point in case
+// Redis has lost that record.
+func (a *Aggregator) consume(ctx context.Context, r reader, partition int, commit func(offset int64) error) {
+	fence := fenceKey(a.Kafka.Topic, partition)
+	queue := make(chan kafka.Message, a.Kafka.BatchSize)
+	go a.fetch(ctx, r, partition, queue)
+	defer func() {
+		for range queue {
+			queued.Dec()
+		}
+	}()
+
+	ticker := time.NewTicker(a.Kafka.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]kafka.Message, 0, a.Kafka.BatchSize)
+	for {
+		select {
+		case msg, ok := <-queue:
+			if !ok {
+				return
+			}
+			queued.Dec()
+			batch = append(batch, msg)
+			if len(batch) < a.Kafka.BatchSize {
 				continue
 			}
-			defer cancel()
-			if err != nil {
-				logger.Errorf("Error reading message from kafka: %v", err)
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
 			}
-			var pErr error
-			pErr = a.processEvent(msg.Key, msg.Value)
-			if pErr == nil {
-				retries = 0
+		}
+
+		if !a.flush(ctx, fence, partition, batch) {
+			return
+		}
+		next := batch[len(batch)-1].Offset + 1
+		if err := commit(next); err != nil {
+			aggErrors.WithLabelValues("commit").Inc()
+			logger.Errorf("Failed to commit offset %d of partition %d: %v", next, partition, err)
+		}
+		batch = make([]kafka.Message, 0, a.Kafka.BatchSize)
+	}
+}
+
+// fetch reads messages from a partition into the queue until ctx is done, then closes the queue
+func (a *Aggregator) fetch(ctx context.Context, r reader, partition int, queue chan<- kafka.Message) {
+	defer close(queue)
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			aggErrors.WithLabelValues("fetch").Inc()
+			logger.Errorf("Error reading partition %d from kafka, retrying in %s: %v", partition, a.Kafka.RetryBackoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(a.Kafka.RetryBackoff):
 			}
-			return pErr
+			continue
+		}
+		select {
+		case queue <- msg:
+			queued.Inc()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (a *Aggregator) processEvent(id []byte, data []byte) error {
-	defer func(start time.Time) {
-		procTime.Observe(float64(time.Since(start).Milliseconds()))
-	}(time.Now())
+// flush aggregates a batch of messages from a partition, retrying temporary failures until they succeed since giving up
+// on the batch would lose its events. Messages that can never be aggregated are set aside in the dead letter topic instead.
+// At most Workers batches are flushed at the same time. flush returns false if ctx was done before the batch was applied.
+func (a *Aggregator) flush(ctx context.Context, fence string, partition int, batch []kafka.Message) bool {
+	wait := time.Now()
+	select {
+	case a.workers <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	defer func() { <-a.workers }()
+	flushWait.Observe(time.Since(wait).Seconds())
+
+	timer := prometheus.NewTimer(flushTime)
+	defer timer.ObserveDuration()
+	flushSize.Observe(float64(len(batch)))
 
-	counters, lendiff, err := aggregator.CountersFromEventData(data)
-	aggregator.RecordLag(string(id))
-	if err != nil {
-		return fmt.Errorf("error processing event: %s, %v", string(data), err)
+	// messages that cannot be aggregated are set aside before the batch is applied, since the fence moves past them
+	// once it is and they would not be seen again after a crash
+	var events []aggregator.Event
+	var skipped []aggregator.Skipped
+	ok := a.retry(ctx, partition, func() error {
+		var err error
+		events, skipped, err = a.decode(batch)
+		if err != nil {
+			aggErrors.WithLabelValues("registry").Inc()
+			return err
+		}
+		return nil
+	})
+	if !ok {
+		return false
 	}
+	skipped = append(skipped, a.engine.Validate(events)...)
+	if len(skipped) > 0 {
+		ok = a.retry(ctx, partition, func() error { return a.setAside(fence, batch, skipped) })
+		if !ok {
+			return false
+		}
+	}
+
+	return a.retry(ctx, partition, func() error {
+		// the events skipped here are those validated above, which have been set aside already
+		_, err := a.engine.ApplyFenced(fence, events)
+		if err != nil {
+			aggErrors.WithLabelValues("redis").Inc()
+		}
+		return err
+	})
+}
 
-	eventTimestamp, err := aggregator.ParseTimestamp(string(id))
+// setAside writes the messages of a batch that cannot be aggregated to the dead letter topic, unless the fence shows
+// that they have been set aside before the batch was applied already
+func (a *Aggregator) setAside(fence string, batch []kafka.Message, skipped []aggregator.Skipped) error {
+	applied, err := a.engine.FenceOffset(fence)
 	if err != nil {
-		return fmt.Errorf("failed to parse timestamp from message: %s: %v", string(id), err)
+		aggErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+	pending := make([]aggregator.Skipped, 0, len(skipped))
+	for _, s := range skipped {
+		if s.Offset > applied {
+			pending = append(pending, s)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
 	}
-	var julianDay int64 = eventTimestamp / 86400000
-	julianPrefix := fmt.Sprintf("day_%d_", julianDay)
+	return a.deadLetter(batch, pending)
+}
 
-	// TODO: this is duplicatede between the two aggregators. Should refactor.
-	for _, counter := range counters {
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		err := a.r.Incr(ctx, counter).Err()
-		if err != nil {
-			return fmt.Errorf("failed to increment Redis counter %s: %v", counter, err)
+// decode turns a batch of messages into events, decoding Avro messages into JSON.
+// Messages that cannot be decoded are returned as skipped events. The only error returned is a failure to reach the
+// schema registry, which is temporary.
+func (a *Aggregator) decode(batch []kafka.Message) ([]aggregator.Event, []aggregator.Skipped, error) {
+	events := make([]aggregator.Event, 0, len(batch))
+	var rejected []aggregator.Skipped
+	for _, msg := range batch {
+		ev := aggregator.Event{ID: string(msg.Key), Offset: msg.Offset}
+		data, err := a.decoder.Deserialize(msg.Value)
+		if _, ok := err.(*avro.RegistryError); ok {
+			return nil, nil, err
 		}
-		err = a.r.Incr(ctx, julianPrefix+counter).Err()
 		if err != nil {
-			return fmt.Errorf("failed to increment Redis counter %s: %v", julianPrefix+counter, err)
+			aggErrors.WithLabelValues("decode").Inc()
+			rejected = append(rejected, aggregator.Skipped{Event: ev, Reason: reasonDecode, Err: err})
+			continue
+		}
+		ev.Data = data
+		events = append(events, ev)
+	}
+	return events, rejected, nil
+}
+
+// retry calls f until it succeeds, backing off exponentially between attempts.
+// It returns false if ctx was done first.
+func (a *Aggregator) retry(ctx context.Context, partition int, f func() error) bool {
+	backoff := a.Kafka.RetryBackoff
+	for {
+		err := f()
+		if err == nil {
+			return true
+		}
+		logger.Errorf("Failed to aggregate batch from partition %d, retrying in %s: %v", partition, backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
 		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// deadLetter writes the messages of a batch that cannot be aggregated to the dead letter topic as they were received,
+// with headers recording where they came from and why they were rejected.
+func (a *Aggregator) deadLetter(batch []kafka.Message, skipped []aggregator.Skipped) error {
+	byOffset := make(map[int64]kafka.Message, len(batch))
+	for _, msg := range batch {
+		byOffset[msg.Offset] = msg
 	}
-	// TODO: remove that duplication below once the return from CountersFromEventData() is less stupid
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	if a.dlq == nil {
+		for _, s := range skipped {
+			msg := byOffset[s.Offset]
+			logger.Errorf("Dropping message at offset %d of partition %d: %v", msg.Offset, msg.Partition, s.Err)
+		}
+		return nil
+	}
+
+	letters := make([]kafka.Message, len(skipped))
+	for i, s := range skipped {
+		msg := byOffset[s.Offset]
+		letters[i] = kafka.Message{
+			Key:   msg.Key,
+			Value: msg.Value,
+			Headers: []kafka.Header{
+				{Key: HeaderReason, Value: []byte(s.Reason)},
+				{Key: HeaderError, Value: []byte(s.Err.Error())},
+				{Key: HeaderTopic, Value: []byte(msg.Topic)},
+				{Key: HeaderPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+				{Key: HeaderOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err = a.r.IncrBy(ctx, "pleiades_growth", lendiff).Err()
+	err := a.dlq.WriteMessages(ctx, letters...)
 	if err != nil {
-		return fmt.Errorf("failed to increment Redis growth counter: %v", err)
+		aggErrors.WithLabelValues("dead_letter").Inc()
+		return fmt.Errorf("failed to write %d messages to dead letter topic %s: %v", len(letters), a.Kafka.DeadLetterTopic, err)
 	}
-	err = a.r.IncrBy(ctx, julianPrefix+"pleiades_growth", lendiff).Err()
-	if err != nil {
-		return fmt.Errorf("failed to increment historic Redis growth counter: %v", err)
+	for _, s := range skipped {
+		deadLetters.WithLabelValues(s.Reason).Inc()
 	}
-
-	msgTotal.Inc()
 	return nil
 }
+
+// fenceKey returns the Redis key recording the offset of the last event of a partition applied to Redis
+func fenceKey(topic string, partition int) string {
+	return fmt.Sprintf("pleiades_fence_%s_%d", topic, partition)
+}
@@ -0,0 +1,291 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/avro"
+	"github.com/gargath/pleiades/pkg/bucket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testID = `[{"topic":"eqiad.mediawiki.recentchange","partition":0,"timestamp":1597056638001}]`
+
+// fakeReader serves its messages in order, then blocks until ctx is done
+type fakeReader struct {
+	messages []kafka.Message
+}
+
+func (f *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if len(f.messages) == 0 {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	m := f.messages[0]
+	f.messages = f.messages[1:]
+	return m, nil
+}
+
+type fakeCommitter struct {
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func (f *fakeCommitter) commit(offset int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offsets = append(f.offsets, offset)
+	return nil
+}
+
+func (f *fakeCommitter) committed() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int64(nil), f.offsets...)
+}
+
+type fakeWriter struct {
+	fail     bool
+	messages []kafka.Message
+	written  func()
+}
+
+func (f *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if f.fail {
+		f.fail = false
+		return fmt.Errorf("broker unavailable")
+	}
+	f.messages = append(f.messages, msgs...)
+	if f.written != nil {
+		f.written()
+	}
+	return nil
+}
+
+func (f *fakeWriter) Close() error {
+	return nil
+}
+
+func header(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+var _ = Describe("Kafka aggregator", func() {
+	const fence = "pleiades_fence_pleiades-events_2"
+
+	var (
+		m   *miniredis.Miniredis
+		dlq *fakeWriter
+		a   *Aggregator
+	)
+
+	message := func(offset int64, value string) kafka.Message {
+		return kafka.Message{Topic: "pleiades-events", Partition: 2, Offset: offset, Key: []byte(testID), Value: []byte(value)}
+	}
+
+	process := func(msgs ...kafka.Message) bool {
+		return a.flush(context.Background(), fence, 2, msgs)
+	}
+
+	consume := func(r *fakeReader, c *fakeCommitter) (context.CancelFunc, chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			a.consume(ctx, r, 2, c.commit)
+			close(done)
+		}()
+		return cancel, done
+	}
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		dlq = &fakeWriter{}
+		a = &Aggregator{
+			Kafka: &Opts{
+				Broker:          "localhost:9092",
+				Topic:           "pleiades-events",
+				DeadLetterTopic: "pleiades-dlq",
+				BatchSize:       2,
+				FlushInterval:   20 * time.Millisecond,
+				Workers:         1,
+				RetryBackoff:    10 * time.Millisecond,
+			},
+			stop:    make(chan (bool)),
+			workers: make(chan struct{}, 1),
+			engine:  aggregator.NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), aggregator.MustCompileDefaultRules(), bucket.UTCDays()),
+			dlq:     dlq,
+			decoder: avro.NewDeserializer(nil),
+		}
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	It("records the offset of each event applied", func() {
+		Expect(process(message(7, `{"wiki":"enwiki","type":"edit"}`))).To(BeTrue())
+		Expect(m.Get("pleiades_wiki_enwiki")).To(Equal("1"))
+		Expect(m.Get(fence)).To(Equal("7"))
+		Expect(dlq.messages).To(BeEmpty())
+	})
+
+	It("does not apply an event twice", func() {
+		Expect(process(message(7, `{"wiki":"enwiki","type":"edit"}`))).To(BeTrue())
+		Expect(process(message(7, `{"wiki":"enwiki","type":"edit"}`))).To(BeTrue())
+		Expect(process(message(5, `{"wiki":"enwiki","type":"edit"}`))).To(BeTrue())
+		Expect(m.Get("pleiades_wiki_enwiki")).To(Equal("1"))
+		Expect(m.Get(fence)).To(Equal("7"))
+	})
+
+	It("retries a message until Redis is available again", func() {
+		m.SetError("ERR unavailable")
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(50 * time.Millisecond)
+			m.SetError("")
+		}()
+		Expect(process(message(8, `{"wiki":"enwiki","type":"edit"}`))).To(BeTrue())
+		Expect(m.Get("pleiades_total")).To(Equal("1"))
+	})
+
+	It("gives up retrying once the partition is revoked", func() {
+		m.SetError("ERR unavailable")
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		Expect(a.flush(ctx, fence, 2, []kafka.Message{message(9, `{"wiki":"enwiki","type":"edit"}`)})).To(BeFalse())
+	})
+
+	It("writes events that cannot be parsed to the dead letter topic", func() {
+		Expect(process(message(10, `{"wiki":`))).To(BeTrue())
+		Expect(m.Get(fence)).To(Equal("10"))
+		Expect(m.Keys()).To(Equal([]string{fence}))
+		Expect(dlq.messages).To(HaveLen(1))
+		d := dlq.messages[0]
+		Expect(string(d.Value)).To(Equal(`{"wiki":`))
+		Expect(string(d.Key)).To(Equal(testID))
+		Expect(header(d, HeaderReason)).To(Equal(aggregator.ReasonParse))
+		Expect(header(d, HeaderTopic)).To(Equal("pleiades-events"))
+		Expect(header(d, HeaderPartition)).To(Equal("2"))
+		Expect(header(d, HeaderOffset)).To(Equal("10"))
+		Expect(header(d, HeaderError)).NotTo(BeEmpty())
+	})
+
+	It("writes messages that cannot be decoded to the dead letter topic", func() {
+		Expect(process(message(11, "\x00\x00\x00\x00\x01\x02"))).To(BeTrue())
+		Expect(dlq.messages).To(HaveLen(1))
+		Expect(header(dlq.messages[0], HeaderReason)).To(Equal(reasonDecode))
+	})
+
+	It("retries writing to the dead letter topic", func() {
+		dlq.fail = true
+		Expect(process(message(12, `{"wiki":`))).To(BeTrue())
+		Expect(dlq.messages).To(HaveLen(1))
+	})
+
+	It("sets aside the messages it cannot aggregate before applying the batch", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		dlq.written = func() {
+			m.SetError("ERR unavailable")
+			cancel()
+		}
+		Expect(a.flush(ctx, fence, 2, []kafka.Message{
+			message(13, `{"wiki":"enwiki","type":"edit"}`),
+			message(14, `{"wiki":`),
+		})).To(BeFalse())
+		m.SetError("")
+		Expect(m.Exists(fence)).To(BeFalse())
+		Expect(dlq.messages).To(HaveLen(1))
+		Expect(header(dlq.messages[0], HeaderOffset)).To(Equal("14"))
+	})
+
+	It("does not set aside a message again once its batch has been applied", func() {
+		batch := []kafka.Message{message(13, `{"wiki":"enwiki","type":"edit"}`), message(14, `{"wiki":`)}
+		Expect(process(batch...)).To(BeTrue())
+		Expect(process(batch...)).To(BeTrue())
+		Expect(m.Get("pleiades_total")).To(Equal("1"))
+		Expect(dlq.messages).To(HaveLen(1))
+	})
+
+	It("drops events that cannot be aggregated without a dead letter topic", func() {
+		a.dlq = nil
+		Expect(process(message(13, `{"wiki":`))).To(BeTrue())
+		Expect(m.Get(fence)).To(Equal("13"))
+	})
+
+	It("applies a batch at once and sets aside the messages it cannot aggregate", func() {
+		Expect(process(
+			message(14, `{"wiki":"enwiki","type":"edit"}`),
+			message(15, `{"wiki":`),
+			message(16, "\x00\x00\x00\x00\x01\x02"),
+			message(17, `{"wiki":"dewiki","type":"edit"}`),
+		)).To(BeTrue())
+		Expect(m.Get("pleiades_total")).To(Equal("2"))
+		Expect(m.Get(fence)).To(Equal("17"))
+		Expect(dlq.messages).To(HaveLen(2))
+		Expect(header(dlq.messages[0], HeaderOffset)).To(Equal("16"))
+		Expect(header(dlq.messages[0], HeaderReason)).To(Equal(reasonDecode))
+		Expect(header(dlq.messages[1], HeaderOffset)).To(Equal("15"))
+		Expect(header(dlq.messages[1], HeaderReason)).To(Equal(aggregator.ReasonParse))
+	})
+
+	It("consumes a partition in batches and commits the offset after each batch", func() {
+		r := &fakeReader{messages: []kafka.Message{
+			message(20, `{"wiki":"enwiki","type":"edit"}`),
+			message(21, `{"wiki":"dewiki","type":"edit"}`),
+			message(22, `{"wiki":"enwiki","type":"log"}`),
+		}}
+		c := &fakeCommitter{}
+		cancel, done := consume(r, c)
+		Eventually(c.committed).Should(Equal([]int64{22, 23}))
+		cancel()
+		Eventually(done).Should(BeClosed())
+		Expect(m.Get("pleiades_total")).To(Equal("3"))
+		Expect(m.Get(fence)).To(Equal("22"))
+	})
+
+	It("does not commit a batch that was not applied", func() {
+		m.SetError("ERR unavailable")
+		r := &fakeReader{messages: []kafka.Message{message(30, `{"wiki":"enwiki","type":"edit"}`)}}
+		c := &fakeCommitter{}
+		cancel, done := consume(r, c)
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		Eventually(done).Should(BeClosed())
+		Expect(c.committed()).To(BeEmpty())
+	})
+
+	Context("when starting a partition", func() {
+		It("uses the committed offset if Redis has none", func() {
+			Expect(a.startOffset(2, 42)).To(Equal(int64(42)))
+			Expect(a.startOffset(2, kafka.FirstOffset)).To(Equal(kafka.FirstOffset))
+		})
+
+		It("seeks past the events applied to Redis", func() {
+			Expect(m.Set(fence, "99")).To(Succeed())
+			Expect(a.startOffset(2, 42)).To(Equal(int64(100)))
+			Expect(a.startOffset(2, kafka.FirstOffset)).To(Equal(int64(100)))
+			Expect(a.startOffset(2, 150)).To(Equal(int64(150)))
+		})
+	})
+})
@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	kafkapub "github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Options are the configuration values of the kafka aggregator.
+// Its connection options are those of the kafka publisher, so that both can be pointed at the same topic.
+var Options = []plugin.Option{
+	kafkapub.BrokerOption,
+	kafkapub.TopicOption,
+	kafkapub.SchemaRegistryOption,
+	{Name: "kafka.batchSize", Usage: "the maximum number of events of a partition aggregated in one batch", Default: 500},
+	{Name: "kafka.flushInterval", Usage: "the maximum time events are collected before a batch is aggregated", Default: time.Second},
+	{Name: "kafka.workers", Usage: "the maximum number of batches written to Redis at the same time", Default: 4},
+	{Name: "kafka.deadLetterTopic", Usage: "the kafka topic to write events that cannot be aggregated to (dropped if empty)", Default: ""},
+}
+
+func init() {
+	aggregator.RegisterSource(&aggregator.SourcePlugin{
+		Name:        "kafka",
+		Description: "kafka aggregator",
+		Options:     Options,
+		New: func(cfg plugin.Config, engine *aggregator.Engine) (aggregator.Server, error) {
+			return NewAggregator(engine, &Opts{
+				Broker:          cfg.String(kafkapub.BrokerOption.Name),
+				Topic:           cfg.String(kafkapub.TopicOption.Name),
+				SchemaRegistry:  cfg.String(kafkapub.SchemaRegistryOption.Name),
+				BatchSize:       cfg.Int("kafka.batchSize"),
+				FlushInterval:   cfg.Duration("kafka.flushInterval"),
+				Workers:         cfg.Int("kafka.workers"),
+				DeadLetterTopic: cfg.String("kafka.deadLetterTopic"),
+			})
+		},
+	})
+}
@@ -1,8 +1,12 @@
 package kafka
 
 import (
+	"context"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/avro"
 	"github.com/gargath/pleiades/pkg/util"
-	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
 )
 
@@ -10,14 +14,41 @@ import (
 type Aggregator struct {
 	Kafka   *Opts
 	stop    chan (bool)
-	Redis   *util.RedisOpts
-	r       *redis.Client
-	k       *kafka.Reader
+	engine  *aggregator.Engine
+	group   *kafka.ConsumerGroup
+	dlq     writer
+	decoder *avro.Deserializer
 	spinner *util.Spinner
+	// workers holds a token for every batch being flushed
+	workers chan struct{}
 }
 
-// Opts hold configuration for the kafka publisheru
+// Opts hold configuration for the kafka aggregator
 type Opts struct {
 	Broker string
 	Topic  string
+	// SchemaRegistry is the URL of the schema registry to decode Avro messages with
+	SchemaRegistry string
+	// DeadLetterTopic is the topic messages that cannot be aggregated are written to.
+	// If empty, they are logged and dropped.
+	DeadLetterTopic string
+	// BatchSize is the maximum number of messages of a partition aggregated in one batch
+	BatchSize int
+	// FlushInterval is the maximum time messages are collected before a batch is aggregated
+	FlushInterval time.Duration
+	// Workers is the maximum number of batches written to Redis at the same time
+	Workers int
+	// RetryBackoff is the initial delay before retrying a message after a temporary failure
+	RetryBackoff time.Duration
+}
+
+// reader is the part of kafka.Reader used to consume a partition
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+}
+
+// writer is the part of kafka.Writer used by the Aggregator
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
 }
@@ -0,0 +1,61 @@
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// SourceFactory creates an aggregation Server reading from a source, configured by the values of the SourcePlugin's options.
+// The Server hands the events it reads to the Engine given.
+type SourceFactory func(cfg plugin.Config, engine *Engine) (Server, error)
+
+// SourcePlugin describes a source the aggregator can consume events from.
+// Sources register themselves from an init function, so linking a source's package into the binary is enough to make it available.
+type SourcePlugin struct {
+	// Name identifies the source and is used to enable it with --<name>.enable
+	Name string
+	// Description is a short human-readable description, e.g. "kafka aggregator"
+	Description string
+	// Options are the source's configuration values, exposed as flags
+	Options []plugin.Option
+	// New creates an aggregation Server for the source
+	New SourceFactory
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]*SourcePlugin)
+)
+
+// RegisterSource makes an aggregator source available by name. It panics if a source of the same name is already registered.
+func RegisterSource(s *SourcePlugin) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	if _, dup := sources[s.Name]; dup {
+		panic(fmt.Sprintf("aggregator source %s registered twice", s.Name))
+	}
+	sources[s.Name] = s
+}
+
+// LookupSource returns the aggregator source registered under the name given
+func LookupSource(name string) (*SourcePlugin, bool) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	s, ok := sources[name]
+	return s, ok
+}
+
+// Sources returns all registered aggregator sources, sorted by name
+func Sources() []*SourcePlugin {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	var list []*SourcePlugin
+	for _, s := range sources {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,58 @@
+package aggregator
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/revert"
+)
+
+// SetReverts makes the Engine check edits for reverts with the Detector given before applying the rules,
+// setting the revert and edit_war fields of the events of edits
+func (e *Engine) SetReverts(d *revert.Detector) {
+	e.reverts = d
+}
+
+// detectReverts checks the edits among a batch of events for reverts, in the order they were received
+func (e *Engine) detectReverts(received []receivedEvent) error {
+	var edits []revert.Edit
+	var checked []map[string]interface{}
+	for _, ev := range received {
+		edit, ok := editOf(ev.event, ev.t)
+		if !ok {
+			continue
+		}
+		edits = append(edits, edit)
+		checked = append(checked, ev.event)
+	}
+	verdicts, err := e.reverts.Check(edits)
+	if err != nil {
+		return err
+	}
+	for i, v := range verdicts {
+		checked[i]["revert"] = v.Revert
+		checked[i]["edit_war"] = v.EditWar
+	}
+	return nil
+}
+
+// editOf returns the Edit an event of an edit or a new page made, or false if it is not one or lacks its revision
+func editOf(event map[string]interface{}, t time.Time) (revert.Edit, bool) {
+	if typ, _ := event["type"].(string); typ != "edit" && typ != "new" {
+		return revert.Edit{}, false
+	}
+	edit := revert.Edit{
+		Revision:  int64(number(lookupField(event, []string{"revision", "new"}))),
+		Parent:    int64(number(lookupField(event, []string{"revision", "old"}))),
+		Length:    int64(number(lookupField(event, []string{"length", "new"}))),
+		OldLength: int64(number(lookupField(event, []string{"length", "old"}))),
+		Time:      t,
+	}
+	edit.Wiki, _ = event["wiki"].(string)
+	edit.Title, _ = event["title"].(string)
+	edit.User, _ = event["user"].(string)
+	edit.Comment, _ = event["comment"].(string)
+	if edit.Revision == 0 || edit.Wiki == "" || edit.Title == "" {
+		return revert.Edit{}, false
+	}
+	return edit, true
+}
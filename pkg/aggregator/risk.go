@@ -0,0 +1,69 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/risk"
+)
+
+// SetScorer makes the Engine score the risk of edits with the Scorer given before applying the rules,
+// setting the risk and risk_factors fields of the events of edits
+func (e *Engine) SetScorer(s risk.Scorer) {
+	e.scorer = s
+}
+
+// scoreRisk scores the edits among a batch of events
+func (e *Engine) scoreRisk(received []receivedEvent) error {
+	var edits []risk.Edit
+	var scored []map[string]interface{}
+	for _, ev := range received {
+		edit, ok := riskEditOf(ev.event, ev.t)
+		if !ok {
+			continue
+		}
+		edits = append(edits, edit)
+		scored = append(scored, ev.event)
+	}
+	if len(edits) == 0 {
+		return nil
+	}
+	scores, err := e.scorer.Score(edits)
+	if err != nil {
+		return err
+	}
+	for i, s := range scores {
+		scored[i]["risk"] = json.Number(strconv.FormatInt(s.Risk, 10))
+		if len(s.Factors) > 0 {
+			scored[i]["risk_factors"] = strings.Join(s.Factors, "+")
+		}
+	}
+	return nil
+}
+
+// riskEditOf returns the risk.Edit an event of an edit or a new page made, or false if it is not one or lacks its revision
+func riskEditOf(event map[string]interface{}, t time.Time) (risk.Edit, bool) {
+	typ, _ := event["type"].(string)
+	if typ != "edit" && typ != "new" {
+		return risk.Edit{}, false
+	}
+	edit := risk.Edit{
+		New:       typ == "new",
+		Namespace: int64(number(event["namespace"])),
+		Revision:  int64(number(lookupField(event, []string{"revision", "new"}))),
+		HasLength: event["length"] != nil,
+		Length:    int64(number(lookupField(event, []string{"length", "new"}))),
+		OldLength: int64(number(lookupField(event, []string{"length", "old"}))),
+		Time:      t,
+	}
+	edit.Wiki, _ = event["wiki"].(string)
+	edit.Title, _ = event["title"].(string)
+	edit.User, _ = event["user"].(string)
+	edit.Comment, _ = event["comment"].(string)
+	if edit.Revision == 0 || edit.Wiki == "" || edit.User == "" {
+		return risk.Edit{}, false
+	}
+	return edit, true
+}
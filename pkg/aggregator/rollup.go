@@ -0,0 +1,577 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/histogram"
+	"github.com/gargath/pleiades/pkg/util"
+)
+
+const (
+	// rollupSourcesKey is a hash of the rolled up resolutions and the resolutions they are rolled up from, so that the
+	// frontend can read buckets that have not been rolled up yet from their source
+	rollupSourcesKey = "pleiades_rollup_sources"
+
+	// rollupLock is held by the aggregator instance running a rollup, so that instances do not duplicate the work
+	rollupLock = "pleiades_rollup_lock"
+
+	// hllMagic starts the string representation of HyperLogLogs in Redis
+	hllMagic = "HYLL"
+
+	// maxRollups is the maximum number of buckets of a resolution rolled up in one run, bounding the time a run takes
+	// when catching up
+	maxRollups = 100
+)
+
+var (
+	rollupBuckets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_rollup_buckets_total",
+			Help: "Number of buckets rolled up, by resolution",
+		},
+		[]string{"resolution"},
+	)
+
+	rollupRepeats = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_rollup_repeats_total",
+			Help: "Number of buckets rolled up again because of late events, by resolution",
+		},
+		[]string{"resolution"},
+	)
+
+	rollupTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_rollup_duration_seconds",
+			Help:    "Time taken by a rollup run",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30},
+		},
+	)
+)
+
+// NewRollup returns a Rollup computing the rolled up resolutions of buckets from the counters in Redis.
+// The retention of the resolutions rolled up from must leave enough time for their buckets to be rolled up.
+func NewRollup(r *redis.Client, buckets *bucket.Config, opts *RollupOpts) (*Rollup, error) {
+	if opts.Delay < 0 {
+		opts.Delay = 0
+	}
+	for _, target := range buckets.Rollups {
+		src, _ := buckets.Source(target)
+		ret, ok := buckets.Retention[src.Name]
+		min := target.Size + opts.Delay + time.Minute
+		if ok && ret < min {
+			return nil, fmt.Errorf("retention of %s must be at least %s to roll up %s", src.Name, min, target.Name)
+		}
+	}
+	return &Rollup{r: r, buckets: buckets, opts: opts}, nil
+}
+
+// Start schedules a rollup every minute
+func (ru *Rollup) Start() error {
+	ru.s = gocron.NewScheduler(time.UTC)
+	_, err := ru.s.Every(1).Minute().Do(ru.run)
+	if err != nil {
+		return fmt.Errorf("failed to schedule rollup: %v", err)
+	}
+	ru.s.StartAsync()
+	logger.Infof("Rolling up %d resolutions every minute", len(ru.buckets.Rollups))
+	return nil
+}
+
+// Stop stops scheduling rollups
+func (ru *Rollup) Stop() {
+	ru.s.Stop()
+}
+
+func (ru *Rollup) run() {
+	timer := prometheus.NewTimer(rollupTime)
+	defer timer.ObserveDuration()
+	err := ru.rollUp(time.Now())
+	if err != nil {
+		logger.Errorf("Rollup failed: %v", err)
+	}
+}
+
+// rollUp computes every bucket of the rolled up resolutions that has ended at least Delay before now and has not been
+// rolled up yet, and rolls up buckets again that events were aggregated into after they were rolled up.
+// Resolutions are rolled up in ascending order, so that a bucket rolled up from another rolled up resolution is only
+// computed once all of its parts are.
+func (ru *Rollup) rollUp(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
+	defer cancel()
+	lock, err := util.TryLock(ctx, ru.r, rollupLock, 50*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to acquire rollup lock: %v", err)
+	}
+	if lock == nil {
+		logger.Debug("Rollup is running on another instance")
+		return nil
+	}
+	defer lock.Release()
+
+	for _, target := range ru.buckets.Rollups {
+		err := ru.rollUpResolution(ctx, target, now)
+		if err != nil {
+			return fmt.Errorf("failed to roll up %s: %v", target.Name, err)
+		}
+	}
+	return nil
+}
+
+func (ru *Rollup) rollUpResolution(ctx context.Context, target bucket.Resolution, now time.Time) error {
+	src, _ := ru.buckets.Source(target)
+	err := ru.r.HSet(ctx, rollupSourcesKey, target.Name, src.Name).Err()
+	if err != nil {
+		return fmt.Errorf("failed to record the source of %s: %v", target.Name, err)
+	}
+	last, err := ru.watermark(ctx, target)
+	if err != nil {
+		return err
+	}
+	srcLast := int64(-1)
+	srcRolledUp := false
+	for _, r := range ru.buckets.Rollups {
+		if r == src {
+			srcRolledUp = true
+		}
+	}
+	if srcRolledUp {
+		if srcLast, err = ru.watermark(ctx, src); err != nil {
+			return err
+		}
+		if srcLast < 0 {
+			return nil
+		}
+	}
+	ready := func(n int64) bool {
+		end := ru.buckets.End(target, n)
+		if end.Add(ru.opts.Delay).After(now) {
+			return false
+		}
+		return !srcRolledUp || ru.buckets.Index(src, end)-1 <= srcLast
+	}
+
+	// the marks are taken before the source keys are listed, so that events aggregated later mark their buckets again
+	dirty, err := ru.takeDirty(ctx, target)
+	if err != nil {
+		return err
+	}
+	var again []int64
+	for _, n := range dirty {
+		if last < 0 || n > last {
+			continue
+		}
+		if !ru.recomputable(src, target, n, now) {
+			logger.Warningf("Not rolling up %s again: some of its %s buckets have expired",
+				strings.TrimSuffix(bucket.Prefix(target, n), "_"), src.Name)
+			continue
+		}
+		again = append(again, n)
+	}
+
+	if len(again) == 0 && last >= 0 && !ready(last+1) {
+		return nil
+	}
+	for i, n := range again {
+		keys, err := ru.sourceKeys(ctx, src, target, n)
+		if err == nil {
+			err = ru.rollUpBucket(ctx, target, n, keys, false)
+		}
+		if err != nil {
+			ru.markDirty(target, again[i:])
+			return err
+		}
+		rollupRepeats.WithLabelValues(target.Name).Inc()
+	}
+
+	if last < 0 {
+		// start with the oldest bucket there is data for
+		first, err := ru.firstBucket(ctx, src, target)
+		if err != nil {
+			return err
+		}
+		if first < 0 {
+			return nil
+		}
+		last = first - 1
+	}
+
+	for i := 0; i < maxRollups && ready(last+1); i++ {
+		keys, err := ru.sourceKeys(ctx, src, target, last+1)
+		if err != nil {
+			return err
+		}
+		last++
+		err = ru.rollUpBucket(ctx, target, last, keys, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeDirty returns and removes the buckets of a rolled up resolution that events were aggregated into since the last run
+func (ru *Rollup) takeDirty(ctx context.Context, target bucket.Resolution) ([]int64, error) {
+	var members *redis.StringSliceCmd
+	_, err := ru.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		members = p.SMembers(ctx, dirtyKey(target))
+		p.Del(ctx, dirtyKey(target))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the buckets written to since the last rollup: %v", err)
+	}
+	var dirty []int64
+	for _, m := range members.Val() {
+		n, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			continue
+		}
+		dirty = append(dirty, n)
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i] < dirty[j] })
+	return dirty, nil
+}
+
+// markDirty marks buckets of a rolled up resolution to be rolled up again in the next run, after a run failed to
+func (ru *Rollup) markDirty(target bucket.Resolution, dirty []int64) {
+	if len(dirty) == 0 {
+		return
+	}
+	members := make([]interface{}, len(dirty))
+	for i, n := range dirty {
+		members[i] = n
+	}
+	err := ru.r.SAdd(context.Background(), dirtyKey(target), members...).Err()
+	if err != nil {
+		logger.Errorf("Failed to mark %d %s buckets to be rolled up again: %v", len(dirty), target.Name, err)
+	}
+}
+
+// recomputable returns whether all source buckets of bucket n of the target resolution are still kept
+func (ru *Rollup) recomputable(src bucket.Resolution, target bucket.Resolution, n int64, now time.Time) bool {
+	expiry := ru.buckets.Expiry(src, ru.buckets.Index(src, ru.buckets.Start(target, n)))
+	return expiry.IsZero() || expiry.After(now)
+}
+
+// rollUpBucket sums the counters of the source keys given into bucket n of the target resolution.
+// Counters are set rather than incremented, so that a bucket can safely be rolled up again. With advance, the bucket is
+// recorded as the last one rolled up.
+// Sorted sets are merged into their union, capped at the size of the largest of them, HyperLogLogs are merged with PFMERGE
+// and the fields of hashes are summed.
+func (ru *Rollup) rollUpBucket(ctx context.Context, target bucket.Resolution, n int64, keys []string, advance bool) error {
+	totals := make(map[string]int64)
+	var names []string
+	hlls := &keyGroups{}
+	var other []string
+	for i := 0; i < len(keys); i += 1000 {
+		end := i + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values, err := ru.r.MGet(ctx, keys[i:end]...).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read counters: %v", err)
+		}
+		for j, v := range values {
+			k := keys[i+j]
+			s, ok := v.(string)
+			if !ok {
+				other = append(other, k)
+				continue
+			}
+			if strings.HasPrefix(s, hllMagic) {
+				hlls.add(k)
+				continue
+			}
+			val, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("counter %s is not a number: %s", k, s)
+			}
+			name := counterName(k)
+			if _, ok := totals[name]; !ok {
+				names = append(names, name)
+			}
+			totals[name] += val
+		}
+	}
+
+	sets, hashes, err := ru.classify(ctx, other, hlls)
+	if err != nil {
+		return err
+	}
+	caps, err := ru.setCaps(ctx, sets)
+	if err != nil {
+		return err
+	}
+	fields, err := ru.sumHashes(ctx, hashes)
+	if err != nil {
+		return err
+	}
+
+	prefix := bucket.Prefix(target, n)
+	expiry := ru.buckets.Expiry(target, n)
+	_, err = ru.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, name := range names {
+			p.Set(ctx, prefix+name, totals[name], 0)
+			if !expiry.IsZero() {
+				p.ExpireAt(ctx, prefix+name, expiry)
+			}
+		}
+		for _, name := range sets.names {
+			if caps[name] == 0 {
+				continue
+			}
+			p.ZUnionStore(ctx, prefix+name, &redis.ZStore{Keys: sets.keys[name]})
+			p.ZRemRangeByRank(ctx, prefix+name, 0, -caps[name]-1)
+			if !expiry.IsZero() {
+				p.ExpireAt(ctx, prefix+name, expiry)
+			}
+		}
+		for _, name := range hlls.names {
+			p.PFMerge(ctx, prefix+name, hlls.keys[name]...)
+			if !expiry.IsZero() {
+				p.ExpireAt(ctx, prefix+name, expiry)
+			}
+		}
+		for _, name := range hashes.names {
+			if len(fields[name]) == 0 {
+				continue
+			}
+			p.Del(ctx, prefix+name)
+			p.HSet(ctx, prefix+name, fields[name]...)
+			if !expiry.IsZero() {
+				p.ExpireAt(ctx, prefix+name, expiry)
+			}
+			if percentiles := histogramPercentiles(fields[name]); percentiles != nil {
+				p.Del(ctx, prefix+name+histogram.PercentilesSuffix)
+				p.HSet(ctx, prefix+name+histogram.PercentilesSuffix, percentiles...)
+				if !expiry.IsZero() {
+					p.ExpireAt(ctx, prefix+name+histogram.PercentilesSuffix, expiry)
+				}
+			}
+		}
+		if advance {
+			p.Set(ctx, watermarkKey(target), n, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write bucket %d: %v", n, err)
+	}
+	rollupBuckets.WithLabelValues(target.Name).Inc()
+	logger.Debugf("Rolled up %d counters, %d sorted sets, %d HyperLogLogs and %d hashes into %s",
+		len(names), len(sets.names), len(hlls.names), len(hashes.names), strings.TrimSuffix(prefix, "_"))
+	return nil
+}
+
+// classify returns the sorted sets and hashes among keys that are not strings, and adds the HyperLogLogs among them to hlls.
+// Keys that have expired since they were listed are skipped, and so are the percentiles of histograms, which are estimated
+// again from the histograms rolled up.
+func (ru *Rollup) classify(ctx context.Context, keys []string, hlls *keyGroups) (*keyGroups, *keyGroups, error) {
+	sets, hashes := &keyGroups{}, &keyGroups{}
+	if len(keys) == 0 {
+		return sets, hashes, nil
+	}
+	types := make([]*redis.StatusCmd, len(keys))
+	_, err := ru.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, k := range keys {
+			types[i] = p.Type(ctx, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key types: %v", err)
+	}
+	for i, k := range keys {
+		switch types[i].Val() {
+		case "zset":
+			sets.add(k)
+		case "hash":
+			if !strings.HasSuffix(k, histogram.PercentilesSuffix) {
+				hashes.add(k)
+			}
+		case "none":
+		default:
+			hlls.add(k)
+		}
+	}
+	return sets, hashes, nil
+}
+
+// setCaps returns the size of the largest sorted set of each name
+func (ru *Rollup) setCaps(ctx context.Context, sets *keyGroups) (map[string]int64, error) {
+	caps := make(map[string]int64)
+	if len(sets.names) == 0 {
+		return caps, nil
+	}
+	cards := make(map[string][]*redis.IntCmd)
+	_, err := ru.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for name, keys := range sets.keys {
+			for _, k := range keys {
+				cards[name] = append(cards[name], p.ZCard(ctx, k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sorted sets: %v", err)
+	}
+	for name, cmds := range cards {
+		for _, c := range cmds {
+			if c.Val() > caps[name] {
+				caps[name] = c.Val()
+			}
+		}
+	}
+	return caps, nil
+}
+
+// sumHashes returns the sums of the fields of the hashes of each name, as field and value pairs
+func (ru *Rollup) sumHashes(ctx context.Context, hashes *keyGroups) (map[string][]interface{}, error) {
+	fields := make(map[string][]interface{})
+	if len(hashes.names) == 0 {
+		return fields, nil
+	}
+	values := make(map[string][]*redis.StringStringMapCmd)
+	_, err := ru.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for name, keys := range hashes.keys {
+			for _, k := range keys {
+				values[name] = append(values[name], p.HGetAll(ctx, k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashes: %v", err)
+	}
+	for _, name := range hashes.names {
+		sums := make(map[string]int64)
+		var order []string
+		for _, c := range values[name] {
+			for f, v := range c.Val() {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("field %s of %s is not a number: %s", f, name, v)
+				}
+				if _, ok := sums[f]; !ok {
+					order = append(order, f)
+				}
+				sums[f] += n
+			}
+		}
+		for _, f := range order {
+			fields[name] = append(fields[name], f, sums[f])
+		}
+	}
+	return fields, nil
+}
+
+// histogramPercentiles returns the percentiles estimated from the field and value pairs of a hash as field and value
+// pairs, or nil if the hash is not a histogram, i.e. has no +Inf bin, or is empty
+func histogramPercentiles(fields []interface{}) []interface{} {
+	counts := make(map[string]int64)
+	for i := 0; i < len(fields); i += 2 {
+		counts[fields[i].(string)] = fields[i+1].(int64)
+	}
+	if _, ok := counts[InfBound]; !ok {
+		return nil
+	}
+	var out []interface{}
+	for name, v := range histogram.Percentiles(histogram.Bins(counts)) {
+		out = append(out, name, v)
+	}
+	return out
+}
+
+// add adds a key to the group of its counter name
+func (g *keyGroups) add(key string) {
+	if g.keys == nil {
+		g.keys = make(map[string][]string)
+	}
+	name := counterName(key)
+	if _, ok := g.keys[name]; !ok {
+		g.names = append(g.names, name)
+	}
+	g.keys[name] = append(g.keys[name], key)
+}
+
+// counterName returns the name of the counter a bucket key holds, e.g. pleiades_total for min_26617610_pleiades_total
+func counterName(key string) string {
+	return strings.SplitN(key, "_", 3)[2]
+}
+
+// sourceKeys returns the keys of the source resolution's buckets that fall into bucket n of the target resolution
+func (ru *Rollup) sourceKeys(ctx context.Context, src bucket.Resolution, target bucket.Resolution, n int64) ([]string, error) {
+	var keys []string
+	from := ru.buckets.Index(src, ru.buckets.Start(target, n))
+	to := ru.buckets.Index(src, ru.buckets.End(target, n))
+	for m := from; m < to; m++ {
+		iter := ru.r.Scan(ctx, 0, bucket.Prefix(src, m)+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list counters: %v", err)
+		}
+	}
+	return keys, nil
+}
+
+// firstBucket returns the first bucket of the target resolution that the source resolution has data for, or -1 if
+// there is none. It lists every key of the source resolution, and is only needed until a first bucket is rolled up.
+func (ru *Rollup) firstBucket(ctx context.Context, src bucket.Resolution, target bucket.Resolution) (int64, error) {
+	first := int64(-1)
+	iter := ru.r.Scan(ctx, 0, src.Prefix+"_*", 1000).Iterator()
+	for iter.Next(ctx) {
+		parts := strings.SplitN(iter.Val(), "_", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		t := ru.buckets.Index(target, ru.buckets.Start(src, n))
+		if first < 0 || t < first {
+			first = t
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list counters: %v", err)
+	}
+	return first, nil
+}
+
+// watermark returns the last bucket of a resolution that has been rolled up, or -1 if there is none
+func (ru *Rollup) watermark(ctx context.Context, r bucket.Resolution) (int64, error) {
+	n, err := ru.r.Get(ctx, watermarkKey(r)).Int64()
+	if err == redis.Nil {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read last bucket rolled up: %v", err)
+	}
+	return n, nil
+}
+
+func watermarkKey(r bucket.Resolution) string {
+	return "pleiades_rollup_" + r.Name
+}
+
+// dirtyKey returns the key of the set of the buckets of a rolled up resolution that events were aggregated into since
+// the last rollup run
+func dirtyKey(r bucket.Resolution) string {
+	return "pleiades_rollup_dirty_" + r.Name
+}
@@ -0,0 +1,203 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rollup", func() {
+	// the hour and day of testID
+	const (
+		hour = 443626
+		day  = 18484
+	)
+
+	var (
+		m       *miniredis.Miniredis
+		buckets *bucket.Config
+		ru      *Rollup
+	)
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		buckets, err = bucket.NewConfig(&bucket.Opts{
+			Resolutions: []string{"1m"},
+			Rollups:     []string{"1d", "1h"},
+			Retention:   map[string]string{"1m": "48h", "1h": "2160h"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		ru, err = NewRollup(redis.NewClient(&redis.Options{Addr: m.Addr()}), buckets, &RollupOpts{Delay: 5 * time.Minute})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	counter := func(key string) string {
+		v, err := m.Get(key)
+		Expect(err).NotTo(HaveOccurred())
+		return v
+	}
+
+	// minute returns the prefix of minute i of the hour of testID
+	minute := func(i int64) string {
+		return bucket.Prefix(bucket.Minute, hour*60+i)
+	}
+
+	// rollUp runs the rollup as if at the time given, which Redis follows when expiring keys
+	rollUp := func(now time.Time) error {
+		m.SetTime(now)
+		return ru.rollUp(now)
+	}
+
+	endOfHour := func(n int64) time.Time {
+		return buckets.End(bucket.Hour, n)
+	}
+
+	BeforeEach(func() {
+		Expect(m.Set(minute(0)+"pleiades_total", "3")).To(Succeed())
+		Expect(m.Set(minute(59)+"pleiades_total", "4")).To(Succeed())
+		Expect(m.Set(minute(59)+"pleiades_wiki_enwiki", "2")).To(Succeed())
+		Expect(m.Set(minute(60)+"pleiades_total", "5")).To(Succeed())
+	})
+
+	It("rolls up the minutes of an hour once the delay has passed", func() {
+		Expect(rollUp(endOfHour(hour).Add(time.Minute))).To(Succeed())
+		Expect(m.Exists("hour_443626_pleiades_total")).To(BeFalse())
+
+		Expect(rollUp(endOfHour(hour).Add(5 * time.Minute))).To(Succeed())
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("7"))
+		Expect(counter("hour_443626_pleiades_wiki_enwiki")).To(Equal("2"))
+		Expect(m.Exists("hour_443627_pleiades_total")).To(BeFalse())
+		Expect(counter("pleiades_rollup_1h")).To(Equal("443626"))
+	})
+
+	It("expires rolled up buckets after their retention", func() {
+		now := endOfHour(hour).Add(5 * time.Minute)
+		Expect(rollUp(now)).To(Succeed())
+		Expect(m.TTL("hour_443626_pleiades_total")).To(Equal(2160*time.Hour - 5*time.Minute))
+	})
+
+	It("does not count a bucket twice when rolling it up again", func() {
+		now := endOfHour(hour).Add(5 * time.Minute)
+		Expect(rollUp(now)).To(Succeed())
+		m.Del("pleiades_rollup_1h")
+		Expect(rollUp(now)).To(Succeed())
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("7"))
+	})
+
+	It("catches up on every bucket that has ended", func() {
+		Expect(rollUp(endOfHour(hour + 1).Add(time.Hour))).To(Succeed())
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("7"))
+		Expect(counter("hour_443627_pleiades_total")).To(Equal("5"))
+		Expect(counter("pleiades_rollup_1h")).To(Equal("443627"))
+	})
+
+	It("rolls up a bucket again once events are aggregated into it late", func() {
+		now := endOfHour(hour).Add(5 * time.Minute)
+		Expect(rollUp(now)).To(Succeed())
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("7"))
+
+		rules, err := CompileRules([]byte(`{counters: [{key: pleiades_total}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		e := NewEngine(redis.NewClient(&redis.Options{Addr: m.Addr()}), rules, buckets)
+		_, err = e.Apply([]Event{{ID: testID, Data: []byte(testEvent)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.SMembers("pleiades_rollup_dirty_1h")).To(ConsistOf("443626"))
+		Expect(m.SMembers("pleiades_rollup_dirty_1d")).To(ConsistOf("18484"))
+
+		Expect(rollUp(now.Add(time.Minute))).To(Succeed())
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("8"))
+		Expect(counter("pleiades_rollup_1h")).To(Equal("443626"))
+		Expect(m.Exists("pleiades_rollup_dirty_1h")).To(BeFalse())
+	})
+
+	It("does not roll up a bucket again once its source has expired", func() {
+		now := endOfHour(hour).Add(5 * time.Minute)
+		Expect(rollUp(now)).To(Succeed())
+		Expect(m.Set(minute(0)+"pleiades_total", "100")).To(Succeed())
+		_, err := m.SAdd("pleiades_rollup_dirty_1h", "443626")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rollUp(now.Add(48 * time.Hour))).To(Succeed())
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("7"))
+	})
+
+	It("records the source of every rolled up resolution", func() {
+		Expect(rollUp(endOfHour(hour).Add(time.Minute))).To(Succeed())
+		Expect(m.HGet("pleiades_rollup_sources", "1h")).To(Equal("1m"))
+		Expect(m.HGet("pleiades_rollup_sources", "1d")).To(Equal("1h"))
+	})
+
+	It("rolls up a day once all of its hours are rolled up", func() {
+		endOfDay := buckets.End(bucket.Day, day)
+		Expect(rollUp(endOfDay.Add(time.Minute))).To(Succeed())
+		Expect(m.Exists("day_18484_pleiades_total")).To(BeFalse())
+
+		Expect(rollUp(endOfDay.Add(5 * time.Minute))).To(Succeed())
+		Expect(counter("day_18484_pleiades_total")).To(Equal("12"))
+		Expect(m.TTL("day_18484_pleiades_total")).To(BeZero())
+	})
+
+	It("merges sorted sets, keeping as many members as the largest", func() {
+		for _, z := range []struct {
+			minute int64
+			member string
+			score  float64
+		}{{0, "A", 3}, {0, "B", 1}, {1, "B", 4}, {1, "C", 2}} {
+			_, err := m.ZAdd(minute(z.minute)+"top_enwiki", z.score, z.member)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(rollUp(endOfHour(hour).Add(5 * time.Minute))).To(Succeed())
+		Expect(m.ZMembers("hour_443626_top_enwiki")).To(Equal([]string{"A", "B"}))
+		Expect(m.ZScore("hour_443626_top_enwiki", "B")).To(Equal(5.0))
+		Expect(counter("hour_443626_pleiades_total")).To(Equal("7"))
+	})
+
+	It("merges HyperLogLogs", func() {
+		r := redis.NewClient(&redis.Options{Addr: m.Addr()})
+		Expect(r.PFAdd(context.Background(), minute(0)+"users", "A", "B").Err()).To(Succeed())
+		Expect(r.PFAdd(context.Background(), minute(1)+"users", "B", "C").Err()).To(Succeed())
+		Expect(rollUp(endOfHour(hour).Add(5 * time.Minute))).To(Succeed())
+		Expect(r.PFCount(context.Background(), "hour_443626_users").Val()).To(Equal(int64(3)))
+		Expect(m.TTL("hour_443626_users")).To(Equal(2160*time.Hour - 5*time.Minute))
+	})
+
+	It("sums the fields of hashes", func() {
+		m.HSet(minute(0)+"size", "0", "2", "100", "1")
+		m.HSet(minute(1)+"size", "100", "3", "+Inf", "1")
+		m.HSet(minute(1)+"size_percentiles", "p50", "12.5")
+		Expect(rollUp(endOfHour(hour).Add(5 * time.Minute))).To(Succeed())
+		Expect(m.HKeys("hour_443626_size")).To(ConsistOf("0", "100", "+Inf"))
+		Expect(m.HGet("hour_443626_size_percentiles", "p50")).To(Equal("37.5"))
+		Expect(m.HGet("hour_443626_size", "100")).To(Equal("4"))
+		Expect(m.HGet("hour_443626_size", "0")).To(Equal("2"))
+	})
+
+	It("skips the run while another instance holds the lock", func() {
+		Expect(m.Set(rollupLock, "1")).To(Succeed())
+		Expect(rollUp(endOfHour(hour).Add(5 * time.Minute))).To(Succeed())
+		Expect(m.Exists("hour_443626_pleiades_total")).To(BeFalse())
+	})
+
+	It("requires the source of a rollup to be kept until it is rolled up", func() {
+		short, err := bucket.NewConfig(&bucket.Opts{
+			Resolutions: []string{"1m"},
+			Rollups:     []string{"1h"},
+			Retention:   map[string]string{"1m": "30m"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = NewRollup(nil, short, &RollupOpts{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,714 @@
+package aggregator
+
+//go:generate go run schema_generate.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/histogram"
+	"github.com/gargath/pleiades/pkg/project"
+	"github.com/gargath/pleiades/pkg/transform"
+)
+
+// DefaultRules are the counter rules used unless a rules file is given.
+// They produce the counters read by the web frontend.
+const DefaultRules = `
+counters:
+  - key: pleiades_total
+  - key: pleiades_wiki_{wiki}
+  - key: pleiades_type_{type}
+  - key: pleiades_family_{project_family}
+  - key: pleiades_language_{project_language}
+  - key: pleiades_bot
+    when:
+      - {field: bot, op: eq, value: true}
+  - key: pleiades_minor
+    when:
+      - {field: minor, op: eq, value: true}
+  - key: pleiades_length_inc
+    when:
+      - {field: length, op: exists}
+      - {field: length.old, op: lt, compare: length.new}
+  - key: pleiades_length_dec
+    when:
+      - {field: length, op: exists}
+      - {field: length.old, op: gte, compare: length.new}
+  - key: pleiades_growth
+    delta: {field: length.new, minus: length.old}
+  - key: pleiades_top_pages_{wiki}
+    member: "{title}"
+    when:
+      - {field: type, op: in, value: [edit, new]}
+  - key: pleiades_top_pages_{wiki}_ns_{namespace}
+    member: "{title}"
+    when:
+      - {field: type, op: in, value: [edit, new]}
+  - key: pleiades_top_pages_{wiki}_human
+    member: "{title}"
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: bot, op: eq, value: false}
+  - key: pleiades_top_pages_{wiki}_ns_{namespace}_human
+    member: "{title}"
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: bot, op: eq, value: false}
+  - key: pleiades_trending_{wiki}
+    member: "{title}"
+    editor: "{user}"
+    halfLife: ` + trendingHalfLife + `
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: bot, op: eq, value: false}
+      - {field: minor, op: eq, value: false}
+    delta: {value: 10}
+  - key: pleiades_trending_{wiki}
+    member: "{title}"
+    editor: "{user}"
+    halfLife: ` + trendingHalfLife + `
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: bot, op: eq, value: false}
+      - {field: minor, op: eq, value: true}
+    delta: {value: 5}
+  - key: pleiades_trending_{wiki}
+    member: "{title}"
+    editor: "{user}"
+    halfLife: ` + trendingHalfLife + `
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: bot, op: eq, value: true}
+  - key: pleiades_unique_users
+    member: "{user}"
+    distinct: true
+    when:
+      - {field: type, op: in, value: [edit, new]}
+  - key: pleiades_unique_users_{wiki}
+    member: "{user}"
+    distinct: true
+    when:
+      - {field: type, op: in, value: [edit, new]}
+  - key: pleiades_unique_pages
+    member: "{wiki}:{title}"
+    distinct: true
+    when:
+      - {field: type, op: in, value: [edit, new]}
+  - key: pleiades_unique_pages_{wiki}
+    member: "{title}"
+    distinct: true
+    when:
+      - {field: type, op: in, value: [edit, new]}
+  - key: pleiades_unique_ips
+    member: "{user}"
+    distinct: true
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: user, op: match, value: '` + ipPattern + `'}
+  - key: pleiades_unique_ips_{wiki}
+    member: "{user}"
+    distinct: true
+    when:
+      - {field: type, op: in, value: [edit, new]}
+      - {field: user, op: match, value: '` + ipPattern + `'}
+  - key: pleiades_bytes_added
+    when:
+      - {field: length, op: exists}
+      - {field: length.old, op: lt, compare: length.new}
+    delta: {field: length.new, minus: length.old}
+  - key: pleiades_bytes_added_{wiki}
+    when:
+      - {field: length, op: exists}
+      - {field: length.old, op: lt, compare: length.new}
+    delta: {field: length.new, minus: length.old}
+  - key: pleiades_bytes_removed
+    when:
+      - {field: length, op: exists}
+      - {field: length.old, op: gt, compare: length.new}
+    delta: {field: length.old, minus: length.new}
+  - key: pleiades_bytes_removed_{wiki}
+    when:
+      - {field: length, op: exists}
+      - {field: length.old, op: gt, compare: length.new}
+    delta: {field: length.old, minus: length.new}
+  - key: pleiades_edit_size
+    when:
+      - {field: length, op: exists}
+    delta: {field: length.new, minus: length.old}
+    histogram: ` + sizeBins + `
+  - key: pleiades_edit_size_{wiki}
+    when:
+      - {field: length, op: exists}
+    delta: {field: length.new, minus: length.old}
+    histogram: ` + sizeBins + `
+  - key: pleiades_rate
+    rate: true
+  - key: pleiades_rate_wikis
+    field: "{wiki}"
+    rate: true
+  - key: pleiades_log_actions
+    field: "{log_type}/{log_action}"
+    when:
+      - {field: type, op: eq, value: log}
+  - key: pleiades_log_actions_{wiki}
+    field: "{log_type}/{log_action}"
+    when:
+      - {field: type, op: eq, value: log}
+  - key: pleiades_reverts
+    when:
+      - {field: revert, op: eq, value: true}
+  - key: pleiades_reverts_{wiki}
+    when:
+      - {field: revert, op: eq, value: true}
+  - key: pleiades_hotspots_{wiki}
+    member: "{title}"
+    when:
+      - {field: revert, op: eq, value: true}
+  - key: pleiades_edit_wars_{wiki}
+    member: "{title}"
+    when:
+      - {field: edit_war, op: eq, value: true}
+  - key: pleiades_risky_edits
+    when:
+      - {field: risk, op: gte, value: ` + riskThreshold + `}
+  - key: pleiades_risky_edits_{wiki}
+    when:
+      - {field: risk, op: gte, value: ` + riskThreshold + `}
+  - key: pleiades_risk_feed_{wiki}
+    member: "{revision.new}|{risk_factors}|{user}|{title}"
+    when:
+      - {field: risk, op: gte, value: ` + riskThreshold + `}
+    delta: {field: risk}
+  - key: pleiades_risky_users_{wiki}
+    member: "{user}"
+    when:
+      - {field: risk, op: gte, value: ` + riskThreshold + `}
+`
+
+// trendingHalfLife is the half-life of the trending scores of pages. Edits by humans score 10, minor edits 5 and bot edits 1.
+const trendingHalfLife = "1h"
+
+// riskThreshold is the risk score from which edits are counted as risky and listed for patrollers
+const riskThreshold = "50"
+
+// sizeBins are the bounds of the bins of the histograms of the change in length of edits
+const sizeBins = "[-10000, -1000, -500, -100, -50, -10, 0, 10, 50, 100, 500, 1000, 10000]"
+
+// ipPattern matches the IPv4 and IPv6 addresses anonymous edits are attributed to instead of a user name, and their
+// hashes if the hash-user transform was applied
+const ipPattern = `^(` + transform.AnonymousPrefix + `[0-9a-f]{32}|\d{1,3}(\.\d{1,3}){3}|[0-9A-Fa-f]{0,4}(:[0-9A-Fa-f]{0,4}){2,7})$`
+
+// InfBound names the histogram bin of values above the last bound
+const InfBound = histogram.InfBound
+
+// derivedFields are added to events before the rules are applied, and can be used by rules like fields of the event schema.
+// They map to their schema type. Reverts and edit wars are only derived if the Engine detects reverts, and the risk of edits
+// and the factors making it up, joined with +, if it scores them.
+var derivedFields = map[string]string{
+	"project_family":   "string",
+	"project_language": "string",
+	"revert":           "boolean",
+	"edit_war":         "boolean",
+	"risk":             "integer",
+	"risk_factors":     "string",
+}
+
+// RepeatWeight is the share of their delta that repeated increments of a decaying member by the same editor count
+const RepeatWeight = 0.1
+
+// DefaultCap is the number of members sorted sets are trimmed to unless their rule sets a cap
+const DefaultCap = 1000
+
+// Reasons for skipping an event
+const (
+	ReasonParse     = "parse"
+	ReasonTimestamp = "timestamp"
+)
+
+// Predicate operators
+const (
+	OpExists  = "exists"
+	OpMissing = "missing"
+	OpEq      = "eq"
+	OpNe      = "ne"
+	OpIn      = "in"
+	OpLt      = "lt"
+	OpLte     = "lte"
+	OpGt      = "gt"
+	OpGte     = "gte"
+	OpMatch   = "match"
+)
+
+var (
+	placeholderRegExp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+	// ErrNoRules is returned when a rules file declares no counters
+	ErrNoRules error = fmt.Errorf("no counters declared")
+)
+
+// LoadRules reads and compiles counter rules from a YAML file
+func LoadRules(filename string) (*Rules, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %v", filename, err)
+	}
+	return CompileRules(b)
+}
+
+// CompileRules parses counter rules and validates every field they reference against the event schema
+func CompileRules(data []byte) (*Rules, error) {
+	var f RuleFile
+	err := yaml.UnmarshalStrict(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %v", err)
+	}
+	if len(f.Counters) == 0 {
+		return nil, ErrNoRules
+	}
+	schema, err := parseEventSchema()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rules{projects: project.Builtin()}
+	for i, c := range f.Counters {
+		cr, err := compileCounter(c, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter %d (%s): %v", i+1, c.Key, err)
+		}
+		r.counters = append(r.counters, cr)
+	}
+	return r, nil
+}
+
+// MustCompileDefaultRules returns the compiled DefaultRules
+func MustCompileDefaultRules() *Rules {
+	r, err := CompileRules([]byte(DefaultRules))
+	if err != nil {
+		panic(fmt.Sprintf("invalid default rules: %v", err))
+	}
+	return r
+}
+
+// Increments parses an event and returns the counter increments the rules produce for it
+func (r *Rules) Increments(data []byte) ([]Increment, error) {
+	event, err := r.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return r.EventIncrements(event), nil
+}
+
+// Parse parses an event and adds the derived fields the rules do not need state to derive
+func (r *Rules) Parse(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var event map[string]interface{}
+	err := d.Decode(&event)
+	if err != nil {
+		logger.Debugf("failed to parse event data line: %s", string(data))
+		return nil, fmt.Errorf("failed to parse event data: %v", err)
+	}
+	r.derive(event)
+	return event, nil
+}
+
+// EventIncrements returns the counter increments the rules produce for a parsed event.
+// Counters whose key template references a field the event does not have are skipped.
+func (r *Rules) EventIncrements(event map[string]interface{}) []Increment {
+	var incs []Increment
+	for _, c := range r.counters {
+		if !c.matches(event) {
+			continue
+		}
+		key, ok := c.key(event)
+		if !ok {
+			continue
+		}
+		inc := Increment{Key: key, Delta: c.deltaFor(event), Distinct: c.distinct, Cap: c.cap, Rate: c.rate, HalfLife: c.decay.HalfLife}
+		if c.bounds != nil {
+			inc.Field, inc.Delta, inc.Bounds = bin(c.bounds, inc.Delta), 1, c.bounds
+		}
+		if c.member != nil {
+			inc.Member, ok = expand(c.member, event)
+			if !ok {
+				continue
+			}
+		}
+		if c.field != nil {
+			inc.Field, ok = expand(c.field, event)
+			if !ok {
+				continue
+			}
+		}
+		if c.editor != nil {
+			inc.Editor, ok = expand(c.editor, event)
+			if !ok {
+				continue
+			}
+		}
+		incs = append(incs, inc)
+	}
+	return incs
+}
+
+// HalfLives returns the half-lives of the decaying sorted sets of the rules by their key template
+func (r *Rules) HalfLives() map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for _, c := range r.counters {
+		if c.decay.HalfLife > 0 {
+			out[c.template] = c.decay.HalfLife
+		}
+	}
+	return out
+}
+
+// SetProjects sets the table the project family and language of events are derived with
+func (r *Rules) SetProjects(t *project.Table) {
+	r.projects = t
+}
+
+// derive adds the derivedFields to an event, unless they were added before it was published
+func (r *Rules) derive(event map[string]interface{}) {
+	if _, ok := event["project_family"]; ok || r.projects == nil {
+		return
+	}
+	wiki, _ := event["wiki"].(string)
+	server, _ := event["server_name"].(string)
+	p, ok := r.projects.Lookup(wiki, server)
+	if !ok {
+		return
+	}
+	event["project_family"] = p.Family
+	if p.Language != "" {
+		event["project_language"] = p.Language
+	}
+}
+
+func compileCounter(c CounterRule, schema *schemaNode) (*counter, error) {
+	if c.Key == "" {
+		return nil, fmt.Errorf("key is required")
+	}
+	cr := &counter{template: c.Key, delta: 1}
+	var err error
+	cr.parts, err = compileTemplate(c.Key, schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if c.Member != "" {
+		cr.member, err = compileTemplate(c.Member, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid member: %v", err)
+		}
+		cr.distinct = c.Distinct
+		cr.cap = c.Cap
+		if cr.cap == 0 && !c.Distinct {
+			cr.cap = DefaultCap
+		}
+	}
+	if c.Cap < 0 || (c.Cap > 0 && (c.Member == "" || c.Distinct)) {
+		return nil, fmt.Errorf("cap must be positive and requires a member that is not distinct")
+	}
+	if c.Distinct && (c.Member == "" || c.Delta != nil) {
+		return nil, fmt.Errorf("distinct requires a member and takes no delta")
+	}
+	if c.Histogram != nil {
+		if c.Member != "" || len(c.Histogram) == 0 {
+			return nil, fmt.Errorf("histogram requires bounds and takes no member")
+		}
+		for i := 1; i < len(c.Histogram); i++ {
+			if c.Histogram[i] <= c.Histogram[i-1] {
+				return nil, fmt.Errorf("histogram bounds must be ascending")
+			}
+		}
+		cr.bounds = c.Histogram
+	}
+	if c.Field != "" {
+		if c.Member != "" || c.Histogram != nil {
+			return nil, fmt.Errorf("field takes no member or histogram")
+		}
+		cr.field, err = compileTemplate(c.Field, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field: %v", err)
+		}
+	}
+	if c.Rate && c.Member != "" {
+		return nil, fmt.Errorf("rate takes no member")
+	}
+	cr.rate = c.Rate
+	if c.HalfLife != "" {
+		if c.Member == "" || c.Distinct {
+			return nil, fmt.Errorf("halfLife requires a member that is not distinct")
+		}
+		cr.decay, err = bucket.ParseDecay(c.HalfLife)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.Editor != "" {
+		if c.HalfLife == "" {
+			return nil, fmt.Errorf("editor requires a halfLife")
+		}
+		cr.editor, err = compileTemplate(c.Editor, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid editor: %v", err)
+		}
+	}
+
+	for _, p := range c.When {
+		cp, err := compilePredicate(p, schema)
+		if err != nil {
+			return nil, err
+		}
+		cr.when = append(cr.when, cp)
+	}
+
+	if c.Delta != nil {
+		if c.Delta.Field == "" {
+			if c.Delta.Minus != "" {
+				return nil, fmt.Errorf("delta minus requires a field")
+			}
+			cr.delta = c.Delta.Value
+		} else {
+			cr.deltaField, err = schema.field(c.Delta.Field, numeric)
+			if err != nil {
+				return nil, err
+			}
+			if c.Delta.Minus != "" {
+				cr.deltaMinus, err = schema.field(c.Delta.Minus, numeric)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return cr, nil
+}
+
+// compileTemplate splits a template into literal parts and the fields substituted for its {field} placeholders
+func compileTemplate(t string, schema *schemaNode) ([]keyPart, error) {
+	var parts []keyPart
+	prev := 0
+	for _, m := range placeholderRegExp.FindAllStringSubmatchIndex(t, -1) {
+		parts = append(parts, keyPart{literal: t[prev:m[0]]})
+		path, err := schema.field(t[m[2]:m[3]], scalar)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, keyPart{field: path})
+		prev = m[1]
+	}
+	rest := t[prev:]
+	if strings.ContainsAny(rest, "{}") {
+		return nil, fmt.Errorf("unbalanced braces")
+	}
+	return append(parts, keyPart{literal: rest}), nil
+}
+
+func compilePredicate(p Predicate, schema *schemaNode) (*predicate, error) {
+	cp := &predicate{op: p.Op}
+	kind := anyKind
+	switch p.Op {
+	case OpExists, OpMissing:
+	case OpEq, OpNe, OpIn, OpMatch:
+		kind = scalar
+	case OpLt, OpLte, OpGt, OpGte:
+		kind = numeric
+	default:
+		return nil, fmt.Errorf("unknown operator %s", p.Op)
+	}
+	var err error
+	cp.field, err = schema.field(p.Field, kind)
+	if err != nil {
+		return nil, err
+	}
+	if p.Op == OpExists || p.Op == OpMissing {
+		return cp, nil
+	}
+
+	if p.Compare != "" {
+		if p.Op == OpIn || p.Op == OpMatch {
+			return nil, fmt.Errorf("operator %s cannot compare fields", p.Op)
+		}
+		cp.compare, err = schema.field(p.Compare, kind)
+		return cp, err
+	}
+	if p.Value == nil {
+		return nil, fmt.Errorf("operator %s requires a value or a field to compare to", p.Op)
+	}
+	if p.Op == OpMatch {
+		s, ok := p.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator %s requires a regular expression", p.Op)
+		}
+		cp.pattern, err = regexp.Compile(s)
+		return cp, err
+	}
+	values := []interface{}{p.Value}
+	if p.Op == OpIn {
+		list, ok := p.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operator %s requires a list of values", p.Op)
+		}
+		values = list
+	}
+	for _, v := range values {
+		s, ok := format(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v for operator %s", v, p.Op)
+		}
+		if kind == numeric {
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("operator %s requires a numeric value, not %v", p.Op, v)
+			}
+			cp.number = n
+		}
+		cp.values = append(cp.values, s)
+	}
+	return cp, nil
+}
+
+func (c *counter) matches(event map[string]interface{}) bool {
+	for _, p := range c.when {
+		if !p.matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *counter) key(event map[string]interface{}) (string, bool) {
+	return expand(c.parts, event)
+}
+
+// expand substitutes the event's values into a compiled template.
+// It returns false if the event lacks one of the fields.
+func expand(parts []keyPart, event map[string]interface{}) (string, bool) {
+	var b strings.Builder
+	for _, p := range parts {
+		if p.field == nil {
+			b.WriteString(p.literal)
+			continue
+		}
+		s, ok := format(lookupField(event, p.field))
+		if !ok || s == "" {
+			return "", false
+		}
+		b.WriteString(s)
+	}
+	return b.String(), true
+}
+
+func (c *counter) deltaFor(event map[string]interface{}) int64 {
+	if c.deltaField == nil {
+		return c.delta
+	}
+	d := int64(number(lookupField(event, c.deltaField)))
+	if c.deltaMinus != nil {
+		d -= int64(number(lookupField(event, c.deltaMinus)))
+	}
+	return d
+}
+
+func (p *predicate) matches(event map[string]interface{}) bool {
+	v := lookupField(event, p.field)
+	switch p.op {
+	case OpExists:
+		return v != nil
+	case OpMissing:
+		return v == nil
+	case OpLt, OpLte, OpGt, OpGte:
+		a, b := number(v), p.number
+		if p.compare != nil {
+			b = number(lookupField(event, p.compare))
+		}
+		switch p.op {
+		case OpLt:
+			return a < b
+		case OpLte:
+			return a <= b
+		case OpGt:
+			return a > b
+		}
+		return a >= b
+	}
+
+	s, ok := format(v)
+	if !ok {
+		return p.op == OpNe
+	}
+	if p.pattern != nil {
+		return p.pattern.MatchString(s)
+	}
+	if p.compare != nil {
+		o, ok := format(lookupField(event, p.compare))
+		return (ok && s == o) == (p.op == OpEq)
+	}
+	for _, want := range p.values {
+		if s == want {
+			return p.op != OpNe
+		}
+	}
+	return p.op == OpNe
+}
+
+// bin returns the name of the histogram bin v falls into: the first bound v does not exceed, or +Inf
+func bin(bounds []int64, v int64) string {
+	for _, b := range bounds {
+		if v <= b {
+			return strconv.FormatInt(b, 10)
+		}
+	}
+	return InfBound
+}
+
+// lookupField returns the value at path, or nil if the event does not have it
+func lookupField(event map[string]interface{}, path []string) interface{} {
+	var v interface{} = event
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+// format returns the string representation of a scalar value, as used in keys and for comparisons
+func format(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case json.Number:
+		return t.String(), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case int:
+		return strconv.Itoa(t), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// number returns the numeric value of v. Missing and non-numeric values count as 0.
+func number(v interface{}) float64 {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		if err == nil {
+			return f
+		}
+	}
+	return 0
+}
@@ -0,0 +1,259 @@
+package aggregator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func increments(r *Rules, data string) []Increment {
+	incs, err := r.Increments([]byte(data))
+	Expect(err).NotTo(HaveOccurred())
+	return incs
+}
+
+// sizeBounds are the bounds of the edit size histograms of the default rules
+var sizeBounds = []int64{-10000, -1000, -500, -100, -50, -10, 0, 10, 50, 100, 500, 1000, 10000}
+
+var _ = Describe("Counter rules", func() {
+
+	Context("with the default rules", func() {
+		var r *Rules
+
+		BeforeEach(func() {
+			r = MustCompileDefaultRules()
+		})
+
+		It("counts edits that grow a page", func() {
+			incs := increments(r, `{"wiki":"enwiki","type":"edit","bot":false,"minor":true,"length":{"old":100,"new":150}}`)
+			Expect(incs).To(Equal([]Increment{
+				{Key: "pleiades_total", Delta: 1},
+				{Key: "pleiades_wiki_enwiki", Delta: 1},
+				{Key: "pleiades_type_edit", Delta: 1},
+				{Key: "pleiades_family_wikipedia", Delta: 1},
+				{Key: "pleiades_language_en", Delta: 1},
+				{Key: "pleiades_minor", Delta: 1},
+				{Key: "pleiades_length_inc", Delta: 1},
+				{Key: "pleiades_growth", Delta: 50},
+				{Key: "pleiades_bytes_added", Delta: 50},
+				{Key: "pleiades_bytes_added_enwiki", Delta: 50},
+				{Key: "pleiades_edit_size", Field: "50", Delta: 1, Bounds: sizeBounds},
+				{Key: "pleiades_edit_size_enwiki", Field: "50", Delta: 1, Bounds: sizeBounds},
+				{Key: "pleiades_rate", Delta: 1, Rate: true},
+				{Key: "pleiades_rate_wikis", Field: "enwiki", Delta: 1, Rate: true},
+			}))
+		})
+
+		It("counts bot edits that shrink a page", func() {
+			incs := increments(r, `{"wiki":"dewiki","type":"edit","bot":true,"length":{"old":150,"new":100}}`)
+			Expect(incs).To(Equal([]Increment{
+				{Key: "pleiades_total", Delta: 1},
+				{Key: "pleiades_wiki_dewiki", Delta: 1},
+				{Key: "pleiades_type_edit", Delta: 1},
+				{Key: "pleiades_family_wikipedia", Delta: 1},
+				{Key: "pleiades_language_de", Delta: 1},
+				{Key: "pleiades_bot", Delta: 1},
+				{Key: "pleiades_length_dec", Delta: 1},
+				{Key: "pleiades_growth", Delta: -50},
+				{Key: "pleiades_bytes_removed", Delta: 50},
+				{Key: "pleiades_bytes_removed_dewiki", Delta: 50},
+				{Key: "pleiades_edit_size", Field: "-50", Delta: 1, Bounds: sizeBounds},
+				{Key: "pleiades_edit_size_dewiki", Field: "-50", Delta: 1, Bounds: sizeBounds},
+				{Key: "pleiades_rate", Delta: 1, Rate: true},
+				{Key: "pleiades_rate_wikis", Field: "dewiki", Delta: 1, Rate: true},
+			}))
+		})
+
+		It("ranks the pages edited", func() {
+			incs := increments(r, `{"wiki":"enwiki","type":"edit","namespace":0,"title":"Berlin","bot":false}`)
+			for _, k := range []string{"pleiades_top_pages_enwiki", "pleiades_top_pages_enwiki_ns_0", "pleiades_top_pages_enwiki_human", "pleiades_top_pages_enwiki_ns_0_human"} {
+				Expect(incs).To(ContainElement(Increment{Key: k, Member: "Berlin", Delta: 1, Cap: DefaultCap}))
+			}
+			incs = increments(r, `{"wiki":"enwiki","type":"log","namespace":2,"title":"User:Example","bot":true}`)
+			for _, inc := range incs {
+				Expect(inc.Member).To(BeEmpty())
+			}
+		})
+
+		It("counts distinct users, pages and anonymous editors", func() {
+			incs := increments(r, `{"wiki":"enwiki","type":"edit","title":"Berlin","user":"Example"}`)
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_unique_users", Member: "Example", Distinct: true, Delta: 1}))
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_unique_users_enwiki", Member: "Example", Distinct: true, Delta: 1}))
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_unique_pages", Member: "enwiki:Berlin", Distinct: true, Delta: 1}))
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_unique_pages_enwiki", Member: "Berlin", Distinct: true, Delta: 1}))
+			for _, inc := range incs {
+				Expect(inc.Key).NotTo(HavePrefix("pleiades_unique_ips"))
+			}
+
+			for _, ip := range []string{"192.0.2.17", "2001:DB8:0:0:0:0:0:1", "2001:db8::1"} {
+				incs = increments(r, `{"wiki":"enwiki","type":"edit","title":"Berlin","user":"`+ip+`"}`)
+				Expect(incs).To(ContainElement(Increment{Key: "pleiades_unique_ips_enwiki", Member: ip, Distinct: true, Delta: 1}), ip)
+			}
+		})
+
+		It("bins the change in length of edits", func() {
+			for delta, field := range map[int]string{-20000: "-10000", -10000: "-10000", -9999: "-1000", 0: "0", 1: "10", 10001: InfBound} {
+				incs := increments(r, fmt.Sprintf(`{"wiki":"enwiki","length":{"old":20000,"new":%d}}`, 20000+delta))
+				Expect(incs).To(ContainElement(Increment{Key: "pleiades_edit_size_enwiki", Field: field, Delta: 1, Bounds: sizeBounds}), field)
+			}
+		})
+
+		It("scores trending pages, discounting bot and minor edits", func() {
+			for event, delta := range map[string]int64{
+				`{"wiki":"enwiki","type":"edit","title":"Berlin","user":"A","bot":false,"minor":false}`: 10,
+				`{"wiki":"enwiki","type":"new","title":"Berlin","user":"A","bot":false,"minor":true}`:   5,
+				`{"wiki":"enwiki","type":"edit","title":"Berlin","user":"A","bot":true,"minor":true}`:   1,
+			} {
+				incs := increments(r, event)
+				Expect(incs).To(ContainElement(Increment{Key: "pleiades_trending_enwiki", Member: "Berlin", Editor: "A", Delta: delta, Cap: DefaultCap, HalfLife: time.Hour}), event)
+			}
+			incs := increments(r, `{"wiki":"enwiki","type":"log","title":"Berlin","user":"A","bot":false,"minor":false}`)
+			for _, inc := range incs {
+				Expect(inc.HalfLife).To(BeZero())
+			}
+		})
+
+		It("counts log actions", func() {
+			incs := increments(r, `{"wiki":"enwiki","type":"log","log_type":"block","log_action":"reblock"}`)
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_log_actions", Field: "block/reblock", Delta: 1}))
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_log_actions_enwiki", Field: "block/reblock", Delta: 1}))
+
+			incs = increments(r, `{"wiki":"enwiki","type":"edit","log_type":"block","log_action":"block"}`)
+			for _, inc := range incs {
+				Expect(inc.Key).NotTo(HavePrefix("pleiades_log_actions"))
+			}
+		})
+
+		It("counts project families and languages", func() {
+			incs := increments(r, `{"wiki":"frwiktionary","server_name":"fr.wiktionary.org"}`)
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_family_wiktionary", Delta: 1}))
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_language_fr", Delta: 1}))
+
+			incs = increments(r, `{"wiki":"commonswiki","server_name":"commons.wikimedia.org"}`)
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_family_commons", Delta: 1}))
+			for _, inc := range incs {
+				Expect(inc.Key).NotTo(HavePrefix("pleiades_language_"))
+			}
+
+			// fields derived before the event was published are kept
+			incs = increments(r, `{"wiki":"enwiki","project_family":"other"}`)
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_family_other", Delta: 1}))
+		})
+
+		It("treats a missing old length as 0", func() {
+			incs := increments(r, `{"wiki":"enwiki","type":"new","length":{"new":42}}`)
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_length_inc", Delta: 1}))
+			Expect(incs).To(ContainElement(Increment{Key: "pleiades_growth", Delta: 42}))
+		})
+
+		It("skips counters for missing fields", func() {
+			incs := increments(r, `{"type":"log"}`)
+			Expect(incs).To(Equal([]Increment{
+				{Key: "pleiades_total", Delta: 1},
+				{Key: "pleiades_type_log", Delta: 1},
+				{Key: "pleiades_growth", Delta: 0},
+				{Key: "pleiades_rate", Delta: 1, Rate: true},
+			}))
+		})
+
+		It("fails on unparsable events", func() {
+			_, err := r.Increments([]byte("not json"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("combines dimensions and nested fields in keys", func() {
+		r, err := CompileRules([]byte(`
+counters:
+  - key: wiki:{wiki}:type:{type}
+  - key: domain_{meta.domain}_ns_{namespace}
+`))
+		Expect(err).NotTo(HaveOccurred())
+		incs := increments(r, `{"wiki":"enwiki","type":"edit","namespace":4,"meta":{"domain":"en.wikipedia.org"}}`)
+		Expect(incs).To(Equal([]Increment{
+			{Key: "wiki:enwiki:type:edit", Delta: 1},
+			{Key: "domain_en.wikipedia.org_ns_4", Delta: 1},
+		}))
+	})
+
+	It("evaluates predicates", func() {
+		r, err := CompileRules([]byte(`
+counters:
+  - key: content
+    when:
+      - {field: namespace, op: in, value: [0, 14]}
+  - key: human
+    when:
+      - {field: bot, op: ne, value: true}
+  - key: large
+    when:
+      - {field: length.new, op: gt, value: 1000}
+  - key: unpatrolled
+    when:
+      - {field: patrolled, op: missing}
+  - key: weighted
+    delta: {value: 5}
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(increments(r, `{"namespace":14,"bot":false,"length":{"new":2000}}`)).To(Equal([]Increment{
+			{Key: "content", Delta: 1},
+			{Key: "human", Delta: 1},
+			{Key: "large", Delta: 1},
+			{Key: "unpatrolled", Delta: 1},
+			{Key: "weighted", Delta: 5},
+		}))
+		Expect(increments(r, `{"namespace":1,"bot":true,"patrolled":true}`)).To(Equal([]Increment{
+			{Key: "weighted", Delta: 5},
+		}))
+	})
+
+	It("rejects rules that do not match the event schema", func() {
+		invalid := map[string]string{
+			"unknown field":       `{counters: [{key: "x_{wikki}"}]}`,
+			"object in key":       `{counters: [{key: "x_{meta}"}]}`,
+			"non-numeric lt":      `{counters: [{key: x, when: [{field: title, op: lt, value: 5}]}]}`,
+			"non-numeric value":   `{counters: [{key: x, when: [{field: namespace, op: gt, value: many}]}]}`,
+			"unknown operator":    `{counters: [{key: x, when: [{field: bot, op: is, value: true}]}]}`,
+			"missing value":       `{counters: [{key: x, when: [{field: bot, op: eq}]}]}`,
+			"unbalanced braces":   `{counters: [{key: "x_{wiki"}]}`,
+			"unknown attribute":   `{counters: [{key: x, filter: bot}]}`,
+			"non-numeric delta":   `{counters: [{key: x, delta: {field: title}}]}`,
+			"missing key":         `{counters: [{when: [{field: bot, op: exists}]}]}`,
+			"no counters":         `{counters: []}`,
+			"in without list":     `{counters: [{key: x, when: [{field: wiki, op: in, value: enwiki}]}]}`,
+			"minus without field": `{counters: [{key: x, delta: {minus: length.old}}]}`,
+			"unknown member":      `{counters: [{key: x, member: "{titel}"}]}`,
+			"cap without member":  `{counters: [{key: x, cap: 10}]}`,
+			"negative cap":        `{counters: [{key: x, member: "{title}", cap: -1}]}`,
+			"distinct with cap":   `{counters: [{key: x, member: "{title}", distinct: true, cap: 5}]}`,
+			"distinct with delta": `{counters: [{key: x, member: "{title}", distinct: true, delta: {value: 2}}]}`,
+			"distinct no member":  `{counters: [{key: x, distinct: true}]}`,
+			"invalid pattern":     `{counters: [{key: x, when: [{field: user, op: match, value: "("}]}]}`,
+			"match compare":       `{counters: [{key: x, when: [{field: user, op: match, compare: title}]}]}`,
+			"empty histogram":     `{counters: [{key: x, histogram: []}]}`,
+			"unordered histogram": `{counters: [{key: x, histogram: [10, 0]}]}`,
+			"histogram of member": `{counters: [{key: x, member: "{title}", histogram: [0]}]}`,
+			"field of member":     `{counters: [{key: x, member: "{title}", field: "{type}"}]}`,
+			"field of histogram":  `{counters: [{key: x, field: "{type}", histogram: [0]}]}`,
+			"unknown hash field":  `{counters: [{key: x, field: "{log_typ}"}]}`,
+			"rate of member":      `{counters: [{key: x, member: "{title}", rate: true}]}`,
+			"half-life no member": `{counters: [{key: x, halfLife: 1h}]}`,
+			"distinct half-life":  `{counters: [{key: x, member: "{title}", distinct: true, halfLife: 1h}]}`,
+			"invalid half-life":   `{counters: [{key: x, member: "{title}", halfLife: 1ms}]}`,
+			"editor no half-life": `{counters: [{key: x, member: "{title}", editor: "{user}"}]}`,
+		}
+		for name, rules := range invalid {
+			_, err := CompileRules([]byte(rules))
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
+
+	It("embeds the current event schema", func() {
+		b, err := ioutil.ReadFile("../../schema.json")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eventSchema).To(Equal(string(b)), "schema_data.go is out of date, run go generate")
+	})
+})
@@ -0,0 +1,80 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// parseEventSchema parses the properties of the event schema
+func parseEventSchema() (*schemaNode, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal([]byte(eventSchema), &raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event schema: %v", err)
+	}
+	n := newSchemaNode(raw)
+	for f, t := range derivedFields {
+		n.properties[f] = &schemaNode{types: []string{t}, properties: map[string]*schemaNode{}}
+	}
+	return n, nil
+}
+
+func newSchemaNode(raw map[string]interface{}) *schemaNode {
+	n := &schemaNode{properties: make(map[string]*schemaNode)}
+	switch t := raw["type"].(type) {
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				n.types = append(n.types, s)
+			}
+		}
+	}
+	props, _ := raw["properties"].(map[string]interface{})
+	for name, p := range props {
+		if pm, ok := p.(map[string]interface{}); ok {
+			n.properties[name] = newSchemaNode(pm)
+		}
+	}
+	return n
+}
+
+// field resolves a dotted field path in the schema and checks that the field can be used as the kind given
+func (n *schemaNode) field(path string, kind fieldKind) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("field name is required")
+	}
+	parts := strings.Split(path, ".")
+	node := n
+	for _, p := range parts {
+		next, ok := node.properties[p]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", path)
+		}
+		node = next
+	}
+	switch kind {
+	case scalar:
+		if !node.hasType("string", "integer", "number", "boolean") {
+			return nil, fmt.Errorf("field %s is not a scalar (%s)", path, strings.Join(node.types, ", "))
+		}
+	case numeric:
+		if !node.hasType("integer", "number") {
+			return nil, fmt.Errorf("field %s is not numeric (%s)", path, strings.Join(node.types, ", "))
+		}
+	}
+	return parts, nil
+}
+
+func (n *schemaNode) hasType(types ...string) bool {
+	for _, have := range n.types {
+		for _, t := range types {
+			if have == t {
+				return true
+			}
+		}
+	}
+	return false
+}
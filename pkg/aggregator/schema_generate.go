@@ -0,0 +1,25 @@
+//go:build ignore
+// +build ignore
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+)
+
+// schema_generate copies the event schema into the aggregator package, so that counter rules can be validated
+// against it without the schema file being present at runtime
+func main() {
+	b, err := ioutil.ReadFile("../../schema.json")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	out := "// Code generated by schema_generate.go; DO NOT EDIT.\n\npackage aggregator\n\n" +
+		"// eventSchema is the JSON schema of recentchange events, copied from schema.json\n" +
+		"const eventSchema = `" + string(b) + "`\n"
+	err = ioutil.WriteFile("schema_data.go", []byte(out), 0644)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
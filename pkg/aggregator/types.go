@@ -1,5 +1,17 @@
 package aggregator
 
+import (
+	"regexp"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/project"
+	"github.com/gargath/pleiades/pkg/revert"
+	"github.com/gargath/pleiades/pkg/risk"
+	"github.com/go-co-op/gocron"
+	"github.com/go-redis/redis/v8"
+)
+
 // Server consumes events from filesystem or kafka, then calculates aggregate stats and stores them in redis
 type Server interface {
 	Start() error
@@ -61,3 +73,217 @@ type Revision struct {
 	New interface{} `json:"new,omitempty"`
 	Old interface{} `json:"old,omitempty"`
 }
+
+// Engine turns events into counter increments and applies them to Redis.
+// It is shared by all aggregator sources, which only need to read events and hand them over in batches.
+type Engine struct {
+	r       *redis.Client
+	rules   *Rules
+	buckets *bucket.Config
+	reverts *revert.Detector
+	scorer  risk.Scorer
+}
+
+// Event is a single event to aggregate.
+// ID is the event's SSE ID, which carries the time the event was received.
+type Event struct {
+	ID   string
+	Data []byte
+	// Offset is the position of the event in its source, used by ApplyFenced
+	Offset int64
+}
+
+// Rollup periodically computes the buckets of rolled up resolutions from the next finer resolution
+type Rollup struct {
+	r       *redis.Client
+	buckets *bucket.Config
+	opts    *RollupOpts
+	s       *gocron.Scheduler
+}
+
+// RollupOpts configure a Rollup
+type RollupOpts struct {
+	// Delay is the time to wait after a bucket has ended before rolling it up, so that late events are included
+	Delay time.Duration
+}
+
+// keyGroups groups bucket keys by the name of the counter they hold, in the order the names first occur
+type keyGroups struct {
+	names []string
+	keys  map[string][]string
+}
+
+// batch holds the summed increments of a batch of events, in the order their counters first occur
+type batch struct {
+	ops   []*op
+	index map[string]*op
+	// histograms are the keys of the histograms the batch increments, mapped to their expiry in seconds since the epoch
+	histograms map[string]int64
+}
+
+// op is the summed increment of a counter, of the score of a member of a sorted set or of a field of a hash, or a member
+// added to a HyperLogLog. The expiry of a key in seconds since the epoch and the number of members a sorted set is capped at are only set on its
+// last op, so that they are applied once all increments of the key are.
+type op struct {
+	key  string
+	kind string
+	// member is the member of a sorted set or HyperLogLog, or the field of a hash
+	member string
+	delta  int64
+	// score is the increment of the member of a sorted set, or the weight of a repeated editor
+	score  float64
+	expiry int64
+	cap    int64
+}
+
+// Kinds of keys an op writes to, as passed to applyOps
+const (
+	kindCounter     = "c"
+	kindSortedSet   = "z"
+	kindHyperLogLog = "h"
+	kindHash        = "f"
+	// kindSet adds a member to a set
+	kindSet = "s"
+	// kindEditors adds an editor to the set of the editors of a decaying sorted set, weighting the kindEditedSortedSet
+	// op following it
+	kindEditors         = "e"
+	kindEditedSortedSet = "w"
+)
+
+// receivedEvent holds a parsed event, its increments and the time it was received
+type receivedEvent struct {
+	event map[string]interface{}
+	incs  []Increment
+	t     time.Time
+}
+
+// Skipped is an event the Engine could not aggregate, and the reason why
+type Skipped struct {
+	Event
+	Reason string
+	Err    error
+}
+
+// Increment is a change to a single Redis counter, or to the score of Member in the sorted set Key.
+// If Distinct is set, Member is added to the HyperLogLog Key instead, and if Field is set, the field of the hash Key is incremented.
+type Increment struct {
+	Key      string
+	Member   string
+	Distinct bool
+	Field    string
+	Delta    int64
+	// Cap is the number of highest scoring members the sorted set is trimmed to
+	Cap int64
+	// Rate keeps the increment in the slots rates are computed from instead of the buckets
+	Rate bool
+	// HalfLife makes the sorted set decay instead of being kept per bucket
+	HalfLife time.Duration
+	// Editor is the editor of a decaying member, whose repeated increments are weighted with RepeatWeight
+	Editor string
+	// Bounds are the bounds of the histogram Field is a bin of
+	Bounds []int64
+}
+
+// Rules are compiled counter rules, turning events into counter increments
+type Rules struct {
+	counters []*counter
+	projects *project.Table
+}
+
+// RuleFile is the YAML representation of counter rules
+type RuleFile struct {
+	Counters []CounterRule `yaml:"counters"`
+}
+
+// CounterRule declares a counter.
+// Key is a template in which {field} placeholders are replaced with the value of that event field, e.g. pleiades_wiki_{wiki}.
+// Nested fields are addressed with dots, e.g. {meta.domain}. Several placeholders combine dimensions, e.g. wiki_{wiki}_type_{type}.
+// The counter is only incremented for events matching all predicates in When.
+// With a Member template, Key names a sorted set per bucket instead, in which the score of the member is incremented,
+// e.g. pleiades_top_pages_{wiki} with member {title}. Sorted sets are trimmed to the Cap highest scoring members.
+// With Distinct, the member is added to a HyperLogLog per bucket instead, counting distinct members, e.g. users.
+// With Histogram, the ascending upper bounds of its bins, Key names a hash per bucket counting events by the bin their
+// delta falls into, e.g. the change in length of edits. Its fields are the upper bounds, and +Inf for larger deltas.
+// With a Field template, Key names a hash per bucket, in which that field is incremented by the delta,
+// e.g. pleiades_log_actions_{wiki} with field {log_type}/{log_action}.
+// With a HalfLife, e.g. 2h, the sorted set of a Member template decays instead of being kept per bucket: an increment
+// counts half as much after every half-life. With an Editor template as well, repeated increments of a member by the same
+// editor count RepeatWeight of their delta, so that members are ranked by the number of distinct editors.
+// With Rate, counters and hashes are kept in the short-lived slots rates are computed from instead of the buckets.
+type CounterRule struct {
+	Key       string      `yaml:"key"`
+	Member    string      `yaml:"member"`
+	Distinct  bool        `yaml:"distinct"`
+	Cap       int64       `yaml:"cap"`
+	Histogram []int64     `yaml:"histogram"`
+	Field     string      `yaml:"field"`
+	Rate      bool        `yaml:"rate"`
+	HalfLife  string      `yaml:"halfLife"`
+	Editor    string      `yaml:"editor"`
+	When      []Predicate `yaml:"when"`
+	Delta     *DeltaRule  `yaml:"delta"`
+}
+
+// Predicate tests an event field with one of the Op* operators, either against Value or against the field named in Compare.
+// Numeric comparisons treat missing fields as 0.
+type Predicate struct {
+	Field   string      `yaml:"field"`
+	Op      string      `yaml:"op"`
+	Value   interface{} `yaml:"value"`
+	Compare string      `yaml:"compare"`
+}
+
+// DeltaRule sets the amount a counter is incremented by: either a constant Value,
+// or the value of Field, optionally minus the value of Minus. Without a DeltaRule, counters are incremented by 1.
+type DeltaRule struct {
+	Value int64  `yaml:"value"`
+	Field string `yaml:"field"`
+	Minus string `yaml:"minus"`
+}
+
+type counter struct {
+	template   string
+	parts      []keyPart
+	member     []keyPart
+	distinct   bool
+	cap        int64
+	bounds     []int64
+	field      []keyPart
+	rate       bool
+	decay      bucket.Decay
+	editor     []keyPart
+	when       []*predicate
+	delta      int64
+	deltaField []string
+	deltaMinus []string
+}
+
+// keyPart is either a literal part of a key or a field whose value is substituted
+type keyPart struct {
+	literal string
+	field   []string
+}
+
+type predicate struct {
+	op      string
+	pattern *regexp.Regexp
+	field   []string
+	compare []string
+	values  []string
+	number  float64
+}
+
+// fieldKind restricts the schema types a rule may use a field as
+type fieldKind int
+
+const (
+	anyKind fieldKind = iota
+	scalar
+	numeric
+)
+
+// schemaNode is a property of the event schema
+type schemaNode struct {
+	types      []string
+	properties map[string]*schemaNode
+}
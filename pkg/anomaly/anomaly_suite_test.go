@@ -0,0 +1,13 @@
+package anomaly
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAnomaly(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Anomaly Suite")
+}
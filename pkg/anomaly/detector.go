@@ -0,0 +1,371 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/util"
+)
+
+const (
+	moduleName = "anomaly"
+
+	// lockKey is held by the aggregator instance checking buckets, so that instances do not alert twice
+	lockKey = "pleiades_anomaly_lock"
+
+	// wikiCounter starts the counters of events per wiki written by the aggregator's default rules
+	wikiCounter = "pleiades_wiki_"
+
+	// maxChecks is the maximum number of buckets checked in one run, bounding the time a run takes when catching up
+	maxChecks = 100
+
+	// minMean is the baseline below which the baseline of a counter that is missing from a bucket is forgotten
+	minMean = 0.01
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	// ErrNoCounters is returned when a Detector is configured without counters to check
+	ErrNoCounters error = fmt.Errorf("no counters to check")
+
+	scores = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pleiades_anomaly_score",
+			Help: "Number of standard deviations a counter deviated from its baseline by in the last bucket checked",
+		},
+		[]string{"counter"},
+	)
+
+	active = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pleiades_anomaly_active",
+			Help: "Whether a counter deviated from its baseline significantly in the last bucket checked, by kind of anomaly",
+		},
+		[]string{"counter", "kind"},
+	)
+
+	alertsSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_anomaly_alerts_total",
+			Help: "Number of anomalies detected, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	sinkErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_anomaly_sink_errors_total",
+			Help: "Number of batches of alerts that could not be sent, by sink",
+		},
+		[]string{"sink"},
+	)
+)
+
+// NewDetector returns a Detector checking the counters of the buckets given in Redis and sending alerts to the sinks given
+func NewDetector(r *redis.Client, buckets *bucket.Config, opts *Opts, sinks []Sink) (*Detector, error) {
+	res, err := bucket.ParseResolution(opts.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	aggregated := false
+	for _, a := range buckets.Resolutions {
+		if a == res {
+			aggregated = true
+		}
+	}
+	if !aggregated {
+		return nil, fmt.Errorf("resolution %s must be aggregated to detect anomalies in it", res.Name)
+	}
+	if len(opts.Counters) == 0 {
+		return nil, ErrNoCounters
+	}
+	for _, c := range opts.Counters {
+		if _, err := path.Match(c, ""); err != nil {
+			return nil, fmt.Errorf("invalid counter pattern %s: %v", c, err)
+		}
+	}
+	if opts.Alpha <= 0 || opts.Alpha > 1 {
+		return nil, fmt.Errorf("alpha must be above 0 and at most 1")
+	}
+	if opts.Threshold <= 0 {
+		return nil, fmt.Errorf("threshold must be positive")
+	}
+	return &Detector{r: r, buckets: buckets, resolution: res, opts: opts, sinks: sinks}, nil
+}
+
+// Start schedules a check every minute
+func (d *Detector) Start() error {
+	d.s = gocron.NewScheduler(time.UTC)
+	_, err := d.s.Every(1).Minute().Do(d.run)
+	if err != nil {
+		return fmt.Errorf("failed to schedule anomaly detection: %v", err)
+	}
+	d.s.StartAsync()
+	logger.Infof("Checking %d counter patterns for anomalies every minute", len(d.opts.Counters))
+	return nil
+}
+
+// Stop stops scheduling checks and closes the sinks
+func (d *Detector) Stop() {
+	d.s.Stop()
+	for _, s := range d.sinks {
+		if err := s.Close(); err != nil {
+			logger.Errorf("Error closing alert sink: %v", err)
+		}
+	}
+}
+
+func (d *Detector) run() {
+	err := d.detect(time.Now())
+	if err != nil {
+		logger.Errorf("Anomaly detection failed: %v", err)
+	}
+}
+
+// detect checks every bucket that has ended at least Delay before now and has not been checked yet.
+// Without a bucket checked before, only the last bucket that has ended is checked, rather than the whole history.
+func (d *Detector) detect(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
+	defer cancel()
+	lock, err := util.TryLock(ctx, d.r, lockKey, 50*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to acquire anomaly detection lock: %v", err)
+	}
+	if lock == nil {
+		logger.Debug("Anomaly detection is running on another instance")
+		return nil
+	}
+	defer lock.Release()
+
+	ready := d.buckets.Index(d.resolution, now.Add(-d.opts.Delay)) - 1
+	last, err := d.r.Get(ctx, d.watermarkKey()).Int64()
+	if err == redis.Nil {
+		last = ready - 1
+	} else if err != nil {
+		return fmt.Errorf("failed to read last bucket checked: %v", err)
+	}
+	for i := 0; i < maxChecks && last < ready; i++ {
+		last++
+		err := d.check(ctx, last)
+		if err != nil {
+			return fmt.Errorf("failed to check bucket %d: %v", last, err)
+		}
+	}
+	return nil
+}
+
+// check compares the counters of bucket n with their baselines, updates the baselines and sends alerts for the
+// counters that entered an anomaly. Counters that have a baseline but are missing from the bucket count as 0.
+func (d *Detector) check(ctx context.Context, n int64) error {
+	values, err := d.counters(ctx, n)
+	if err != nil {
+		return err
+	}
+	stored, err := d.r.HGetAll(ctx, d.baselinesKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read baselines: %v", err)
+	}
+	baselines := make(map[string]*baseline)
+	for name, v := range stored {
+		b := &baseline{}
+		if err := json.Unmarshal([]byte(v), b); err != nil {
+			logger.Errorf("Discarding invalid baseline of %s: %v", name, err)
+			continue
+		}
+		baselines[name] = b
+		if _, ok := values[name]; !ok {
+			values[name] = 0
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var alerts []Alert
+	updated := make(map[string]interface{})
+	var forgotten []string
+	for _, name := range names {
+		b, ok := baselines[name]
+		if !ok {
+			b = &baseline{}
+		}
+		x := values[name]
+		a, entered := d.update(b, x)
+		if entered {
+			a.Time = d.buckets.Start(d.resolution, n)
+			a.Resolution = d.resolution.Name
+			a.Bucket = n
+			a.Counter = name
+			if strings.HasPrefix(name, wikiCounter) {
+				a.Wiki = strings.TrimPrefix(name, wikiCounter)
+			}
+			alerts = append(alerts, a)
+		}
+		setGauges(name, a.Score, b.Active)
+		if x == 0 && b.Mean < minMean {
+			forgotten = append(forgotten, name)
+			scores.DeleteLabelValues(name)
+			continue
+		}
+		v, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		updated[name] = string(v)
+	}
+
+	_, err = d.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		if len(updated) > 0 {
+			p.HSet(ctx, d.baselinesKey(), updated)
+		}
+		if len(forgotten) > 0 {
+			p.HDel(ctx, d.baselinesKey(), forgotten...)
+		}
+		p.Set(ctx, d.watermarkKey(), n, 0)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write baselines: %v", err)
+	}
+	if len(alerts) > 0 {
+		d.send(ctx, alerts)
+	}
+	return nil
+}
+
+// update scores the value x of a counter against its baseline and then adds it to the baseline.
+// It returns the Alert describing the score, and whether the counter entered an anomaly or changed its kind.
+func (d *Detector) update(b *baseline, x int64) (Alert, bool) {
+	// the standard deviation of counts of events is at least that of a Poisson process
+	stddev := math.Max(math.Sqrt(b.Variance), math.Max(math.Sqrt(b.Mean), 1))
+	score := (float64(x) - b.Mean) / stddev
+	kind := ""
+	if b.Count >= d.opts.Warmup {
+		switch {
+		case score >= d.opts.Threshold && float64(x) >= d.opts.MinCount:
+			kind = KindSpike
+		case x == 0 && b.Mean >= d.opts.MinCount:
+			kind = KindOutage
+		case score <= -d.opts.Threshold && b.Mean >= d.opts.MinCount:
+			kind = KindDrop
+		}
+	}
+	a := Alert{Kind: kind, Value: x, Baseline: b.Mean, StdDev: stddev, Score: score}
+	entered := kind != "" && kind != b.Active
+
+	diff := float64(x) - b.Mean
+	if b.Count == 0 {
+		b.Mean = float64(x)
+	} else {
+		incr := d.opts.Alpha * diff
+		b.Mean += incr
+		// anomalies only move the mean, so that the baseline follows a lasting change without the variance
+		// growing to hide the anomalies that follow
+		if kind == "" {
+			b.Variance = (1 - d.opts.Alpha) * (b.Variance + diff*incr)
+		}
+	}
+	b.Count++
+	b.Active = kind
+	return a, entered
+}
+
+// setGauges records the score of a counter in the last bucket checked, and the kind of anomaly it is in
+func setGauges(name string, score float64, kind string) {
+	scores.WithLabelValues(name).Set(score)
+	for _, k := range []string{KindSpike, KindDrop, KindOutage} {
+		if k == kind {
+			active.WithLabelValues(name, k).Set(1)
+		} else {
+			active.DeleteLabelValues(name, k)
+		}
+	}
+}
+
+// counters returns the values of the counters of bucket n that match the Detector's patterns.
+// Keys that do not hold counters, such as sorted sets and HyperLogLogs, are skipped.
+func (d *Detector) counters(ctx context.Context, n int64) (map[string]int64, error) {
+	prefix := bucket.Prefix(d.resolution, n)
+	var keys []string
+	iter := d.r.Scan(ctx, 0, prefix+"pleiades*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if d.matches(strings.TrimPrefix(iter.Val(), prefix)) {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list counters: %v", err)
+	}
+
+	values := make(map[string]int64)
+	if len(keys) == 0 {
+		return values, nil
+	}
+	// MGET returns nil for keys that do not hold strings, and HyperLogLogs do not parse as numbers
+	vals, err := d.r.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counters: %v", err)
+	}
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		x, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimPrefix(keys[i], prefix)] = x
+	}
+	return values, nil
+}
+
+// matches returns whether a counter matches one of the Detector's patterns
+func (d *Detector) matches(name string) bool {
+	for _, c := range d.opts.Counters {
+		if ok, _ := path.Match(c, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// send records alerts in the metrics and sends them to every sink. Sinks that fail are logged and skipped,
+// so that an unavailable sink does not hold up the others.
+func (d *Detector) send(ctx context.Context, alerts []Alert) {
+	for _, a := range alerts {
+		alertsSent.WithLabelValues(a.Kind).Inc()
+	}
+	for _, s := range d.sinks {
+		if err := s.Send(ctx, alerts); err != nil {
+			sinkErrors.WithLabelValues(SinkName(s)).Inc()
+			logger.Errorf("Failed to send %d alerts: %v", len(alerts), err)
+		}
+	}
+}
+
+func (d *Detector) baselinesKey() string {
+	return "pleiades_anomaly_baselines_" + d.resolution.Name
+}
+
+func (d *Detector) watermarkKey() string {
+	return "pleiades_anomaly_" + d.resolution.Name
+}
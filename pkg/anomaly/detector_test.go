@@ -0,0 +1,209 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeSink records the alerts sent to it
+type fakeSink struct {
+	alerts []Alert
+	fail   bool
+}
+
+func (f *fakeSink) Send(ctx context.Context, alerts []Alert) error {
+	if f.fail {
+		return fmt.Errorf("sink unavailable")
+	}
+	f.alerts = append(f.alerts, alerts...)
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+var _ = Describe("Anomaly detector", func() {
+	// 2020-08-10T10:50:00Z
+	const first = int64(26617610)
+
+	var (
+		m       *miniredis.Miniredis
+		r       *redis.Client
+		buckets *bucket.Config
+		sink    *fakeSink
+		d       *Detector
+		opts    *Opts
+	)
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+		buckets, err = bucket.NewConfig(&bucket.Opts{Resolutions: []string{"1m", "1d"}, Timezone: "UTC"})
+		Expect(err).NotTo(HaveOccurred())
+		opts = &Opts{
+			Resolution: "1m",
+			Counters:   []string{"pleiades_total", "pleiades_wiki_*"},
+			Alpha:      0.1,
+			Threshold:  4,
+			Warmup:     10,
+			MinCount:   10,
+			Delay:      time.Minute,
+		}
+		sink = &fakeSink{}
+		d, err = NewDetector(r, buckets, opts, []Sink{sink})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	set := func(n int64, counter string, value int) {
+		Expect(m.Set(bucket.Prefix(bucket.Minute, n)+counter, fmt.Sprint(value))).To(Succeed())
+	}
+
+	// warmUp writes counters around 100 for enwiki and 200 in total, and checks their buckets
+	warmUp := func() int64 {
+		n := first
+		for ; n < first+20; n++ {
+			set(n, "pleiades_total", 200+int(n%5))
+			set(n, "pleiades_wiki_enwiki", 100+int(n%3))
+			Expect(d.check(context.Background(), n)).To(Succeed())
+		}
+		return n
+	}
+
+	It("does not alert while counters follow their baseline", func() {
+		warmUp()
+		Expect(sink.alerts).To(BeEmpty())
+		Expect(m.HKeys("pleiades_anomaly_baselines_1m")).To(ConsistOf("pleiades_total", "pleiades_wiki_enwiki"))
+		Expect(m.Get("pleiades_anomaly_1m")).To(Equal(fmt.Sprint(first + 19)))
+	})
+
+	It("alerts once when a counter spikes", func() {
+		n := warmUp()
+		set(n, "pleiades_total", 1200)
+		set(n, "pleiades_wiki_enwiki", 1100)
+		Expect(d.check(context.Background(), n)).To(Succeed())
+		Expect(sink.alerts).To(HaveLen(2))
+		a := sink.alerts[1]
+		Expect(a.Counter).To(Equal("pleiades_wiki_enwiki"))
+		Expect(a.Wiki).To(Equal("enwiki"))
+		Expect(a.Kind).To(Equal(KindSpike))
+		Expect(a.Value).To(Equal(int64(1100)))
+		Expect(a.Baseline).To(BeNumerically("~", 101, 1))
+		Expect(a.Score).To(BeNumerically(">", 4))
+		Expect(a.Bucket).To(Equal(n))
+		Expect(a.Resolution).To(Equal("1m"))
+		Expect(a.Time).To(BeTemporally("==", time.Date(2020, 8, 10, 11, 10, 0, 0, time.UTC)))
+		Expect(sink.alerts[0].Wiki).To(BeEmpty())
+
+		// the anomaly is still going on
+		set(n+1, "pleiades_total", 1300)
+		set(n+1, "pleiades_wiki_enwiki", 1200)
+		Expect(d.check(context.Background(), n+1)).To(Succeed())
+		Expect(sink.alerts).To(HaveLen(2))
+	})
+
+	It("alerts when counters drop to zero", func() {
+		n := warmUp()
+		// the bucket is empty, e.g. because the ingest stopped
+		Expect(d.check(context.Background(), n)).To(Succeed())
+		Expect(sink.alerts).To(HaveLen(2))
+		for _, a := range sink.alerts {
+			Expect(a.Kind).To(Equal(KindOutage))
+			Expect(a.Value).To(BeZero())
+		}
+
+		set(n+1, "pleiades_total", 20)
+		set(n+1, "pleiades_wiki_enwiki", 100)
+		Expect(d.check(context.Background(), n+1)).To(Succeed())
+		Expect(sink.alerts).To(HaveLen(3))
+		Expect(sink.alerts[2].Counter).To(Equal("pleiades_total"))
+		Expect(sink.alerts[2].Kind).To(Equal(KindDrop))
+	})
+
+	It("does not alert on quiet counters or before the baseline has warmed up", func() {
+		for n := first; n < first+20; n++ {
+			set(n, "pleiades_wiki_smallwiki", int(n%2))
+			set(n, "pleiades_wiki_newwiki", 0)
+			Expect(d.check(context.Background(), n)).To(Succeed())
+		}
+		set(first+20, "pleiades_wiki_smallwiki", 8)
+		set(first+20, "pleiades_wiki_newwiki", 500)
+		Expect(d.check(context.Background(), first+20)).To(Succeed())
+		Expect(sink.alerts).To(BeEmpty())
+	})
+
+	It("only checks the counters matching its patterns", func() {
+		n := warmUp()
+		set(n, "pleiades_total", 200)
+		set(n, "pleiades_wiki_enwiki", 100)
+		set(n, "pleiades_bot", 10000)
+		Expect(m.PfAdd(bucket.Prefix(bucket.Minute, n)+"pleiades_wiki_hll", "a")).To(Equal(1))
+		Expect(d.check(context.Background(), n)).To(Succeed())
+		Expect(sink.alerts).To(BeEmpty())
+		Expect(m.HKeys("pleiades_anomaly_baselines_1m")).To(ConsistOf("pleiades_total", "pleiades_wiki_enwiki"))
+	})
+
+	It("keeps alerting other sinks when one fails", func() {
+		other := &fakeSink{}
+		d.sinks = []Sink{&fakeSink{fail: true}, other}
+		n := warmUp()
+		Expect(d.check(context.Background(), n)).To(Succeed())
+		Expect(other.alerts).To(HaveLen(2))
+	})
+
+	Context("when scheduled", func() {
+		now := bucket.UTCDays().Start(bucket.Minute, first+10).Add(90 * time.Second)
+
+		It("starts with the last bucket that has ended", func() {
+			Expect(d.detect(now)).To(Succeed())
+			Expect(m.Get("pleiades_anomaly_1m")).To(Equal(fmt.Sprint(first + 9)))
+			Expect(m.Exists(lockKey)).To(BeFalse())
+		})
+
+		It("catches up with the buckets that ended since the last check", func() {
+			Expect(m.Set("pleiades_anomaly_1m", fmt.Sprint(first+5))).To(Succeed())
+			for n := first + 6; n <= first+9; n++ {
+				set(n, "pleiades_total", 100)
+			}
+			Expect(d.detect(now)).To(Succeed())
+			Expect(m.Get("pleiades_anomaly_1m")).To(Equal(fmt.Sprint(first + 9)))
+			Expect(m.HGet("pleiades_anomaly_baselines_1m", "pleiades_total")).To(ContainSubstring(`"n":4`))
+		})
+
+		It("leaves the check to the instance holding the lock", func() {
+			Expect(m.Set(lockKey, "1")).To(Succeed())
+			Expect(d.detect(now)).To(Succeed())
+			Expect(m.Exists("pleiades_anomaly_1m")).To(BeFalse())
+		})
+	})
+
+	It("validates its options", func() {
+		_, err := NewDetector(r, bucket.UTCDays(), opts, nil)
+		Expect(err).To(HaveOccurred())
+		for _, invalid := range []*Opts{
+			{Resolution: "1m", Alpha: 0.1, Threshold: 4},
+			{Resolution: "1m", Counters: []string{"["}, Alpha: 0.1, Threshold: 4},
+			{Resolution: "1m", Counters: []string{"pleiades_total"}, Alpha: 0, Threshold: 4},
+			{Resolution: "1m", Counters: []string{"pleiades_total"}, Alpha: 0.1},
+			{Resolution: "1w", Counters: []string{"pleiades_total"}, Alpha: 0.1, Threshold: 4},
+		} {
+			_, err := NewDetector(r, buckets, invalid, nil)
+			Expect(err).To(HaveOccurred(), fmt.Sprint(invalid))
+		}
+	})
+})
@@ -0,0 +1,132 @@
+package anomaly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher/webhook"
+)
+
+// Names of the sinks
+const (
+	SinkLog     = "log"
+	SinkWebhook = "webhook"
+	SinkKafka   = "kafka"
+)
+
+// NewLogSink returns a Sink logging alerts
+func NewLogSink() *LogSink {
+	return &LogSink{}
+}
+
+// Send logs every alert as a warning
+func (s *LogSink) Send(ctx context.Context, alerts []Alert) error {
+	for _, a := range alerts {
+		if a.Kind == KindEditWar {
+			logger.Warningf("Edit war on %s page %s: %d reverts by %s", a.Wiki, a.Title, a.Value, strings.Join(a.Users, ", "))
+			continue
+		}
+		logger.Warningf("Anomaly in %s bucket %d: %s of %s to %d, baseline %.1f ± %.1f (score %.1f)",
+			a.Resolution, a.Bucket, a.Kind, a.Counter, a.Value, a.Baseline, a.StdDev, a.Score)
+	}
+	return nil
+}
+
+// Close does nothing
+func (s *LogSink) Close() error {
+	return nil
+}
+
+// NewWebhookSink returns a Sink POSTing alerts to the URL given.
+// If secret is set, requests are signed like those of the webhook publisher.
+func NewWebhookSink(url string, secret string) (*WebhookSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("no webhook URL given for alerts")
+	}
+	return &WebhookSink{url: url, secret: secret, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Send POSTs alerts to the endpoint as a JSON array
+func (s *WebhookSink) Send(ctx context.Context, alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("failed to encode alerts: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pleiades")
+	if s.secret != "" {
+		req.Header.Set(webhook.SignatureHeader, "sha256="+webhook.Sign([]byte(s.secret), body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error performing request: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close does nothing
+func (s *WebhookSink) Close() error {
+	return nil
+}
+
+// NewKafkaSink returns a Sink writing alerts to the topic given
+func NewKafkaSink(broker string, topic string) (*KafkaSink, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("no kafka topic given for alerts")
+	}
+	return &KafkaSink{w: kafka.NewWriter(kafka.WriterConfig{
+		Brokers:  []string{broker},
+		Topic:    topic,
+		Balancer: kafka.Murmur2Balancer{},
+	})}, nil
+}
+
+// Send writes every alert as a JSON message keyed by its counter
+func (s *KafkaSink) Send(ctx context.Context, alerts []Alert) error {
+	msgs := make([]kafka.Message, len(alerts))
+	for i, a := range alerts {
+		v, err := json.Marshal(a)
+		if err != nil {
+			return fmt.Errorf("failed to encode alert: %v", err)
+		}
+		msgs[i] = kafka.Message{Key: []byte(a.Counter), Value: v}
+	}
+	return s.w.WriteMessages(ctx, msgs...)
+}
+
+// Close closes the kafka writer
+func (s *KafkaSink) Close() error {
+	return s.w.Close()
+}
+
+// SinkName returns the name of a Sink for metrics
+func SinkName(s Sink) string {
+	switch s.(type) {
+	case *LogSink:
+		return SinkLog
+	case *WebhookSink:
+		return SinkWebhook
+	case *KafkaSink:
+		return SinkKafka
+	}
+	return "unknown"
+}
@@ -0,0 +1,76 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher/webhook"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeWriter struct {
+	messages []kafka.Message
+}
+
+func (f *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.messages = append(f.messages, msgs...)
+	return nil
+}
+
+func (f *fakeWriter) Close() error {
+	return nil
+}
+
+var _ = Describe("Alert sinks", func() {
+	alerts := []Alert{
+		{Counter: "pleiades_wiki_enwiki", Wiki: "enwiki", Kind: KindSpike, Value: 1000, Baseline: 100, StdDev: 10, Score: 90},
+		{Resolution: "1m", Bucket: 26617610, Counter: "pleiades_total", Kind: KindOutage, Baseline: 200, StdDev: 14, Score: -14},
+	}
+
+	It("posts signed alerts to a webhook", func() {
+		var body []byte
+		var signature string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			signature = r.Header.Get(webhook.SignatureHeader)
+		}))
+		defer srv.Close()
+
+		s, err := NewWebhookSink(srv.URL, "secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Send(context.Background(), alerts)).To(Succeed())
+		var received []Alert
+		Expect(json.Unmarshal(body, &received)).To(Succeed())
+		Expect(received).To(Equal(alerts))
+		Expect(signature).To(Equal("sha256=" + webhook.Sign([]byte("secret"), body)))
+	})
+
+	It("reports webhook failures", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer srv.Close()
+
+		s, err := NewWebhookSink(srv.URL, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Send(context.Background(), alerts)).NotTo(Succeed())
+		_, err = NewWebhookSink("", "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes alerts to kafka keyed by counter", func() {
+		w := &fakeWriter{}
+		s := &KafkaSink{w: w}
+		Expect(s.Send(context.Background(), alerts)).To(Succeed())
+		Expect(w.messages).To(HaveLen(2))
+		Expect(string(w.messages[0].Key)).To(Equal("pleiades_wiki_enwiki"))
+		Expect(w.messages[1].Value).To(MatchJSON(`{"time":"0001-01-01T00:00:00Z","resolution":"1m","bucket":26617610,"counter":"pleiades_total","kind":"outage","value":0,"baseline":200,"stddev":14,"score":-14}`))
+	})
+})
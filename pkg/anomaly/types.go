@@ -0,0 +1,112 @@
+package anomaly
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+)
+
+// Kinds of anomalies
+const (
+	// KindSpike is a counter far above its baseline, e.g. a spam wave or a bot flood
+	KindSpike = "spike"
+	// KindDrop is a counter far below its baseline
+	KindDrop = "drop"
+	// KindOutage is a counter that dropped to zero, e.g. because the ingest stopped
+	KindOutage = "outage"
+	// KindEditWar is a page whose editors revert each other repeatedly, as detected by the revert package
+	KindEditWar = "edit_war"
+)
+
+// Detector compares the counters of every bucket of a resolution with their baselines once the bucket has ended,
+// and sends an Alert to its sinks when a counter deviates from its baseline significantly
+type Detector struct {
+	r          *redis.Client
+	buckets    *bucket.Config
+	resolution bucket.Resolution
+	opts       *Opts
+	sinks      []Sink
+	s          *gocron.Scheduler
+}
+
+// Opts configure a Detector
+type Opts struct {
+	// Resolution is the name of the resolution whose buckets are checked. It must be aggregated.
+	Resolution string
+	// Counters are the patterns of the names of the counters checked, e.g. pleiades_wiki_*
+	Counters []string
+	// Alpha is the weight of every new bucket in the exponentially weighted moving averages baselines are kept as
+	Alpha float64
+	// Threshold is the number of standard deviations a counter must deviate from its baseline by to be an anomaly
+	Threshold float64
+	// Warmup is the number of buckets a baseline must have seen before deviations from it are anomalies
+	Warmup int64
+	// MinCount is the smallest count that is an anomaly when a counter spikes, and the smallest baseline
+	// that is an anomaly when a counter drops, so that counters of quiet wikis do not raise alerts all the time
+	MinCount float64
+	// Delay is the time after the end of a bucket it is checked, to let late events be aggregated
+	Delay time.Duration
+}
+
+// Alert is an anomaly of a counter in a bucket, or an edit war on a page, as sent to sinks
+type Alert struct {
+	// Time is the start of the bucket, or the time of the edit that started the edit war
+	Time       time.Time `json:"time"`
+	Resolution string    `json:"resolution,omitempty"`
+	Bucket     int64     `json:"bucket,omitempty"`
+	Counter    string    `json:"counter"`
+	// Wiki is the wiki the counter is of, for counters per wiki
+	Wiki string `json:"wiki,omitempty"`
+	// Title is the page and Users are the users reverting each other in an edit war
+	Title string   `json:"title,omitempty"`
+	Users []string `json:"users,omitempty"`
+	Kind  string   `json:"kind"`
+	// Value is the value of the counter, or the number of reverts in an edit war
+	Value int64 `json:"value"`
+	// Baseline and StdDev are the expected value of the counter and its standard deviation
+	Baseline float64 `json:"baseline"`
+	StdDev   float64 `json:"stddev"`
+	// Score is the number of standard deviations the counter deviates from its baseline by
+	Score float64 `json:"score"`
+}
+
+// baseline is the moving average and variance of a counter, and the kind of anomaly it is in, if any
+type baseline struct {
+	Mean     float64 `json:"m"`
+	Variance float64 `json:"v"`
+	Count    int64   `json:"n"`
+	Active   string  `json:"a,omitempty"`
+}
+
+// Sink receives the alerts of a Detector
+type Sink interface {
+	Send(ctx context.Context, alerts []Alert) error
+	Close() error
+}
+
+// LogSink logs alerts as warnings
+type LogSink struct{}
+
+// WebhookSink POSTs alerts to an HTTP endpoint as a JSON array
+type WebhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// KafkaSink writes alerts to a Kafka topic as JSON messages, keyed by counter
+type KafkaSink struct {
+	w writer
+}
+
+// writer is the part of kafka.Writer used by the KafkaSink
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
@@ -0,0 +1,13 @@
+package avro
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAvro(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Avro Suite")
+}
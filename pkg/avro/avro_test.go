@@ -0,0 +1,188 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testEvent = `{"$schema":"/mediawiki/recentchange/1.0.0","meta":{"uri":"https://en.wikipedia.org/wiki/Example",` +
+	`"request_id":"abc","id":"6f3a2b1c","dt":"2020-07-01T12:00:00Z","domain":"en.wikipedia.org","stream":"mediawiki.recentchange"},` +
+	`"id":1234567890,"type":"log","namespace":0,"title":"Example","comment":"moved <b>page</b> & more","timestamp":1593604800,` +
+	`"user":"Example","bot":false,"server_url":"https://en.wikipedia.org","server_name":"en.wikipedia.org","wiki":"enwiki",` +
+	`"log_id":987,"log_type":"move","log_action":"move","log_params":{"target":"Example 2","noredir":"0"},` +
+	`"log_action_comment":"moved Example to Example 2","notify_url":"https://en.wikipedia.org/w/index.php?diff=1"}`
+
+// fakeRegistry is a minimal stand-in for a Confluent schema registry
+type fakeRegistry struct {
+	mu      sync.Mutex
+	schemas []string
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/subjects/") && strings.HasSuffix(r.URL.Path, "/versions"):
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if json.Unmarshal(b, &req) != nil || req.Schema == "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		for i, s := range f.schemas {
+			if s == req.Schema {
+				fmt.Fprintf(w, `{"id":%d}`, i+1)
+				return
+			}
+		}
+		f.schemas = append(f.schemas, req.Schema)
+		fmt.Fprintf(w, `{"id":%d}`, len(f.schemas))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+		var id int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"), "%d", &id)
+		if id < 1 || id > len(f.schemas) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error_code":40403,"message":"Schema not found"}`)
+			return
+		}
+		b, _ := json.Marshal(map[string]string{"schema": f.schemas[id-1]})
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Avro encoding", func() {
+
+	It("round-trips events through the event schema", func() {
+		s := EventSchema()
+		var v interface{}
+		d := json.NewDecoder(strings.NewReader(testEvent))
+		d.UseNumber()
+		Expect(d.Decode(&v)).To(Succeed())
+
+		var buf bytes.Buffer
+		Expect(Encode(s, v, &buf)).To(Succeed())
+		Expect(buf.Len()).To(BeNumerically("<", len(testEvent)))
+
+		out, err := Decode(s, buf.Bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(MatchJSON(testEvent))
+		Expect(string(out)).To(ContainSubstring("<b>page</b> & more"))
+	})
+
+	It("produces a schema that parses back to the same structure", func() {
+		s := EventSchema()
+		p, err := ParseSchema(s.String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Fields).To(HaveLen(len(s.Fields)))
+		Expect(p.Fields[0].Name).To(Equal("id"))
+	})
+
+	It("uses zigzag varints for longs", func() {
+		s := &Schema{Type: TypeLong}
+		for n, expected := range map[string][]byte{"0": {0x00}, "-1": {0x01}, "1": {0x02}, "64": {0x80, 0x01}, "-65": {0x81, 0x01}} {
+			var buf bytes.Buffer
+			Expect(Encode(s, json.Number(n), &buf)).To(Succeed())
+			Expect(buf.Bytes()).To(Equal(expected), n)
+		}
+	})
+
+	It("encodes arrays, maps and doubles of other schemas", func() {
+		s, err := ParseSchema(`{"type":"record","name":"r","fields":[` +
+			`{"name":"a","type":{"type":"array","items":"double"}},{"name":"m","type":{"type":"map","values":"string"}},` +
+			`{"name":"n","type":["null","r"]}]}`)
+		Expect(err).NotTo(HaveOccurred())
+		in := `{"a":[1.5,-2],"m":{"x":"y"},"n":{"a":[],"m":{}}}`
+		var v interface{}
+		d := json.NewDecoder(strings.NewReader(in))
+		d.UseNumber()
+		Expect(d.Decode(&v)).To(Succeed())
+		var buf bytes.Buffer
+		Expect(Encode(s, v, &buf)).To(Succeed())
+		out, err := Decode(s, buf.Bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(MatchJSON(in))
+	})
+
+	It("rejects values that do not match the schema", func() {
+		var buf bytes.Buffer
+		Expect(Encode(EventSchema(), map[string]interface{}{"namespace": "main"}, &buf)).NotTo(Succeed())
+		Expect(Encode(EventSchema(), "not an object", &buf)).NotTo(Succeed())
+	})
+
+	It("fails on truncated data", func() {
+		s := EventSchema()
+		var v interface{}
+		d := json.NewDecoder(strings.NewReader(testEvent))
+		d.UseNumber()
+		Expect(d.Decode(&v)).To(Succeed())
+		var buf bytes.Buffer
+		Expect(Encode(s, v, &buf)).To(Succeed())
+		_, err := Decode(s, buf.Bytes()[:buf.Len()/2])
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Schema registry serialization", func() {
+	var (
+		server *httptest.Server
+		fake   *fakeRegistry
+	)
+
+	BeforeEach(func() {
+		fake = &fakeRegistry{}
+		server = httptest.NewServer(fake)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("registers the schema once and frames messages with its ID", func() {
+		ser, err := NewSerializer(NewRegistry(server.URL), SubjectFor("pleiades-events"), EventSchema())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = NewSerializer(NewRegistry(server.URL), SubjectFor("pleiades-events"), EventSchema())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.schemas).To(HaveLen(1))
+
+		msg, err := ser.Serialize([]byte(testEvent))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg[:5]).To(Equal([]byte{0, 0, 0, 0, 1}))
+	})
+
+	It("decodes messages with schemas fetched from the registry", func() {
+		ser, err := NewSerializer(NewRegistry(server.URL), SubjectFor("pleiades-events"), EventSchema())
+		Expect(err).NotTo(HaveOccurred())
+		msg, err := ser.Serialize([]byte(testEvent))
+		Expect(err).NotTo(HaveOccurred())
+
+		out, err := NewDeserializer(NewRegistry(server.URL)).Deserialize(msg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(MatchJSON(testEvent))
+	})
+
+	It("passes JSON messages through unchanged", func() {
+		out, err := NewDeserializer(nil).Deserialize([]byte(testEvent))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal(testEvent))
+	})
+
+	It("fails on Avro messages without a registry or with an unknown schema", func() {
+		_, err := NewDeserializer(nil).Deserialize([]byte{0, 0, 0, 0, 1, 0})
+		Expect(err).To(Equal(ErrNoRegistry))
+		_, err = NewDeserializer(NewRegistry(server.URL)).Deserialize([]byte{0, 0, 0, 0, 7, 0})
+		Expect(err).To(HaveOccurred())
+	})
+})
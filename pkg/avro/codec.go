@@ -0,0 +1,426 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Encode writes the Avro binary encoding of a decoded JSON value to buf.
+// Numbers must have been decoded as json.Number.
+func Encode(s *Schema, v interface{}, buf *bytes.Buffer) error {
+	switch s.Type {
+	case TypeNull:
+		if v != nil {
+			return fmt.Errorf("expected null, got %T", v)
+		}
+	case TypeBoolean:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expected boolean, got %T", v)
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case TypeInt, TypeLong:
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("expected %s, got %T", s.Type, v)
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fmt.Errorf("expected %s, got %s", s.Type, n)
+		}
+		writeLong(buf, i)
+	case TypeFloat, TypeDouble:
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("expected %s, got %T", s.Type, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("expected %s, got %s", s.Type, n)
+		}
+		if s.Type == TypeFloat {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(f)))
+			buf.Write(b[:])
+		} else {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+			buf.Write(b[:])
+		}
+	case TypeString, TypeBytes:
+		if s.LogicalType == LogicalJSON {
+			var b bytes.Buffer
+			e := json.NewEncoder(&b)
+			e.SetEscapeHTML(false)
+			err := e.Encode(v)
+			if err != nil {
+				return err
+			}
+			writeBytes(buf, bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+			return nil
+		}
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected %s, got %T", s.Type, v)
+		}
+		writeBytes(buf, []byte(str))
+	case TypeRecord:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected record %s, got %T", s.Name, v)
+		}
+		return encodeRecord(s, m, buf)
+	case TypeArray:
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected array, got %T", v)
+		}
+		if len(a) > 0 {
+			writeLong(buf, int64(len(a)))
+			for _, item := range a {
+				err := Encode(s.Items, item, buf)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case TypeMap:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected map, got %T", v)
+		}
+		if len(m) > 0 {
+			writeLong(buf, int64(len(m)))
+			for _, k := range sortedKeys(m) {
+				writeBytes(buf, []byte(k))
+				err := Encode(s.Values, m[k], buf)
+				if err != nil {
+					return fmt.Errorf("%s: %v", k, err)
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case TypeUnion:
+		for i, b := range s.Branches {
+			if accepts(b, v) {
+				writeLong(buf, int64(i))
+				return Encode(b, v, buf)
+			}
+		}
+		return fmt.Errorf("no branch of union accepts %T", v)
+	default:
+		return fmt.Errorf("unsupported type %s", s.Type)
+	}
+	return nil
+}
+
+// encodeRecord encodes the fields of a record in schema order.
+// Keys of m not declared as fields are collected into the additional_properties field, if the record has one.
+func encodeRecord(s *Schema, m map[string]interface{}, buf *bytes.Buffer) error {
+	used := make(map[string]bool, len(s.Fields))
+	for _, f := range s.Fields {
+		used[jsonName(f.Name)] = true
+	}
+	for _, f := range s.Fields {
+		v := m[jsonName(f.Name)]
+		if f.Name == ExtraField {
+			extra := make(map[string]interface{})
+			for k, ev := range m {
+				if !used[k] {
+					extra[k] = ev
+				}
+			}
+			v = nil
+			if len(extra) > 0 {
+				v = extra
+			}
+		}
+		err := Encode(f.Type, v, buf)
+		if err != nil {
+			return fmt.Errorf("%s: %v", jsonName(f.Name), err)
+		}
+	}
+	return nil
+}
+
+// accepts reports whether a union branch can hold the value given
+func accepts(s *Schema, v interface{}) bool {
+	if v == nil {
+		return s.Type == TypeNull
+	}
+	switch s.Type {
+	case TypeBoolean:
+		_, ok := v.(bool)
+		return ok
+	case TypeInt, TypeLong:
+		n, ok := v.(json.Number)
+		if ok {
+			_, err := n.Int64()
+			return err == nil
+		}
+	case TypeFloat, TypeDouble:
+		_, ok := v.(json.Number)
+		return ok
+	case TypeString, TypeBytes:
+		if s.LogicalType == LogicalJSON {
+			return true
+		}
+		_, ok := v.(string)
+		return ok
+	case TypeRecord, TypeMap:
+		_, ok := v.(map[string]interface{})
+		return ok
+	case TypeArray:
+		_, ok := v.([]interface{})
+		return ok
+	}
+	return false
+}
+
+// Decode reads a value of the given schema from Avro binary data and returns it as JSON.
+// Null record fields are omitted, and the contents of additional_properties are merged back into the record.
+func Decode(s *Schema, data []byte) ([]byte, error) {
+	r := &reader{data: data}
+	v, err := r.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(data) {
+		return nil, fmt.Errorf("%d trailing bytes after value", len(data)-r.pos)
+	}
+	var buf bytes.Buffer
+	err = writeJSON(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) decode(s *Schema) (interface{}, error) {
+	switch s.Type {
+	case TypeNull:
+		return nil, nil
+	case TypeBoolean:
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case TypeInt, TypeLong:
+		return r.long()
+	case TypeFloat:
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case TypeDouble:
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case TypeString, TypeBytes:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if s.LogicalType == LogicalJSON {
+			return json.RawMessage(b), nil
+		}
+		return string(b), nil
+	case TypeRecord:
+		o := &object{}
+		for _, f := range s.Fields {
+			v, err := r.decode(f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", jsonName(f.Name), err)
+			}
+			if v == nil {
+				continue
+			}
+			if extra, ok := v.(*object); ok && f.Name == ExtraField {
+				o.keys = append(o.keys, extra.keys...)
+				o.values = append(o.values, extra.values...)
+				continue
+			}
+			o.keys = append(o.keys, jsonName(f.Name))
+			o.values = append(o.values, v)
+		}
+		return o, nil
+	case TypeArray:
+		a := []interface{}{}
+		err := r.blocks(func() error {
+			v, err := r.decode(s.Items)
+			a = append(a, v)
+			return err
+		})
+		return a, err
+	case TypeMap:
+		o := &object{}
+		err := r.blocks(func() error {
+			k, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			v, err := r.decode(s.Values)
+			o.keys = append(o.keys, string(k))
+			o.values = append(o.values, v)
+			return err
+		})
+		return o, err
+	case TypeUnion:
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.Branches) {
+			return nil, fmt.Errorf("invalid union branch %d", i)
+		}
+		return r.decode(s.Branches[i])
+	}
+	return nil, fmt.Errorf("unsupported type %s", s.Type)
+}
+
+// blocks reads the blocks of an array or map, calling fn for every item
+func (r *reader) blocks(fn func() error) error {
+	for {
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if n < 0 {
+			// a negative count is followed by the size of the block in bytes
+			n = -n
+			if _, err := r.long(); err != nil {
+				return err
+			}
+		}
+		for ; n > 0; n-- {
+			err := fn()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *reader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) long() (int64, error) {
+	u, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	r.pos += n
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	n, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	return r.next(int(n))
+}
+
+func writeLong(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64((v<<1)^(v>>63)))
+	buf.Write(b[:n])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeLong(buf, int64(len(b)))
+	buf.Write(b)
+}
+
+// writeJSON encodes a decoded value as JSON without escaping HTML characters, so that events read the same as before encoding
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(t))
+	case int64:
+		buf.WriteString(strconv.FormatInt(t, 10))
+	case float64:
+		buf.WriteString(strconv.FormatFloat(t, 'g', -1, 64))
+	case json.RawMessage:
+		buf.Write(t)
+	case string:
+		e := json.NewEncoder(buf)
+		e.SetEscapeHTML(false)
+		err := e.Encode(t)
+		if err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSON(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case *object:
+		buf.WriteByte('{')
+		for i, k := range t.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSON(buf, k)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			err = writeJSON(buf, t.values[i])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot encode %T as JSON", v)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,98 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// NewRegistry returns a client for the schema registry at the URL given
+func NewRegistry(registryURL string) *Registry {
+	return &Registry{
+		url:  strings.TrimSuffix(registryURL, "/"),
+		http: &http.Client{Timeout: 10 * time.Second},
+		byID: make(map[int]*Schema),
+	}
+}
+
+// SubjectFor returns the subject the schema of a topic's messages is registered under,
+// following the registry's default TopicNameStrategy
+func SubjectFor(topic string) string {
+	return topic + "-value"
+}
+
+// Register registers a schema under the subject given and returns its ID.
+// Registering a schema that is already registered returns the existing ID.
+func (r *Registry) Register(subject string, s *Schema) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": s.String()})
+	if err != nil {
+		return 0, err
+	}
+	var res struct {
+		ID int `json:"id"`
+	}
+	err = r.do(http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &res)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema for %s: %v", subject, err)
+	}
+	r.mu.Lock()
+	r.byID[res.ID] = s
+	r.mu.Unlock()
+	return res.ID, nil
+}
+
+// Schema returns the schema with the ID given, or a *RegistryError if it cannot be retrieved
+func (r *Registry) Schema(id int) (*Schema, error) {
+	r.mu.Lock()
+	s, ok := r.byID[id]
+	r.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	var res struct {
+		Schema string `json:"schema"`
+	}
+	err := r.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &res)
+	if err != nil {
+		return nil, &RegistryError{ID: id, Err: err}
+	}
+	s, err = ParseSchema(res.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema %d: %v", id, err)
+	}
+	r.mu.Lock()
+	r.byID[id] = s
+	r.mu.Unlock()
+	return s, nil
+}
+
+func (r *Registry) do(method string, path string, body []byte, res interface{}) error {
+	req, err := http.NewRequest(method, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("registry returned status %d: %s", resp.StatusCode, string(b))
+	}
+	return json.Unmarshal(b, res)
+}
@@ -0,0 +1,201 @@
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+)
+
+// fieldOverrides replace the type-derived Avro type for event fields declared as interface{}
+var fieldOverrides = map[string]string{
+	"log_id":       TypeLong,
+	"revision.new": TypeLong,
+	"revision.old": TypeLong,
+}
+
+// renamed maps event field names that are not valid Avro names to the name used in the schema
+var renamed = map[string]string{
+	"$schema": "_schema",
+}
+
+// EventSchema returns the Avro schema of events, derived from the fields of aggregator.MediawikiRecentchange.
+// All fields are optional. Fields of undeclared type such as log_params are stored as JSON text, and fields not
+// declared at all are kept in the additional_properties map, so that events survive a round trip unchanged.
+func EventSchema() *Schema {
+	fields := fieldsFor(reflect.TypeOf(aggregator.MediawikiRecentchange{}), nil)
+	fields = append(fields, map[string]interface{}{
+		"name":    ExtraField,
+		"type":    []interface{}{TypeNull, map[string]interface{}{"type": TypeMap, "values": jsonString()}},
+		"default": nil,
+	})
+	s, err := ParseSchema(mustMarshal(map[string]interface{}{
+		"type":      TypeRecord,
+		"name":      "recentchange",
+		"namespace": "pleiades",
+		"fields":    fields,
+	}))
+	if err != nil {
+		panic(fmt.Sprintf("invalid event schema: %v", err))
+	}
+	return s
+}
+
+func fieldsFor(t reflect.Type, path []string) []interface{} {
+	var fields []interface{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		p := append(append([]string{}, path...), name)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		var typ interface{}
+		if o, ok := fieldOverrides[strings.Join(p, ".")]; ok {
+			typ = o
+		} else {
+			switch ft.Kind() {
+			case reflect.Struct:
+				typ = map[string]interface{}{"type": TypeRecord, "name": name, "fields": fieldsFor(ft, p)}
+			case reflect.Bool:
+				typ = TypeBoolean
+			case reflect.Int, reflect.Int32, reflect.Int64:
+				typ = TypeLong
+			case reflect.String:
+				typ = TypeString
+			case reflect.Map:
+				continue
+			default:
+				typ = jsonString()
+			}
+		}
+		if r, ok := renamed[name]; ok {
+			name = r
+		}
+		fields = append(fields, map[string]interface{}{
+			"name":    name,
+			"type":    []interface{}{TypeNull, typ},
+			"default": nil,
+		})
+	}
+	return fields
+}
+
+func jsonString() map[string]interface{} {
+	return map[string]interface{}{"type": TypeString, "logicalType": LogicalJSON}
+}
+
+// ParseSchema parses an Avro schema from its JSON representation.
+// Enums and fixed types are not supported.
+func ParseSchema(text string) (*Schema, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(text), &v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	s, err := parse(v, make(map[string]*Schema))
+	if err != nil {
+		return nil, err
+	}
+	s.text = text
+	return s, nil
+}
+
+// String returns the JSON representation of the schema, as registered with a schema registry
+func (s *Schema) String() string {
+	return s.text
+}
+
+func parse(v interface{}, named map[string]*Schema) (*Schema, error) {
+	switch t := v.(type) {
+	case string:
+		switch t {
+		case TypeNull, TypeBoolean, TypeInt, TypeLong, TypeFloat, TypeDouble, TypeString, TypeBytes:
+			return &Schema{Type: t}, nil
+		}
+		if s, ok := named[t]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown type %s", t)
+	case []interface{}:
+		s := &Schema{Type: TypeUnion}
+		for _, b := range t {
+			bs, err := parse(b, named)
+			if err != nil {
+				return nil, err
+			}
+			s.Branches = append(s.Branches, bs)
+		}
+		return s, nil
+	case map[string]interface{}:
+		typ, _ := t["type"].(string)
+		logical, _ := t["logicalType"].(string)
+		switch typ {
+		case TypeRecord:
+			name, _ := t["name"].(string)
+			s := &Schema{Type: TypeRecord, Name: name}
+			named[name] = s
+			fields, _ := t["fields"].([]interface{})
+			for _, f := range fields {
+				fm, ok := f.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("invalid field in record %s", name)
+				}
+				fname, _ := fm["name"].(string)
+				ft, err := parse(fm["type"], named)
+				if err != nil {
+					return nil, fmt.Errorf("invalid type of field %s.%s: %v", name, fname, err)
+				}
+				s.Fields = append(s.Fields, &Field{Name: fname, Type: ft})
+			}
+			return s, nil
+		case TypeArray:
+			items, err := parse(t["items"], named)
+			if err != nil {
+				return nil, err
+			}
+			return &Schema{Type: TypeArray, Items: items}, nil
+		case TypeMap:
+			values, err := parse(t["values"], named)
+			if err != nil {
+				return nil, err
+			}
+			return &Schema{Type: TypeMap, Values: values}, nil
+		}
+		s, err := parse(typ, named)
+		if err != nil {
+			return nil, err
+		}
+		if logical != "" {
+			c := *s
+			c.LogicalType = logical
+			return &c, nil
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid schema %v", v)
+}
+
+// jsonName returns the event field name of a record field
+func jsonName(name string) string {
+	for k, v := range renamed {
+		if v == name {
+			return k
+		}
+	}
+	return name
+}
+
+func mustMarshal(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
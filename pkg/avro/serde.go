@@ -0,0 +1,66 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// NewSerializer registers the schema given under subject and returns a Serializer encoding events with it
+func NewSerializer(r *Registry, subject string, s *Schema) (*Serializer, error) {
+	id, err := r.Register(subject, s)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 5)
+	header[0] = magicByte
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	return &Serializer{schema: s, header: header}, nil
+}
+
+// Serialize encodes a JSON event, prefixed with the magic byte and schema ID
+func (s *Serializer) Serialize(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse event: %v", err)
+	}
+	var buf bytes.Buffer
+	buf.Write(s.header)
+	err = Encode(s.schema, v, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// NewDeserializer returns a Deserializer looking up schemas in the registry given.
+// The registry may be nil if only JSON messages are expected.
+func NewDeserializer(r *Registry) *Deserializer {
+	return &Deserializer{registry: r}
+}
+
+// Deserialize returns the JSON event held in a message.
+// Messages that are not in the Confluent wire format are assumed to be JSON and returned unchanged,
+// so that topics holding both encodings, e.g. while switching a publisher over, can be read.
+func (d *Deserializer) Deserialize(msg []byte) ([]byte, error) {
+	if len(msg) < 5 || msg[0] != magicByte {
+		return msg, nil
+	}
+	if d.registry == nil {
+		return nil, ErrNoRegistry
+	}
+	id := int(binary.BigEndian.Uint32(msg[1:5]))
+	s, err := d.registry.Schema(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := Decode(s, msg[5:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message with schema %d: %v", id, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,99 @@
+package avro
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Avro schema types
+const (
+	TypeNull    = "null"
+	TypeBoolean = "boolean"
+	TypeInt     = "int"
+	TypeLong    = "long"
+	TypeFloat   = "float"
+	TypeDouble  = "double"
+	TypeString  = "string"
+	TypeBytes   = "bytes"
+	TypeRecord  = "record"
+	TypeArray   = "array"
+	TypeMap     = "map"
+	TypeUnion   = "union"
+
+	// LogicalJSON marks string fields holding JSON text, for event fields that have no fixed type.
+	// They are decoded back into JSON values rather than strings.
+	LogicalJSON = "json"
+
+	// ExtraField is the name of the map field holding any event fields not declared in the schema
+	ExtraField = "additional_properties"
+
+	// magicByte starts every message in the Confluent wire format, followed by the 4-byte schema ID
+	magicByte = 0
+)
+
+var (
+	// ErrNoRegistry is returned when decoding an Avro message without a schema registry
+	ErrNoRegistry error = fmt.Errorf("no schema registry configured to decode Avro message")
+)
+
+// RegistryError is returned when a schema cannot be retrieved from the registry.
+// Unlike errors decoding a message, it is usually temporary.
+type RegistryError struct {
+	ID  int
+	Err error
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("failed to retrieve schema %d: %v", e.ID, e.Err)
+}
+
+// Schema is a parsed Avro schema
+type Schema struct {
+	Type        string
+	Name        string
+	LogicalType string
+	// Fields of a record
+	Fields []*Field
+	// Items of an array
+	Items *Schema
+	// Values of a map
+	Values *Schema
+	// Branches of a union
+	Branches []*Schema
+
+	text string
+}
+
+// Field is a single field of a record
+type Field struct {
+	Name string
+	Type *Schema
+}
+
+// Registry is a client for a Confluent-compatible schema registry.
+// Schemas are cached once retrieved, since registered schemas never change.
+type Registry struct {
+	url  string
+	http *http.Client
+
+	mu   sync.Mutex
+	byID map[int]*Schema
+}
+
+// Serializer encodes JSON events into Avro messages in the Confluent wire format
+type Serializer struct {
+	schema *Schema
+	header []byte
+}
+
+// Deserializer decodes Avro messages in the Confluent wire format back into JSON events
+type Deserializer struct {
+	registry *Registry
+}
+
+// object is a decoded record, preserving the order of its fields
+type object struct {
+	keys   []string
+	values []interface{}
+}
@@ -0,0 +1,166 @@
+package bucket
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Supported resolutions
+var (
+	Minute = Resolution{Name: "1m", Prefix: "min", Size: time.Minute}
+	Hour   = Resolution{Name: "1h", Prefix: "hour", Size: time.Hour}
+	Day    = Resolution{Name: "1d", Prefix: "day", Size: 24 * time.Hour}
+
+	resolutions = []Resolution{Minute, Hour, Day}
+)
+
+// NewConfig returns a Config for the resolutions, retention periods and time zone given
+func NewConfig(opts *Opts) (*Config, error) {
+	if len(opts.Resolutions) == 0 {
+		return nil, fmt.Errorf("no resolutions given")
+	}
+	loc, err := time.LoadLocation(opts.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s: %v", opts.Timezone, err)
+	}
+	c := &Config{Location: loc, Retention: make(map[string]time.Duration)}
+	seen := make(map[string]bool)
+	for _, n := range opts.Resolutions {
+		r, err := ParseResolution(n)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[r.Name] {
+			c.Resolutions = append(c.Resolutions, r)
+		}
+		seen[r.Name] = true
+	}
+	for _, n := range opts.Rollups {
+		r, err := ParseResolution(n)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("resolution %s cannot be both aggregated and rolled up", r.Name)
+		}
+		seen[r.Name] = true
+		c.Rollups = append(c.Rollups, r)
+	}
+	sort.Slice(c.Rollups, func(i, j int) bool { return c.Rollups[i].Size < c.Rollups[j].Size })
+	for _, r := range c.Rollups {
+		src, ok := c.Source(r)
+		if !ok {
+			return nil, fmt.Errorf("cannot roll up %s without aggregating a finer resolution", r.Name)
+		}
+		if r == Day && !alignedDays(loc, src) {
+			return nil, fmt.Errorf("cannot roll up %s from %s in time zone %s, whose days do not start on the %s",
+				r.Name, src.Name, loc, src.Name)
+		}
+	}
+
+	for n, d := range opts.Retention {
+		r, err := ParseResolution(n)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[r.Name] {
+			continue
+		}
+		dur, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention %s for resolution %s: %v", d, n, err)
+		}
+		if dur > 0 {
+			c.Retention[r.Name] = dur
+		}
+	}
+	return c, nil
+}
+
+// alignedDays returns whether the days of a time zone start at the start of a bucket of the UTC resolution given,
+// checking the offsets of the zone in winter and summer
+func alignedDays(loc *time.Location, r Resolution) bool {
+	year := time.Now().Year()
+	for _, t := range []time.Time{time.Date(year, 1, 1, 0, 0, 0, 0, loc), time.Date(year, 7, 1, 0, 0, 0, 0, loc)} {
+		if t.Unix()%int64(r.Size/time.Second) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// UTCDays returns the Config counters were always aggregated with: days in UTC
+func UTCDays() *Config {
+	return &Config{Resolutions: []Resolution{Day}, Location: time.UTC, Retention: map[string]time.Duration{}}
+}
+
+// ParseResolution returns the resolution with the name given
+func ParseResolution(name string) (Resolution, error) {
+	var names []string
+	for _, r := range resolutions {
+		if r.Name == name {
+			return r, nil
+		}
+		names = append(names, r.Name)
+	}
+	return Resolution{}, fmt.Errorf("unknown resolution %s, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// Index returns the number of the bucket t falls into, counted from the start of 1970. Days follow the Config's time
+// zone, while minutes and hours follow UTC, so that they are neither repeated nor skipped when daylight saving time
+// starts or ends. In UTC, the day bucket is the Julian day used since the first release.
+func (c *Config) Index(r Resolution, t time.Time) int64 {
+	secs := t.Unix()
+	if r == Day {
+		_, offset := t.In(c.Location).Zone()
+		secs += int64(offset)
+	}
+	size := int64(r.Size / time.Second)
+	if secs < 0 {
+		return (secs - size + 1) / size
+	}
+	return secs / size
+}
+
+// Start returns the time the bucket with the number given starts at
+func (c *Config) Start(r Resolution, n int64) time.Time {
+	start := time.Unix(n*int64(r.Size/time.Second), 0).UTC()
+	if r != Day {
+		return start
+	}
+	return time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, c.Location)
+}
+
+// Prefix returns the key prefix of counters in the bucket with the number given, e.g. "day_18484_"
+func Prefix(r Resolution, n int64) string {
+	return fmt.Sprintf("%s_%d_", r.Prefix, n)
+}
+
+// End returns the time the bucket with the number given ends at
+func (c *Config) End(r Resolution, n int64) time.Time {
+	return c.Start(r, n+1)
+}
+
+// Expiry returns the time the bucket with the number given expires at, or the zero time if it is kept forever
+func (c *Config) Expiry(r Resolution, n int64) time.Time {
+	d, ok := c.Retention[r.Name]
+	if !ok {
+		return time.Time{}
+	}
+	return c.End(r, n).Add(d)
+}
+
+// Source returns the resolution a rollup is computed from: the next finer resolution that is aggregated or rolled up
+func (c *Config) Source(r Resolution) (Resolution, bool) {
+	var src Resolution
+	found := false
+	for _, s := range append(append([]Resolution{}, c.Resolutions...), c.Rollups...) {
+		if s.Size < r.Size && (!found || s.Size > src.Size) {
+			src = s
+			found = true
+		}
+	}
+	return src, found
+}
@@ -0,0 +1,159 @@
+package bucket
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Time buckets", func() {
+	// 2020-08-10T10:50:38.001Z
+	t := time.Unix(0, 1597056638001*int64(time.Millisecond))
+
+	It("numbers UTC days by Julian day", func() {
+		c := UTCDays()
+		Expect(c.Index(Day, t)).To(Equal(int64(1597056638001 / 86400000)))
+		Expect(Prefix(Day, c.Index(Day, t))).To(Equal("day_18484_"))
+	})
+
+	It("numbers the buckets of every resolution", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1m", "1h", "1d"}, Timezone: "UTC"})
+		Expect(err).NotTo(HaveOccurred())
+		var prefixes []string
+		for _, r := range c.Resolutions {
+			prefixes = append(prefixes, Prefix(r, c.Index(r, t)))
+		}
+		Expect(prefixes).To(Equal([]string{"min_26617610_", "hour_443626_", "day_18484_"}))
+	})
+
+	It("follows the day boundaries of a time zone", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1d"}, Timezone: "Europe/Berlin"})
+		Expect(err).NotTo(HaveOccurred())
+		// 23:30 UTC is already the next day in Berlin
+		late := time.Date(2020, 8, 10, 23, 30, 0, 0, time.UTC)
+		Expect(c.Index(Day, late)).To(Equal(int64(18485)))
+		Expect(UTCDays().Index(Day, late)).To(Equal(int64(18484)))
+		Expect(c.Start(Day, 18485)).To(BeTemporally("==", time.Date(2020, 8, 10, 22, 0, 0, 0, time.UTC)))
+	})
+
+	It("follows daylight saving time", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1d"}, Timezone: "Europe/Berlin"})
+		Expect(err).NotTo(HaveOccurred())
+		winter := time.Date(2020, 1, 10, 23, 30, 0, 0, time.UTC)
+		Expect(c.Start(Day, c.Index(Day, winter))).To(BeTemporally("==", time.Date(2020, 1, 10, 23, 0, 0, 0, time.UTC)))
+	})
+
+	It("keeps minutes and hours in UTC when daylight saving time ends", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1m", "1h", "1d"}, Timezone: "Europe/Berlin"})
+		Expect(err).NotTo(HaveOccurred())
+		// 02:30 happens twice in Berlin on 2020-10-25, first in CEST and then in CET
+		summer := time.Date(2020, 10, 25, 0, 30, 0, 0, time.UTC)
+		winter := summer.Add(time.Hour)
+		Expect(summer.In(c.Location).Format("15:04")).To(Equal(winter.In(c.Location).Format("15:04")))
+		Expect(c.Index(Minute, winter) - c.Index(Minute, summer)).To(Equal(int64(60)))
+		Expect(c.Index(Hour, winter) - c.Index(Hour, summer)).To(Equal(int64(1)))
+		Expect(c.Index(Day, winter)).To(Equal(c.Index(Day, summer)))
+		day := c.Index(Day, summer)
+		Expect(c.End(Day, day).Sub(c.Start(Day, day))).To(Equal(25 * time.Hour))
+		Expect(c.Start(Hour, c.Index(Hour, winter))).To(BeTemporally("==", winter.Truncate(time.Hour)))
+	})
+
+	It("keeps minutes and hours in UTC when daylight saving time starts", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1m", "1h", "1d"}, Timezone: "Europe/Berlin"})
+		Expect(err).NotTo(HaveOccurred())
+		// 01:59 CET is followed by 03:00 CEST in Berlin on 2020-03-29
+		before := time.Date(2020, 3, 29, 0, 59, 0, 0, time.UTC)
+		after := before.Add(time.Minute)
+		Expect(after.In(c.Location).Format("15:04")).To(Equal("03:00"))
+		Expect(c.Index(Minute, after) - c.Index(Minute, before)).To(Equal(int64(1)))
+		Expect(c.Index(Hour, after) - c.Index(Hour, before)).To(Equal(int64(1)))
+		day := c.Index(Day, before)
+		Expect(c.End(Day, day).Sub(c.Start(Day, day))).To(Equal(23 * time.Hour))
+	})
+
+	It("follows the days of time zones that are not a whole number of hours from UTC", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1h", "1d"}, Timezone: "Asia/Kolkata"})
+		Expect(err).NotTo(HaveOccurred())
+		n := c.Index(Hour, t)
+		Expect(c.Start(Hour, n)).To(BeTemporally("==", time.Date(2020, 8, 10, 10, 0, 0, 0, time.UTC)))
+		Expect(c.Start(Day, c.Index(Day, t))).To(BeTemporally("==", time.Date(2020, 8, 9, 18, 30, 0, 0, time.UTC)))
+
+		_, err = NewConfig(&Opts{Resolutions: []string{"1h"}, Rollups: []string{"1d"}, Timezone: "Asia/Kolkata"})
+		Expect(err).To(HaveOccurred())
+		_, err = NewConfig(&Opts{Resolutions: []string{"1m"}, Rollups: []string{"1d"}, Timezone: "Asia/Kolkata"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("numbers the slots rates are computed from", func() {
+		n := RateIndex(t)
+		Expect(Prefix(RateSlot, n)).To(Equal("rate_159705663_"))
+		Expect(RateStart(n)).To(BeTemporally("==", time.Date(2020, 8, 10, 10, 50, 30, 0, time.UTC)))
+		Expect(RateExpiry(n)).To(BeTemporally("==", time.Date(2020, 8, 10, 11, 5, 40, 0, time.UTC)))
+
+		from, to := RateRange(t, time.Minute)
+		Expect(to).To(Equal(n))
+		Expect(to - from).To(Equal(int64(5)))
+		Expect(RateStart(from)).To(BeTemporally("==", time.Date(2020, 8, 10, 10, 49, 40, 0, time.UTC)))
+	})
+
+	It("numbers the generations of decaying scores", func() {
+		d, err := ParseDecay("1h")
+		Expect(err).NotTo(HaveOccurred())
+		n := d.Index(t)
+		Expect(Prefix(d.Generation(), n)).To(Equal("trend_13863_"))
+		Expect(d.Start(n)).To(BeTemporally("==", time.Date(2020, 8, 10, 0, 0, 0, 0, time.UTC)))
+		Expect(d.Expiry(n)).To(BeTemporally("==", time.Date(2020, 8, 12, 16, 0, 0, 0, time.UTC)))
+		Expect(d.Weight(n, d.Start(n))).To(Equal(1.0))
+		Expect(d.Weight(n, d.Start(n).Add(3*time.Hour))).To(Equal(8.0))
+		Expect(d.Weight(n-1, d.Start(n))).To(Equal(float64(1 << DecayHalfLives)))
+
+		for _, invalid := range []string{"", "1ms", "soon"} {
+			_, err = ParseDecay(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("returns the start of a UTC bucket", func() {
+		c := UTCDays()
+		Expect(c.Start(Day, 18484)).To(BeTemporally("==", time.Date(2020, 8, 10, 0, 0, 0, 0, time.UTC)))
+		Expect(c.Start(Minute, 26617610)).To(BeTemporally("==", time.Date(2020, 8, 10, 10, 50, 0, 0, time.UTC)))
+	})
+
+	It("expires buckets their retention after they end", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1m", "1h", "1d"}, Retention: map[string]string{"1m": "48h", "1h": "2160h"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Expiry(Minute, 26617610)).To(BeTemporally("==", time.Date(2020, 8, 12, 10, 51, 0, 0, time.UTC)))
+		Expect(c.Expiry(Hour, 443626)).To(BeTemporally("==", time.Date(2020, 11, 8, 11, 0, 0, 0, time.UTC)))
+		Expect(c.Expiry(Day, 18484).IsZero()).To(BeTrue())
+	})
+
+	It("rolls up from the next finer resolution", func() {
+		c, err := NewConfig(&Opts{Resolutions: []string{"1m"}, Rollups: []string{"1d", "1h"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Rollups).To(Equal([]Resolution{Hour, Day}))
+		src, ok := c.Source(Day)
+		Expect(ok).To(BeTrue())
+		Expect(src).To(Equal(Hour))
+		src, _ = c.Source(Hour)
+		Expect(src).To(Equal(Minute))
+	})
+
+	It("rejects rollups without a finer resolution", func() {
+		_, err := NewConfig(&Opts{Resolutions: []string{"1h"}, Rollups: []string{"1m"}})
+		Expect(err).To(HaveOccurred())
+		_, err = NewConfig(&Opts{Resolutions: []string{"1h"}, Rollups: []string{"1h"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects unknown resolutions and time zones", func() {
+		_, err := NewConfig(&Opts{Resolutions: []string{"5m"}, Timezone: "UTC"})
+		Expect(err).To(HaveOccurred())
+		_, err = NewConfig(&Opts{Resolutions: []string{"1d"}, Timezone: "Mars/Olympus_Mons"})
+		Expect(err).To(HaveOccurred())
+		_, err = NewConfig(&Opts{Timezone: "UTC"})
+		Expect(err).To(HaveOccurred())
+		_, err = NewConfig(&Opts{Resolutions: []string{"1m"}, Retention: map[string]string{"1m": "2 days"}})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,56 @@
+package bucket
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DecayHalfLives is the number of half-lives a generation of time-decayed sorted sets spans
+const DecayHalfLives = 32
+
+// Decay numbers the generations of sorted sets whose scores decay exponentially with HalfLife.
+// Rather than decaying the scores written before, increments are scaled up by 2^(age of the generation/HalfLife),
+// so that scores written at different times within a generation compare as if they had decayed.
+// A new generation starts every DecayHalfLives half-lives to keep scores within the range of a float.
+type Decay struct {
+	HalfLife time.Duration
+}
+
+// ParseDecay returns the Decay with the half-life given, e.g. "2h"
+func ParseDecay(halfLife string) (Decay, error) {
+	d, err := time.ParseDuration(halfLife)
+	if err != nil {
+		return Decay{}, fmt.Errorf("invalid half-life %s: %v", halfLife, err)
+	}
+	if d < time.Second {
+		return Decay{}, fmt.Errorf("half-life %s must be at least 1s", halfLife)
+	}
+	return Decay{HalfLife: d}, nil
+}
+
+// Generation returns the resolution of the generations, whose keys start with trend_<generation>_
+func (d Decay) Generation() Resolution {
+	return Resolution{Name: d.HalfLife.String(), Prefix: "trend", Size: DecayHalfLives * d.HalfLife}
+}
+
+// Index returns the number of the generation t falls into
+func (d Decay) Index(t time.Time) int64 {
+	return t.Unix() / int64(d.Generation().Size/time.Second)
+}
+
+// Start returns the time the generation with the number given starts at
+func (d Decay) Start(n int64) time.Time {
+	return time.Unix(n*int64(d.Generation().Size/time.Second), 0)
+}
+
+// Expiry returns the time the generation with the number given expires at, once the next generation has ended
+func (d Decay) Expiry(n int64) time.Time {
+	return d.Start(n + 2)
+}
+
+// Weight returns the factor increments at t are scaled by in the generation with the number given.
+// Scores of the generation decayed to t are its scores divided by the weight.
+func (d Decay) Weight(n int64, t time.Time) float64 {
+	return math.Exp2(t.Sub(d.Start(n)).Seconds() / d.HalfLife.Seconds())
+}
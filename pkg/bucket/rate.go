@@ -0,0 +1,35 @@
+package bucket
+
+import (
+	"time"
+)
+
+var (
+	// RateSlot is the resolution of the ring of short-lived buckets rates are computed from.
+	// It is independent of the Config's time zone, as its slots are far shorter than any time zone offset.
+	RateSlot = Resolution{Name: "10s", Prefix: "rate", Size: 10 * time.Second}
+
+	// RateWindows are the sliding windows rates are computed over
+	RateWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+)
+
+// RateIndex returns the number of the rate slot t falls into
+func RateIndex(t time.Time) int64 {
+	return t.Unix() / int64(RateSlot.Size/time.Second)
+}
+
+// RateStart returns the time the rate slot with the number given starts at
+func RateStart(n int64) time.Time {
+	return time.Unix(n*int64(RateSlot.Size/time.Second), 0)
+}
+
+// RateExpiry returns the time the rate slot with the number given expires at, once it has left the longest window
+func RateExpiry(n int64) time.Time {
+	return RateStart(n + 1).Add(RateWindows[len(RateWindows)-1])
+}
+
+// RateRange returns the first and last rate slot of the window ending at now.
+// The first slot is the oldest one that starts within the window, so that the slots cover the time from its start to now.
+func RateRange(now time.Time, window time.Duration) (int64, int64) {
+	return RateIndex(now.Add(-window)) + 1, RateIndex(now)
+}
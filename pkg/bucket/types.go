@@ -0,0 +1,35 @@
+package bucket
+
+import (
+	"time"
+)
+
+// Resolution is the length of the time buckets counters are aggregated in
+type Resolution struct {
+	// Name is the name used in configuration and the API, e.g. "1h"
+	Name string
+	// Prefix starts the keys of counters at this resolution, followed by the bucket number, e.g. "hour"
+	Prefix string
+	Size   time.Duration
+}
+
+// Config determines the resolutions counters are aggregated at, how long they are kept and the time zone their buckets follow
+type Config struct {
+	// Resolutions are written by the aggregator
+	Resolutions []Resolution
+	// Rollups are computed from the next finer resolution by the rollup job, in ascending order
+	Rollups []Resolution
+	// Retention is the time buckets are kept for after they end, by resolution name. Buckets without one are kept forever.
+	Retention map[string]time.Duration
+	Location  *time.Location
+}
+
+// Opts hold the names of the resolutions, retention periods and time zone of a Config
+type Opts struct {
+	Resolutions []string
+	Rollups     []string
+	// Retention maps resolution names to durations, e.g. "1m" to "48h"
+	Retention map[string]string
+	// Timezone is the name of the time zone buckets follow. An empty time zone means UTC.
+	Timezone string
+}
@@ -0,0 +1,94 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	// InfBound names the histogram bin of values above the last bound
+	InfBound = "+Inf"
+
+	// PercentilesSuffix ends the keys of the hashes of the percentiles estimated from the histogram of the same name,
+	// e.g. day_18484_pleiades_edit_size_percentiles
+	PercentilesSuffix = "_percentiles"
+)
+
+// Quantiles are the quantiles whose percentiles are estimated from histograms
+var Quantiles = []float64{0.5, 0.95, 0.99}
+
+// Bins returns the bins of a histogram hash, mapping upper bounds to counts, in ascending order.
+// The hash must hold every bin, including empty ones, for the bounds of the bins to be known.
+func Bins(counts map[string]int64) []Bin {
+	bins := make([]Bin, 0, len(counts))
+	for bound, n := range counts {
+		bins = append(bins, Bin{UpperBound: bound, Count: n})
+	}
+	sort.Slice(bins, func(i, j int) bool { return upperBound(bins[i]) < upperBound(bins[j]) })
+	return bins
+}
+
+// Percentiles returns the percentiles of the Quantiles estimated from a histogram, e.g. p95, or nil if it is empty
+func Percentiles(bins []Bin) map[string]float64 {
+	var out map[string]float64
+	for _, q := range Quantiles {
+		v, ok := Percentile(bins, q)
+		if !ok {
+			return nil
+		}
+		if out == nil {
+			out = make(map[string]float64)
+		}
+		out[Name(q)] = v
+	}
+	return out
+}
+
+// Name returns the name of the percentile of a quantile, e.g. p95 for 0.95
+func Name(q float64) string {
+	return fmt.Sprintf("p%g", q*100)
+}
+
+// Percentile estimates the q-quantile of the values counted in a histogram with bins in ascending order,
+// by interpolating linearly within the bin it falls into. It returns false if the histogram is empty.
+func Percentile(bins []Bin, q float64) (float64, bool) {
+	var total int64
+	for _, b := range bins {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0, false
+	}
+	rank := q * float64(total)
+	var cum int64
+	for i, b := range bins {
+		if float64(cum+b.Count) < rank || b.Count == 0 {
+			cum += b.Count
+			continue
+		}
+		upper := upperBound(b)
+		if i == 0 {
+			return upper, true
+		}
+		lower := upperBound(bins[i-1])
+		if math.IsInf(upper, 1) {
+			return lower, true
+		}
+		return lower + (upper-lower)*(rank-float64(cum))/float64(b.Count), true
+	}
+	return upperBound(bins[len(bins)-1]), true
+}
+
+// upperBound returns the upper bound of a bin as a number
+func upperBound(b Bin) float64 {
+	if b.UpperBound == InfBound {
+		return math.Inf(1)
+	}
+	v, err := strconv.ParseFloat(b.UpperBound, 64)
+	if err != nil {
+		return math.Inf(1)
+	}
+	return v
+}
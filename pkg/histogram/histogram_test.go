@@ -0,0 +1,48 @@
+package histogram
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Histograms", func() {
+	percentile := func(bins []Bin, q float64) float64 {
+		v, ok := Percentile(bins, q)
+		Expect(ok).To(BeTrue())
+		return v
+	}
+
+	It("orders bins by their upper bound", func() {
+		Expect(Bins(map[string]int64{"+Inf": 1, "10": 2, "-10": 3, "0": 0})).To(Equal([]Bin{
+			{UpperBound: "-10", Count: 3},
+			{UpperBound: "0", Count: 0},
+			{UpperBound: "10", Count: 2},
+			{UpperBound: InfBound, Count: 1},
+		}))
+	})
+
+	It("interpolates within the bin a percentile falls into", func() {
+		bins := []Bin{{"0", 10}, {"10", 10}, {"50", 20}}
+		Expect(percentile(bins, 0.5)).To(Equal(10.0))
+		Expect(percentile(bins, 0.75)).To(Equal(30.0))
+		Expect(percentile(bins, 0.1)).To(Equal(0.0))
+	})
+
+	It("interpolates from the bound of empty bins", func() {
+		bins := []Bin{{"0", 10}, {"10", 0}, {"50", 10}}
+		Expect(percentile(bins, 0.75)).To(Equal(30.0))
+	})
+
+	It("estimates percentiles above the last bound as the last bound", func() {
+		bins := []Bin{{"0", 1}, {"10", 0}, {InfBound, 9}}
+		Expect(percentile(bins, 0.99)).To(Equal(10.0))
+	})
+
+	It("names the percentiles of the quantiles", func() {
+		Expect(Percentiles([]Bin{{"0", 100}, {"100", 100}})).To(Equal(map[string]float64{"p50": 0, "p95": 90, "p99": 98}))
+		Expect(Percentiles([]Bin{{"0", 0}})).To(BeNil())
+		Expect(Percentiles(nil)).To(BeNil())
+		_, ok := Percentile(nil, 0.5)
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,7 @@
+package histogram
+
+// Bin is a bin of a histogram, counting the values above the previous bin's upper bound up to its own
+type Bin struct {
+	UpperBound string
+	Count      int64
+}
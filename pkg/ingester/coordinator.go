@@ -2,11 +2,11 @@ package ingester
 
 import (
 	"fmt"
+	"io/ioutil"
 	"sync"
 	"time"
 
-	"github.com/gargath/pleiades/pkg/ingester/publisher/file"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
 	"github.com/gargath/pleiades/pkg/log"
 	"github.com/gargath/pleiades/pkg/util"
@@ -37,88 +37,56 @@ func (c *Coordinator) Start() (string, error) {
 	logger.Debug("Coordinator setting up...")
 	c.stop = make(chan (bool))
 	c.events = make(chan (*sse.Event))
-	var resumeID string
-
-	if c.File != nil {
-		f, err := file.NewPublisher(c.File, c.events)
-		if err != nil {
-			return lastEventID, fmt.Errorf("Failed to initialize file publisher: %v", err)
-		}
-		if c.Resume {
-			resumeID = f.GetResumeID()
-			if resumeID != "" {
-				logger.Infof("Resume Event ID found: %s", resumeID)
-			} else {
-				logger.Info("No resume ID found")
-			}
-		}
+	c.published = c.events
+	if len(c.Transforms) > 0 {
+		c.published = make(chan (*sse.Event))
 		wgSub.Add(1)
-		go func() {
-			defer wgSub.Done()
-			for {
-				for {
-					select {
-					case <-c.stop:
-						{
-							return
-						}
-					default:
-						count, err := f.ReadAndPublish()
-						if err != nil {
-							logger.Errorf("File Publisher exited with error after processing %d events: %s", count, err)
-						} else {
-							logger.Infof("File Publisher finished after processing %d events\n", count)
-						}
-						restarts.WithLabelValues("file_publisher").Inc()
-					}
-				}
-			}
-		}()
-		logger.Debug("file publisher is up")
+		go c.transform()
+		logger.Debugf("%d transforms are set up", len(c.Transforms))
 	}
+	var resumeID string
 
-	if c.Kafka != nil {
-		k, err := kafka.NewPublisher(c.Kafka, c.events)
-		if err != nil {
-			return lastEventID, fmt.Errorf("Failed to initialize kafka publisher: %v", err)
-		}
-		err = k.ValidateConnection()
-		if err != nil {
-			return lastEventID, fmt.Errorf("Failed to validate kafka connection: %v", err)
-		}
-		if c.Resume {
-			resumeID = k.GetResumeID()
-			if resumeID != "" {
-				logger.Infof("Resume Event ID found: %s", resumeID)
-			} else {
-				logger.Info("No resume ID found")
-			}
+	plugin, ok := publisher.Lookup(c.Publisher)
+	if !ok {
+		return lastEventID, fmt.Errorf("Unknown publisher %s", c.Publisher)
+	}
+	p, err := plugin.New(c.PublisherConfig, c.published)
+	if err != nil {
+		return lastEventID, fmt.Errorf("Failed to initialize %s: %v", plugin.Description, err)
+	}
+	err = p.ValidateConnection()
+	if err != nil {
+		return lastEventID, fmt.Errorf("Failed to validate %s connection: %v", plugin.Description, err)
+	}
+	if c.Resume {
+		resumeID = p.GetResumeID()
+		if resumeID != "" {
+			logger.Infof("Resume Event ID found: %s", resumeID)
+		} else {
+			logger.Info("No resume ID found")
 		}
-		wgSub.Add(1)
-		go func() {
-			defer wgSub.Done()
-			for {
-				for {
-					select {
-					case <-c.stop:
-						{
-							return
-						}
-					default:
-						count, err := k.ReadAndPublish()
-						logger.Debug("Kafka Publisher exited")
-						if err != nil {
-							logger.Errorf("Kafka Publisher exited with error after processing %d events: %s", count, err)
-						} else {
-							logger.Infof("Kafka Publisher finished after processing %d events\n", count)
-						}
-						restarts.WithLabelValues("kafka_publisher").Inc()
-					}
+	}
+	wgSub.Add(1)
+	go func() {
+		defer wgSub.Done()
+		for {
+			select {
+			case <-c.stop:
+				{
+					return
+				}
+			default:
+				count, err := p.ReadAndPublish()
+				if err != nil {
+					logger.Errorf("%s exited with error after processing %d events: %s", plugin.Description, count, err)
+				} else {
+					logger.Infof("%s finished after processing %d events\n", plugin.Description, count)
 				}
+				restarts.WithLabelValues(plugin.Name + "_publisher").Inc()
 			}
-		}()
-		logger.Debug("kafka publisher is up")
-	}
+		}
+	}()
+	logger.Debugf("%s is up", plugin.Description)
 
 	wgPub.Add(1)
 	go func() {
@@ -184,3 +152,23 @@ func (c *Coordinator) Stop() {
 	wgSub.Wait()
 	logger.Debug("subscriber waitgroup finished - SSE connection closed")
 }
+
+// transform applies the configured transforms to each event received until the event channel is closed.
+// Events that fail to transform are dropped, so that the publisher never sees untransformed data.
+func (c *Coordinator) transform() {
+	defer wgSub.Done()
+	defer close(c.published)
+	for e := range c.events {
+		data, err := ioutil.ReadAll(e.GetData())
+		if err != nil {
+			logger.Errorf("Dropping event %s: %v", e.ID, err)
+			continue
+		}
+		data, err = c.Transforms.Process(data)
+		if err != nil {
+			logger.Errorf("Dropping event %s: %v", e.ID, err)
+			continue
+		}
+		c.published <- sse.NewEvent(e.URI, e.ID, data)
+	}
+}
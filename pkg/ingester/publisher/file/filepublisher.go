@@ -10,6 +10,7 @@ import (
 	"github.com/gargath/pleiades/pkg/ingester/publisher"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
 	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/parquet"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -59,6 +60,25 @@ func NewPublisher(opts *Opts, src <-chan *sse.Event) (publisher.Publisher, error
 		destination: dest,
 		prefix:      uid,
 	}
+	switch opts.Format {
+	case "", FormatDat:
+	case FormatParquet:
+		f.parquet, err = parquet.NewFileWriter(&parquet.FileWriterOpts{
+			Dir:         dest,
+			Prefix:      uid,
+			MaxRows:     opts.MaxRows,
+			MaxAge:      opts.MaxAge,
+			Compression: opts.Compression,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if opts.MaxAge > 0 {
+			f.rollCheck = time.Second
+		}
+	default:
+		return nil, fmt.Errorf("unsupported file format %s (use %s or %s)", opts.Format, FormatDat, FormatParquet)
+	}
 	return f, nil
 }
 
@@ -75,15 +95,41 @@ func (f *Publisher) ValidateConnection() error {
 // returns the value of the counter when the Publisher's source channel is closed
 func (f *Publisher) ReadAndPublish() (int64, error) {
 	f.msgCount = 0
-	for e := range f.source {
-		f.msgCount++
-		if e != nil {
-			err := f.ProcessEvent(e)
+	var roll <-chan time.Time
+	if f.rollCheck > 0 {
+		t := time.NewTicker(f.rollCheck)
+		defer t.Stop()
+		roll = t.C
+	}
+loop:
+	for {
+		select {
+		case e, ok := <-f.source:
+			if !ok {
+				break loop
+			}
+			f.msgCount++
+			if e != nil {
+				err := f.ProcessEvent(e)
+				if err != nil {
+					return f.msgCount, fmt.Errorf("error processing event: %v", err)
+				}
+			}
+		case <-roll:
+			err := f.parquet.RollIfDue()
 			if err != nil {
-				return f.msgCount, fmt.Errorf("error processing event: %v", err)
+				pubErrors.WithLabelValues("write").Inc()
+				return f.msgCount, fmt.Errorf("error completing parquet file: %v", err)
 			}
 		}
 	}
+	if f.parquet != nil {
+		err := f.parquet.Close()
+		if err != nil {
+			pubErrors.WithLabelValues("write").Inc()
+			return f.msgCount, fmt.Errorf("error completing parquet file: %v", err)
+		}
+	}
 	err := ioutil.WriteFile("./.pleiades_resumeID", []byte(f.lastEventID), 0644)
 	if err != nil {
 		logger.Error("unable to write last processed event ID to file .pleiades_resumeID: %v", err)
@@ -99,6 +145,15 @@ func (f *Publisher) ProcessEvent(e *sse.Event) error {
 		pubErrors.WithLabelValues("event_data_read").Inc()
 		return fmt.Errorf("error reading event data: %v", err)
 	}
+	if f.parquet != nil {
+		err = f.parquet.Write(d)
+		if err != nil {
+			pubErrors.WithLabelValues("write").Inc()
+			return fmt.Errorf("error writing parquet file: %v", err)
+		}
+		f.lastEventID = e.ID
+		return nil
+	}
 	d = append([]byte("\n"), d...)
 	d = append([]byte(e.ID), d...)
 	err = ioutil.WriteFile(fmt.Sprintf("%s/%s-event-%d.dat", f.destination, f.prefix, f.msgCount), d, 0644)
@@ -0,0 +1,44 @@
+package file
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// DirOption and FormatOption are shared with the file aggregator, so that both are pointed at the same directory
+var (
+	DirOption    = plugin.Option{Name: "file.publishDir", Usage: "the directory to publish events to", Default: "./events"}
+	FormatOption = plugin.Option{Name: "file.format", Usage: "the file format to publish events in ('dat' or 'parquet')", Default: FormatDat}
+)
+
+// Options are the configuration values of the file publisher
+var Options = []plugin.Option{
+	DirOption,
+	FormatOption,
+	{Name: "file.maxRows", Usage: "the maximum number of events per parquet file", Default: int64(100000)},
+	{Name: "file.maxAge", Usage: "the maximum time to write to a parquet file before starting a new one", Default: time.Hour},
+}
+
+func init() {
+	publisher.Register(&publisher.Plugin{
+		Name:        "file",
+		Description: "filesystem publisher",
+		Options:     Options,
+		New: func(cfg plugin.Config, src <-chan *sse.Event) (publisher.Publisher, error) {
+			return NewPublisher(OptsFromConfig(cfg), src)
+		},
+	})
+}
+
+// OptsFromConfig returns the Opts described by the values of Options
+func OptsFromConfig(cfg plugin.Config) *Opts {
+	return &Opts{
+		Destination: cfg.String(DirOption.Name),
+		Format:      cfg.String(FormatOption.Name),
+		MaxRows:     cfg.Int64("file.maxRows"),
+		MaxAge:      cfg.Duration("file.maxAge"),
+	}
+}
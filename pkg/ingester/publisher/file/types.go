@@ -2,8 +2,17 @@ package file
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/parquet"
+)
+
+const (
+	// FormatDat writes one file per event, holding the event ID and data
+	FormatDat = "dat"
+	// FormatParquet writes events to Parquet files that are rolled by row count or age
+	FormatParquet = "parquet"
 )
 
 // Publisher reads Events and writes them to disk
@@ -13,11 +22,17 @@ type Publisher struct {
 	msgCount    int64
 	prefix      string
 	lastEventID string
+	parquet     *parquet.FileWriter
+	rollCheck   time.Duration
 }
 
 // Opts hold config options for the file publisher
 type Opts struct {
 	Destination string
+	Format      string
+	MaxRows     int64
+	MaxAge      time.Duration
+	Compression string
 }
 
 // PublisherConfig contains configuration for the file Publisher
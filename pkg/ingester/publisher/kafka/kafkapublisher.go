@@ -10,6 +10,7 @@ import (
 
 	kafka "github.com/segmentio/kafka-go"
 
+	"github.com/gargath/pleiades/pkg/avro"
 	"github.com/gargath/pleiades/pkg/ingester/publisher"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
 	"github.com/gargath/pleiades/pkg/log"
@@ -48,6 +49,21 @@ func NewPublisher(opts *Opts, src <-chan *sse.Event) (publisher.Publisher, error
 		destination: o,
 	}
 
+	switch opts.Encoding {
+	case "", EncodingJSON:
+	case EncodingAvro:
+		if opts.SchemaRegistry == "" {
+			return nil, ErrNoRegistry
+		}
+		s, err := avro.NewSerializer(avro.NewRegistry(opts.SchemaRegistry), avro.SubjectFor(topic), avro.EventSchema())
+		if err != nil {
+			return nil, err
+		}
+		f.serializer = s
+	default:
+		return nil, fmt.Errorf("unsupported encoding %s (use %s or %s)", opts.Encoding, EncodingJSON, EncodingAvro)
+	}
+
 	f.w = kafka.NewWriter(kafka.WriterConfig{
 		Brokers:      f.destination.Brokers,
 		Topic:        f.destination.Topic,
@@ -115,6 +131,15 @@ func (f *Publisher) ProcessEvent(e *sse.Event) error {
 		pubErrors.WithLabelValues("event_data_read").Inc()
 		return fmt.Errorf("error reading event data: %v", err)
 	}
+	if f.serializer != nil {
+		d, err = f.serializer.Serialize(d)
+		if err != nil {
+			// a single malformed event must not stop publishing, so it is dropped
+			pubErrors.WithLabelValues("encode").Inc()
+			logger.Errorf("Dropping event %s: %v", e.ID, err)
+			return nil
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	err = f.w.WriteMessages(ctx, kafka.Message{
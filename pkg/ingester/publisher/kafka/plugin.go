@@ -0,0 +1,44 @@
+package kafka
+
+import (
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// BrokerOption, TopicOption and SchemaRegistryOption are shared with the kafka aggregator, so that both are pointed at
+// the same topic
+var (
+	BrokerOption         = plugin.Option{Name: "kafka.broker", Usage: "the kafka broker to connect to", Default: "localhost:9092"}
+	TopicOption          = plugin.Option{Name: "kafka.topic", Usage: "the kafka topic events are published to", Default: "pleiades-events"}
+	SchemaRegistryOption = plugin.Option{Name: "kafka.schemaRegistry", Usage: "the URL of the schema registry used for Avro encoding", Default: ""}
+)
+
+// Options are the configuration values of the kafka publisher
+var Options = []plugin.Option{
+	BrokerOption,
+	TopicOption,
+	{Name: "kafka.encoding", Usage: "the encoding of published events (json or avro)", Default: EncodingJSON},
+	SchemaRegistryOption,
+}
+
+func init() {
+	publisher.Register(&publisher.Plugin{
+		Name:        "kafka",
+		Description: "kafka publisher",
+		Options:     Options,
+		New: func(cfg plugin.Config, src <-chan *sse.Event) (publisher.Publisher, error) {
+			return NewPublisher(OptsFromConfig(cfg), src)
+		},
+	})
+}
+
+// OptsFromConfig returns the Opts described by the values of Options
+func OptsFromConfig(cfg plugin.Config) *Opts {
+	return &Opts{
+		Broker:         cfg.String(BrokerOption.Name),
+		Topic:          cfg.String(TopicOption.Name),
+		Encoding:       cfg.String("kafka.encoding"),
+		SchemaRegistry: cfg.String(SchemaRegistryOption.Name),
+	}
+}
@@ -5,15 +5,24 @@ import (
 
 	kafka "github.com/segmentio/kafka-go"
 
+	"github.com/gargath/pleiades/pkg/avro"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
 )
 
+const (
+	// EncodingJSON publishes events as received
+	EncodingJSON = "json"
+	// EncodingAvro publishes events as Avro in the Confluent wire format, registering the schema with a schema registry
+	EncodingAvro = "avro"
+)
+
 // Publisher reads Events and writes them to disk
 type Publisher struct {
 	destination *ConnectionOpts
 	source      <-chan *sse.Event
 	msgCount    int64
 	w           *kafka.Writer
+	serializer  *avro.Serializer
 	currMsgID   string
 }
 
@@ -21,6 +30,10 @@ type Publisher struct {
 type Opts struct {
 	Broker string
 	Topic  string
+	// Encoding is either EncodingJSON or EncodingAvro
+	Encoding string
+	// SchemaRegistry is the URL of the schema registry used with EncodingAvro
+	SchemaRegistry string
 }
 
 // ConnectionOpts wrap the information needed to connect to kafka
@@ -31,3 +44,6 @@ type ConnectionOpts struct {
 
 // ErrNilChan indicates that the FilePublisher has no source channel
 var ErrNilChan error = fmt.Errorf("Source channel is nil")
+
+// ErrNoRegistry indicates that Avro encoding was requested without a schema registry
+var ErrNoRegistry error = fmt.Errorf("Avro encoding requires a schema registry")
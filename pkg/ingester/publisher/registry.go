@@ -0,0 +1,61 @@
+package publisher
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Factory creates a Publisher reading Events from src, configured by the values of the Plugin's options
+type Factory func(cfg plugin.Config, src <-chan *sse.Event) (Publisher, error)
+
+// Plugin describes a publisher backend.
+// Backends register themselves from an init function, so linking a backend's package into the binary is enough to make it available.
+type Plugin struct {
+	// Name identifies the backend and is used to enable it with --<name>.enable
+	Name string
+	// Description is a short human-readable description, e.g. "kafka publisher"
+	Description string
+	// Options are the backend's configuration values, exposed as flags
+	Options []plugin.Option
+	// New creates an instance of the backend
+	New Factory
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*Plugin)
+)
+
+// Register makes a publisher backend available by name. It panics if a backend of the same name is already registered.
+func Register(p *Plugin) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[p.Name]; dup {
+		panic(fmt.Sprintf("publisher %s registered twice", p.Name))
+	}
+	registry[p.Name] = p
+}
+
+// Lookup returns the publisher backend registered under the name given
+func Lookup(name string) (*Plugin, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	p, ok := registry[name]
+	return p, ok
+}
+
+// Plugins returns all registered publisher backends, sorted by name
+func Plugins() []*Plugin {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var plugins []*Plugin
+	for _, p := range registry {
+		plugins = append(plugins, p)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
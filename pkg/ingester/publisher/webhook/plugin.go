@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Options are the configuration values of the webhook publisher
+var Options = []plugin.Option{
+	{Name: "webhook.endpoint", Usage: "the URL(s) to POST event batches to", Default: []string{}},
+	{Name: "webhook.format", Usage: "the batch encoding to use ('ndjson' or 'json')", Default: FormatNDJSON},
+	{Name: "webhook.batchSize", Usage: "the maximum number of events per batch", Default: 100},
+	{Name: "webhook.flushInterval", Usage: "the maximum time to wait before sending an incomplete batch", Default: 5 * time.Second},
+	{Name: "webhook.secret", Usage: "if set, sign request bodies with HMAC-SHA256 using this secret", Default: ""},
+	{Name: "webhook.maxRetries", Usage: "the number of times to retry a failed delivery", Default: 5},
+	{Name: "webhook.retryBackoff", Usage: "the time to wait before the first retry, doubled for every further retry", Default: 500 * time.Millisecond},
+	{Name: "webhook.timeout", Usage: "the maximum time to wait for an endpoint to respond", Default: 10 * time.Second},
+	{Name: "webhook.concurrency", Usage: "the maximum number of concurrent deliveries per endpoint", Default: 2},
+	{Name: "webhook.breakerThreshold", Usage: "the number of consecutive failed deliveries after which an endpoint is suspended", Default: 5},
+	{Name: "webhook.breakerCooldown", Usage: "the time to suspend deliveries to a failing endpoint", Default: 30 * time.Second},
+}
+
+func init() {
+	publisher.Register(&publisher.Plugin{
+		Name:        "webhook",
+		Description: "webhook publisher",
+		Options:     Options,
+		New: func(cfg plugin.Config, src <-chan *sse.Event) (publisher.Publisher, error) {
+			return NewPublisher(OptsFromConfig(cfg), src)
+		},
+	})
+}
+
+// OptsFromConfig returns the Opts described by the values of Options
+func OptsFromConfig(cfg plugin.Config) *Opts {
+	return &Opts{
+		Endpoints:        cfg.StringSlice("webhook.endpoint"),
+		Format:           cfg.String("webhook.format"),
+		BatchSize:        cfg.Int("webhook.batchSize"),
+		FlushInterval:    cfg.Duration("webhook.flushInterval"),
+		Secret:           cfg.String("webhook.secret"),
+		MaxRetries:       cfg.Int("webhook.maxRetries"),
+		RetryBackoff:     cfg.Duration("webhook.retryBackoff"),
+		Timeout:          cfg.Duration("webhook.timeout"),
+		Concurrency:      cfg.Int("webhook.concurrency"),
+		BreakerThreshold: cfg.Int("webhook.breakerThreshold"),
+		BreakerCooldown:  cfg.Duration("webhook.breakerCooldown"),
+	}
+}
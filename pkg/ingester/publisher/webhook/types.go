@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+)
+
+const (
+	// FormatNDJSON sends batches as newline-delimited JSON, one event per line
+	FormatNDJSON = "ndjson"
+	// FormatJSON sends batches as a single JSON array of events
+	FormatJSON = "json"
+)
+
+// Publisher reads Events and POSTs them in batches to one or more HTTP endpoints
+type Publisher struct {
+	opts        *Opts
+	source      <-chan *sse.Event
+	msgCount    int64
+	batch       [][]byte
+	batchLastID string
+	endpoints   []*endpoint
+	client      *http.Client
+	inflight    sync.WaitGroup
+	stop        chan (bool)
+	stopping    sync.Once
+}
+
+// Opts hold configuration for the webhook publisher
+type Opts struct {
+	Endpoints        []string
+	Format           string
+	BatchSize        int
+	FlushInterval    time.Duration
+	Secret           string
+	MaxRetries       int
+	RetryBackoff     time.Duration
+	Concurrency      int
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	Timeout          time.Duration
+}
+
+// endpoint holds the per-destination delivery state
+type endpoint struct {
+	url     string
+	slots   chan struct{}
+	breaker *breaker
+}
+
+// ErrNilChan indicates that the Publisher has no source channel
+var ErrNilChan error = fmt.Errorf("Source channel is nil")
+
+// ErrNoEndpoints indicates that the Publisher has no endpoints to deliver to
+var ErrNoEndpoints error = fmt.Errorf("No webhook endpoints configured")
+
+// ErrCircuitOpen is returned when a delivery is refused because the endpoint's circuit breaker is open
+var ErrCircuitOpen error = fmt.Errorf("circuit breaker is open")
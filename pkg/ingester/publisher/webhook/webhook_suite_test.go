@@ -0,0 +1,15 @@
+package webhook
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/op/go-logging"
+)
+
+func TestWebhookPublisher(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Webhook Publisher Suite")
+}
@@ -0,0 +1,328 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	moduleName = "webhookpublisher"
+
+	// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body if a secret is configured
+	SignatureHeader = "X-Pleiades-Signature"
+	// LastEventIDHeader carries the ID of the last event contained in the batch
+	LastEventIDHeader = "X-Pleiades-Last-Event-ID"
+
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	eventsPublished = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_webhook_publish_events_total",
+			Help: "The total number of events delivered to at least one webhook endpoint",
+		})
+
+	batchesDelivered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_webhook_publish_batches_total",
+			Help: "The total number of batches delivered to webhook endpoints",
+		},
+		[]string{"endpoint"})
+
+	pubErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_webhook_publish_errors_total",
+			Help: "Total numbers of errors encountered while publishing to webhook endpoints",
+		},
+		[]string{"type"})
+
+	deliveryTime = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_webhook_delivery_duration_seconds",
+			Help:    "Time taken to deliver a batch to a webhook endpoint, including retries",
+			Buckets: []float64{0.05, 0.1, 0.5, 1, 5, 30},
+		},
+		[]string{"endpoint"})
+
+	circuitOpen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pleiades_webhook_circuit_open",
+			Help: "Whether the circuit breaker for a webhook endpoint is open (1) or closed (0)",
+		},
+		[]string{"endpoint"})
+)
+
+// NewPublisher returns a Publisher initialized with the source channel and endpoints provided
+func NewPublisher(opts *Opts, src <-chan *sse.Event) (publisher.Publisher, error) {
+	if src == nil {
+		return nil, ErrNilChan
+	}
+	if len(opts.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if opts.Format == "" {
+		opts.Format = FormatNDJSON
+	}
+	if opts.Format != FormatNDJSON && opts.Format != FormatJSON {
+		return nil, fmt.Errorf("unsupported webhook format %s (use %s or %s)", opts.Format, FormatNDJSON, FormatJSON)
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 500 * time.Millisecond
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	p := &Publisher{
+		opts:   opts,
+		source: src,
+		client: &http.Client{Timeout: opts.Timeout},
+		stop:   make(chan (bool)),
+	}
+	for _, u := range opts.Endpoints {
+		p.endpoints = append(p.endpoints, &endpoint{
+			url:     u,
+			slots:   make(chan struct{}, opts.Concurrency),
+			breaker: newBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		})
+		circuitOpen.WithLabelValues(u).Set(0)
+	}
+	return p, nil
+}
+
+// ValidateConnection checks that all configured endpoints are valid HTTP(S) URLs
+func (p *Publisher) ValidateConnection() error {
+	for _, e := range p.endpoints {
+		u, err := url.Parse(e.url)
+		if err != nil {
+			return fmt.Errorf("invalid webhook endpoint %s: %v", e.url, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid webhook endpoint %s: scheme must be http or https", e.url)
+		}
+	}
+	return nil
+}
+
+// ReadAndPublish will read Events from the input channel and deliver them in batches to all configured endpoints.
+// A batch is sent once it reaches the configured size or the flush interval elapses, whichever comes first.
+//
+// Calling ReadAndPublish() will reset the processed message counter of the underlying Publisher and
+// returns the value of the counter when the Publisher's source channel is closed. Deliveries waiting to be retried then
+// give up, so that shutting down does not wait for their backoff.
+func (p *Publisher) ReadAndPublish() (int64, error) {
+	logger.Debug("Webhook publisher starting to process events")
+	p.msgCount = 0
+	ticker := time.NewTicker(p.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-p.source:
+			if !ok {
+				p.flush()
+				p.stopping.Do(func() { close(p.stop) })
+				p.inflight.Wait()
+				logger.Debug("Webhook publisher stopped")
+				return p.msgCount, nil
+			}
+			p.msgCount++
+			if e != nil {
+				err := p.ProcessEvent(e)
+				if err != nil {
+					return p.msgCount, fmt.Errorf("error processing event: %v", err)
+				}
+			}
+		case <-ticker.C:
+			p.flush()
+		}
+	}
+}
+
+// ProcessEvent adds a single event to the current batch and flushes the batch if it is full
+func (p *Publisher) ProcessEvent(e *sse.Event) error {
+	d, err := ioutil.ReadAll(e.GetData())
+	if err != nil {
+		pubErrors.WithLabelValues("event_data_read").Inc()
+		return fmt.Errorf("error reading event data: %v", err)
+	}
+	p.batch = append(p.batch, d)
+	p.batchLastID = e.ID
+	if len(p.batch) >= p.opts.BatchSize {
+		p.flush()
+	}
+	return nil
+}
+
+// GetResumeID always returns an empty string, since webhook endpoints provide no way to query what they have received
+func (p *Publisher) GetResumeID() string {
+	logger.Info("Webhook publisher does not support resuming")
+	return ""
+}
+
+// flush encodes the current batch and hands it off for delivery to every endpoint.
+// It blocks while an endpoint has no free delivery slots, applying backpressure to the event source.
+func (p *Publisher) flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+	body := encodeBatch(p.opts.Format, p.batch)
+	lastID, count := p.batchLastID, len(p.batch)
+	p.batch = nil
+
+	// events are counted once, by the first endpoint the batch is delivered to
+	var counted sync.Once
+
+	for _, ep := range p.endpoints {
+		if !ep.breaker.Allow() {
+			pubErrors.WithLabelValues("circuit_open").Inc()
+			logger.Warningf("Dropping batch for %s: %v", ep.url, ErrCircuitOpen)
+			continue
+		}
+		ep.slots <- struct{}{}
+		p.inflight.Add(1)
+		go func(ep *endpoint) {
+			defer p.inflight.Done()
+			defer func() { <-ep.slots }()
+			if p.deliver(ep, body, lastID) {
+				counted.Do(func() { eventsPublished.Add(float64(count)) })
+			}
+		}(ep)
+	}
+}
+
+// deliver sends a batch to a single endpoint, retrying with exponential backoff on retryable failures
+// until the publisher stops, and reports whether the batch was delivered
+func (p *Publisher) deliver(ep *endpoint, body []byte, lastID string) bool {
+	timer := prometheus.NewTimer(deliveryTime.WithLabelValues(ep.url))
+	defer timer.ObserveDuration()
+
+	var err error
+	backoff := p.opts.RetryBackoff
+	for attempt := 0; attempt <= p.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			pubErrors.WithLabelValues("retry").Inc()
+			select {
+			case <-p.stop:
+				pubErrors.WithLabelValues("delivery").Inc()
+				logger.Errorf("Giving up delivering batch to %s on shutdown: %v", ep.url, err)
+				return false
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		var retryable bool
+		retryable, err = p.post(ep.url, body, lastID)
+		if err == nil {
+			ep.breaker.Success()
+			circuitOpen.WithLabelValues(ep.url).Set(0)
+			batchesDelivered.WithLabelValues(ep.url).Inc()
+			return true
+		}
+		logger.Debugf("Delivery attempt %d to %s failed: %v", attempt+1, ep.url, err)
+		if !retryable {
+			break
+		}
+	}
+	ep.breaker.Failure()
+	if ep.breaker.IsOpen() {
+		circuitOpen.WithLabelValues(ep.url).Set(1)
+	}
+	pubErrors.WithLabelValues("delivery").Inc()
+	logger.Errorf("Failed to deliver batch to %s: %v", ep.url, err)
+	return false
+}
+
+// post performs a single delivery attempt and reports whether a failure may be retried
+func (p *Publisher) post(u string, body []byte, lastID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if p.opts.Format == FormatJSON {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	req.Header.Set("User-Agent", "pleiades")
+	req.Header.Set(LastEventIDHeader, lastID)
+	if p.opts.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign([]byte(p.opts.Secret), body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("error performing request: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of body using the given secret
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func encodeBatch(format string, events [][]byte) []byte {
+	var b bytes.Buffer
+	if format == FormatJSON {
+		b.WriteByte('[')
+		for i, e := range events {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.Write(e)
+		}
+		b.WriteByte(']')
+		return b.Bytes()
+	}
+	for _, e := range events {
+		b.Write(e)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type received struct {
+	body      string
+	signature string
+	lastID    string
+	ctype     string
+}
+
+var _ = Describe("Webhook Publisher", func() {
+
+	var (
+		server   *httptest.Server
+		mu       sync.Mutex
+		requests []received
+		failures int
+		status   int
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		failures = 0
+		status = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, received{
+				body:      string(b),
+				signature: r.Header.Get(SignatureHeader),
+				lastID:    r.Header.Get(LastEventIDHeader),
+				ctype:     r.Header.Get("Content-Type"),
+			})
+			w.WriteHeader(status)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// start publishes n events and returns the source channel and a channel closed once the publisher has stopped
+	start := func(opts *Opts, n int) (chan *sse.Event, chan bool) {
+		ch := make(chan *sse.Event)
+		p, err := NewPublisher(opts, ch)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.ValidateConnection()).To(Succeed())
+		done := make(chan bool)
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			count, err := p.ReadAndPublish()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).Should(Equal(int64(n)))
+		}()
+		for i := 0; i < n; i++ {
+			ch <- sse.NewEvent("test", "id-"+string(rune('a'+i)), []byte(`{"n":`+string(rune('0'+i))+`}`))
+		}
+		return ch, done
+	}
+
+	publish := func(opts *Opts, n int) {
+		ch, done := start(opts, n)
+		close(ch)
+		Eventually(done, 5*time.Second).Should(BeClosed())
+	}
+
+	delivered := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests)
+	}
+
+	It("rejects a configuration without endpoints", func() {
+		_, err := NewPublisher(&Opts{}, make(chan *sse.Event))
+		Expect(err).To(Equal(ErrNoEndpoints))
+	})
+
+	It("batches events as NDJSON", func() {
+		publish(&Opts{Endpoints: []string{server.URL}, BatchSize: 2, FlushInterval: time.Minute}, 3)
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).Should(HaveLen(2))
+		Expect(requests[0].body + requests[1].body).Should(Equal("{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n"))
+		Expect(requests[0].ctype).Should(Equal("application/x-ndjson"))
+		Expect(requests[0].signature).Should(BeEmpty())
+	})
+
+	It("batches events as a JSON array and signs them", func() {
+		publish(&Opts{Endpoints: []string{server.URL}, Format: FormatJSON, BatchSize: 10, Secret: "s3cr3t"}, 3)
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).Should(HaveLen(1))
+		Expect(requests[0].body).Should(Equal(`[{"n":0},{"n":1},{"n":2}]`))
+		Expect(requests[0].lastID).Should(Equal("id-c"))
+		Expect(requests[0].signature).Should(Equal("sha256=" + Sign([]byte("s3cr3t"), []byte(requests[0].body))))
+	})
+
+	It("counts events delivered to several endpoints once", func() {
+		before := testutil.ToFloat64(eventsPublished)
+		publish(&Opts{Endpoints: []string{server.URL, server.URL + "/second"}, BatchSize: 2, FlushInterval: time.Minute}, 3)
+		Expect(delivered()).Should(Equal(4))
+		Expect(testutil.ToFloat64(eventsPublished) - before).Should(Equal(3.0))
+	})
+
+	It("retries failed deliveries", func() {
+		failures = 2
+		ch, done := start(&Opts{Endpoints: []string{server.URL}, BatchSize: 1, MaxRetries: 3, RetryBackoff: time.Millisecond}, 1)
+		Eventually(delivered, 5*time.Second).Should(Equal(1))
+		close(ch)
+		Eventually(done, 5*time.Second).Should(BeClosed())
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).Should(HaveLen(1))
+		Expect(failures).Should(Equal(0))
+	})
+
+	It("stops retrying once the source is closed", func() {
+		failures = 2
+		ch, done := start(&Opts{Endpoints: []string{server.URL}, BatchSize: 1, MaxRetries: 3, RetryBackoff: time.Minute}, 1)
+		Eventually(func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return failures
+		}, 5*time.Second).Should(Equal(1))
+		close(ch)
+		Eventually(done, 5*time.Second).Should(BeClosed())
+		Expect(delivered()).Should(Equal(0))
+	})
+
+	It("does not retry client errors", func() {
+		status = http.StatusBadRequest
+		publish(&Opts{Endpoints: []string{server.URL}, BatchSize: 1, MaxRetries: 3, RetryBackoff: time.Millisecond}, 2)
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).Should(HaveLen(2))
+	})
+})
+
+var _ = Describe("Circuit Breaker", func() {
+
+	It("opens after consecutive failures and recovers after cooldown", func() {
+		now := time.Now()
+		b := newBreaker(2, time.Minute)
+		b.now = func() time.Time { return now }
+
+		Expect(b.Allow()).To(BeTrue())
+		b.Failure()
+		Expect(b.Allow()).To(BeTrue())
+		b.Failure()
+		Expect(b.IsOpen()).To(BeTrue())
+		Expect(b.Allow()).To(BeFalse())
+
+		now = now.Add(2 * time.Minute)
+		Expect(b.Allow()).To(BeTrue(), "a trial call should be allowed after cooldown")
+		Expect(b.Allow()).To(BeFalse(), "only a single trial call should be allowed while half-open")
+		b.Success()
+		Expect(b.IsOpen()).To(BeFalse())
+		Expect(b.Allow()).To(BeTrue())
+	})
+
+	It("re-opens when the trial call fails", func() {
+		now := time.Now()
+		b := newBreaker(1, time.Minute)
+		b.now = func() time.Time { return now }
+		b.Failure()
+		now = now.Add(2 * time.Minute)
+		Expect(b.Allow()).To(BeTrue())
+		b.Failure()
+		Expect(b.Allow()).To(BeFalse())
+	})
+})
+
+var _ = Describe("Batch Encoding", func() {
+	It("produces valid NDJSON and JSON", func() {
+		events := [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}
+		Expect(string(encodeBatch(FormatNDJSON, events))).Should(Equal("{\"a\":1}\n{\"b\":2}\n"))
+		Expect(string(encodeBatch(FormatJSON, events))).Should(Equal(`[{"a":1},{"b":2}]`))
+		Expect(strings.Count(string(encodeBatch(FormatJSON, nil)), "[")).Should(Equal(1))
+	})
+})
@@ -20,3 +20,8 @@ type Event struct {
 func (e *Event) GetData() io.Reader {
 	return e.data
 }
+
+// NewEvent creates an Event with the given ID and data, e.g. for replaying stored events
+func NewEvent(uri string, id string, data []byte) *Event {
+	return &Event{URI: uri, Type: "message", ID: id, data: bytes.NewBuffer(data)}
+}
@@ -1,9 +1,9 @@
 package ingester
 
 import (
-	"github.com/gargath/pleiades/pkg/ingester/publisher/file"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+	"github.com/gargath/pleiades/pkg/transform"
 	"github.com/gargath/pleiades/pkg/util"
 )
 
@@ -11,9 +11,13 @@ import (
 type Coordinator struct {
 	LastMsgID string
 	Resume    bool
-	File      *file.Opts
-	Kafka     *kafka.Opts
-	stop      chan (bool)
-	events    chan *sse.Event
-	spinner   *util.Spinner
+	// Publisher is the name the publisher to use is registered under, and PublisherConfig its configuration
+	Publisher       string
+	PublisherConfig plugin.Config
+	// Transforms are applied to every event before it is handed to the publisher
+	Transforms transform.Chain
+	stop       chan (bool)
+	events     chan *sse.Event
+	published  chan *sse.Event
+	spinner    *util.Spinner
 }
@@ -0,0 +1,114 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+)
+
+// columnOverrides replace the type-derived column type for fields declared as interface{}
+var columnOverrides = map[string]Type{
+	"log_id":       Int64,
+	"revision.new": Int64,
+	"revision.old": Int64,
+}
+
+// EventColumns returns the columns of the event schema, derived from the fields of aggregator.MediawikiRecentchange.
+// Nested objects such as meta, length and revision are flattened into one column per field, e.g. length_new.
+// Fields of undeclared type such as log_params are stored as JSON text.
+func EventColumns() []Column {
+	return columnsFor(reflect.TypeOf(aggregator.MediawikiRecentchange{}), nil)
+}
+
+func columnsFor(t reflect.Type, path []string) []Column {
+	var cols []Column
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || strings.HasPrefix(name, "$") {
+			continue
+		}
+		p := append(append([]string{}, path...), name)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if typ, ok := columnOverrides[strings.Join(p, ".")]; ok {
+			cols = append(cols, Column{Name: strings.Join(p, "_"), Path: p, Type: typ})
+			continue
+		}
+		switch ft.Kind() {
+		case reflect.Struct:
+			cols = append(cols, columnsFor(ft, p)...)
+		case reflect.Bool:
+			cols = append(cols, Column{Name: strings.Join(p, "_"), Path: p, Type: Boolean})
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			cols = append(cols, Column{Name: strings.Join(p, "_"), Path: p, Type: Int64})
+		case reflect.Map:
+			continue
+		default:
+			cols = append(cols, Column{Name: strings.Join(p, "_"), Path: p, Type: ByteArray})
+		}
+	}
+	return cols
+}
+
+// EventRow extracts the values of the given columns from a JSON event.
+// Missing fields and values that cannot be represented in the column's type are returned as nil.
+func EventRow(columns []Column, data []byte) ([]interface{}, error) {
+	var event map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode event: %v", err)
+	}
+	row := make([]interface{}, len(columns))
+	for i, col := range columns {
+		row[i] = convert(lookup(event, col.Path), col.Type)
+	}
+	return row, nil
+}
+
+func lookup(event map[string]interface{}, path []string) interface{} {
+	var v interface{} = event
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+func convert(v interface{}, t Type) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch t {
+	case Boolean:
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	case Int64:
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				return i
+			}
+		}
+	case ByteArray:
+		if s, ok := v.(string); ok {
+			return s
+		}
+		b, err := json.Marshal(v)
+		if err == nil {
+			return b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package parquet
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const tmpSuffix = ".tmp"
+
+// NewFileWriter returns a FileWriter writing event files to the directory given, creating it if needed
+func NewFileWriter(opts *FileWriterOpts) (*FileWriter, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("no output directory given")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "events"
+	}
+	if opts.Compression != "" && opts.Compression != CodecNone && opts.Compression != CodecGzip {
+		return nil, fmt.Errorf("unsupported compression %s (use %s or %s)", opts.Compression, CodecNone, CodecGzip)
+	}
+	err := os.MkdirAll(opts.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	return &FileWriter{
+		opts:    opts,
+		columns: EventColumns(),
+		now:     time.Now,
+	}, nil
+}
+
+// Write adds a JSON event to the current file, starting a new file first if the current one is due to be rolled
+func (f *FileWriter) Write(data []byte) error {
+	row, err := EventRow(f.columns, data)
+	if err != nil {
+		return err
+	}
+	err = f.RollIfDue()
+	if err != nil {
+		return err
+	}
+	if f.writer == nil {
+		err = f.open()
+		if err != nil {
+			return err
+		}
+	}
+	return f.writer.WriteRow(row)
+}
+
+// RollIfDue completes the current file if it has reached MaxRows or MaxAge
+func (f *FileWriter) RollIfDue() error {
+	if f.writer == nil {
+		return nil
+	}
+	if (f.opts.MaxRows > 0 && f.writer.Rows() >= f.opts.MaxRows) ||
+		(f.opts.MaxAge > 0 && f.now().Sub(f.opened) >= f.opts.MaxAge) {
+		return f.Close()
+	}
+	return nil
+}
+
+// Close completes the current file, if any. Later writes will start a new file.
+func (f *FileWriter) Close() error {
+	if f.writer == nil {
+		return nil
+	}
+	w := f.writer
+	f.writer = nil
+	err := w.Close()
+	if err == nil {
+		err = f.buf.Flush()
+	}
+	cerr := f.current.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete %s: %v", f.name, err)
+	}
+	return os.Rename(f.name+tmpSuffix, f.name)
+}
+
+func (f *FileWriter) open() error {
+	f.opened = f.now()
+	f.seq++
+	f.name = filepath.Join(f.opts.Dir, fmt.Sprintf("%s-%s-%04d.parquet", f.opts.Prefix, strings.Replace(f.opened.UTC().Format("20060102T150405.000Z"), ".", "", 1), f.seq))
+	file, err := os.Create(f.name + tmpSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	f.buf = bufio.NewWriter(file)
+	w, err := NewWriter(f.buf, f.columns, &WriterOpts{RowGroupSize: f.opts.RowGroupSize, Compression: f.opts.Compression})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.current = file
+	f.writer = w
+	return nil
+}
@@ -0,0 +1,179 @@
+package parquet
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testEvent = `{"$schema":"/mediawiki/recentchange/1.0.0","meta":{"uri":"https://he.wikipedia.org/wiki/X","request_id":"e386ef4b","id":"9bea80f8","dt":"2020-07-31T14:58:47Z","domain":"he.wikipedia.org","stream":"mediawiki.recentchange"},"id":53404707,"type":"edit","namespace":10,"title":"Slovakia","comment":"bot","timestamp":1596207527,"user":"DMbotY","bot":true,"minor":false,"patrolled":true,"length":{"old":4905,"new":4910},"revision":{"old":28682248,"new":28826355},"server_url":"https://he.wikipedia.org","server_name":"he.wikipedia.org","server_script_path":"/w","wiki":"hewiki","parsedcomment":"bot"}`
+
+const testLogEvent = `{"meta":{"dt":"2020-07-31T14:58:48Z","id":"0c5a1e2b"},"type":"log","title":"User:Example","timestamp":1596207528,"user":"Admin","log_id":1234,"log_type":"block","log_action":"block","log_params":{"duration":"1 week","flags":["nocreate"]},"wiki":"enwiki"}`
+
+func columnIndex(cols []Column, name string) int {
+	for i, c := range cols {
+		if c.Name == name {
+			return i
+		}
+	}
+	Fail("no column " + name)
+	return -1
+}
+
+var _ = Describe("Parquet Writer", func() {
+
+	It("derives a flat schema from the event type", func() {
+		cols := EventColumns()
+		types := make(map[string]Type)
+		for _, c := range cols {
+			types[c.Name] = c.Type
+		}
+		Expect(types).Should(HaveKeyWithValue("meta_dt", ByteArray))
+		Expect(types).Should(HaveKeyWithValue("meta_id", ByteArray))
+		Expect(types).Should(HaveKeyWithValue("length_new", Int64))
+		Expect(types).Should(HaveKeyWithValue("length_old", Int64))
+		Expect(types).Should(HaveKeyWithValue("revision_new", Int64))
+		Expect(types).Should(HaveKeyWithValue("revision_old", Int64))
+		Expect(types).Should(HaveKeyWithValue("log_id", Int64))
+		Expect(types).Should(HaveKeyWithValue("log_params", ByteArray))
+		Expect(types).Should(HaveKeyWithValue("bot", Boolean))
+		Expect(types).Should(HaveKeyWithValue("namespace", Int64))
+		Expect(types).ShouldNot(HaveKey("$schema"))
+		Expect(cols[columnIndex(cols, "length_new")].Path).Should(Equal([]string{"length", "new"}))
+	})
+
+	It("writes events that can be read back", func() {
+		cols := EventColumns()
+		var b bytes.Buffer
+		w, err := NewWriter(&b, cols, &WriterOpts{RowGroupSize: 2})
+		Expect(err).NotTo(HaveOccurred())
+		for _, e := range []string{testEvent, testLogEvent, testEvent} {
+			row, err := EventRow(cols, []byte(e))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.WriteRow(row)).To(Succeed())
+		}
+		Expect(w.Rows()).Should(Equal(int64(3)))
+		Expect(w.Close()).To(Succeed())
+
+		meta, rows := readFile(b.Bytes())
+		Expect(meta[3]).Should(Equal(int64(3)))
+		Expect(meta[4]).Should(HaveLen(2))
+		Expect(meta[2]).Should(HaveLen(len(cols) + 1))
+		Expect(rows).Should(HaveLen(3))
+
+		Expect(rows[0][columnIndex(cols, "title")]).Should(Equal("Slovakia"))
+		Expect(rows[0][columnIndex(cols, "meta_dt")]).Should(Equal("2020-07-31T14:58:47Z"))
+		Expect(rows[0][columnIndex(cols, "length_new")]).Should(Equal(int64(4910)))
+		Expect(rows[0][columnIndex(cols, "revision_old")]).Should(Equal(int64(28682248)))
+		Expect(rows[0][columnIndex(cols, "bot")]).Should(Equal(true))
+		Expect(rows[0][columnIndex(cols, "minor")]).Should(Equal(false))
+		Expect(rows[0][columnIndex(cols, "log_id")]).Should(BeNil())
+
+		Expect(rows[1][columnIndex(cols, "length_new")]).Should(BeNil())
+		Expect(rows[1][columnIndex(cols, "bot")]).Should(BeNil())
+		Expect(rows[1][columnIndex(cols, "log_id")]).Should(Equal(int64(1234)))
+		Expect(rows[1][columnIndex(cols, "log_type")]).Should(Equal("block"))
+		Expect(rows[1][columnIndex(cols, "log_params")]).Should(MatchJSON(`{"duration":"1 week","flags":["nocreate"]}`))
+		Expect(rows[2][columnIndex(cols, "server_name")]).Should(Equal("he.wikipedia.org"))
+	})
+
+	It("writes uncompressed files", func() {
+		cols := []Column{{Name: "a", Path: []string{"a"}, Type: Int64}, {Name: "b", Path: []string{"b"}, Type: Boolean}}
+		var b bytes.Buffer
+		w, err := NewWriter(&b, cols, &WriterOpts{Compression: CodecNone})
+		Expect(err).NotTo(HaveOccurred())
+		for i := int64(0); i < 20; i++ {
+			Expect(w.WriteRow([]interface{}{i, i%3 == 0})).To(Succeed())
+		}
+		Expect(w.Close()).To(Succeed())
+		_, rows := readFile(b.Bytes())
+		Expect(rows).Should(HaveLen(20))
+		Expect(rows[9]).Should(Equal([]interface{}{int64(9), true}))
+		Expect(rows[10]).Should(Equal([]interface{}{int64(10), false}))
+	})
+
+	It("rejects values of the wrong type without writing a partial row", func() {
+		cols := []Column{{Name: "a", Type: Int64}, {Name: "b", Type: ByteArray}}
+		var b bytes.Buffer
+		w, err := NewWriter(&b, cols, &WriterOpts{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.WriteRow([]interface{}{int64(1), 2})).ShouldNot(Succeed())
+		Expect(w.WriteRow([]interface{}{int64(1)})).ShouldNot(Succeed())
+		Expect(w.Rows()).Should(BeZero())
+		Expect(w.WriteRow([]interface{}{nil, "x"})).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+		_, rows := readFile(b.Bytes())
+		Expect(rows).Should(Equal([][]interface{}{{nil, "x"}}))
+		Expect(w.WriteRow([]interface{}{nil, nil})).Should(Equal(ErrClosed))
+	})
+})
+
+var _ = Describe("Parquet FileWriter", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pleiades-parquet")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	listFiles := func(pattern string) []string {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	It("rolls files by row count", func() {
+		f, err := NewFileWriter(&FileWriterOpts{Dir: dir, MaxRows: 2})
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 5; i++ {
+			Expect(f.Write([]byte(testEvent))).To(Succeed())
+		}
+		Expect(listFiles("*.parquet")).Should(HaveLen(2))
+		Expect(listFiles("*.tmp")).Should(HaveLen(1))
+		Expect(f.Close()).To(Succeed())
+		files := listFiles("*.parquet")
+		Expect(files).Should(HaveLen(3))
+		Expect(listFiles("*.tmp")).Should(BeEmpty())
+
+		d, err := ioutil.ReadFile(files[2])
+		Expect(err).NotTo(HaveOccurred())
+		_, rows := readFile(d)
+		Expect(rows).Should(HaveLen(1))
+	})
+
+	It("rolls files by age", func() {
+		now := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+		f, err := NewFileWriter(&FileWriterOpts{Dir: dir, Prefix: "test", MaxAge: time.Minute})
+		Expect(err).NotTo(HaveOccurred())
+		f.now = func() time.Time { return now }
+		Expect(f.Write([]byte(testEvent))).To(Succeed())
+		now = now.Add(30 * time.Second)
+		Expect(f.RollIfDue()).To(Succeed())
+		Expect(listFiles("*.parquet")).Should(BeEmpty())
+		now = now.Add(30 * time.Second)
+		Expect(f.RollIfDue()).To(Succeed())
+		Expect(listFiles("*.parquet")).Should(Equal([]string{filepath.Join(dir, "test-20200801T120000000Z-0001.parquet")}))
+		Expect(f.Write([]byte(testLogEvent))).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+		Expect(listFiles("*.parquet")).Should(HaveLen(2))
+	})
+
+	It("rejects events that are not JSON", func() {
+		f, err := NewFileWriter(&FileWriterOpts{Dir: dir})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Write([]byte("not json"))).ShouldNot(Succeed())
+		Expect(f.Close()).To(Succeed())
+		Expect(listFiles("*")).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,156 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// A minimal Parquet reader used to verify the files written in tests.
+// It only understands the subset of the format produced by Writer.
+
+type tstruct map[int16]interface{}
+
+func readStruct(r *bytes.Reader) tstruct {
+	s := make(tstruct)
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		Expect(err).NotTo(HaveOccurred())
+		if b == 0 {
+			return s
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			id = int16(readZigzag(r))
+		}
+		last = id
+		s[id] = readValue(r, b&0x0f)
+	}
+}
+
+func readValue(r *bytes.Reader, typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3, 4, thriftI32, thriftI64:
+		return readZigzag(r)
+	case thriftBinary:
+		n, err := binary.ReadUvarint(r)
+		Expect(err).NotTo(HaveOccurred())
+		b := make([]byte, n)
+		r.Read(b)
+		return string(b)
+	case thriftList:
+		h, _ := r.ReadByte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n, _ = binary.ReadUvarint(r)
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = readValue(r, h&0x0f)
+		}
+		return l
+	case thriftStruct:
+		return readStruct(r)
+	}
+	Fail("unexpected thrift type")
+	return nil
+}
+
+func readZigzag(r *bytes.Reader) int64 {
+	v, err := binary.ReadUvarint(r)
+	Expect(err).NotTo(HaveOccurred())
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// readFile returns the footer metadata and all rows of a Parquet file
+func readFile(file []byte) (tstruct, [][]interface{}) {
+	Expect(string(file[:4])).Should(Equal(magic))
+	Expect(string(file[len(file)-4:])).Should(Equal(magic))
+	n := binary.LittleEndian.Uint32(file[len(file)-8:])
+	meta := readStruct(bytes.NewReader(file[len(file)-8-int(n) : len(file)-8]))
+
+	var rows [][]interface{}
+	for _, g := range meta[4].([]interface{}) {
+		rg := g.(tstruct)
+		groupRows := make([][]interface{}, rg[3].(int64))
+		for c, cc := range rg[1].([]interface{}) {
+			cm := cc.(tstruct)[3].(tstruct)
+			values := readColumn(file, cm)
+			Expect(values).Should(HaveLen(len(groupRows)))
+			for i, v := range values {
+				if c == 0 {
+					groupRows[i] = []interface{}{}
+				}
+				groupRows[i] = append(groupRows[i], v)
+			}
+		}
+		rows = append(rows, groupRows...)
+	}
+	return meta, rows
+}
+
+func readColumn(file []byte, cm tstruct) []interface{} {
+	r := bytes.NewReader(file[cm[9].(int64):])
+	header := readStruct(r)
+	body := make([]byte, header[3].(int64))
+	r.Read(body)
+	if cm[4].(int64) == compressionGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		body, err = ioutil.ReadAll(zr)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(int64(len(body))).Should(Equal(header[2].(int64)))
+	numValues := int(header[5].(tstruct)[1].(int64))
+
+	br := bytes.NewReader(body)
+	var levelsLen uint32
+	binary.Read(br, binary.LittleEndian, &levelsLen)
+	lr := bytes.NewReader(body[4 : 4+levelsLen])
+	var levels []byte
+	for lr.Len() > 0 {
+		h, _ := binary.ReadUvarint(lr)
+		Expect(h & 1).Should(BeZero())
+		v, _ := lr.ReadByte()
+		for i := uint64(0); i < h>>1; i++ {
+			levels = append(levels, v)
+		}
+	}
+	Expect(levels).Should(HaveLen(numValues))
+
+	vr := bytes.NewReader(body[4+levelsLen:])
+	var values []interface{}
+	var bit int
+	for _, l := range levels {
+		if l == 0 {
+			values = append(values, nil)
+			continue
+		}
+		switch Type(cm[1].(int64)) {
+		case Boolean:
+			b := body[4+int(levelsLen)+bit/8]
+			values = append(values, b&(1<<uint(bit%8)) != 0)
+			bit++
+		case Int64:
+			var i int64
+			binary.Read(vr, binary.LittleEndian, &i)
+			values = append(values, i)
+		case ByteArray:
+			var n uint32
+			binary.Read(vr, binary.LittleEndian, &n)
+			b := make([]byte, n)
+			vr.Read(b)
+			values = append(values, string(b))
+		}
+	}
+	return values
+}
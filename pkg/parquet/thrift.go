@@ -0,0 +1,98 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Type IDs of the thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// compactWriter encodes thrift structs using the compact protocol, which is what Parquet uses for all of its metadata.
+// Fields must be written in ascending order of their IDs within each struct.
+type compactWriter struct {
+	buf    bytes.Buffer
+	lastID int16
+	stack  []int16
+}
+
+func (c *compactWriter) fieldHeader(id int16, typ byte) {
+	delta := id - c.lastID
+	if delta > 0 && delta <= 15 {
+		c.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		c.buf.WriteByte(typ)
+		c.varint(uint64(zigzag(int64(id))))
+	}
+	c.lastID = id
+}
+
+func (c *compactWriter) i32(id int16, v int32) {
+	c.fieldHeader(id, thriftI32)
+	c.varint(zigzag(int64(v)))
+}
+
+func (c *compactWriter) i64(id int16, v int64) {
+	c.fieldHeader(id, thriftI64)
+	c.varint(zigzag(v))
+}
+
+func (c *compactWriter) string(id int16, s string) {
+	c.fieldHeader(id, thriftBinary)
+	c.rawString(s)
+}
+
+// structField starts a nested struct field; it must be closed with end()
+func (c *compactWriter) structField(id int16) {
+	c.fieldHeader(id, thriftStruct)
+	c.begin()
+}
+
+// list writes the header of a list field, which must be followed by exactly n elements of the given type
+func (c *compactWriter) list(id int16, elemType byte, n int) {
+	c.fieldHeader(id, thriftList)
+	if n < 15 {
+		c.buf.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		c.buf.WriteByte(0xf0 | elemType)
+		c.varint(uint64(n))
+	}
+}
+
+// begin starts a struct, either a list element or a nested field
+func (c *compactWriter) begin() {
+	c.stack = append(c.stack, c.lastID)
+	c.lastID = 0
+}
+
+// end writes the stop field of the current struct
+func (c *compactWriter) end() {
+	c.buf.WriteByte(0)
+	c.lastID = c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+}
+
+func (c *compactWriter) listI32(v int32) {
+	c.varint(zigzag(int64(v)))
+}
+
+func (c *compactWriter) rawString(s string) {
+	c.varint(uint64(len(s)))
+	c.buf.WriteString(s)
+}
+
+func (c *compactWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	c.buf.Write(b[:n])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
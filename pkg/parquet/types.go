@@ -0,0 +1,112 @@
+package parquet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Type is the physical type of a column
+type Type int32
+
+// Physical types as defined by the Parquet format. Only the types needed for event data are supported.
+const (
+	Boolean   Type = 0
+	Int64     Type = 2
+	ByteArray Type = 6
+)
+
+const (
+	// CodecNone writes uncompressed pages
+	CodecNone = "none"
+	// CodecGzip compresses pages with gzip
+	CodecGzip = "gzip"
+)
+
+// Column describes a single optional, flat column.
+// Path is the location of the column's value within a JSON event, Name is the column name in the file.
+type Column struct {
+	Name string
+	Path []string
+	Type Type
+}
+
+// Writer writes rows to a single Parquet file
+// Rows are buffered in memory and written as a row group once RowGroupSize rows have been collected or the Writer is closed.
+type Writer struct {
+	w         *countingWriter
+	columns   []Column
+	opts      *WriterOpts
+	buffers   []*columnBuffer
+	rows      int
+	totalRows int64
+	rowGroups []rowGroup
+	closed    bool
+}
+
+// WriterOpts hold configuration for a Writer
+type WriterOpts struct {
+	RowGroupSize int
+	Compression  string
+}
+
+// FileWriter writes JSON events to a sequence of Parquet files in a directory,
+// starting a new file once MaxRows events have been written or the current file is older than MaxAge.
+// Files are written under a temporary name and only renamed to *.parquet once they are complete.
+type FileWriter struct {
+	opts    *FileWriterOpts
+	columns []Column
+	seq     int
+	current *os.File
+	buf     *bufio.Writer
+	writer  *Writer
+	name    string
+	opened  time.Time
+	now     func() time.Time
+}
+
+// FileWriterOpts hold configuration for a FileWriter
+type FileWriterOpts struct {
+	Dir          string
+	Prefix       string
+	MaxRows      int64
+	MaxAge       time.Duration
+	RowGroupSize int
+	Compression  string
+}
+
+type columnBuffer struct {
+	levels []byte
+	values bytes.Buffer
+	bools  []bool
+}
+
+type rowGroup struct {
+	rows    int64
+	size    int64
+	columns []columnChunk
+}
+
+type columnChunk struct {
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ErrClosed is returned when writing to a Writer that has already been closed
+var ErrClosed = fmt.Errorf("parquet writer is closed")
@@ -0,0 +1,300 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	magic = "PAR1"
+
+	// Enum values from the Parquet format definition
+	repetitionOptional  = 1
+	convertedTypeUTF8   = 0
+	encodingPlain       = 0
+	encodingRLE         = 3
+	pageTypeData        = 0
+	compressionNone     = 0
+	compressionGzip     = 2
+	defaultRowGroupSize = 10000
+)
+
+// NewWriter returns a Writer that writes a Parquet file with the given columns to w.
+// The file header is written immediately; the file is only complete once Close has been called.
+func NewWriter(w io.Writer, columns []Column, opts *WriterOpts) (*Writer, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns given")
+	}
+	if opts.RowGroupSize < 1 {
+		opts.RowGroupSize = defaultRowGroupSize
+	}
+	if opts.Compression == "" {
+		opts.Compression = CodecGzip
+	}
+	if opts.Compression != CodecNone && opts.Compression != CodecGzip {
+		return nil, fmt.Errorf("unsupported compression %s (use %s or %s)", opts.Compression, CodecNone, CodecGzip)
+	}
+	pw := &Writer{
+		w:       &countingWriter{w: w},
+		columns: columns,
+		opts:    opts,
+	}
+	pw.resetBuffers()
+	_, err := pw.w.Write([]byte(magic))
+	if err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WriteRow adds a row to the current row group. values must hold one entry per column, in column order.
+// A nil value is written as null, all other values must match the column type: bool, int64 or string/[]byte.
+func (w *Writer) WriteRow(values []interface{}) error {
+	if w.closed {
+		return ErrClosed
+	}
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("row has %d values, expected %d", len(values), len(w.columns))
+	}
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		var ok bool
+		switch w.columns[i].Type {
+		case Boolean:
+			_, ok = v.(bool)
+		case Int64:
+			_, ok = v.(int64)
+		case ByteArray:
+			switch v.(type) {
+			case string, []byte:
+				ok = true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("value %v of type %T is not valid for column %s", v, v, w.columns[i].Name)
+		}
+	}
+
+	for i, v := range values {
+		b := w.buffers[i]
+		if v == nil {
+			b.levels = append(b.levels, 0)
+			continue
+		}
+		b.levels = append(b.levels, 1)
+		switch val := v.(type) {
+		case bool:
+			b.bools = append(b.bools, val)
+		case int64:
+			binary.Write(&b.values, binary.LittleEndian, val)
+		case string:
+			binary.Write(&b.values, binary.LittleEndian, uint32(len(val)))
+			b.values.WriteString(val)
+		case []byte:
+			binary.Write(&b.values, binary.LittleEndian, uint32(len(val)))
+			b.values.Write(val)
+		}
+	}
+	w.rows++
+	if w.rows >= w.opts.RowGroupSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Rows returns the number of rows written so far, including buffered rows
+func (w *Writer) Rows() int64 {
+	return w.totalRows + int64(w.rows)
+}
+
+// Flush writes all buffered rows as a row group
+func (w *Writer) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	rg := rowGroup{rows: int64(w.rows)}
+	for i, col := range w.columns {
+		chunk, err := w.writeColumn(col, w.buffers[i])
+		if err != nil {
+			return fmt.Errorf("failed to write column %s: %v", col.Name, err)
+		}
+		rg.columns = append(rg.columns, chunk)
+		rg.size += chunk.uncompressedSize
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+	w.totalRows += int64(w.rows)
+	w.rows = 0
+	w.resetBuffers()
+	return nil
+}
+
+// Close flushes buffered rows and writes the file footer. It does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	w.closed = true
+	footer := w.footer()
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(footer)))
+	for _, b := range [][]byte{footer, trailer[:], []byte(magic)} {
+		_, err = w.w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) resetBuffers() {
+	w.buffers = make([]*columnBuffer, len(w.columns))
+	for i := range w.buffers {
+		w.buffers[i] = &columnBuffer{}
+	}
+}
+
+// writeColumn writes the buffered values of a column as a single data page
+func (w *Writer) writeColumn(col Column, b *columnBuffer) (columnChunk, error) {
+	var page bytes.Buffer
+	levels := encodeLevels(b.levels)
+	binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+	page.Write(levels)
+	if col.Type == Boolean {
+		page.Write(packBools(b.bools))
+	} else {
+		page.Write(b.values.Bytes())
+	}
+
+	body := page.Bytes()
+	if w.opts.Compression == CodecGzip {
+		var z bytes.Buffer
+		zw := gzip.NewWriter(&z)
+		_, err := zw.Write(body)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return columnChunk{}, err
+		}
+		body = z.Bytes()
+	}
+
+	h := &compactWriter{}
+	h.i32(1, pageTypeData)
+	h.i32(2, int32(page.Len()))
+	h.i32(3, int32(len(body)))
+	h.structField(5)
+	h.i32(1, int32(len(b.levels)))
+	h.i32(2, encodingPlain)
+	h.i32(3, encodingRLE)
+	h.i32(4, encodingRLE)
+	h.end()
+	h.buf.WriteByte(0)
+
+	chunk := columnChunk{
+		offset:           w.w.n,
+		numValues:        int64(len(b.levels)),
+		uncompressedSize: int64(h.buf.Len() + page.Len()),
+		compressedSize:   int64(h.buf.Len() + len(body)),
+	}
+	_, err := w.w.Write(h.buf.Bytes())
+	if err != nil {
+		return chunk, err
+	}
+	_, err = w.w.Write(body)
+	return chunk, err
+}
+
+// footer encodes the FileMetaData struct
+func (w *Writer) footer() []byte {
+	codec := int32(compressionNone)
+	if w.opts.Compression == CodecGzip {
+		codec = compressionGzip
+	}
+
+	m := &compactWriter{}
+	m.i32(1, 1)
+	m.list(2, thriftStruct, len(w.columns)+1)
+	m.begin()
+	m.string(4, "schema")
+	m.i32(5, int32(len(w.columns)))
+	m.end()
+	for _, col := range w.columns {
+		m.begin()
+		m.i32(1, int32(col.Type))
+		m.i32(3, repetitionOptional)
+		m.string(4, col.Name)
+		if col.Type == ByteArray {
+			m.i32(6, convertedTypeUTF8)
+		}
+		m.end()
+	}
+	m.i64(3, w.totalRows)
+	m.list(4, thriftStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		m.begin()
+		m.list(1, thriftStruct, len(rg.columns))
+		for i, chunk := range rg.columns {
+			m.begin()
+			m.i64(2, chunk.offset)
+			m.structField(3)
+			m.i32(1, int32(w.columns[i].Type))
+			m.list(2, thriftI32, 2)
+			m.listI32(encodingPlain)
+			m.listI32(encodingRLE)
+			m.list(3, thriftBinary, 1)
+			m.rawString(w.columns[i].Name)
+			m.i32(4, codec)
+			m.i64(5, chunk.numValues)
+			m.i64(6, chunk.uncompressedSize)
+			m.i64(7, chunk.compressedSize)
+			m.i64(9, chunk.offset)
+			m.end()
+			m.end()
+		}
+		m.i64(2, rg.size)
+		m.i64(3, rg.rows)
+		m.end()
+	}
+	m.string(6, "pleiades")
+	m.buf.WriteByte(0)
+	return m.buf.Bytes()
+}
+
+// encodeLevels encodes definition levels with the RLE/bit-packing hybrid encoding, using only RLE runs.
+// With a maximum level of 1 each run is its length followed by a single byte holding the level.
+func encodeLevels(levels []byte) []byte {
+	var b bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		n := binary.PutUvarint(tmp[:], uint64(j-i)<<1)
+		b.Write(tmp[:n])
+		b.WriteByte(levels[i])
+		i = j
+	}
+	return b.Bytes()
+}
+
+// packBools bit-packs boolean values, least significant bit first
+func packBools(values []bool) []byte {
+	b := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			b[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return b
+}
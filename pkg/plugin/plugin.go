@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Option declares a single configuration value of a backend.
+// Name is the full flag name, e.g. "kafka.broker". Default determines the type of the option and must be
+// a string, bool, int, int64, time.Duration or []string.
+type Option struct {
+	Name    string
+	Usage   string
+	Default interface{}
+}
+
+// Config holds the values of a backend's options, keyed by option name
+type Config map[string]interface{}
+
+// EnableFlag returns the name of the flag that enables the backend with the given name
+func EnableFlag(name string) string {
+	return name + ".enable"
+}
+
+// BindFlags registers a flag for every option on the FlagSet given.
+// Options that are already registered are skipped, so backends that share a connection (such as the kafka
+// publisher and the kafka aggregator source) can both declare it.
+func BindFlags(fs *pflag.FlagSet, options []Option) {
+	for _, o := range options {
+		if fs.Lookup(o.Name) != nil {
+			continue
+		}
+		switch d := o.Default.(type) {
+		case string:
+			fs.String(o.Name, d, o.Usage)
+		case bool:
+			fs.Bool(o.Name, d, o.Usage)
+		case int:
+			fs.Int(o.Name, d, o.Usage)
+		case int64:
+			fs.Int64(o.Name, d, o.Usage)
+		case time.Duration:
+			fs.Duration(o.Name, d, o.Usage)
+		case []string:
+			fs.StringSlice(o.Name, d, o.Usage)
+		default:
+			panic(fmt.Sprintf("option %s has unsupported type %T", o.Name, o.Default))
+		}
+	}
+}
+
+// FromFlags reads the values of the options given from the FlagSet
+func FromFlags(fs *pflag.FlagSet, options []Option) (Config, error) {
+	c := make(Config)
+	for _, o := range options {
+		var v interface{}
+		var err error
+		switch o.Default.(type) {
+		case string:
+			v, err = fs.GetString(o.Name)
+		case bool:
+			v, err = fs.GetBool(o.Name)
+		case int:
+			v, err = fs.GetInt(o.Name)
+		case int64:
+			v, err = fs.GetInt64(o.Name)
+		case time.Duration:
+			v, err = fs.GetDuration(o.Name)
+		case []string:
+			v, err = fs.GetStringSlice(o.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read option %s: %v", o.Name, err)
+		}
+		c[o.Name] = v
+	}
+	return c, nil
+}
+
+// String returns the value of a string option, or "" if it is not set
+func (c Config) String(name string) string {
+	v, _ := c[name].(string)
+	return v
+}
+
+// Bool returns the value of a bool option, or false if it is not set
+func (c Config) Bool(name string) bool {
+	v, _ := c[name].(bool)
+	return v
+}
+
+// Int returns the value of an int option, or 0 if it is not set
+func (c Config) Int(name string) int {
+	v, _ := c[name].(int)
+	return v
+}
+
+// Int64 returns the value of an int64 option, or 0 if it is not set
+func (c Config) Int64(name string) int64 {
+	v, _ := c[name].(int64)
+	return v
+}
+
+// Duration returns the value of a duration option, or 0 if it is not set
+func (c Config) Duration(name string) time.Duration {
+	v, _ := c[name].(time.Duration)
+	return v
+}
+
+// StringSlice returns the value of a string slice option, or nil if it is not set
+func (c Config) StringSlice(name string) []string {
+	v, _ := c[name].([]string)
+	return v
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var testOptions = []Option{
+	{Name: "test.string", Usage: "a string", Default: "default"},
+	{Name: "test.bool", Usage: "a bool", Default: false},
+	{Name: "test.int", Usage: "an int", Default: 5},
+	{Name: "test.int64", Usage: "an int64", Default: int64(7)},
+	{Name: "test.duration", Usage: "a duration", Default: time.Second},
+	{Name: "test.list", Usage: "a list", Default: []string{}},
+}
+
+var _ = Describe("Plugin options", func() {
+
+	It("binds flags and reads their values", func() {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		BindFlags(fs, testOptions)
+		Expect(fs.Parse([]string{"--test.string=x", "--test.bool", "--test.int64=9", "--test.duration=1m", "--test.list=a,b"})).To(Succeed())
+
+		cfg, err := FromFlags(fs, testOptions)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.String("test.string")).Should(Equal("x"))
+		Expect(cfg.Bool("test.bool")).Should(BeTrue())
+		Expect(cfg.Int("test.int")).Should(Equal(5))
+		Expect(cfg.Int64("test.int64")).Should(Equal(int64(9)))
+		Expect(cfg.Duration("test.duration")).Should(Equal(time.Minute))
+		Expect(cfg.StringSlice("test.list")).Should(Equal([]string{"a", "b"}))
+	})
+
+	It("skips options that are already bound", func() {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		BindFlags(fs, testOptions)
+		Expect(func() { BindFlags(fs, testOptions[:1]) }).ShouldNot(Panic())
+	})
+
+	It("returns zero values for unknown options", func() {
+		cfg := Config{}
+		Expect(cfg.String("missing")).Should(BeEmpty())
+		Expect(cfg.Duration("missing")).Should(BeZero())
+	})
+
+	It("fails to read options that were never bound", func() {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		_, err := FromFlags(fs, testOptions)
+		Expect(err).Should(HaveOccurred())
+	})
+})
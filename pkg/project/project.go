@@ -0,0 +1,136 @@
+package project
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// BuiltinTable is the mapping used unless a table file is given, and extended by table files
+const BuiltinTable = `
+wikis:
+  testwiki: {family: test}
+  test2wiki: {family: test}
+  testwikidatawiki: {family: test}
+  testcommonswiki: {family: test}
+  commonswiki: {family: commons}
+  wikidatawiki: {family: wikidata}
+  metawiki: {family: meta}
+  specieswiki: {family: species}
+  mediawikiwiki: {family: mediawiki}
+  incubatorwiki: {family: incubator}
+  sourceswiki: {family: wikisource}
+  foundationwiki: {family: foundation}
+  outreachwiki: {family: outreach}
+  wikifunctionswiki: {family: wikifunctions}
+  be_x_oldwiki: {family: wikipedia, language: be-tarask}
+suffixes:
+  wiki: wikipedia
+  wiktionary: wiktionary
+  wikibooks: wikibooks
+  wikinews: wikinews
+  wikiquote: wikiquote
+  wikisource: wikisource
+  wikiversity: wikiversity
+  wikivoyage: wikivoyage
+`
+
+var (
+	builtin     *Table
+	builtinOnce sync.Once
+)
+
+// Builtin returns the table parsed from BuiltinTable
+func Builtin() *Table {
+	builtinOnce.Do(func() {
+		var f File
+		err := yaml.UnmarshalStrict([]byte(BuiltinTable), &f)
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in project table: %v", err))
+		}
+		builtin = newTable(&f)
+	})
+	return builtin
+}
+
+// Load reads a table from a YAML file. Its entries are added to those of the built-in table, replacing entries for the
+// same wikis and suffixes, so that new wikis can be mapped without a new release.
+func Load(filename string) (*Table, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project table %s: %v", filename, err)
+	}
+	var f File
+	err = yaml.UnmarshalStrict(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse project table %s: %v", filename, err)
+	}
+	for wiki, p := range f.Wikis {
+		if p.Family == "" {
+			return nil, fmt.Errorf("no family given for wiki %s", wiki)
+		}
+	}
+
+	merged := &File{Wikis: make(map[string]Project), Suffixes: make(map[string]string)}
+	for _, t := range []*File{{Wikis: Builtin().wikis, Suffixes: Builtin().suffixes}, &f} {
+		for k, v := range t.Wikis {
+			merged.Wikis[k] = v
+		}
+		for k, v := range t.Suffixes {
+			merged.Suffixes[k] = v
+		}
+	}
+	return newTable(merged), nil
+}
+
+func newTable(f *File) *Table {
+	t := &Table{wikis: f.Wikis, suffixes: f.Suffixes}
+	for s := range f.Suffixes {
+		t.order = append(t.order, s)
+	}
+	sort.Slice(t.order, func(i, j int) bool { return len(t.order[i]) > len(t.order[j]) })
+	return t
+}
+
+// Lookup returns the project of a wiki, given its database name and server name.
+// Wikis in the table come first, then the project is derived from the server name, e.g. de.wikipedia.org is
+// (wikipedia, de), commons.wikimedia.org is (commons, "") and www.wikidata.org is (wikidata, ""), and last from the
+// suffix of the database name. It returns false if neither tells the project.
+func (t *Table) Lookup(wiki, server string) (Project, bool) {
+	if p, ok := t.wikis[wiki]; ok {
+		return p, true
+	}
+	if p, ok := fromServer(server); ok {
+		return p, true
+	}
+	for _, s := range t.order {
+		if len(wiki) > len(s) && strings.HasSuffix(wiki, s) {
+			lang := strings.Replace(strings.TrimSuffix(wiki, s), "_", "-", -1)
+			return Project{Family: t.suffixes[s], Language: lang}, true
+		}
+	}
+	return Project{}, false
+}
+
+// fromServer splits a server name into the project family and language
+func fromServer(server string) (Project, bool) {
+	labels := strings.Split(strings.ToLower(server), ".")
+	if len(labels) < 2 {
+		return Project{}, false
+	}
+	sub, domain := labels[0], labels[len(labels)-2]
+	if len(labels) < 3 {
+		return Project{Family: domain}, true
+	}
+	switch {
+	case domain == "wikimedia":
+		return Project{Family: sub}, true
+	case sub == "www":
+		return Project{Family: domain}, true
+	}
+	return Project{Family: domain, Language: sub}, true
+}
@@ -0,0 +1,82 @@
+package project
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Project table", func() {
+	lookup := func(t *Table, wiki, server string) Project {
+		p, ok := t.Lookup(wiki, server)
+		Expect(ok).To(BeTrue(), wiki+" "+server)
+		return p
+	}
+
+	It("derives the project from the server name", func() {
+		t := Builtin()
+		Expect(lookup(t, "dewiki", "de.wikipedia.org")).To(Equal(Project{Family: "wikipedia", Language: "de"}))
+		Expect(lookup(t, "frwiktionary", "fr.wiktionary.org")).To(Equal(Project{Family: "wiktionary", Language: "fr"}))
+		Expect(lookup(t, "zh_min_nanwiki", "zh-min-nan.wikipedia.org")).To(Equal(Project{Family: "wikipedia", Language: "zh-min-nan"}))
+		Expect(lookup(t, "", "commons.wikimedia.org")).To(Equal(Project{Family: "commons"}))
+		Expect(lookup(t, "", "www.wikidata.org")).To(Equal(Project{Family: "wikidata"}))
+		Expect(lookup(t, "sourceswiki", "wikisource.org")).To(Equal(Project{Family: "wikisource"}))
+	})
+
+	It("maps wikis whose server name is misleading", func() {
+		Expect(lookup(Builtin(), "testwiki", "test.wikipedia.org")).To(Equal(Project{Family: "test"}))
+		Expect(lookup(Builtin(), "be_x_oldwiki", "")).To(Equal(Project{Family: "wikipedia", Language: "be-tarask"}))
+	})
+
+	It("derives the project from the database name without a server name", func() {
+		Expect(lookup(Builtin(), "enwikivoyage", "")).To(Equal(Project{Family: "wikivoyage", Language: "en"}))
+		Expect(lookup(Builtin(), "enwiki", "")).To(Equal(Project{Family: "wikipedia", Language: "en"}))
+		_, ok := Builtin().Lookup("wiki", "")
+		Expect(ok).To(BeFalse())
+	})
+
+	Context("with a table file", func() {
+		var filename string
+
+		write := func(content string) {
+			f, err := ioutil.TempFile("", "projects-*.yaml")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.WriteString(content)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			filename = f.Name()
+		}
+
+		AfterEach(func() {
+			os.Remove(filename)
+		})
+
+		It("extends and overrides the built-in table", func() {
+			write(`
+wikis:
+  testwiki: {family: wikipedia, language: test}
+  newwiki: {family: new}
+suffixes:
+  wikifoo: foo
+`)
+			t, err := Load(filename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lookup(t, "testwiki", "")).To(Equal(Project{Family: "wikipedia", Language: "test"}))
+			Expect(lookup(t, "newwiki", "new.wikipedia.org")).To(Equal(Project{Family: "new"}))
+			Expect(lookup(t, "dewikifoo", "")).To(Equal(Project{Family: "foo", Language: "de"}))
+			Expect(lookup(t, "commonswiki", "")).To(Equal(Project{Family: "commons"}))
+			Expect(lookup(Builtin(), "testwiki", "")).To(Equal(Project{Family: "test"}))
+		})
+
+		It("rejects invalid tables", func() {
+			for _, content := range []string{`wikis: {x: {language: de}}`, `projects: {}`, `wikis: [`} {
+				write(content)
+				_, err := Load(filename)
+				Expect(err).To(HaveOccurred(), content)
+				os.Remove(filename)
+			}
+		})
+	})
+})
@@ -0,0 +1,25 @@
+package project
+
+// Project is the project family and language of a wiki, e.g. wiktionary and fr for frwiktionary.
+// Language is empty for projects that are not specific to a language, like commons or wikidata.
+type Project struct {
+	Family   string `yaml:"family"`
+	Language string `yaml:"language"`
+}
+
+// Table maps wikis to their project
+type Table struct {
+	wikis    map[string]Project
+	suffixes map[string]string
+	// ordered longest first, so that e.g. wiktionary is matched before wiki
+	order []string
+}
+
+// File is the YAML representation of a Table
+type File struct {
+	// Wikis maps the database names of wikis whose server name does not tell their project, e.g. testwiki
+	Wikis map[string]Project `yaml:"wikis"`
+	// Suffixes map the suffix of database names to a project family, for events without a server name.
+	// The rest of the database name is the language, e.g. fr for frwiktionary.
+	Suffixes map[string]string `yaml:"suffixes"`
+}
@@ -0,0 +1,31 @@
+package revert
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var (
+	// revertComment matches the edit summaries of reverts made with undo, rollback or tools like Twinkle and Huggle,
+	// after an optional section link, e.g. "Reverted edits by ...", "Undid revision 123 by ..." or "rv vandalism"
+	revertComment = regexp.MustCompile(`(?i)^\s*(/\*[^*]*\*/\s*)?(\[\[[^\]|]*\|)?(revert(ed|ing)?|rvv?|undid|undo(ne)?|roll(ed)? ?back|restored? (revision|version))\b`)
+
+	// undidComment matches the edit summaries of undo, naming the revision undone
+	undidComment = regexp.MustCompile(`(?i)\bundid revision (\d+)`)
+)
+
+// ParseComment tells whether an edit summary is that of a revert, and returns the revision it names as undone, if any
+func ParseComment(c string) (bool, int64) {
+	if !revertComment.MatchString(c) {
+		return false, 0
+	}
+	m := undidComment.FindStringSubmatch(c)
+	if m == nil {
+		return true, 0
+	}
+	undid, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return true, 0
+	}
+	return true, undid
+}
@@ -0,0 +1,302 @@
+package revert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/gargath/pleiades/pkg/anomaly"
+	"github.com/gargath/pleiades/pkg/log"
+)
+
+const (
+	moduleName = "revert"
+
+	// historyPrefix starts the lists of the recent edits of every page, e.g. revert_history_enwiki_Main Page
+	historyPrefix = "revert_history_"
+
+	// warPrefix starts the keys marking the pages an edit war has been alerted for
+	warPrefix = "revert_war_"
+
+	// editWarCounter starts the sorted sets of the pages edit wars are fought on, written by the aggregator's default rules
+	editWarCounter = "pleiades_edit_wars_"
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	// record adds the entry in ARGV[1] to the history of a page in KEYS[1], keeps the ARGV[2] most recent entries and
+	// expires the history at ARGV[3]. It returns the entries older than the one added, most recent first.
+	// If the history has the entry already, because the edit has been checked before, it is not added again.
+	record = redis.NewScript(`
+local history = redis.call('LRANGE', KEYS[1], 0, -1)
+for i = 1, #history do
+	if history[i] == ARGV[1] then
+		return {unpack(history, i + 1)}
+	end
+end
+redis.call('LPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], 0, tonumber(ARGV[2]) - 1)
+redis.call('EXPIREAT', KEYS[1], ARGV[3])
+return history
+`)
+
+	checkTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_revert_check_duration_seconds",
+			Help:    "Time taken to check a batch of edits for reverts",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+		},
+	)
+
+	editWars = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_revert_edit_wars_total",
+			Help: "Number of edit wars detected",
+		},
+	)
+
+	sinkErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_revert_sink_errors_total",
+			Help: "Number of batches of edit war alerts that could not be sent, by sink",
+		},
+		[]string{"sink"},
+	)
+)
+
+// NewDetector returns a Detector keeping the histories of pages in Redis and sending an alert to the sinks given
+// when an edit war starts
+func NewDetector(r *redis.Client, opts *Opts, sinks []anomaly.Sink) (*Detector, error) {
+	if opts.Window <= 0 {
+		return nil, fmt.Errorf("revert window must be positive")
+	}
+	if opts.History < 2 {
+		return nil, fmt.Errorf("revert history must keep at least 2 edits")
+	}
+	if opts.MinReverts < 1 || opts.MinUsers < 1 {
+		return nil, fmt.Errorf("edit wars need at least 1 revert by at least 1 user")
+	}
+	return &Detector{r: r, opts: opts, sinks: sinks}, nil
+}
+
+// Check adds edits to the histories of their pages and returns their verdicts, in the order of the edits.
+// Edits of the same page must be passed in the order they were made. An edit checked again gets the same verdict,
+// so that a batch of events can be retried.
+func (d *Detector) Check(edits []Edit) ([]Verdict, error) {
+	if len(edits) == 0 {
+		return nil, nil
+	}
+	timer := prometheus.NewTimer(checkTime)
+	defer timer.ObserveDuration()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries := make([]entry, len(edits))
+	histories := make([]*redis.Cmd, len(edits))
+	expiry := time.Now().Add(d.opts.Window).Unix()
+	_, err := d.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, e := range edits {
+			entries[i] = newEntry(e)
+			v, err := json.Marshal(entries[i])
+			if err != nil {
+				return err
+			}
+			histories[i] = record.Eval(ctx, p, []string{historyKey(e)}, string(v), d.opts.History, expiry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the histories of %d edits in Redis: %v", len(edits), err)
+	}
+
+	verdicts := make([]Verdict, len(edits))
+	var wars []war
+	for i, h := range histories {
+		older := decode(h.Val())
+		verdicts[i] = d.classify(entries[i], older)
+		if len(verdicts[i].Reverted) > 0 {
+			w := d.war(entries[i], older)
+			w.edit = edits[i]
+			if w.reverts >= d.opts.MinReverts && len(w.users) >= d.opts.MinUsers {
+				verdicts[i].EditWar = true
+				wars = append(wars, w)
+			}
+		}
+	}
+	if len(wars) > 0 {
+		err := d.alert(ctx, wars)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return verdicts, nil
+}
+
+// Close closes the sinks
+func (d *Detector) Close() {
+	for _, s := range d.sinks {
+		if err := s.Close(); err != nil {
+			logger.Errorf("Error closing alert sink: %v", err)
+		}
+	}
+}
+
+// classify tells whether an edit reverts edits in the history before it, most recent first.
+// An edit reverts the revision its summary names as undone, or the edits it restores the length of the page before,
+// following the edits it was made to back through the window. Failing that, an edit whose summary is that of a revert
+// reverts the edit it was made to. Edits only reverting edits of the same user are not reverts.
+func (d *Detector) classify(e entry, older []entry) Verdict {
+	if e.Undid != 0 {
+		for _, h := range older {
+			if h.Revision == e.Undid {
+				return verdict(e, []entry{h})
+			}
+		}
+		return Verdict{Revert: true}
+	}
+	if e.Length != e.OldLength {
+		parent := e.Parent
+		var undone []entry
+		for _, h := range older {
+			if h.Revision != parent || d.expired(e, h) {
+				break
+			}
+			undone = append(undone, h)
+			if h.Parent != 0 && h.OldLength == e.Length {
+				return verdict(e, undone)
+			}
+			parent = h.Parent
+		}
+	}
+	if e.Comment {
+		if len(older) > 0 && older[0].Revision == e.Parent {
+			return verdict(e, older[:1])
+		}
+		return Verdict{Revert: true}
+	}
+	return Verdict{}
+}
+
+// war counts the reverts of other users' edits in the window up to a revert, and the users who made them
+func (d *Detector) war(e entry, older []entry) war {
+	w := war{reverts: 1, users: []string{e.User}}
+	seen := map[string]bool{e.User: true}
+	for i, h := range older {
+		if d.expired(e, h) {
+			break
+		}
+		if len(d.classify(h, older[i+1:]).Reverted) > 0 {
+			w.reverts++
+			if !seen[h.User] {
+				seen[h.User] = true
+				w.users = append(w.users, h.User)
+			}
+		}
+	}
+	sort.Strings(w.users)
+	return w
+}
+
+// expired tells whether edit h was made longer than the window before edit e
+func (d *Detector) expired(e entry, h entry) bool {
+	return time.Duration(e.Time-h.Time)*time.Second > d.opts.Window
+}
+
+// alert sends an alert for each page an edit war started on, once per window.
+// Sinks that fail are logged and skipped, so that an unavailable sink does not hold up aggregation.
+func (d *Detector) alert(ctx context.Context, wars []war) error {
+	started := make([]*redis.BoolCmd, len(wars))
+	_, err := d.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, w := range wars {
+			started[i] = p.SetNX(ctx, warPrefix+w.edit.Wiki+"_"+w.edit.Title, w.edit.Revision, d.opts.Window)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record edit wars in Redis: %v", err)
+	}
+	var alerts []anomaly.Alert
+	for i, w := range wars {
+		if !started[i].Val() {
+			continue
+		}
+		editWars.Inc()
+		alerts = append(alerts, anomaly.Alert{
+			Time:    w.edit.Time,
+			Counter: editWarCounter + w.edit.Wiki,
+			Wiki:    w.edit.Wiki,
+			Title:   w.edit.Title,
+			Users:   w.users,
+			Kind:    anomaly.KindEditWar,
+			Value:   int64(w.reverts),
+		})
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+	for _, s := range d.sinks {
+		if err := s.Send(ctx, alerts); err != nil {
+			sinkErrors.WithLabelValues(anomaly.SinkName(s)).Inc()
+			logger.Errorf("Failed to send %d edit war alerts: %v", len(alerts), err)
+		}
+	}
+	return nil
+}
+
+// verdict returns the verdict of an edit reverting the edits given
+func verdict(e entry, undone []entry) Verdict {
+	seen := make(map[string]bool)
+	var users []string
+	for _, h := range undone {
+		if h.User != e.User && !seen[h.User] {
+			seen[h.User] = true
+			users = append(users, h.User)
+		}
+	}
+	sort.Strings(users)
+	return Verdict{Revert: len(users) > 0, Reverted: users}
+}
+
+// decode returns the entries of a history returned by record, skipping those that are not valid
+func decode(v interface{}) []entry {
+	raw, _ := v.([]interface{})
+	entries := make([]entry, 0, len(raw))
+	for _, r := range raw {
+		s, ok := r.(string)
+		if !ok {
+			continue
+		}
+		var e entry
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			logger.Debugf("Discarding invalid history entry %s: %v", s, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func newEntry(e Edit) entry {
+	c, undid := ParseComment(e.Comment)
+	return entry{
+		Revision:  e.Revision,
+		Parent:    e.Parent,
+		Length:    e.Length,
+		OldLength: e.OldLength,
+		User:      e.User,
+		Time:      e.Time.Unix(),
+		Comment:   c,
+		Undid:     undid,
+	}
+}
+
+func historyKey(e Edit) string {
+	return historyPrefix + e.Wiki + "_" + e.Title
+}
@@ -0,0 +1,216 @@
+package revert
+
+import (
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/anomaly"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeSink records the alerts sent to it
+type fakeSink struct {
+	alerts []anomaly.Alert
+}
+
+func (f *fakeSink) Send(ctx context.Context, alerts []anomaly.Alert) error {
+	f.alerts = append(f.alerts, alerts...)
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+var _ = Describe("Revert detector", func() {
+	start := time.Date(2020, 8, 10, 10, 0, 0, 0, time.UTC)
+
+	var (
+		m    *miniredis.Miniredis
+		sink *fakeSink
+		d    *Detector
+	)
+
+	// edit returns the edit of Page by user making revision rev to rev-1, changing its length from old to length
+	edit := func(user string, rev int64, old int64, length int64, comment string) Edit {
+		return Edit{
+			Wiki:      "enwiki",
+			Title:     "Page",
+			User:      user,
+			Comment:   comment,
+			Revision:  rev,
+			Parent:    rev - 1,
+			Length:    length,
+			OldLength: old,
+			Time:      start.Add(time.Duration(rev) * time.Minute),
+		}
+	}
+
+	check := func(edits ...Edit) []Verdict {
+		verdicts, err := d.Check(edits)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verdicts).To(HaveLen(len(edits)))
+		return verdicts
+	}
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		sink = &fakeSink{}
+		d, err = NewDetector(redis.NewClient(&redis.Options{Addr: m.Addr()}),
+			&Opts{Window: time.Hour, History: 10, MinReverts: 3, MinUsers: 2}, []anomaly.Sink{sink})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	It("tells reverts restoring an earlier length", func() {
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Carol", 12, 150, 170, ""),
+			edit("Alice", 13, 170, 100, ""),
+		)
+		Expect(v[:3]).To(Equal([]Verdict{{}, {}, {}}))
+		Expect(v[3]).To(Equal(Verdict{Revert: true, Reverted: []string{"Bob", "Carol"}}))
+	})
+
+	It("tells reverts by their summary", func() {
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Carol", 12, 150, 160, ""),
+			edit("Alice", 13, 160, 110, "Undid revision 11 by [[Special:Contributions/Bob|Bob]] ([[User talk:Bob|talk]])"),
+			edit("Bob", 14, 110, 112, "Reverted edits by [[Special:Contributions/Alice|Alice]] to last version by Carol"),
+		)
+		Expect(v[3]).To(Equal(Verdict{Revert: true, Reverted: []string{"Bob"}}))
+		Expect(v[4]).To(Equal(Verdict{Revert: true, Reverted: []string{"Alice"}}))
+	})
+
+	It("does not count reverts of the editor's own edits", func() {
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Bob", 12, 150, 100, "rv"),
+		)
+		Expect(v[2].Revert).To(BeFalse())
+	})
+
+	It("does not follow edits it missed", func() {
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Alice", 13, 170, 100, ""),
+		)
+		Expect(v[2].Revert).To(BeFalse())
+	})
+
+	It("flags edit wars and alerts once per page", func() {
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Alice", 12, 150, 100, ""),
+			edit("Bob", 13, 100, 150, ""),
+			edit("Alice", 14, 150, 100, ""),
+			edit("Bob", 15, 100, 150, ""),
+		)
+		Expect(v[3]).To(Equal(Verdict{Revert: true, Reverted: []string{"Alice"}}))
+		Expect(v[4]).To(Equal(Verdict{Revert: true, Reverted: []string{"Bob"}, EditWar: true}))
+		Expect(v[5].EditWar).To(BeTrue())
+		Expect(sink.alerts).To(Equal([]anomaly.Alert{{
+			Time:    start.Add(14 * time.Minute),
+			Counter: "pleiades_edit_wars_enwiki",
+			Wiki:    "enwiki",
+			Title:   "Page",
+			Users:   []string{"Alice", "Bob"},
+			Kind:    anomaly.KindEditWar,
+			Value:   3,
+		}}))
+	})
+
+	It("needs several users for an edit war", func() {
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Alice", 12, 150, 100, ""),
+			edit("Carol", 13, 100, 150, ""),
+			edit("Alice", 14, 150, 100, ""),
+		)
+		Expect(v[4].EditWar).To(BeTrue())
+
+		d.opts.MinUsers = 3
+		v = check(edit("Bob", 15, 100, 150, ""))
+		Expect(v[0].EditWar).To(BeTrue())
+		v = check(edit("Alice", 16, 150, 100, ""), edit("Alice", 17, 100, 100, ""))
+		Expect(v[0].EditWar).To(BeTrue())
+		Expect(v[1].Revert).To(BeFalse())
+	})
+
+	It("gives edits checked again the same verdict", func() {
+		edits := []Edit{
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			edit("Alice", 12, 150, 100, ""),
+		}
+		first := check(edits...)
+		Expect(check(edits...)).To(Equal(first))
+		history, err := m.List("revert_history_enwiki_Page")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(history).To(HaveLen(3))
+	})
+
+	It("keeps a limited history for the window", func() {
+		d.opts.History = 2
+		late := edit("Alice", 12, 150, 100, "")
+		late.Time = late.Time.Add(2 * time.Hour)
+		v := check(
+			edit("Alice", 10, 0, 100, ""),
+			edit("Bob", 11, 100, 150, ""),
+			late,
+		)
+		Expect(v[2].Revert).To(BeFalse())
+		history, err := m.List("revert_history_enwiki_Page")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(history).To(HaveLen(2))
+		Expect(m.TTL("revert_history_enwiki_Page")).To(BeNumerically("~", time.Hour, time.Minute))
+	})
+
+	It("keeps pages apart", func() {
+		other := edit("Bob", 11, 100, 150, "")
+		other.Title = "Other"
+		v := check(edit("Alice", 10, 0, 100, ""), other, edit("Alice", 12, 150, 100, ""))
+		Expect(v[2].Revert).To(BeFalse())
+	})
+})
+
+var _ = Describe("Revert comments", func() {
+	It("tells the summaries of reverts", func() {
+		for c, undid := range map[string]int64{
+			"Undid revision 971935871 by [[Special:Contributions/Example|Example]] ([[User talk:Example|talk]])":                971935871,
+			"Reverted edits by [[Special:Contributions/Example|Example]] ([[User talk:Example|talk]]) to last version by Other": 0,
+			"Reverted 1 edit by [[Special:Contributions/Example|Example]] ([[User talk:Example|talk]]): Unsourced":              0,
+			"/* History */ rv vandalism":   0,
+			"Restored revision 123 by X":   0,
+			"[[WP:RV|Reverted]] vandalism": 0,
+		} {
+			revert, n := ParseComment(c)
+			Expect(revert).To(BeTrue(), c)
+			Expect(n).To(Equal(undid), c)
+		}
+	})
+
+	It("ignores other summaries", func() {
+		for _, c := range []string{"", "Revertible changes", "/* Reversal */ copyedit", "rvw"} {
+			revert, _ := ParseComment(c)
+			Expect(revert).To(BeFalse(), c)
+		}
+	})
+})
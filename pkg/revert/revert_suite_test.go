@@ -0,0 +1,13 @@
+package revert
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRevert(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Revert Suite")
+}
@@ -0,0 +1,75 @@
+package revert
+
+import (
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/anomaly"
+)
+
+// Detector keeps the recent edits of every page in Redis, and tells which edits revert others and which pages
+// their editors revert each other on repeatedly
+type Detector struct {
+	r     *redis.Client
+	opts  *Opts
+	sinks []anomaly.Sink
+}
+
+// Opts configure a Detector
+type Opts struct {
+	// Window is the time edits are kept for and reverts are counted in
+	Window time.Duration
+	// History is the maximum number of edits kept per page
+	History int64
+	// MinReverts is the number of reverts of each other's edits in a Window that makes an edit war
+	MinReverts int
+	// MinUsers is the number of users reverting each other in a Window that makes an edit war
+	MinUsers int
+}
+
+// Edit is an edit of a page, as checked by a Detector
+type Edit struct {
+	Wiki  string
+	Title string
+	User  string
+	// Comment is the edit summary, telling reverts made with undo or rollback
+	Comment string
+	// Revision is the ID of the revision the edit made, and Parent that of the revision it was made to
+	Revision int64
+	Parent   int64
+	// Length is the length of the page after the edit, and OldLength before it
+	Length    int64
+	OldLength int64
+	Time      time.Time
+}
+
+// Verdict tells whether an Edit reverts others, and whether it is part of an edit war
+type Verdict struct {
+	Revert bool
+	// Reverted are the other users whose edits were reverted, if known
+	Reverted []string
+	EditWar  bool
+}
+
+// war is a revert of other users' edits, with the number of such reverts in the window up to it and the users who made them
+type war struct {
+	edit    Edit
+	reverts int
+	users   []string
+}
+
+// entry is an Edit as kept in the history of a page. It only holds what the edit itself tells, so that the entry of
+// an edit checked again is the same and can be recognised.
+type entry struct {
+	Revision  int64  `json:"r"`
+	Parent    int64  `json:"p,omitempty"`
+	Length    int64  `json:"l"`
+	OldLength int64  `json:"o"`
+	User      string `json:"u"`
+	// Time is the time of the edit in seconds since the epoch
+	Time int64 `json:"t"`
+	// Comment is set if the edit summary is that of a revert, and Undid to the revision it names as undone, if any
+	Comment bool  `json:"c,omitempty"`
+	Undid   int64 `json:"x,omitempty"`
+}
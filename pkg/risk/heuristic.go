@@ -0,0 +1,260 @@
+package risk
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transform"
+)
+
+// DefaultRules are the rules used unless a rules file is given
+const DefaultRules = `
+anonymous: 30
+removal: 30
+removalBytes: 500
+emptyComment: 10
+newArticle: 20
+velocity: 20
+velocityEdits: 10
+velocityWindow: 1m
+`
+
+// Factors of the risk of an edit
+const (
+	FactorAnonymous    = "anonymous"
+	FactorRemoval      = "removal"
+	FactorEmptyComment = "empty_comment"
+	FactorNewArticle   = "new_article"
+	FactorVelocity     = "velocity"
+)
+
+const (
+	moduleName = "risk"
+
+	// velocityPrefix starts the sets of the revisions a user made in a velocity window,
+	// e.g. risk_velocity_<window>_enwiki_Example
+	velocityPrefix = "risk_velocity_"
+)
+
+// Results of reloading rules
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	scores = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_risk_score",
+			Help:    "Risk scores of edits",
+			Buckets: []float64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100},
+		},
+	)
+
+	reloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_risk_rule_reloads_total",
+			Help: "Number of times the risk rules file was reloaded, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+// NewHeuristic returns a Heuristic keeping the edit velocity of users in Redis, with the rules of the file given in opts
+// or the DefaultRules
+func NewHeuristic(r *redis.Client, opts *Opts) (*Heuristic, error) {
+	h := &Heuristic{r: r, opts: opts}
+	if opts.File == "" {
+		rs, err := compileRules([]byte(DefaultRules))
+		if err != nil {
+			return nil, fmt.Errorf("invalid default risk rules: %v", err)
+		}
+		h.rules = rs
+		return h, nil
+	}
+	if opts.ReloadInterval <= 0 {
+		return nil, fmt.Errorf("risk rules reload interval must be positive")
+	}
+	err := h.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// compileRules parses and validates risk rules
+func compileRules(data []byte) (*rules, error) {
+	var rs Rules
+	err := yaml.UnmarshalStrict(data, &rs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse risk rules: %v", err)
+	}
+	c := &rules{Rules: rs}
+	if rs.Removal != 0 && rs.RemovalBytes <= 0 {
+		return nil, fmt.Errorf("removal requires a positive removalBytes")
+	}
+	if rs.Velocity != 0 {
+		if rs.VelocityEdits < 1 {
+			return nil, fmt.Errorf("velocity requires a positive velocityEdits")
+		}
+		c.window, err = time.ParseDuration(rs.VelocityWindow)
+		if err != nil || c.window < time.Second {
+			return nil, fmt.Errorf("velocity requires a velocityWindow of at least 1s")
+		}
+	}
+	return c, nil
+}
+
+// Start checks the rules file for changes every ReloadInterval and reloads it when it changed
+func (h *Heuristic) Start() {
+	if h.opts.File == "" {
+		return
+	}
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		t := time.NewTicker(h.opts.ReloadInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-t.C:
+				err := h.reloadIfModified()
+				if err != nil {
+					logger.Errorf("Keeping the previous risk rules: %v", err)
+				}
+			}
+		}
+	}()
+	logger.Infof("Reloading risk rules from %s when it changes", h.opts.File)
+}
+
+// Stop stops checking the rules file for changes
+func (h *Heuristic) Stop() {
+	if h.stop == nil {
+		return
+	}
+	close(h.stop)
+	<-h.done
+}
+
+// Reload loads the rules file. If it is invalid, the rules are left unchanged.
+func (h *Heuristic) Reload() error {
+	fi, err := os.Stat(h.opts.File)
+	if err != nil {
+		reloads.WithLabelValues(resultError).Inc()
+		return fmt.Errorf("failed to read risk rules file %s: %v", h.opts.File, err)
+	}
+	b, err := ioutil.ReadFile(h.opts.File)
+	if err != nil {
+		reloads.WithLabelValues(resultError).Inc()
+		return fmt.Errorf("failed to read risk rules file %s: %v", h.opts.File, err)
+	}
+	rs, err := compileRules(b)
+	if err != nil {
+		reloads.WithLabelValues(resultError).Inc()
+		return fmt.Errorf("invalid risk rules file %s: %v", h.opts.File, err)
+	}
+	h.mu.Lock()
+	h.rules = rs
+	h.modified = fi.ModTime()
+	h.mu.Unlock()
+	reloads.WithLabelValues(resultSuccess).Inc()
+	logger.Infof("Loaded risk rules from %s", h.opts.File)
+	return nil
+}
+
+// reloadIfModified reloads the rules file if it was modified since it was last loaded.
+// An invalid file is only reported once, until it is modified again.
+func (h *Heuristic) reloadIfModified() error {
+	fi, err := os.Stat(h.opts.File)
+	if err != nil {
+		return fmt.Errorf("failed to read risk rules file %s: %v", h.opts.File, err)
+	}
+	h.mu.RLock()
+	modified := h.modified
+	h.mu.RUnlock()
+	if fi.ModTime().Equal(modified) {
+		return nil
+	}
+	err = h.Reload()
+	if err != nil {
+		h.mu.Lock()
+		h.modified = fi.ModTime()
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// Score sums the scores of the factors every edit has. The velocity of a user counts each revision once, so that the
+// edits of a batch scored again are not counted twice.
+func (h *Heuristic) Score(edits []Edit) ([]Score, error) {
+	h.mu.RLock()
+	rs := h.rules
+	h.mu.RUnlock()
+
+	velocities, err := h.velocities(rs, edits)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Score, len(edits))
+	for i, e := range edits {
+		s := &out[i]
+		add := func(factor string, score int64, applies bool) {
+			if score != 0 && applies {
+				s.Risk += score
+				s.Factors = append(s.Factors, factor)
+			}
+		}
+		add(FactorAnonymous, rs.Anonymous, transform.IsAnonymous(e.User))
+		add(FactorRemoval, rs.Removal, e.HasLength && e.OldLength-e.Length >= rs.RemovalBytes)
+		add(FactorEmptyComment, rs.EmptyComment, e.Comment == "")
+		add(FactorNewArticle, rs.NewArticle, e.New && e.Namespace == 0)
+		add(FactorVelocity, rs.Velocity, velocities != nil && velocities[i] >= rs.VelocityEdits)
+		scores.Observe(float64(s.Risk))
+	}
+	return out, nil
+}
+
+// velocities adds the revisions of edits to the sets of their users' revisions in their velocity window, and returns
+// the number of revisions of each edit's user in its window, or nil if velocity is not scored
+func (h *Heuristic) velocities(rs *rules, edits []Edit) ([]int64, error) {
+	if rs.Velocity == 0 || len(edits) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts := make([]*redis.IntCmd, len(edits))
+	_, err := h.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, e := range edits {
+			n := e.Time.UnixNano() / int64(rs.window)
+			key := velocityPrefix + strconv.FormatInt(n, 10) + "_" + e.Wiki + "_" + e.User
+			p.SAdd(ctx, key, e.Revision)
+			counts[i] = p.SCard(ctx, key)
+			p.Expire(ctx, key, 2*rs.window)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the velocity of %d edits in Redis: %v", len(edits), err)
+	}
+	velocities := make([]int64, len(edits))
+	for i, c := range counts {
+		velocities[i] = c.Val()
+	}
+	return velocities, nil
+}
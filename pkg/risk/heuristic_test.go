@@ -0,0 +1,155 @@
+package risk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/transform"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Heuristic risk scorer", func() {
+	now := time.Date(2020, 8, 10, 10, 50, 30, 0, time.UTC)
+
+	var (
+		m *miniredis.Miniredis
+		r *redis.Client
+		h *Heuristic
+	)
+
+	edit := func(user string, rev int64, comment string) Edit {
+		return Edit{Wiki: "enwiki", Title: "Page", User: user, Comment: comment, Revision: rev, Time: now}
+	}
+
+	score := func(edits ...Edit) []Score {
+		s, err := h.Score(edits)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s).To(HaveLen(len(edits)))
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+		h, err = NewHeuristic(r, &Opts{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	It("sums the scores of the factors of edits", func() {
+		removal := edit("Example", 2, "trim")
+		removal.HasLength, removal.OldLength, removal.Length = true, 1000, 400
+		article := edit("Example", 3, "")
+		article.New = true
+		userPage := article
+		userPage.Namespace = 2
+		s := score(edit("192.0.2.1", 1, ""), removal, article, userPage, edit("2001:DB8:0:0:0:0:0:1", 5, "typo"), edit("Example", 6, "typo"))
+		Expect(s).To(Equal([]Score{
+			{Risk: 40, Factors: []string{FactorAnonymous, FactorEmptyComment}},
+			{Risk: 30, Factors: []string{FactorRemoval}},
+			{Risk: 30, Factors: []string{FactorEmptyComment, FactorNewArticle}},
+			{Risk: 10, Factors: []string{FactorEmptyComment}},
+			{Risk: 30, Factors: []string{FactorAnonymous}},
+			{Risk: 0},
+		}))
+	})
+
+	It("scores anonymous edits whose IP address was hashed", func() {
+		s := score(edit(transform.AnonymousPrefix+"0123456789abcdef0123456789abcdef", 1, "typo"), edit("0123456789abcdef0123456789abcdef", 2, "typo"))
+		Expect(s).To(Equal([]Score{
+			{Risk: 30, Factors: []string{FactorAnonymous}},
+			{Risk: 0},
+		}))
+	})
+
+	It("scores the velocity of users once per revision", func() {
+		var edits []Edit
+		for i := int64(1); i <= 10; i++ {
+			edits = append(edits, edit("Example", i, "typo"))
+		}
+		s := score(edits...)
+		Expect(s[8].Factors).To(BeEmpty())
+		Expect(s[9].Factors).To(Equal([]string{FactorVelocity}))
+		Expect(score(edits[:9]...)[0].Factors).To(Equal([]string{FactorVelocity}))
+
+		other := edit("Other", 11, "typo")
+		later := edit("Example", 12, "typo")
+		later.Time = now.Add(time.Minute)
+		Expect(score(other, later)).To(Equal([]Score{{}, {}}))
+		Expect(m.TTL("risk_velocity_26617610_enwiki_Example")).To(BeNumerically(">", 0))
+	})
+
+	Context("with a rules file", func() {
+		var file string
+
+		write := func(rules string) {
+			Expect(ioutil.WriteFile(file, []byte(rules), 0644)).To(Succeed())
+			// make sure the modification time changes on file systems with coarse timestamps
+			t := time.Now().Add(time.Duration(len(rules)) * time.Second)
+			Expect(os.Chtimes(file, t, t)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "risk")
+			Expect(err).NotTo(HaveOccurred())
+			file = filepath.Join(dir, "risk.yaml")
+			write("anonymous: 50\n")
+			h, err = NewHeuristic(r, &Opts{File: file, ReloadInterval: 10 * time.Millisecond})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(file))
+		})
+
+		It("scores the factors of the file only", func() {
+			Expect(score(edit("192.0.2.1", 1, ""), edit("Example", 2, ""))).To(Equal([]Score{
+				{Risk: 50, Factors: []string{FactorAnonymous}},
+				{},
+			}))
+		})
+
+		It("reloads the file when it changes", func() {
+			h.Start()
+			defer h.Stop()
+			write("anonymous: 50\nemptyComment: 15\n")
+			Eventually(func() int64 { return score(edit("192.0.2.1", 1, ""))[0].Risk }).Should(Equal(int64(65)))
+		})
+
+		It("keeps the rules when the file becomes invalid", func() {
+			write("anonymous: 50\nvelocity: 10\n")
+			Expect(h.reloadIfModified()).To(HaveOccurred())
+			Expect(score(edit("192.0.2.1", 1, ""))[0].Risk).To(Equal(int64(50)))
+			Expect(h.reloadIfModified()).To(Succeed())
+
+			write("emptyComment: 5\n")
+			Expect(h.reloadIfModified()).To(Succeed())
+			Expect(score(edit("192.0.2.1", 1, ""))[0].Risk).To(Equal(int64(5)))
+		})
+	})
+
+	It("rejects invalid rules", func() {
+		for rules, msg := range map[string]string{
+			"unknown: 1":                                        "field unknown not found",
+			"removal: 10":                                       "removal requires a positive removalBytes",
+			"velocity: 10\nvelocityEdits: 0":                    "velocity requires a positive velocityEdits",
+			"velocity: 10\nvelocityEdits: 3":                    "velocity requires a velocityWindow of at least 1s",
+			"velocity: 10\nvelocityEdits: 3\nvelocityWindow: x": "velocity requires a velocityWindow of at least 1s",
+		} {
+			_, err := compileRules([]byte(rules))
+			Expect(err).To(MatchError(ContainSubstring(msg)), rules)
+		}
+	})
+})
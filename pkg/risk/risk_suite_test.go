@@ -0,0 +1,13 @@
+package risk
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRisk(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Risk Suite")
+}
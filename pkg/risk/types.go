@@ -0,0 +1,84 @@
+package risk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Scorer assigns edits a heuristic risk of being vandalism.
+// The Heuristic is the built-in Scorer; others can be set on the aggregation Engine instead.
+type Scorer interface {
+	// Score returns the scores of edits, in the order of the edits
+	Score(edits []Edit) ([]Score, error)
+}
+
+// Edit is an edit or a new page, as scored by a Scorer
+type Edit struct {
+	Wiki      string
+	Title     string
+	User      string
+	Namespace int64
+	// New is set for new pages
+	New     bool
+	Comment string
+	// Revision is the ID of the revision the edit made
+	Revision int64
+	// Length is the length of the page after the edit, and OldLength before it, if the event tells them
+	HasLength bool
+	Length    int64
+	OldLength int64
+	Time      time.Time
+}
+
+// Score is the risk of an edit and the factors that make it up
+type Score struct {
+	Risk    int64
+	Factors []string
+}
+
+// Heuristic scores edits by summing the scores its Rules give to the factors an edit has.
+// With a rules file, the rules are reloaded whenever the file changes, so that they can be tuned without a restart.
+type Heuristic struct {
+	r     *redis.Client
+	opts  *Opts
+	mu    sync.RWMutex
+	rules *rules
+	// modified is the modification time of the rules file when it was last loaded
+	modified time.Time
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Opts configure a Heuristic
+type Opts struct {
+	// File is a YAML file of Rules. Without one, the DefaultRules are used.
+	File string
+	// ReloadInterval is the interval at which the file is checked for changes
+	ReloadInterval time.Duration
+}
+
+// Rules weigh the factors of the risk of an edit. Factors scoring 0 are not checked.
+type Rules struct {
+	// Anonymous scores edits made from IP addresses
+	Anonymous int64 `yaml:"anonymous"`
+	// Removal scores edits removing at least RemovalBytes
+	Removal      int64 `yaml:"removal"`
+	RemovalBytes int64 `yaml:"removalBytes"`
+	// EmptyComment scores edits without a summary
+	EmptyComment int64 `yaml:"emptyComment"`
+	// NewArticle scores new pages in the main namespace
+	NewArticle int64 `yaml:"newArticle"`
+	// Velocity scores the edits of users who made at least VelocityEdits edits of the wiki in the current VelocityWindow,
+	// e.g. 1m
+	Velocity       int64  `yaml:"velocity"`
+	VelocityEdits  int64  `yaml:"velocityEdits"`
+	VelocityWindow string `yaml:"velocityWindow"`
+}
+
+// rules are validated Rules
+type rules struct {
+	Rules
+	window time.Duration
+}
@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/avro"
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+const moduleName = "sink"
+
+var (
+	wg sync.WaitGroup
+
+	logger      = log.MustGetLogger(moduleName)
+	kafkaLogger = log.MustGetLogger("kafka-client")
+
+	recordsWritten = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_sink_records_total",
+			Help: "Total number of events written to the sink",
+		},
+	)
+
+	sinkErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_sink_errors_total",
+			Help: "Total number of errors encountered while writing to the sink",
+		},
+		[]string{"type"},
+	)
+
+	flushTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_sink_flush_duration_seconds",
+			Help:    "Time taken to write a batch to the sink",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5},
+		},
+	)
+)
+
+// NewConsumer returns a Consumer that writes events from the given kafka topic to the Sink provided
+func NewConsumer(s Sink, opts *ConsumerOpts) (*Consumer, error) {
+	if (opts.Broker == "") || (opts.Topic == "") || (opts.GroupID == "") {
+		return nil, ErrNoSrc
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+
+	k := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:               []string{opts.Broker},
+		GroupID:               opts.GroupID,
+		Topic:                 opts.Topic,
+		ErrorLogger:           &crudErrorLogger{},
+		Logger:                newCrudLogger(),
+		WatchPartitionChanges: true,
+	})
+
+	var registry *avro.Registry
+	if opts.SchemaRegistry != "" {
+		registry = avro.NewRegistry(opts.SchemaRegistry)
+	}
+
+	return &Consumer{
+		opts:    opts,
+		sink:    s,
+		k:       k,
+		decoder: avro.NewDeserializer(registry),
+		stop:    make(chan (bool)),
+	}, nil
+}
+
+// Start starts consuming events and blocks until the Consumer is stopped
+func (c *Consumer) Start() error {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-c.stop:
+				return
+			default:
+				err := c.run()
+				if err != nil {
+					logger.Errorf("Sink consumer exited with error: %v", err)
+					time.Sleep(5 * time.Second)
+				}
+			}
+		}
+	}()
+
+	if !util.IsTTY() {
+		logger.Info("Terminal is not a TTY, not displaying progress indicator")
+	} else {
+		c.spinner = util.NewSpinner("Processing... ")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-c.stop:
+					return
+				default:
+					c.spinner.Tick()
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// Stop shuts down the Consumer, closing the kafka reader and the Sink
+func (c *Consumer) Stop() {
+	close(c.stop)
+	wg.Wait()
+	if err := c.k.Close(); err != nil {
+		logger.Errorf("Error closing kafka reader: %v", err)
+	}
+	if err := c.sink.Close(); err != nil {
+		logger.Errorf("Error closing sink: %v", err)
+	}
+}
+
+func (c *Consumer) run() error {
+	var batch []kafka.Message
+	deadline := time.Now().Add(c.opts.FlushInterval)
+	for {
+		select {
+		case <-c.stop:
+			return nil
+		default:
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		msg, err := c.k.FetchMessage(ctx)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err != nil && !timedOut {
+			return fmt.Errorf("error reading message from kafka: %v", err)
+		}
+		if err == nil {
+			batch = append(batch, msg)
+		}
+		if len(batch) >= c.opts.BatchSize || timedOut {
+			if len(batch) > 0 {
+				if !c.flush(batch) {
+					return nil
+				}
+				batch = nil
+			}
+			deadline = time.Now().Add(c.opts.FlushInterval)
+		}
+	}
+}
+
+// decode turns a batch of messages into records, decoding Avro messages into JSON.
+// Messages that cannot be decoded are skipped, since retrying cannot fix them. The only error returned is a failure to
+// reach the schema registry, which is temporary.
+func (c *Consumer) decode(batch []kafka.Message) ([]*Record, error) {
+	records := make([]*Record, 0, len(batch))
+	for _, m := range batch {
+		data, err := c.decoder.Deserialize(m.Value)
+		if _, ok := err.(*avro.RegistryError); ok {
+			return nil, err
+		}
+		if err != nil {
+			sinkErrors.WithLabelValues("decode").Inc()
+			logger.Errorf("Skipping message at offset %d of partition %d: %v", m.Offset, m.Partition, err)
+			continue
+		}
+		records = append(records, &Record{ID: string(m.Key), Data: data, Partition: m.Partition, Offset: m.Offset})
+	}
+	return records, nil
+}
+
+// flush writes a batch to the sink and commits its offsets, retrying until it succeeds.
+// It returns false if the Consumer was stopped before the batch could be written.
+// Since the reader has already moved past the batch, giving up on it would lose events.
+func (c *Consumer) flush(batch []kafka.Message) bool {
+	backoff := time.Second
+	var records []*Record
+	for {
+		var err error
+		records, err = c.decode(batch)
+		if err != nil {
+			sinkErrors.WithLabelValues("registry").Inc()
+		} else {
+			timer := prometheus.NewTimer(flushTime)
+			err = c.sink.Write(records)
+			timer.ObserveDuration()
+			if err == nil {
+				break
+			}
+			sinkErrors.WithLabelValues("write").Inc()
+		}
+		logger.Errorf("Failed to write batch of %d events, retrying in %s: %v", len(batch), backoff, err)
+		select {
+		case <-c.stop:
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+	recordsWritten.Add(float64(len(records)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.k.CommitMessages(ctx, batch...); err != nil {
+		// the batch is stored, so a failed commit only means it may be written again after a restart
+		sinkErrors.WithLabelValues("commit").Inc()
+		logger.Errorf("Failed to commit offsets: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const moduleName = "elastic-sink"
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	docsIndexed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_elastic_indexed_documents_total",
+			Help: "Total number of documents indexed into Elasticsearch",
+		},
+	)
+
+	bulkErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_elastic_bulk_errors_total",
+			Help: "Total number of errors encountered during bulk indexing",
+		},
+		[]string{"type"},
+	)
+
+	bulkTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_elastic_bulk_duration_seconds",
+			Help:    "Time taken by a single bulk request",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5},
+		},
+	)
+)
+
+// NewSink returns a Sink for the Elasticsearch cluster given and installs the index template for its indices
+func NewSink(opts *Opts) (*Sink, error) {
+	if opts.URL == "" {
+		return nil, ErrNoURL
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	if opts.IndexPrefix == "" {
+		opts.IndexPrefix = "pleiades-events"
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 500 * time.Millisecond
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	s := &Sink{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+	err := s.putTemplate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to install index template: %v", err)
+	}
+	return s, nil
+}
+
+// NewPublisher returns a Publisher that bulk-indexes events from the source channel into Elasticsearch
+func NewPublisher(opts *Opts, src <-chan *sse.Event) (publisher.Publisher, error) {
+	s, err := NewSink(opts)
+	if err != nil {
+		return nil, err
+	}
+	return sink.NewPublisher("elasticsearch", s, &sink.PublisherOpts{
+		BatchSize:     opts.BatchSize,
+		FlushInterval: opts.FlushInterval,
+	}, src)
+}
+
+// IndexName returns the daily index an event belongs in, based on its meta.dt or timestamp
+func (s *Sink) IndexName(data []byte) (string, string, error) {
+	var e event
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse event: %v", err)
+	}
+	var t time.Time
+	var id string
+	if e.Meta != nil {
+		id = e.Meta.ID
+		t, _ = time.Parse(time.RFC3339, e.Meta.DT)
+	}
+	if t.IsZero() && e.Timestamp > 0 {
+		t = time.Unix(e.Timestamp, 0)
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return fmt.Sprintf("%s-%s", s.opts.IndexPrefix, t.UTC().Format("2006.01.02")), id, nil
+}
+
+// Write bulk-indexes a batch of events, using each event's meta.id as document ID.
+// Requests and items rejected with 429 are retried with backoff; any other item failure is logged and skipped.
+func (s *Sink) Write(records []*sink.Record) error {
+	pending := make([][]byte, 0, len(records))
+	for _, r := range records {
+		index, id, err := s.IndexName(r.Data)
+		if err != nil {
+			bulkErrors.WithLabelValues("parse").Inc()
+			logger.Errorf("Skipping unparsable event %s: %v", r.ID, err)
+			continue
+		}
+		action := map[string]map[string]string{"index": {"_index": index}}
+		if id != "" {
+			action["index"]["_id"] = id
+		}
+		a, _ := json.Marshal(action)
+		line := append(append(a, '\n'), bytes.TrimSpace(r.Data)...)
+		pending = append(pending, append(line, '\n'))
+	}
+
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > s.opts.MaxRetries {
+				return fmt.Errorf("giving up on %d documents after %d retries", len(pending), s.opts.MaxRetries)
+			}
+			bulkErrors.WithLabelValues("retry").Inc()
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var err error
+		pending, err = s.bulk(pending)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op, since the sink holds no resources beyond its HTTP client
+func (s *Sink) Close() error {
+	return nil
+}
+
+// bulk sends a single _bulk request and returns the items that should be retried
+func (s *Sink) bulk(items [][]byte) ([][]byte, error) {
+	timer := prometheus.NewTimer(bulkTime)
+	defer timer.ObserveDuration()
+
+	body := bytes.Join(items, nil)
+	resp, err := s.do(http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		bulkErrors.WithLabelValues("request").Inc()
+		return nil, fmt.Errorf("bulk request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		io.Copy(ioutil.Discard, resp.Body)
+		bulkErrors.WithLabelValues("throttled").Inc()
+		return items, nil
+	}
+	if resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		bulkErrors.WithLabelValues("request").Inc()
+		return nil, fmt.Errorf("bulk request failed with status %d: %s", resp.StatusCode, string(msg))
+	}
+
+	var br bulkResponse
+	err = json.NewDecoder(resp.Body).Decode(&br)
+	if err != nil {
+		bulkErrors.WithLabelValues("response").Inc()
+		return nil, fmt.Errorf("failed to parse bulk response: %v", err)
+	}
+	if !br.Errors {
+		docsIndexed.Add(float64(len(items)))
+		return nil, nil
+	}
+	if len(br.Items) != len(items) {
+		return nil, fmt.Errorf("bulk response contained %d items for %d documents", len(br.Items), len(items))
+	}
+
+	var retry [][]byte
+	for i, item := range br.Items {
+		for _, result := range item {
+			switch {
+			case result.Status < 300:
+				docsIndexed.Inc()
+			case result.Status == http.StatusTooManyRequests:
+				retry = append(retry, items[i])
+			default:
+				bulkErrors.WithLabelValues("document").Inc()
+				if result.Error != nil {
+					logger.Errorf("Failed to index document %s into %s: %s: %s", result.ID, result.Index, result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+	}
+	if len(retry) > 0 {
+		bulkErrors.WithLabelValues("throttled").Add(float64(len(retry)))
+	}
+	return retry, nil
+}
+
+func (s *Sink) putTemplate() error {
+	body, err := json.Marshal(IndexTemplate(s.opts.IndexPrefix))
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, "/_index_template/"+s.opts.IndexPrefix, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(msg))
+	}
+	logger.Debugf("Installed index template %s", s.opts.IndexPrefix)
+	return nil
+}
+
+func (s *Sink) do(method string, path string, contentType string, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	req, err := http.NewRequest(method, s.opts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if s.opts.Username != "" {
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,15 @@
+package elastic
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/op/go-logging"
+)
+
+func TestElasticSink(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Elasticsearch Sink Suite")
+}
@@ -0,0 +1,127 @@
+package elastic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/sink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testEvent = `{"$schema":"/mediawiki/recentchange/1.0.0","meta":{"id":"9bea80f8-f99c-4b56-93c4-0eb4272bbcb9","dt":"2020-07-31T14:58:47Z","stream":"mediawiki.recentchange"},"id":53404707,"type":"edit","namespace":10,"title":"Test","timestamp":1596207527,"user":"DMbotY","bot":true,"wiki":"hewiki"}`
+
+// fakeCluster is a minimal stand-in for the Elasticsearch template and bulk APIs
+type fakeCluster struct {
+	mu        sync.Mutex
+	templates map[string]map[string]interface{}
+	docs      map[string]map[string]string
+	throttle  int
+	rejectOne int
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut && len(r.URL.Path) > len("/_index_template/"):
+		t := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&t)
+		f.templates[r.URL.Path[len("/_index_template/"):]] = t
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+		if f.throttle > 0 {
+			f.throttle--
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(make([]byte, 1024*1024), 1024*1024)
+		resp := bulkResponse{}
+		for sc.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(sc.Bytes(), &action)
+			sc.Scan()
+			idx, id := action["index"]["_index"], action["index"]["_id"]
+			status := http.StatusCreated
+			if f.rejectOne > 0 {
+				f.rejectOne--
+				status = http.StatusTooManyRequests
+				resp.Errors = true
+			} else {
+				if f.docs[idx] == nil {
+					f.docs[idx] = make(map[string]string)
+				}
+				f.docs[idx][id] = sc.Text()
+			}
+			resp.Items = append(resp.Items, map[string]bulkResponseItem{"index": {Index: idx, ID: id, Status: status}})
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Elasticsearch Sink", func() {
+
+	var (
+		cluster *fakeCluster
+		server  *httptest.Server
+	)
+
+	BeforeEach(func() {
+		cluster = &fakeCluster{templates: make(map[string]map[string]interface{}), docs: make(map[string]map[string]string)}
+		server = httptest.NewServer(cluster)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("installs an index template derived from the event type", func() {
+		_, err := NewSink(&Opts{URL: server.URL, IndexPrefix: "test"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cluster.templates).Should(HaveKey("test"))
+		props := IndexTemplate("test")["template"].(map[string]interface{})["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+		Expect(props["wiki"]).Should(Equal(map[string]interface{}{"type": "keyword"}))
+		Expect(props["bot"]).Should(Equal(map[string]interface{}{"type": "boolean"}))
+		Expect(props["namespace"]).Should(Equal(map[string]interface{}{"type": "long"}))
+		Expect(props["timestamp"]).Should(HaveKeyWithValue("format", "epoch_second"))
+		Expect(props["length"]).Should(HaveKey("properties"))
+		Expect(props).ShouldNot(HaveKey("$schema"))
+	})
+
+	It("indexes events into daily indices by meta.id", func() {
+		s, err := NewSink(&Opts{URL: server.URL, IndexPrefix: "test"})
+		Expect(err).NotTo(HaveOccurred())
+		err = s.Write([]*sink.Record{{ID: "1", Data: []byte(testEvent)}, {ID: "1", Data: []byte(testEvent)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cluster.docs).Should(HaveKey("test-2020.07.31"))
+		Expect(cluster.docs["test-2020.07.31"]).Should(HaveLen(1))
+		Expect(cluster.docs["test-2020.07.31"]).Should(HaveKey("9bea80f8-f99c-4b56-93c4-0eb4272bbcb9"))
+	})
+
+	It("retries throttled requests and documents", func() {
+		s, err := NewSink(&Opts{URL: server.URL, IndexPrefix: "test", MaxRetries: 3, RetryBackoff: time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		cluster.throttle = 1
+		cluster.rejectOne = 1
+		err = s.Write([]*sink.Record{{ID: "1", Data: []byte(testEvent)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cluster.docs["test-2020.07.31"]).Should(HaveLen(1))
+	})
+
+	It("gives up after the configured number of retries", func() {
+		s, err := NewSink(&Opts{URL: server.URL, IndexPrefix: "test", MaxRetries: 1, RetryBackoff: time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		cluster.throttle = 5
+		err = s.Write([]*sink.Record{{ID: "1", Data: []byte(testEvent)}})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,44 @@
+package elastic
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Options are the configuration values of the Elasticsearch sink
+var Options = []plugin.Option{
+	{Name: "elastic.url", Usage: "the Elasticsearch or OpenSearch URL to index events into", Default: "http://localhost:9200"},
+	{Name: "elastic.indexPrefix", Usage: "the prefix for daily index names (<prefix>-YYYY.MM.DD)", Default: "pleiades-events"},
+	{Name: "elastic.username", Usage: "the username for Elasticsearch basic auth", Default: ""},
+	{Name: "elastic.password", Usage: "the password for Elasticsearch basic auth", Default: ""},
+	{Name: "elastic.batchSize", Usage: "the maximum number of events per bulk request", Default: 500},
+	{Name: "elastic.flushInterval", Usage: "the maximum time to wait before sending an incomplete bulk request", Default: 5 * time.Second},
+	{Name: "elastic.maxRetries", Usage: "the number of times to retry throttled bulk requests", Default: 5},
+}
+
+func init() {
+	publisher.Register(&publisher.Plugin{
+		Name:        "elastic",
+		Description: "elasticsearch publisher",
+		Options:     Options,
+		New: func(cfg plugin.Config, src <-chan *sse.Event) (publisher.Publisher, error) {
+			return NewPublisher(OptsFromConfig(cfg), src)
+		},
+	})
+}
+
+// OptsFromConfig returns the Opts described by the values of Options
+func OptsFromConfig(cfg plugin.Config) *Opts {
+	return &Opts{
+		URL:           cfg.String("elastic.url"),
+		IndexPrefix:   cfg.String("elastic.indexPrefix"),
+		Username:      cfg.String("elastic.username"),
+		Password:      cfg.String("elastic.password"),
+		MaxRetries:    cfg.Int("elastic.maxRetries"),
+		BatchSize:     cfg.Int("elastic.batchSize"),
+		FlushInterval: cfg.Duration("elastic.flushInterval"),
+	}
+}
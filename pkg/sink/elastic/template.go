@@ -0,0 +1,74 @@
+package elastic
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+)
+
+// mappingOverrides replace the type-derived mapping for fields that need more than a keyword
+var mappingOverrides = map[string]map[string]interface{}{
+	"meta.dt":            {"type": "date"},
+	"timestamp":          {"type": "date", "format": "epoch_second"},
+	"comment":            {"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 1024}}},
+	"parsedcomment":      {"type": "text", "index": false},
+	"title":              {"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 1024}}},
+	"log_id":             {"type": "long"},
+	"log_type":           {"type": "keyword"},
+	"log_action_comment": {"type": "text"},
+	"log_params":         {"type": "object", "enabled": false},
+	"revision.new":       {"type": "long"},
+	"revision.old":       {"type": "long"},
+}
+
+// IndexTemplate returns an index template body for indices matching the given prefix.
+// The mappings are derived from the fields of aggregator.MediawikiRecentchange.
+func IndexTemplate(prefix string) map[string]interface{} {
+	return map[string]interface{}{
+		"index_patterns": []string{prefix + "-*"},
+		"template": map[string]interface{}{
+			"settings": map[string]interface{}{
+				"number_of_shards": 1,
+			},
+			"mappings": map[string]interface{}{
+				"dynamic":    false,
+				"properties": mappingFor(reflect.TypeOf(aggregator.MediawikiRecentchange{}), ""),
+			},
+		},
+	}
+}
+
+func mappingFor(t reflect.Type, path string) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || strings.HasPrefix(name, "$") {
+			continue
+		}
+		full := name
+		if path != "" {
+			full = path + "." + name
+		}
+		if m, ok := mappingOverrides[full]; ok {
+			props[name] = m
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.Struct:
+			props[name] = map[string]interface{}{"properties": mappingFor(ft, full)}
+		case reflect.Bool:
+			props[name] = map[string]interface{}{"type": "boolean"}
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			props[name] = map[string]interface{}{"type": "long"}
+		default:
+			props[name] = map[string]interface{}{"type": "keyword"}
+		}
+	}
+	return props
+}
@@ -0,0 +1,58 @@
+package elastic
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Sink bulk-indexes events into Elasticsearch or OpenSearch
+type Sink struct {
+	opts   *Opts
+	client *http.Client
+}
+
+// Opts hold configuration for the Elasticsearch sink
+type Opts struct {
+	URL          string
+	IndexPrefix  string
+	Username     string
+	Password     string
+	MaxRetries   int
+	RetryBackoff time.Duration
+	Timeout      time.Duration
+
+	// BatchSize and FlushInterval control batching when the sink is used as a publisher
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// event holds the fields needed to route a document to its index
+type event struct {
+	Meta *struct {
+		ID string `json:"id"`
+		DT string `json:"dt"`
+	} `json:"meta"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// bulkResponse is the subset of the _bulk API response needed to detect failed items
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Index  string         `json:"_index"`
+	ID     string         `json:"_id"`
+	Status int            `json:"status"`
+	Error  *bulkItemError `json:"error,omitempty"`
+}
+
+type bulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// ErrNoURL is returned when a Sink is created without an Elasticsearch URL
+var ErrNoURL = fmt.Errorf("No Elasticsearch URL provided")
@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+)
+
+// NewPublisher returns a Publisher that writes events from the source channel to the Sink provided
+func NewPublisher(name string, s Sink, opts *PublisherOpts, src <-chan *sse.Event) (publisher.Publisher, error) {
+	if src == nil {
+		return nil, ErrNilChan
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	return &Publisher{
+		opts:   opts,
+		sink:   s,
+		name:   name,
+		source: src,
+	}, nil
+}
+
+// ValidateConnection always returns nil, since sinks validate their connection when they are created
+func (p *Publisher) ValidateConnection() error {
+	return nil
+}
+
+// ReadAndPublish will read Events from the input channel and write them to the sink in batches
+//
+// Calling ReadAndPublish() will reset the processed message counter of the underlying Publisher and
+// returns the value of the counter when the Publisher's source channel is closed
+func (p *Publisher) ReadAndPublish() (int64, error) {
+	logger.Debugf("%s publisher starting to process events", p.name)
+	p.msgCount = 0
+	ticker := time.NewTicker(p.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-p.source:
+			if !ok {
+				err := p.flush()
+				logger.Debugf("%s publisher stopped", p.name)
+				return p.msgCount, err
+			}
+			p.msgCount++
+			if e != nil {
+				err := p.ProcessEvent(e)
+				if err != nil {
+					return p.msgCount, fmt.Errorf("error processing event: %v", err)
+				}
+			}
+		case <-ticker.C:
+			err := p.flush()
+			if err != nil {
+				return p.msgCount, err
+			}
+		}
+	}
+}
+
+// ProcessEvent adds a single event to the current batch and flushes the batch if it is full
+func (p *Publisher) ProcessEvent(e *sse.Event) error {
+	d, err := ioutil.ReadAll(e.GetData())
+	if err != nil {
+		sinkErrors.WithLabelValues("event_data_read").Inc()
+		return fmt.Errorf("error reading event data: %v", err)
+	}
+	p.batch = append(p.batch, &Record{ID: e.ID, Data: d, Offset: -1})
+	if len(p.batch) >= p.opts.BatchSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// GetResumeID always returns an empty string, since sinks are not queried for previously written events
+func (p *Publisher) GetResumeID() string {
+	logger.Infof("%s publisher does not support resuming", p.name)
+	return ""
+}
+
+func (p *Publisher) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	err := p.sink.Write(p.batch)
+	if err != nil {
+		sinkErrors.WithLabelValues("write").Inc()
+		return fmt.Errorf("error writing to %s: %v", p.name, err)
+	}
+	recordsWritten.Add(float64(len(p.batch)))
+	p.batch = nil
+	return nil
+}
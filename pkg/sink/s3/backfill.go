@@ -0,0 +1,126 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// backfillTopic is the topic in the event IDs of replayed events, so that they are not archived again
+const backfillTopic = "pleiades.backfill"
+
+var partitionRegExp = regexp.MustCompile(`date=(\d{4}-\d{2}-\d{2})/hour=(\d{2})/_manifest[^/]*\.json$`)
+
+// Replay reads all archived events between from (inclusive) and to (exclusive) and passes them to fn in archive order.
+// If wiki is not empty, only events from that wiki are replayed. Only objects listed in a manifest are read.
+// Each event is given a synthetic event ID carrying its timestamp, in the same format as the IDs of the WMF stream.
+// Parquet objects cannot be replayed, so Replay fails before replaying anything if the time range contains any.
+func (s *Sink) Replay(from time.Time, to time.Time, wiki string, fn func(id string, data []byte) error) (int64, error) {
+	prefix := "wiki="
+	if wiki != "" {
+		prefix = "wiki=" + wiki + "/"
+	}
+	if s.opts.Prefix != "" {
+		prefix = s.opts.Prefix + "/" + prefix
+	}
+	keys, err := s.client.ListObjects(prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list archive: %v", err)
+	}
+
+	var objects []string
+	for _, k := range keys {
+		match := partitionRegExp.FindStringSubmatch(k)
+		if len(match) < 3 {
+			continue
+		}
+		hour, err := time.Parse("2006-01-02 15", match[1]+" "+match[2])
+		if err != nil || hour.Before(from.Truncate(time.Hour)) || !hour.Before(to) {
+			continue
+		}
+		m, err := s.manifest(k)
+		if err != nil {
+			return 0, err
+		}
+		for _, o := range m.Objects {
+			if !strings.HasSuffix(o.Key, ".ndjson.gz") {
+				return 0, fmt.Errorf("cannot replay %s: only %s objects can be replayed", o.Key, FormatNDJSON)
+			}
+			objects = append(objects, o.Key)
+		}
+	}
+
+	var count int64
+	for _, k := range objects {
+		n, err := s.replayObject(k, from, to, fn)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (s *Sink) replayObject(key string, from time.Time, to time.Time, fn func(id string, data []byte) error) (int64, error) {
+	b, err := s.client.GetObject(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress %s: %v", key, err)
+	}
+	defer zr.Close()
+
+	var count int64
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		var e event
+		err := json.Unmarshal(line, &e)
+		if err != nil {
+			logger.Errorf("Skipping unparsable event in %s: %v", key, err)
+			continue
+		}
+		ts := eventTime(&e)
+		if ts.Before(from) || !ts.Before(to) {
+			continue
+		}
+		id := fmt.Sprintf(`[{"topic":"%s","partition":0,"timestamp":%d}]`, backfillTopic, ts.UnixNano()/1000000)
+		err = fn(id, append([]byte{}, line...))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, sc.Err()
+}
+
+// isBackfilled returns whether an event ID is one given to a replayed event
+func isBackfilled(id string) bool {
+	var parts []struct {
+		Topic string `json:"topic"`
+	}
+	err := json.Unmarshal([]byte(id), &parts)
+	return err == nil && len(parts) > 0 && parts[0].Topic == backfillTopic
+}
+
+// eventTime returns the time an event occurred, or the zero time if it carries no timestamp
+func eventTime(e *event) time.Time {
+	if e.Meta != nil {
+		t, err := time.Parse(time.RFC3339, e.Meta.DT)
+		if err == nil {
+			return t.UTC()
+		}
+	}
+	if e.Timestamp > 0 {
+		return time.Unix(e.Timestamp, 0).UTC()
+	}
+	return time.Time{}
+}
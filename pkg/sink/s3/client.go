@@ -0,0 +1,362 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a minimal client for S3-compatible object storage, signing requests with AWS Signature Version 4
+type Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	partSize  int
+	http      *http.Client
+	now       func() time.Time
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// NewClient returns a Client for the given bucket
+func NewClient(opts *Opts) (*Client, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" {
+		return nil, ErrNoBucket
+	}
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %v", opts.Endpoint, err)
+	}
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	accessKey, secretKey := opts.AccessKey, opts.SecretKey
+	if accessKey == "" && secretKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	partSize := opts.PartSize
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return &Client{
+		endpoint:  u,
+		bucket:    opts.Bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: opts.PathStyle,
+		partSize:  partSize,
+		http:      &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// Upload stores an object, using a multipart upload if it is larger than the configured part size
+func (c *Client) Upload(key string, body []byte, contentType string) error {
+	if len(body) <= c.partSize {
+		return c.PutObject(key, body, contentType)
+	}
+	return c.multipartUpload(key, body, contentType)
+}
+
+// PutObject stores an object in a single request
+func (c *Client) PutObject(key string, body []byte, contentType string) error {
+	resp, err := c.do(http.MethodPut, key, nil, body, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetObject retrieves an object, returning ErrNotFound if it does not exist
+func (c *Client) GetObject(key string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ListObjects returns the keys of all objects starting with prefix
+func (c *Client) ListObjects(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object listing: %v", err)
+		}
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (c *Client) multipartUpload(key string, body []byte, contentType string) error {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return fmt.Errorf("failed to initiate multipart upload: %v", err)
+	}
+	var init initiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&init)
+	resp.Body.Close()
+	if err != nil || init.UploadID == "" {
+		return fmt.Errorf("failed to parse multipart upload ID: %v", err)
+	}
+
+	var complete completeMultipartUpload
+	for n, off := 1, 0; off < len(body); n, off = n+1, off+c.partSize {
+		end := off + c.partSize
+		if end > len(body) {
+			end = len(body)
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {init.UploadID}}
+		resp, err := c.do(http.MethodPut, key, q, body[off:end], nil)
+		if err != nil {
+			c.abortMultipartUpload(key, init.UploadID)
+			return fmt.Errorf("failed to upload part %d: %v", n, err)
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completePart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		c.abortMultipartUpload(key, init.UploadID)
+		return err
+	}
+	resp, err = c.do(http.MethodPost, key, url.Values{"uploadId": {init.UploadID}}, b, map[string]string{"Content-Type": "application/xml"})
+	if err != nil {
+		c.abortMultipartUpload(key, init.UploadID)
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+	defer resp.Body.Close()
+	// S3 may report a failure with a 200 status once the upload has started, so check the body as well
+	rb, _ := ioutil.ReadAll(resp.Body)
+	if bytes.Contains(rb, []byte("<Error>")) {
+		c.abortMultipartUpload(key, init.UploadID)
+		return fmt.Errorf("failed to complete multipart upload: %s", string(rb))
+	}
+	return nil
+}
+
+func (c *Client) abortMultipartUpload(key string, uploadID string) {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		logger.Errorf("Failed to abort multipart upload %s for %s: %v", uploadID, key, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// do performs a signed request and returns the response if it has a 2xx status
+func (c *Client) do(method string, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer func() {
+		if cancel != nil {
+			cancel()
+		}
+	}()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	sign(req, payloadHash, c.accessKey, c.secretKey, c.region, "s3", c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s failed with status %d: %s", method, key, resp.StatusCode, string(msg))
+	}
+	// the body is read by the caller, so the context may only be cancelled once it is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	cancel = nil
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request.
+// The host header and all x-amz-* headers present on the request are signed.
+func sign(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters sorted by key, as required for signing
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// encodePath percent-encodes each segment of an object path
+func encodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// uriEncode percent-encodes everything except the unreserved characters, as required for signing
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,33 @@
+package s3
+
+import (
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Options are the configuration values of the S3 sink
+var Options = []plugin.Option{
+	{Name: "s3.endpoint", Usage: "the S3-compatible endpoint to archive events to", Default: "https://s3.amazonaws.com"},
+	{Name: "s3.bucket", Usage: "the bucket to archive events to", Default: ""},
+	{Name: "s3.region", Usage: "the region used to sign S3 requests", Default: "us-east-1"},
+	{Name: "s3.accessKey", Usage: "the S3 access key (defaults to $AWS_ACCESS_KEY_ID)", Default: ""},
+	{Name: "s3.secretKey", Usage: "the S3 secret key (defaults to $AWS_SECRET_ACCESS_KEY)", Default: ""},
+	{Name: "s3.pathStyle", Usage: "use path-style bucket addressing (required for MinIO)", Default: false},
+	{Name: "s3.prefix", Usage: "the key prefix for archived objects", Default: "events"},
+	{Name: "s3.format", Usage: "the object format to archive events in ('ndjson' or 'parquet')", Default: FormatNDJSON},
+	{Name: "s3.partSize", Usage: "objects larger than this are uploaded in parts of this size", Default: 16 * 1024 * 1024},
+}
+
+// OptsFromConfig returns the Opts described by the values of Options
+func OptsFromConfig(cfg plugin.Config) *Opts {
+	return &Opts{
+		Endpoint:  cfg.String("s3.endpoint"),
+		Bucket:    cfg.String("s3.bucket"),
+		Region:    cfg.String("s3.region"),
+		AccessKey: cfg.String("s3.accessKey"),
+		SecretKey: cfg.String("s3.secretKey"),
+		PathStyle: cfg.Bool("s3.pathStyle"),
+		Prefix:    cfg.String("s3.prefix"),
+		Format:    cfg.String("s3.format"),
+		PartSize:  cfg.Int("s3.partSize"),
+	}
+}
@@ -0,0 +1,15 @@
+package s3
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/op/go-logging"
+)
+
+func TestS3Sink(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "S3 Sink Suite")
+}
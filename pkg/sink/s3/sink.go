@@ -0,0 +1,311 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/parquet"
+	"github.com/gargath/pleiades/pkg/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	moduleName = "s3-sink"
+
+	// maxCachedManifests bounds the number of manifests kept in memory between writes
+	maxCachedManifests = 10000
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	objectsWritten = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_s3_objects_written_total",
+			Help: "Total number of objects written to the archive",
+		},
+	)
+
+	bytesWritten = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_s3_bytes_written_total",
+			Help: "Total number of compressed bytes written to the archive",
+		},
+	)
+
+	recordsSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_s3_records_skipped_total",
+			Help: "Total number of events not archived, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+// NewSink returns a Sink writing to the bucket given
+func NewSink(opts *Opts) (*Sink, error) {
+	if opts.Format == "" {
+		opts.Format = FormatNDJSON
+	}
+	if opts.Format != FormatNDJSON && opts.Format != FormatParquet {
+		return nil, fmt.Errorf("unsupported archive format %s (use %s or %s)", opts.Format, FormatNDJSON, FormatParquet)
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	c, err := NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{
+		opts:      opts,
+		client:    c,
+		manifests: make(map[string]*Manifest),
+	}, nil
+}
+
+// Write archives a batch of events, writing one object per hourly partition and kafka partition.
+// Events at or below the last offset recorded in a partition's manifest have already been archived and are skipped,
+// so a batch that is retried after a failure is never archived twice. Objects of events without offsets already listed in
+// the manifest are skipped likewise, and events replayed from the archive are not archived again.
+func (s *Sink) Write(records []*sink.Record) error {
+	groups := make(map[string][]*sink.Record)
+	var order []string
+	for _, r := range records {
+		if isBackfilled(r.ID) {
+			// the event was republished from the archive, which holds it already
+			recordsSkipped.WithLabelValues("backfill").Inc()
+			continue
+		}
+		dir, err := s.Dir(r.Data)
+		if err != nil {
+			recordsSkipped.WithLabelValues("parse").Inc()
+			logger.Errorf("Skipping unparsable event %s: %v", r.ID, err)
+			continue
+		}
+		g := manifestKey(dir, r)
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], r)
+	}
+
+	for _, g := range order {
+		err := s.writeGroup(g, groups[g])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op, since all objects are fully written by the time Write returns
+func (s *Sink) Close() error {
+	return nil
+}
+
+// Dir returns the hourly partition an event belongs in
+func (s *Sink) Dir(data []byte) (string, error) {
+	var e event
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse event: %v", err)
+	}
+	t := eventTime(&e)
+	if t.IsZero() {
+		return "", fmt.Errorf("event has no timestamp")
+	}
+	wiki := e.Wiki
+	if wiki == "" {
+		wiki = "unknown"
+	}
+	return path.Join(s.opts.Prefix, "wiki="+wiki, "date="+t.Format("2006-01-02"), "hour="+t.Format("15")), nil
+}
+
+func (s *Sink) writeGroup(mkey string, records []*sink.Record) error {
+	m, err := s.manifest(mkey)
+	if err != nil {
+		return err
+	}
+	fromKafka := records[0].Offset >= 0
+	if fromKafka {
+		m.Partition = records[0].Partition
+		var fresh []*sink.Record
+		for _, r := range records {
+			if r.Offset > m.LastOffset {
+				fresh = append(fresh, r)
+			}
+		}
+		if skipped := len(records) - len(fresh); skipped > 0 {
+			recordsSkipped.WithLabelValues("archived").Add(float64(skipped))
+		}
+		records = fresh
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	var body []byte
+	var ext, contentType string
+	if s.opts.Format == FormatParquet {
+		body, err = encodeParquet(records)
+		ext, contentType = ".parquet", "application/vnd.apache.parquet"
+	} else {
+		body, err = encodeNDJSON(records)
+		ext, contentType = ".ndjson.gz", "application/x-ndjson"
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode objects: %v", err)
+	}
+	first, last := records[0], records[len(records)-1]
+	key := path.Join(path.Dir(mkey), objectName(records)+ext)
+	if !fromKafka && m.lists(key) {
+		// objects of records without offsets are named by their events, so these have been archived before
+		recordsSkipped.WithLabelValues("archived").Add(float64(len(records)))
+		return nil
+	}
+	err = s.client.Upload(key, body, contentType)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	objectsWritten.Inc()
+	bytesWritten.Add(float64(len(body)))
+
+	entry := ManifestEntry{
+		Key:         key,
+		Format:      s.opts.Format,
+		Records:     len(records),
+		Bytes:       len(body),
+		FirstOffset: first.Offset,
+		LastOffset:  last.Offset,
+		Created:     time.Now().UTC(),
+	}
+	updated := &Manifest{
+		Partition:  m.Partition,
+		LastOffset: m.LastOffset,
+		Objects:    append(append([]ManifestEntry{}, m.Objects...), entry),
+	}
+	if fromKafka {
+		updated.LastOffset = last.Offset
+	}
+	mb, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	err = s.client.PutObject(mkey, mb, "application/json")
+	if err != nil {
+		return fmt.Errorf("failed to update manifest %s: %v", mkey, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.manifests) >= maxCachedManifests {
+		s.manifests = make(map[string]*Manifest)
+	}
+	s.manifests[mkey] = updated
+	return nil
+}
+
+// lists returns whether the manifest lists the object key
+func (m *Manifest) lists(key string) bool {
+	for _, o := range m.Objects {
+		if o.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// manifest returns the current manifest for a key, from cache or from the bucket
+func (s *Sink) manifest(key string) (*Manifest, error) {
+	s.mu.Lock()
+	m, ok := s.manifests[key]
+	s.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	b, err := s.client.GetObject(key)
+	if err == ErrNotFound {
+		return &Manifest{Partition: -1, LastOffset: -1}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %v", key, err)
+	}
+	m = &Manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", key, err)
+	}
+	return m, nil
+}
+
+// manifestKey returns the manifest a record is tracked in.
+// Each kafka partition has its own manifest, so that consumers of different partitions never write the same manifest.
+func manifestKey(dir string, r *sink.Record) string {
+	if r.Offset < 0 {
+		return path.Join(dir, "_manifest.json")
+	}
+	return path.Join(dir, fmt.Sprintf("_manifest-p%d.json", r.Partition))
+}
+
+// objectName derives a deterministic object name from the records it contains,
+// so that rewriting the same records after a failure replaces the earlier object instead of duplicating it
+func objectName(records []*sink.Record) string {
+	first, last := records[0], records[len(records)-1]
+	if first.Offset >= 0 {
+		return fmt.Sprintf("p%d-%020d-%020d", first.Partition, first.Offset, last.Offset)
+	}
+	h := sha1.New()
+	for _, r := range records {
+		h.Write([]byte(r.ID))
+		h.Write([]byte{0})
+	}
+	return "ev-" + hex.EncodeToString(h.Sum(nil))
+}
+
+func encodeNDJSON(records []*sink.Record) ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	for _, r := range records {
+		_, err := zw.Write(append(bytes.TrimSpace(r.Data), '\n'))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func encodeParquet(records []*sink.Record) ([]byte, error) {
+	var b bytes.Buffer
+	cols := parquet.EventColumns()
+	w, err := parquet.NewWriter(&b, cols, &parquet.WriterOpts{RowGroupSize: len(records)})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		row, err := parquet.EventRow(cols, r.Data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.WriteRow(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
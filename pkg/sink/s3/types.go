@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// FormatNDJSON writes gzip-compressed newline-delimited JSON objects
+	FormatNDJSON = "ndjson"
+	// FormatParquet writes gzip-compressed Parquet objects with one column per event field
+	FormatParquet = "parquet"
+
+	// minPartSize is the smallest part size S3 accepts for all but the last part of a multipart upload
+	minPartSize = 5 * 1024 * 1024
+)
+
+// Sink archives events as time-partitioned objects in S3-compatible storage
+type Sink struct {
+	opts   *Opts
+	client *Client
+
+	mu        sync.Mutex
+	manifests map[string]*Manifest
+}
+
+// Opts hold configuration for the S3 sink
+type Opts struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Prefix    string
+	Format    string
+	PartSize  int
+}
+
+// Manifest lists the objects written to one hourly partition from one kafka partition.
+// Readers should only consider objects listed in a manifest; objects that are not listed were
+// left behind by an interrupted write and will have been rewritten under the same name.
+type Manifest struct {
+	Partition  int             `json:"partition"`
+	LastOffset int64           `json:"last_offset"`
+	Objects    []ManifestEntry `json:"objects"`
+}
+
+// ManifestEntry describes a single archived object
+type ManifestEntry struct {
+	Key         string    `json:"key"`
+	Format      string    `json:"format"`
+	Records     int       `json:"records"`
+	Bytes       int       `json:"bytes"`
+	FirstOffset int64     `json:"first_offset"`
+	LastOffset  int64     `json:"last_offset"`
+	Created     time.Time `json:"created"`
+}
+
+// event holds the fields needed to partition an event
+type event struct {
+	Meta *struct {
+		DT string `json:"dt"`
+	} `json:"meta"`
+	Timestamp int64  `json:"timestamp"`
+	Wiki      string `json:"wiki"`
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// ErrNoBucket is returned when a Client is created without an endpoint or bucket
+var ErrNoBucket = fmt.Errorf("No S3 endpoint or bucket provided")
+
+// ErrNotFound is returned when a requested object does not exist
+var ErrNotFound = fmt.Errorf("object not found")
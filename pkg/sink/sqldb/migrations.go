@@ -0,0 +1,54 @@
+package sqldb
+
+// The events table and its indexes, one migration per schema version.
+// Migrations are applied in order and never changed once released; add a new one instead.
+
+var postgresMigrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS pleiades_events (
+			meta_id      TEXT PRIMARY KEY,
+			wiki         TEXT NOT NULL,
+			type         TEXT NOT NULL,
+			title        TEXT,
+			username     TEXT,
+			namespace    INTEGER,
+			bot          BOOLEAN NOT NULL DEFAULT FALSE,
+			ts           TIMESTAMPTZ NOT NULL,
+			length_delta BIGINT,
+			data         JSONB NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_wiki_ts ON pleiades_events (wiki, ts)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_type_ts ON pleiades_events (type, ts)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_title ON pleiades_events (title)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_username ON pleiades_events (username)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_namespace ON pleiades_events (namespace)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_bot ON pleiades_events (bot)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_ts ON pleiades_events (ts)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_length_delta ON pleiades_events (length_delta)`,
+	},
+}
+
+var sqliteMigrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS pleiades_events (
+			meta_id      TEXT PRIMARY KEY,
+			wiki         TEXT NOT NULL,
+			type         TEXT NOT NULL,
+			title        TEXT,
+			username     TEXT,
+			namespace    INTEGER,
+			bot          BOOLEAN NOT NULL DEFAULT 0,
+			ts           TIMESTAMP NOT NULL,
+			length_delta INTEGER,
+			data         TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_wiki_ts ON pleiades_events (wiki, ts)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_type_ts ON pleiades_events (type, ts)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_title ON pleiades_events (title)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_username ON pleiades_events (username)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_namespace ON pleiades_events (namespace)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_bot ON pleiades_events (bot)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_ts ON pleiades_events (ts)`,
+		`CREATE INDEX IF NOT EXISTS pleiades_events_length_delta ON pleiades_events (length_delta)`,
+	},
+}
@@ -0,0 +1,38 @@
+package sqldb
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/plugin"
+)
+
+// Options are the configuration values of the SQL sink
+var Options = []plugin.Option{
+	{Name: "sql.driver", Usage: "the database driver to use ('postgres', or 'sqlite3' in binaries built with cgo)", Default: DriverPostgres},
+	{Name: "sql.dsn", Usage: "the database to write events to (a connection string for postgres, a file name for sqlite3)", Default: ""},
+	{Name: "sql.batchSize", Usage: "the maximum number of events per insert transaction", Default: 500},
+	{Name: "sql.flushInterval", Usage: "the maximum time to wait before inserting an incomplete batch", Default: 5 * time.Second},
+}
+
+func init() {
+	publisher.Register(&publisher.Plugin{
+		Name:        "sql",
+		Description: "SQL publisher",
+		Options:     Options,
+		New: func(cfg plugin.Config, src <-chan *sse.Event) (publisher.Publisher, error) {
+			return NewPublisher(OptsFromConfig(cfg), src)
+		},
+	})
+}
+
+// OptsFromConfig returns the Opts described by the values of Options
+func OptsFromConfig(cfg plugin.Config) *Opts {
+	return &Opts{
+		Driver:        cfg.String("sql.driver"),
+		DSN:           cfg.String("sql.dsn"),
+		BatchSize:     cfg.Int("sql.batchSize"),
+		FlushInterval: cfg.Duration("sql.flushInterval"),
+	}
+}
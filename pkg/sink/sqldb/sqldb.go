@@ -0,0 +1,312 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	// database driver, SQLite is registered in sqlite_cgo.go
+	_ "github.com/lib/pq"
+)
+
+const (
+	moduleName = "sql-sink"
+
+	insertColumns = "meta_id, wiki, type, title, username, namespace, bot, ts, length_delta, data"
+	numColumns    = 10
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	dialects = map[string]*dialect{
+		DriverPostgres: {
+			placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+			maxParams:   65535,
+			migrations:  postgresMigrations,
+			// serialises migrations of instances starting at the same time, released on commit
+			lock: "SELECT pg_advisory_xact_lock(7355608)",
+		},
+		DriverSQLite: {
+			placeholder: func(n int) string { return "?" },
+			maxParams:   999,
+			migrations:  sqliteMigrations,
+		},
+	}
+
+	rowsInserted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_sql_rows_inserted_total",
+			Help: "Total number of events inserted into the database",
+		},
+	)
+
+	rowsSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_sql_rows_skipped_total",
+			Help: "Total number of events not inserted, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	insertTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_sql_insert_duration_seconds",
+			Help:    "Time taken to insert a batch of events",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5},
+		},
+	)
+)
+
+// NewSink opens the database given and brings its schema up to date
+func NewSink(opts *Opts) (*Sink, error) {
+	if opts.DSN == "" {
+		return nil, ErrNoDSN
+	}
+	if opts.Driver == "" {
+		opts.Driver = DriverPostgres
+	}
+	d, ok := dialects[opts.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %s (use %s or %s)", opts.Driver, DriverPostgres, DriverSQLite)
+	}
+	if opts.Driver == DriverSQLite && !sqliteSupported {
+		return nil, ErrNoSQLite
+	}
+	db, err := sql.Open(opts.Driver, opts.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if opts.Driver == DriverSQLite {
+		// SQLite only supports a single writer
+		db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	s := &Sink{
+		opts:    opts,
+		db:      db,
+		dialect: d,
+	}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database schema: %v", err)
+	}
+	return s, nil
+}
+
+// NewPublisher returns a Publisher that writes events from the source channel into the database
+func NewPublisher(opts *Opts, src <-chan *sse.Event) (publisher.Publisher, error) {
+	s, err := NewSink(opts)
+	if err != nil {
+		return nil, err
+	}
+	return sink.NewPublisher("sql", s, &sink.PublisherOpts{
+		BatchSize:     opts.BatchSize,
+		FlushInterval: opts.FlushInterval,
+	}, src)
+}
+
+// Write inserts a batch of events in a single transaction using multi-row inserts.
+// Events whose meta.id is already present are ignored, so batches can safely be written more than once.
+func (s *Sink) Write(records []*sink.Record) error {
+	timer := prometheus.NewTimer(insertTime)
+	defer timer.ObserveDuration()
+
+	var rows []*row
+	seen := make(map[string]bool, len(records))
+	for _, r := range records {
+		rw, err := parseRow(r.Data)
+		if err != nil {
+			rowsSkipped.WithLabelValues("parse").Inc()
+			logger.Errorf("Skipping event %s: %v", r.ID, err)
+			continue
+		}
+		if seen[rw.metaID] {
+			rowsSkipped.WithLabelValues("duplicate").Inc()
+			continue
+		}
+		seen[rw.metaID] = true
+		rows = append(rows, rw)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	var inserted int64
+	perStatement := s.dialect.maxParams / numColumns
+	for start := 0; start < len(rows); start += perStatement {
+		end := start + perStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+		query, args := s.insertStatement(rows[start:end])
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert events: %v", err)
+		}
+		n, err := res.RowsAffected()
+		if err == nil {
+			inserted += n
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit events: %v", err)
+	}
+	rowsInserted.Add(float64(inserted))
+	rowsSkipped.WithLabelValues("duplicate").Add(float64(int64(len(rows)) - inserted))
+	return nil
+}
+
+// Close closes the database connection
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
+
+// insertStatement builds a single multi-row insert that skips rows whose meta_id already exists
+func (s *Sink) insertStatement(rows []*row) (string, []interface{}) {
+	var b strings.Builder
+	args := make([]interface{}, 0, len(rows)*numColumns)
+	b.WriteString("INSERT INTO pleiades_events (" + insertColumns + ") VALUES ")
+	for i, r := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for c := 1; c <= numColumns; c++ {
+			if c > 1 {
+				b.WriteString(", ")
+			}
+			b.WriteString(s.dialect.placeholder(i*numColumns + c))
+		}
+		b.WriteString(")")
+		var ns, delta interface{}
+		if r.namespace != nil {
+			ns = *r.namespace
+		}
+		if r.lengthDelta != nil {
+			delta = *r.lengthDelta
+		}
+		args = append(args, r.metaID, r.wiki, r.typ, r.title, r.user, ns, r.bot, r.ts, delta, r.data)
+	}
+	b.WriteString(" ON CONFLICT (meta_id) DO NOTHING")
+	return b.String(), args
+}
+
+// migrate applies all migrations newer than the schema version recorded in the database.
+// Each migration re-reads the version inside its own transaction, after taking the dialect's lock,
+// so instances starting at the same time apply every migration exactly once.
+func (s *Sink) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS pleiades_schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	for i := range s.dialect.migrations {
+		err = s.applyMigration(ctx, i+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration for the given schema version unless it has been applied already
+func (s *Sink) applyMigration(ctx context.Context, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.dialect.lock != "" {
+		_, err = tx.ExecContext(ctx, s.dialect.lock)
+		if err != nil {
+			return fmt.Errorf("failed to lock schema migrations: %v", err)
+		}
+	}
+	var current sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT MAX(version) FROM pleiades_schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if int(current.Int64) >= version {
+		return nil
+	}
+	logger.Infof("Applying schema migration %d", version)
+	for _, stmt := range s.dialect.migrations[version-1] {
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", version, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO pleiades_schema_migrations (version, applied_at) VALUES (%s, %s)",
+		s.dialect.placeholder(1), s.dialect.placeholder(2)), version, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %v", version, err)
+	}
+	return tx.Commit()
+}
+
+// parseRow extracts the indexed columns from an event
+func parseRow(data []byte) (*row, error) {
+	var e event
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse event: %v", err)
+	}
+	if e.Meta == nil || e.Meta.ID == "" {
+		return nil, fmt.Errorf("event has no meta.id")
+	}
+	r := &row{
+		metaID:    e.Meta.ID,
+		wiki:      e.Wiki,
+		typ:       e.Type,
+		title:     e.Title,
+		user:      e.User,
+		namespace: e.Namespace,
+		bot:       e.Bot,
+		data:      string(data),
+	}
+	r.ts, err = time.Parse(time.RFC3339, e.Meta.DT)
+	if err != nil {
+		if e.Timestamp == 0 {
+			return nil, fmt.Errorf("event has no timestamp")
+		}
+		r.ts = time.Unix(e.Timestamp, 0)
+	}
+	r.ts = r.ts.UTC()
+	if e.Length != nil {
+		delta := e.Length.New - e.Length.Old
+		r.lengthDelta = &delta
+	}
+	return r, nil
+}
@@ -0,0 +1,129 @@
+package sqldb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gargath/pleiades/pkg/sink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func testRecord(id string, wiki string, length string) *sink.Record {
+	return &sink.Record{
+		ID:   "kafka-" + id,
+		Data: []byte(fmt.Sprintf(`{"meta":{"id":"%s","dt":"2020-08-01T14:10:00Z"},"wiki":"%s","type":"edit","title":"Page %s","user":"Someone","namespace":0,"bot":true,"timestamp":1596291000%s}`, id, wiki, id, length)),
+	}
+}
+
+var _ = Describe("SQL Sink", func() {
+
+	var (
+		dir string
+		dsn string
+		s   *Sink
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pleiades-sql")
+		Expect(err).NotTo(HaveOccurred())
+		dsn = filepath.Join(dir, "events.db")
+		s, err = NewSink(&Opts{Driver: DriverSQLite, DSN: dsn})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	count := func(where string) int {
+		var n int
+		Expect(s.db.QueryRow("SELECT COUNT(*) FROM pleiades_events " + where).Scan(&n)).To(Succeed())
+		return n
+	}
+
+	It("migrates the schema only once", func() {
+		var version int
+		Expect(s.db.QueryRow("SELECT MAX(version) FROM pleiades_schema_migrations").Scan(&version)).To(Succeed())
+		Expect(version).Should(Equal(len(sqliteMigrations)))
+
+		s2, err := NewSink(&Opts{Driver: DriverSQLite, DSN: dsn})
+		Expect(err).NotTo(HaveOccurred())
+		defer s2.Close()
+		var applied int
+		Expect(s2.db.QueryRow("SELECT COUNT(*) FROM pleiades_schema_migrations").Scan(&applied)).To(Succeed())
+		Expect(applied).Should(Equal(len(sqliteMigrations)))
+	})
+
+	It("applies each migration once when migrating concurrently", func() {
+		_, err := s.db.Exec("DELETE FROM pleiades_schema_migrations")
+		Expect(err).NotTo(HaveOccurred())
+
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			go func() { errs <- s.migrate() }()
+		}
+		for i := 0; i < cap(errs); i++ {
+			Expect(<-errs).To(Succeed())
+		}
+		var applied int
+		Expect(s.db.QueryRow("SELECT COUNT(*) FROM pleiades_schema_migrations").Scan(&applied)).To(Succeed())
+		Expect(applied).Should(Equal(len(sqliteMigrations)))
+	})
+
+	It("stores indexed columns and the full event", func() {
+		r := testRecord("a1", "enwiki", `,"length":{"old":100,"new":40}`)
+		Expect(s.Write([]*sink.Record{r})).To(Succeed())
+
+		var wiki, typ, title, user, data string
+		var ns int
+		var bot bool
+		var delta int64
+		err := s.db.QueryRow("SELECT wiki, type, title, username, namespace, bot, length_delta, data FROM pleiades_events WHERE meta_id = 'a1'").
+			Scan(&wiki, &typ, &title, &user, &ns, &bot, &delta, &data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]interface{}{wiki, typ, title, user, ns, bot, delta}).Should(Equal([]interface{}{"enwiki", "edit", "Page a1", "Someone", 0, true, int64(-60)}))
+		Expect(data).Should(MatchJSON(r.Data))
+		Expect(count("WHERE ts >= '2020-08-01 14:00:00' AND ts < '2020-08-01 15:00:00'")).Should(Equal(1))
+		Expect(count("WHERE length_delta IS NULL")).Should(Equal(0))
+	})
+
+	It("ignores events that have already been written", func() {
+		batch := []*sink.Record{testRecord("a1", "enwiki", ""), testRecord("a2", "dewiki", ""), testRecord("a1", "enwiki", "")}
+		Expect(s.Write(batch)).To(Succeed())
+		Expect(s.Write(append(batch, testRecord("a3", "dewiki", "")))).To(Succeed())
+		Expect(count("")).Should(Equal(3))
+		Expect(count("WHERE wiki = 'dewiki'")).Should(Equal(2))
+		Expect(count("WHERE length_delta IS NULL")).Should(Equal(3))
+	})
+
+	It("splits large batches into several statements", func() {
+		var batch []*sink.Record
+		for i := 0; i < 1000; i++ {
+			batch = append(batch, testRecord(fmt.Sprintf("id%d", i), "enwiki", ""))
+		}
+		Expect(s.Write(batch)).To(Succeed())
+		Expect(count("")).Should(Equal(1000))
+	})
+
+	It("skips events without an ID", func() {
+		Expect(s.Write([]*sink.Record{{ID: "x", Data: []byte(`{"wiki":"enwiki","timestamp":1}`)}, {ID: "y", Data: []byte(`not json`)}})).To(Succeed())
+		Expect(count("")).Should(Equal(0))
+	})
+
+	It("uses numbered placeholders for postgres", func() {
+		pg := &Sink{dialect: dialects[DriverPostgres]}
+		r, err := parseRow(testRecord("a1", "enwiki", "").Data)
+		Expect(err).NotTo(HaveOccurred())
+		query, args := pg.insertStatement([]*row{r, r})
+		Expect(query).Should(HavePrefix("INSERT INTO pleiades_events (" + insertColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10), ($11,"))
+		Expect(strings.HasSuffix(query, "$20) ON CONFLICT (meta_id) DO NOTHING")).Should(BeTrue())
+		Expect(args).Should(HaveLen(20))
+	})
+})
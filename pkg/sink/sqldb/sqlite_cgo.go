@@ -0,0 +1,11 @@
+//go:build cgo
+// +build cgo
+
+package sqldb
+
+import (
+	// go-sqlite3 is a cgo package and only works in binaries built with cgo
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSupported = true
@@ -0,0 +1,80 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// DriverPostgres selects PostgreSQL via github.com/lib/pq
+	DriverPostgres = "postgres"
+	// DriverSQLite selects SQLite via github.com/mattn/go-sqlite3
+	DriverSQLite = "sqlite3"
+)
+
+// Sink writes events into a relational table
+type Sink struct {
+	opts    *Opts
+	db      *sql.DB
+	dialect *dialect
+}
+
+// Opts hold configuration for the SQL sink
+type Opts struct {
+	Driver string
+	DSN    string
+
+	// BatchSize and FlushInterval control batching when the sink is used as a publisher
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// dialect holds everything that differs between the supported databases
+type dialect struct {
+	placeholder func(n int) string
+	// maxParams is the maximum number of bind parameters in a single statement
+	maxParams  int
+	migrations [][]string
+	// lock is executed at the start of every migration transaction, if set
+	lock string
+}
+
+// row is a single event as stored in the events table
+type row struct {
+	metaID      string
+	wiki        string
+	typ         string
+	title       string
+	user        string
+	namespace   *int
+	bot         bool
+	ts          time.Time
+	lengthDelta *int64
+	data        string
+}
+
+// event holds the fields extracted into their own columns
+type event struct {
+	Meta *struct {
+		ID string `json:"id"`
+		DT string `json:"dt"`
+	} `json:"meta"`
+	Wiki      string `json:"wiki"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	User      string `json:"user"`
+	Namespace *int   `json:"namespace"`
+	Bot       bool   `json:"bot"`
+	Timestamp int64  `json:"timestamp"`
+	Length    *struct {
+		Old int64 `json:"old"`
+		New int64 `json:"new"`
+	} `json:"length"`
+}
+
+// ErrNoDSN indicates that no data source name was configured
+var ErrNoDSN error = fmt.Errorf("No database DSN configured")
+
+// ErrNoSQLite indicates that SQLite was selected in a binary built without cgo
+var ErrNoSQLite error = fmt.Errorf("SQLite is not supported by this binary, rebuild it with CGO_ENABLED=1 or use --sql.driver=%s", DriverPostgres)
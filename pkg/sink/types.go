@@ -0,0 +1,73 @@
+package sink
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/avro"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/util"
+	"github.com/segmentio/kafka-go"
+)
+
+// Record is a single event to be written to a Sink
+// Partition and Offset identify the kafka message the event was read from.
+// Records that did not come from kafka have an Offset of -1.
+type Record struct {
+	ID        string
+	Data      []byte
+	Partition int
+	Offset    int64
+}
+
+// Sink writes batches of events to an external system
+// Write must only return once all records are durably stored, or return an error if they are not.
+// Writing the same record twice must not result in duplicates.
+type Sink interface {
+	Write(records []*Record) error
+	Close() error
+}
+
+// Consumer reads events from kafka as part of a consumer group and writes them to a Sink
+// Offsets are only committed after the Sink has accepted a batch.
+type Consumer struct {
+	opts    *ConsumerOpts
+	sink    Sink
+	k       *kafka.Reader
+	decoder *avro.Deserializer
+	stop    chan (bool)
+	spinner *util.Spinner
+}
+
+// ConsumerOpts hold configuration for a sink Consumer
+type ConsumerOpts struct {
+	Broker        string
+	Topic         string
+	GroupID       string
+	BatchSize     int
+	FlushInterval time.Duration
+	// SchemaRegistry is the URL of the schema registry to decode Avro messages with
+	SchemaRegistry string
+}
+
+// Publisher adapts a Sink to the ingester's publisher interface
+type Publisher struct {
+	opts     *PublisherOpts
+	sink     Sink
+	name     string
+	source   <-chan *sse.Event
+	msgCount int64
+	batch    []*Record
+}
+
+// PublisherOpts hold configuration for a sink Publisher
+type PublisherOpts struct {
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// ErrNilChan indicates that the Publisher has no source channel
+var ErrNilChan error = fmt.Errorf("Source channel is nil")
+
+// ErrNoSrc is returned when a Consumer is created without kafka details
+var ErrNoSrc = fmt.Errorf("No source kafka details provided")
@@ -0,0 +1,134 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	eventsTransformed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_transform_events_total",
+			Help: "Total number of events transformed before publishing",
+		},
+	)
+
+	eventsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_transform_dropped_total",
+			Help: "Total number of events dropped because they could not be transformed",
+		},
+	)
+)
+
+// NewChain builds a Chain from a list of transform specs, applied in the order given.
+// Each spec is the name of a transform, optionally followed by a colon and its arguments:
+//
+//	drop:<field>[,<field>...]     removes fields, e.g. drop:comment,parsedcomment
+//	hash-user[:anonymous|all]     replaces IP usernames (or all usernames) with a keyed hash
+//	truncate:<field>:<length>     shortens a string field to at most length characters
+//	derive-project                adds project_family and project_language
+//
+// Nested fields are addressed with dots, e.g. meta.request_id.
+func NewChain(specs []string, opts *Opts) (Chain, error) {
+	var c Chain
+	for _, s := range specs {
+		t, err := parse(s, opts)
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, t)
+	}
+	return c, nil
+}
+
+// Process decodes an event, applies all transforms of the chain to it and returns the re-encoded event
+func (c Chain) Process(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var event map[string]interface{}
+	err := d.Decode(&event)
+	if err != nil {
+		eventsDropped.Inc()
+		return nil, fmt.Errorf("failed to parse event: %v", err)
+	}
+	for _, t := range c {
+		err = t.Apply(event)
+		if err != nil {
+			eventsDropped.Inc()
+			return nil, err
+		}
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	err = e.Encode(event)
+	if err != nil {
+		eventsDropped.Inc()
+		return nil, fmt.Errorf("failed to encode event: %v", err)
+	}
+	eventsTransformed.Inc()
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func parse(spec string, opts *Opts) (Transform, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	name, args := parts[0], ""
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+	switch name {
+	case "drop":
+		if args == "" {
+			return nil, fmt.Errorf("transform %s requires a list of fields", name)
+		}
+		t := &dropFields{}
+		for _, f := range strings.Split(args, ",") {
+			t.paths = append(t.paths, strings.Split(strings.TrimSpace(f), "."))
+		}
+		return t, nil
+	case "hash-user":
+		if opts == nil || opts.Secret == "" {
+			return nil, ErrNoSecret
+		}
+		switch args {
+		case "", HashAnonymous:
+			return &hashUser{secret: []byte(opts.Secret)}, nil
+		case HashAll:
+			return &hashUser{secret: []byte(opts.Secret), all: true}, nil
+		}
+		return nil, fmt.Errorf("invalid mode %s for transform %s (use %s or %s)", args, name, HashAnonymous, HashAll)
+	case "truncate":
+		a := strings.Split(args, ":")
+		if len(a) != 2 {
+			return nil, fmt.Errorf("transform %s requires a field and a length, e.g. truncate:title:255", name)
+		}
+		max, err := strconv.Atoi(a[1])
+		if err != nil || max < 1 {
+			return nil, fmt.Errorf("invalid length %s for transform %s", a[1], name)
+		}
+		return &truncate{path: strings.Split(a[0], "."), max: max}, nil
+	case "derive-project":
+		return &deriveProject{}, nil
+	}
+	return nil, fmt.Errorf("unknown transform %s", name)
+}
+
+// lookup returns the object holding the field at path, and the name of the field within it
+func lookup(event map[string]interface{}, path []string) (map[string]interface{}, string) {
+	m := event
+	for _, p := range path[:len(path)-1] {
+		next, ok := m[p].(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		m = next
+	}
+	return m, path[len(path)-1]
+}
@@ -0,0 +1,13 @@
+package transform
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTransform(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Transform Suite")
+}
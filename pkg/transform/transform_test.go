@@ -0,0 +1,156 @@
+package transform
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testEvent = `{"id":1234567890123,"type":"edit","namespace":3,"title":"User talk:192.0.2.1/Archive","user":"192.0.2.1",` +
+	`"comment":"fixed <b>typo</b>","parsedcomment":"fixed typo","server_name":"de.wikipedia.org","wiki":"dewiki",` +
+	`"meta":{"uri":"https://de.wikipedia.org/wiki/User_talk:192.0.2.1/Archive","request_id":"abc"}}`
+
+func process(specs []string, data string) map[string]interface{} {
+	c, err := NewChain(specs, &Opts{Secret: "secret"})
+	Expect(err).NotTo(HaveOccurred())
+	out, err := c.Process([]byte(data))
+	Expect(err).NotTo(HaveOccurred())
+	var event map[string]interface{}
+	Expect(json.Unmarshal(out, &event)).To(Succeed())
+	return event
+}
+
+var _ = Describe("Transform chain", func() {
+
+	It("drops top-level and nested fields", func() {
+		event := process([]string{"drop:comment,parsedcomment,meta.request_id"}, testEvent)
+		Expect(event).NotTo(HaveKey("comment"))
+		Expect(event).NotTo(HaveKey("parsedcomment"))
+		Expect(event["meta"]).NotTo(HaveKey("request_id"))
+		Expect(event["meta"]).To(HaveKey("uri"))
+	})
+
+	It("hashes IP usernames, including in user page titles and URIs", func() {
+		event := process([]string{"hash-user"}, testEvent)
+		user := event["user"].(string)
+		Expect(user).To(HavePrefix(AnonymousPrefix))
+		Expect(user).To(HaveLen(len(AnonymousPrefix) + 32))
+		Expect(IsAnonymous(user)).To(BeTrue())
+		Expect(event["title"]).To(Equal("User talk:" + user + "/Archive"))
+		Expect(event["meta"].(map[string]interface{})["uri"]).To(Equal("https://de.wikipedia.org/wiki/User_talk:" + user + "/Archive"))
+		Expect(string(mustMarshal(event))).NotTo(ContainSubstring("192.0.2.1"))
+	})
+
+	It("hashes the same username to the same value", func() {
+		a := process([]string{"hash-user"}, testEvent)
+		b := process([]string{"hash-user"}, `{"user":"192.0.2.1"}`)
+		Expect(a["user"]).To(Equal(b["user"]))
+	})
+
+	It("leaves registered usernames alone unless all usernames are hashed", func() {
+		data := `{"user":"Example","namespace":2,"title":"User:Example"}`
+		event := process([]string{"hash-user:anonymous"}, data)
+		Expect(event["user"]).To(Equal("Example"))
+		Expect(event["title"]).To(Equal("User:Example"))
+
+		event = process([]string{"hash-user:all"}, data)
+		Expect(event["user"]).NotTo(Equal("Example"))
+		Expect(IsAnonymous(event["user"].(string))).To(BeFalse())
+		Expect(event["title"]).To(Equal("User:" + event["user"].(string)))
+	})
+
+	It("hashes IP addresses in comments and log parameters", func() {
+		data := `{"type":"log","user":"Admin","comment":"Block 192.0.2.1 and 2001:DB8:0:0:0:0:0:1 at 12:30:45",` +
+			`"parsedcomment":"<a href=\"/wiki/Special:Contributions/192.0.2.1\">192.0.2.1</a>",` +
+			`"log_action_comment":"blocked User:192.0.2.1","log_params":{"target":"192.0.2.1","flags":["nocreate"],"list":["192.0.2.7"]}}`
+		event := process([]string{"hash-user"}, data)
+		ip := process([]string{"hash-user"}, `{"user":"192.0.2.1"}`)["user"].(string)
+		ip6 := process([]string{"hash-user"}, `{"user":"2001:DB8:0:0:0:0:0:1"}`)["user"].(string)
+		Expect(event["comment"]).To(Equal("Block " + ip + " and " + ip6 + " at 12:30:45"))
+		Expect(event["log_action_comment"]).To(Equal("blocked User:" + ip))
+		Expect(event["log_params"].(map[string]interface{})["target"]).To(Equal(ip))
+		Expect(event["log_params"].(map[string]interface{})["flags"]).To(Equal([]interface{}{"nocreate"}))
+		out := string(mustMarshal(event))
+		Expect(out).NotTo(ContainSubstring("192.0.2"))
+		Expect(out).To(ContainSubstring("Admin"))
+	})
+
+	It("hashes the username in comments if all usernames are hashed", func() {
+		event := process([]string{"hash-user:all"}, `{"user":"Jane Doe","comment":"Undo [[User:Jane_Doe]] and Jane Doe"}`)
+		user := event["user"].(string)
+		Expect(event["comment"]).To(Equal("Undo [[User:" + user + "]] and " + user))
+	})
+
+	It("only hashes whole-word mentions of short usernames", func() {
+		event := process([]string{"hash-user:all"}, `{"user":"Jo","comment":"Jo: joined John's Jo-Jo (Jo)","log_params":{"note":"by Jo"}}`)
+		user := event["user"].(string)
+		Expect(event["comment"]).To(Equal(user + ": joined John's " + user + "-" + user + " (" + user + ")"))
+		Expect(event["log_params"].(map[string]interface{})["note"]).To(Equal("by " + user))
+
+		event = process([]string{"hash-user:all"}, `{"user":"Foo (bar)","comment":"Foo (bar) and [Foo (bar)]"}`)
+		user = event["user"].(string)
+		Expect(event["comment"]).To(Equal(user + " and [" + user + "]"))
+	})
+
+	It("hashes IPv6 usernames", func() {
+		event := process([]string{"hash-user"}, `{"user":"2001:DB8:0:0:0:0:0:1"}`)
+		Expect(event["user"]).To(HaveLen(len(AnonymousPrefix) + 32))
+	})
+
+	It("truncates strings by character", func() {
+		event := process([]string{"truncate:title:4"}, `{"title":"Ämter und Würden"}`)
+		Expect(event["title"]).To(Equal("Ämte"))
+		event = process([]string{"truncate:meta.uri:5"}, testEvent)
+		Expect(event["meta"].(map[string]interface{})["uri"]).To(Equal("https"))
+	})
+
+	It("derives project family and language", func() {
+		event := process([]string{"derive-project"}, testEvent)
+		Expect(event["project_family"]).To(Equal("wikipedia"))
+		Expect(event["project_language"]).To(Equal("de"))
+
+		event = process([]string{"derive-project"}, `{"server_name":"commons.wikimedia.org"}`)
+		Expect(event["project_family"]).To(Equal("commons"))
+		Expect(event).NotTo(HaveKey("project_language"))
+
+		event = process([]string{"derive-project"}, `{"server_name":"www.wikidata.org"}`)
+		Expect(event["project_family"]).To(Equal("wikidata"))
+		Expect(event).NotTo(HaveKey("project_language"))
+	})
+
+	It("applies transforms in order and preserves other fields", func() {
+		c, err := NewChain([]string{"drop:comment", "hash-user", "truncate:title:4"}, &Opts{Secret: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+		out, err := c.Process([]byte(testEvent))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(ContainSubstring(`"id":1234567890123`))
+		Expect(string(out)).To(ContainSubstring(`"title":"User"`))
+		Expect(string(out)).NotTo(ContainSubstring("192.0.2.1"))
+	})
+
+	It("rejects invalid specs", func() {
+		for _, spec := range []string{"unknown", "drop", "truncate:title", "truncate:title:x", "hash-user:some"} {
+			_, err := NewChain([]string{spec}, &Opts{Secret: "secret"})
+			Expect(err).To(HaveOccurred(), spec)
+		}
+	})
+
+	It("refuses to hash usernames without a secret", func() {
+		_, err := NewChain([]string{"hash-user"}, &Opts{})
+		Expect(err).To(Equal(ErrNoSecret))
+	})
+
+	It("fails on events that are not JSON objects", func() {
+		c, err := NewChain([]string{"drop:comment"}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Process([]byte("not json"))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+	return b
+}
@@ -0,0 +1,178 @@
+package transform
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gargath/pleiades/pkg/project"
+)
+
+// namespaces whose page titles are usernames
+var userNamespaces = map[string]bool{"2": true, "3": true}
+
+// textFields are the fields of free text and log parameters in which usernames may appear
+var textFields = []string{"comment", "parsedcomment", "log_action_comment", "log_params"}
+
+// ipCandidate matches what may be an IPv4 or IPv6 address in free text. Matches are only hashed if they parse as one.
+var ipCandidate = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4}`)
+
+// Apply removes the configured fields
+func (t *dropFields) Apply(event map[string]interface{}) error {
+	for _, p := range t.paths {
+		m, field := lookup(event, p)
+		if m != nil {
+			delete(m, field)
+		}
+	}
+	return nil
+}
+
+// Apply hashes the event's username.
+// The username also appears in the title and URI of user and user talk pages, so it is hashed there as well.
+// Every IP address in the comments and log parameters of the event is hashed too. When all usernames are hashed, so
+// are the whole-word mentions of the event's username there. Other registered usernames are left as they are.
+// Hashed IP addresses start with AnonymousPrefix, so that anonymous edits can still be told apart.
+func (t *hashUser) Apply(event map[string]interface{}) error {
+	user, _ := event["user"].(string)
+	if t.matches(user) {
+		event["user"] = t.hash(user)
+	}
+	var mentions *regexp.Regexp
+	if t.all && user != "" {
+		mentions = wholeWords(user, strings.Replace(user, " ", "_", -1))
+	}
+	for _, f := range textFields {
+		if v, ok := event[f]; ok {
+			event[f] = t.hashText(v, user, mentions)
+		}
+	}
+
+	ns, _ := event["namespace"].(json.Number)
+	title, _ := event["title"].(string)
+	if !userNamespaces[ns.String()] {
+		return nil
+	}
+	parts := strings.SplitN(title, ":", 2)
+	if len(parts) < 2 {
+		return nil
+	}
+	name := strings.SplitN(parts[1], "/", 2)[0]
+	if !t.matches(name) {
+		return nil
+	}
+	hashed := t.hash(name)
+	event["title"] = parts[0] + ":" + strings.Replace(parts[1], name, hashed, 1)
+	if meta, ok := event["meta"].(map[string]interface{}); ok {
+		if uri, ok := meta["uri"].(string); ok {
+			meta["uri"] = strings.Replace(uri, strings.Replace(name, " ", "_", -1), hashed, -1)
+		}
+	}
+	return nil
+}
+
+func (t *hashUser) matches(user string) bool {
+	if user == "" {
+		return false
+	}
+	return t.all || net.ParseIP(user) != nil
+}
+
+// hashText hashes the IP addresses in a string, or in the strings of a JSON object or array.
+// If mentions is not nil, the mentions of user it matches are replaced with the hash of user as well.
+func (t *hashUser) hashText(v interface{}, user string, mentions *regexp.Regexp) interface{} {
+	switch v := v.(type) {
+	case string:
+		if mentions != nil {
+			v = mentions.ReplaceAllLiteralString(v, t.hash(user))
+		}
+		return ipCandidate.ReplaceAllStringFunc(v, func(ip string) string {
+			if net.ParseIP(ip) == nil {
+				return ip
+			}
+			return t.hash(ip)
+		})
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = t.hashText(e, user, mentions)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = t.hashText(e, user, mentions)
+		}
+	}
+	return v
+}
+
+// hash returns the first 128 bits of the HMAC-SHA256 of a username, after AnonymousPrefix if it is an IP address
+func (t *hashUser) hash(user string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(user))
+	hashed := hex.EncodeToString(mac.Sum(nil)[:16])
+	if net.ParseIP(user) != nil {
+		return AnonymousPrefix + hashed
+	}
+	return hashed
+}
+
+// wholeWords returns a regexp matching any of the words given where it is not part of a longer word
+func wholeWords(words ...string) *regexp.Regexp {
+	alternatives := make([]string, len(words))
+	for i, w := range words {
+		alternatives[i] = regexp.QuoteMeta(w)
+		// \b only separates word and non-word characters, so it is only required next to word characters
+		if isWordChar(w[0]) {
+			alternatives[i] = `\b` + alternatives[i]
+		}
+		if isWordChar(w[len(w)-1]) {
+			alternatives[i] += `\b`
+		}
+	}
+	return regexp.MustCompile(strings.Join(alternatives, "|"))
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// IsAnonymous returns whether a username is that of an anonymous edit, either an IP address or one hashed by the
+// hash-user transform
+func IsAnonymous(user string) bool {
+	return strings.HasPrefix(user, AnonymousPrefix) || net.ParseIP(user) != nil
+}
+
+// Apply shortens the configured field if it is a string longer than the limit
+func (t *truncate) Apply(event map[string]interface{}) error {
+	m, field := lookup(event, t.path)
+	if m == nil {
+		return nil
+	}
+	s, ok := m[field].(string)
+	if !ok || utf8.RuneCountInString(s) <= t.max {
+		return nil
+	}
+	runes := []rune(s)
+	m[field] = string(runes[:t.max])
+	return nil
+}
+
+// Apply sets project_family and project_language from the event's wiki and server name, as mapped by the built-in project table.
+// project_language is only set for wikis that have one, e.g. en.wikipedia.org but not commons.wikimedia.org.
+func (t *deriveProject) Apply(event map[string]interface{}) error {
+	wiki, _ := event["wiki"].(string)
+	server, _ := event["server_name"].(string)
+	p, ok := project.Builtin().Lookup(wiki, server)
+	if !ok {
+		return nil
+	}
+	event["project_family"] = p.Family
+	if p.Language != "" {
+		event["project_language"] = p.Language
+	}
+	return nil
+}
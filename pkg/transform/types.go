@@ -0,0 +1,56 @@
+package transform
+
+import (
+	"fmt"
+)
+
+const (
+	// HashAnonymous only hashes usernames that are IP addresses, i.e. those of anonymous edits
+	HashAnonymous = "anonymous"
+	// HashAll hashes every username
+	HashAll = "all"
+
+	// AnonymousPrefix starts the hashes of IP addresses. Usernames cannot contain a colon, so it marks anonymous edits
+	// once their IP address is hashed.
+	AnonymousPrefix = "ip:"
+)
+
+var (
+	// ErrNoSecret is returned when usernames are to be hashed without a secret
+	ErrNoSecret error = fmt.Errorf("hashing usernames requires a secret")
+)
+
+// Transform modifies a single decoded event in place
+type Transform interface {
+	Apply(event map[string]interface{}) error
+}
+
+// Chain applies a list of transforms to each event in order
+type Chain []Transform
+
+// Opts hold configuration shared by the transforms of a chain
+type Opts struct {
+	// Secret is the key usernames are hashed with. Without it, the hash of an IP address could be
+	// reversed by simply hashing all addresses.
+	Secret string
+}
+
+// dropFields removes fields from the event
+type dropFields struct {
+	paths [][]string
+}
+
+// hashUser replaces usernames with a keyed hash
+type hashUser struct {
+	secret []byte
+	all    bool
+}
+
+// truncate shortens a string field to a maximum number of characters
+type truncate struct {
+	path []string
+	max  int
+}
+
+// deriveProject adds the project family and language of the wiki an event occurred on
+type deriveProject struct{}
@@ -2,6 +2,8 @@ package util
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -13,6 +15,14 @@ const moduleName = "util"
 
 var (
 	logger = logging.MustGetLogger(moduleName)
+
+	// unlock deletes the lock in KEYS[1] if it still holds the token in ARGV[1]
+	unlock = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
 )
 
 // NewValidatedRedisClient creates a new redis client and performs a PING before returning it
@@ -37,3 +47,27 @@ func NewValidatedRedisClient(opts *RedisOpts) (*redis.Client, error) {
 	logger.Debugf("Connected to Redis: %v", pong)
 	return r, nil
 }
+
+// TryLock acquires the lock in key for at most ttl, so that only one instance does the work it guards.
+// It returns nil if another instance holds the lock.
+func TryLock(ctx context.Context, r *redis.Client, key string, ttl time.Duration) (*Lock, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate lock token: %v", err)
+	}
+	token := hex.EncodeToString(b)
+	ok, err := r.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &Lock{r: r, key: key, token: token}, nil
+}
+
+// Release deletes the lock unless it has expired and been acquired by another instance since
+func (l *Lock) Release() {
+	err := unlock.Run(context.Background(), l.r, []string{l.key}, l.token).Err()
+	if err != nil {
+		logger.Errorf("Failed to release lock %s: %v", l.key, err)
+	}
+}
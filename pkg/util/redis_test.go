@@ -0,0 +1,60 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redis lock", func() {
+
+	var (
+		m *miniredis.Miniredis
+		r *redis.Client
+	)
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	})
+
+	AfterEach(func() {
+		r.Close()
+		m.Close()
+	})
+
+	It("is held by a single instance until released", func() {
+		lock, err := TryLock(context.Background(), r, "test_lock", time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lock).NotTo(BeNil())
+
+		other, err := TryLock(context.Background(), r, "test_lock", time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeNil())
+
+		lock.Release()
+		Expect(m.Exists("test_lock")).To(BeFalse())
+	})
+
+	It("is not released once another instance has acquired it after it expired", func() {
+		lock, err := TryLock(context.Background(), r, "test_lock", time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		m.FastForward(2 * time.Minute)
+
+		other, err := TryLock(context.Background(), r, "test_lock", time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).NotTo(BeNil())
+
+		lock.Release()
+		Expect(m.Exists("test_lock")).To(BeTrue())
+		other.Release()
+		Expect(m.Exists("test_lock")).To(BeFalse())
+	})
+})
@@ -1,7 +1,16 @@
 package util
 
+import "github.com/go-redis/redis/v8"
+
 // RedisOpts contains redis configuration
 type RedisOpts struct {
 	RedisAddr        string
 	RedisUseSentinel bool
 }
+
+// Lock is a lock held in Redis by a single instance
+type Lock struct {
+	r     *redis.Client
+	key   string
+	token string
+}
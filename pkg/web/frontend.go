@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/gargath/pleiades/pkg/bucket"
 	"github.com/gargath/pleiades/pkg/log"
 	"github.com/gargath/pleiades/pkg/util"
 	"github.com/gargath/pleiades/pkg/web/static"
@@ -36,6 +37,14 @@ func (f *Frontend) Start() error {
 	sr.HandleFunc("/stats", f.statsHandler)
 	sr.HandleFunc("/stats/{day}", f.statsForDayHandler)
 	sr.HandleFunc("/days", f.daysHandler)
+	sr.HandleFunc("/buckets", f.daysHandler)
+	sr.HandleFunc("/top/pages", f.topPagesHandler)
+	sr.HandleFunc("/distribution", f.distributionHandler)
+	sr.HandleFunc("/moderation", f.moderationHandler)
+	sr.HandleFunc("/rates", f.ratesHandler)
+	sr.HandleFunc("/trending", f.trendingHandler)
+	sr.HandleFunc("/hotspots", f.hotspotsHandler)
+	sr.HandleFunc("/risk", f.riskHandler)
 	//	s.HandleFunc("/stats/{key}", f.singleStatHandler)
 	//	r.HandleFunc("/ws", f.websocketHandler)
 
@@ -52,6 +61,10 @@ func (f *Frontend) Start() error {
 
 // NewFrontend initialized a frontend server
 func NewFrontend(fo *Opts) (*Frontend, error) {
+	loc, err := time.LoadLocation(fo.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create frontend: unknown time zone %s: %v", fo.Timezone, err)
+	}
 	r, err := util.NewValidatedRedisClient(fo.Redis)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create frontend: %v", err)
@@ -62,5 +75,6 @@ func NewFrontend(fo *Opts) (*Frontend, error) {
 		listenAddr: fo.ListenAddr,
 	}
 	s.r = r
+	s.buckets = &bucket.Config{Location: loc}
 	return s, nil
 }
@@ -10,12 +10,76 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/histogram"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	// topPagesKey starts the sorted sets of the most edited pages written by the aggregator's default rules,
+	// followed by the wiki and optionally _ns_<namespace> and _human
+	topPagesKey = "pleiades_top_pages_"
+
+	defaultTopLimit = 50
+	maxTopLimit     = 1000
+
+	// editSizeKey, bytesAddedKey and bytesRemovedKey are the edit size histograms and gross bytes written by the
+	// aggregator's default rules, overall and followed by _<wiki>
+	editSizeKey     = "pleiades_edit_size"
+	bytesAddedKey   = "pleiades_bytes_added"
+	bytesRemovedKey = "pleiades_bytes_removed"
+
+	// logActionsKey is the hash of log actions written by the aggregator's default rules, whose fields are
+	// <log_type>/<log_action>, overall and followed by _<wiki>
+	logActionsKey = "pleiades_log_actions"
+
+	// trendingKey starts the decaying sorted sets of trending pages written by the aggregator's default rules,
+	// followed by the wiki. trendingTemplate is the template of their keys in the rules.
+	trendingKey      = "pleiades_trending_"
+	trendingTemplate = "pleiades_trending_{wiki}"
+
+	// halfLivesKey is the hash of the key templates of the decaying sorted sets the aggregator writes and their
+	// half-lives
+	halfLivesKey = "pleiades_half_lives"
+
+	// hotspotsKey and editWarsKey start the sorted sets of pages by the number of reverts and of reverts in edit wars
+	// written by the aggregator's default rules, followed by the wiki
+	hotspotsKey = "pleiades_hotspots_"
+	editWarsKey = "pleiades_edit_wars_"
+
+	// riskFeedKey and riskyUsersKey start the sorted sets of risky edits and of the users who made them written by the
+	// aggregator's default rules, followed by the wiki. The members of the feed are <revision>|<factors>|<user>|<title>,
+	// scored by their risk.
+	riskFeedKey   = "pleiades_risk_feed_"
+	riskyUsersKey = "pleiades_risky_users_"
+
+	// rateKey and rateWikisKey are the counter and hash of events per wiki written to rate slots by the aggregator's
+	// default rules
+	rateKey      = "pleiades_rate"
+	rateWikisKey = "pleiades_rate_wikis"
+
+	// rollupSourcesKey is the hash of the resolutions the aggregator rolls up and the resolutions they are rolled up
+	// from, and rollupKey is followed by a rolled up resolution to name the last bucket of it rolled up
+	rollupSourcesKey = "pleiades_rollup_sources"
+	rollupKey        = "pleiades_rollup_"
+
+	// mergeKey holds HyperLogLogs merged to count them
+	mergeKey = "pleiades_merge"
+
+	// hllMagic starts the string representation of HyperLogLogs in Redis
+	hllMagic = "HYLL"
+
+	// maxRange is the maximum number of buckets whose counters are combined in a single request
+	maxRange = 1000
+)
+
 var (
+	// data before this date is spurious because the ingest wasn't running. All we have is events that arrived out of sequence
+	firstDay = time.Unix(18489*86400, 0)
+
 	counterDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "pleiades_web_counter_marshal_duration_seconds",
 		Help: "Time taken to generate the stats json",
@@ -32,7 +96,12 @@ func (f *Frontend) daysHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
 
-	days, err := f.getDays(ctx)
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+
+	days, err := f.getDays(ctx, res)
 	if err != nil {
 		logger.Errorf("Error retrieving available days from Redis keys: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -53,14 +122,41 @@ func (f *Frontend) daysHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (f *Frontend) statsHandler(w http.ResponseWriter, r *http.Request) {
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	from, to, ok := f.bucketRange(w, r, res)
+	if !ok {
+		return
+	}
+	f.writeCounters(w, res, from, to)
+}
+
+func (f *Frontend) statsForDayHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	n, err := strconv.ParseInt(vars["day"], 10, 64)
+	if err != nil {
+		logger.Infof("Rejecting invalid day format %s: %v", vars["day"], err)
+		w.WriteHeader(http.StatusBadRequest) //TODO: Add an error response that is useful
+		return
+	}
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	f.writeCounters(w, res, n, n)
+}
+
+// writeCounters responds with the counters of buckets from to to at the resolution given
+func (f *Frontend) writeCounters(w http.ResponseWriter, res bucket.Resolution, from, to int64) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
 
-	julianDay := time.Now().Unix() / 86400
-
-	counters, err := f.getAllCounters(ctx, julianDay)
+	counters, err := f.getCountersInRange(ctx, res, from, to)
 	if err != nil {
 		logger.Errorf("Error retrieving Redis stats: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -71,8 +167,11 @@ func (f *Frontend) statsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	resp := &Counters{
-		Since:    julianDay * 86400,
-		Counters: counters,
+		Since:      f.buckets.Start(res, from).Unix(),
+		Resolution: res.Name,
+		Bucket:     from,
+		Last:       to,
+		Counters:   counters,
 	}
 	b, err := json.Marshal(resp)
 	if err != nil {
@@ -84,38 +183,175 @@ func (f *Frontend) statsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(b))
 }
 
-func (f *Frontend) statsForDayHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+func (f *Frontend) topPagesHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	wiki := q.Get("wiki")
+	if wiki == "" {
+		logger.Info("Rejecting top pages request without wiki")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := topPagesKey + wiki
+	if ns := q.Get("namespace"); ns != "" {
+		if _, err := strconv.Atoi(ns); err != nil {
+			logger.Infof("Rejecting invalid namespace %s: %v", ns, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key += "_ns_" + ns
+	}
+	if bots := q.Get("bots"); bots != "" {
+		include, err := strconv.ParseBool(bots)
+		if err != nil {
+			logger.Infof("Rejecting invalid bots filter %s: %v", bots, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !include {
+			key += "_human"
+		}
+	}
+	limit, ok := topLimit(w, r)
+	if !ok {
+		return
+	}
+	n, ok := f.bucketIndex(w, r, res)
+	if !ok {
+		return
+	}
 
-	julianDay, err := strconv.ParseInt(vars["day"], 10, 64)
+	pages, err := f.getTopPages(ctx, bucket.Prefix(res, n)+key, limit)
 	if err != nil {
-		logger.Infof("Rejecting invalid day format %s: %v", vars["day"], err)
-		w.WriteHeader(http.StatusBadRequest) //TODO: Add an error response that is useful
+		logger.Errorf("Error retrieving top pages from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := &TopPages{
+		Since:      f.buckets.Start(res, n).Unix(),
+		Resolution: res.Name,
+		Bucket:     n,
+		Wiki:       wiki,
+		Pages:      pages,
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		logger.Errorf("Error marshalling top pages respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(out))
+}
 
+func (f *Frontend) distributionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
 
-	counters, err := f.getAllCounters(ctx, julianDay)
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	from, to, ok := f.bucketRange(w, r, res)
+	if !ok {
+		return
+	}
+	wiki := r.URL.Query().Get("wiki")
+	suffix := ""
+	if wiki != "" {
+		suffix = "_" + wiki
+	}
+
+	d, err := f.getDistribution(ctx, res, from, to, suffix)
 	if err != nil {
-		logger.Errorf("Error retrieving Redis stats: %v", err)
+		logger.Errorf("Error retrieving edit size distribution from Redis: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if counters == nil {
-		w.WriteHeader(http.StatusNotFound)
+	d.Since = f.buckets.Start(res, from).Unix()
+	d.Resolution = res.Name
+	d.Bucket = from
+	d.Last = to
+	d.Wiki = wiki
+	b, err := json.Marshal(d)
+	if err != nil {
+		logger.Errorf("Error marshalling distribution respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	resp := &Counters{
-		Since:    julianDay * 86400,
-		Counters: counters,
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(b))
+}
+
+func (f *Frontend) moderationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	from, to, ok := f.bucketRange(w, r, res)
+	if !ok {
+		return
+	}
+	wiki := r.URL.Query().Get("wiki")
+	key := logActionsKey
+	if wiki != "" {
+		key += "_" + wiki
+	}
+
+	types, err := f.getLogTypes(ctx, res, from, to, key)
+	if err != nil {
+		logger.Errorf("Error retrieving log actions from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := &Moderation{
+		Since:      f.buckets.Start(res, from).Unix(),
+		Resolution: res.Name,
+		Bucket:     from,
+		Last:       to,
+		Wiki:       wiki,
+		LogTypes:   types,
 	}
 	b, err := json.Marshal(resp)
 	if err != nil {
-		logger.Errorf("Error marshalling stats respone: %v", err)
+		logger.Errorf("Error marshalling moderation respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(b))
+}
+
+func (f *Frontend) ratesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	rates, err := f.getRates(ctx, time.Now(), r.URL.Query().Get("wiki"))
+	if err != nil {
+		logger.Errorf("Error retrieving rates from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(rates)
+	if err != nil {
+		logger.Errorf("Error marshalling rates respone: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -123,10 +359,244 @@ func (f *Frontend) statsForDayHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(b))
 }
 
-func (f *Frontend) getKeys(ctx context.Context, day int64) ([]string, error) {
-	prefix := fmt.Sprintf("day_%d_pleiades*", day)
-	logger.Debugf("getting counters for prefix %s", prefix)
-	keys, err := f.r.Keys(ctx, prefix).Result()
+func (f *Frontend) trendingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	q := r.URL.Query()
+	wiki := q.Get("wiki")
+	if wiki == "" {
+		logger.Info("Rejecting trending pages request without wiki")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, ok := topLimit(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	decay, ok, err := f.getDecay(ctx, trendingTemplate)
+	if err != nil {
+		logger.Errorf("Error retrieving the half-life of trending pages from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := &Trending{
+		Time:  now.Unix(),
+		Wiki:  wiki,
+		Pages: []TrendingPage{},
+	}
+	if ok {
+		resp.HalfLife = decay.HalfLife.String()
+		resp.Pages, err = f.getTrending(ctx, now, decay, trendingKey+wiki, limit)
+		if err != nil {
+			logger.Errorf("Error retrieving trending pages from Redis: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		logger.Errorf("Error marshalling trending pages respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(b))
+}
+
+func (f *Frontend) hotspotsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	wiki := q.Get("wiki")
+	if wiki == "" {
+		logger.Info("Rejecting hotspots request without wiki")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, ok := topLimit(w, r)
+	if !ok {
+		return
+	}
+	n, ok := f.bucketIndex(w, r, res)
+	if !ok {
+		return
+	}
+
+	pages, err := f.getHotspots(ctx, bucket.Prefix(res, n), wiki, limit)
+	if err != nil {
+		logger.Errorf("Error retrieving hotspots from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := &Hotspots{
+		Since:      f.buckets.Start(res, n).Unix(),
+		Resolution: res.Name,
+		Bucket:     n,
+		Wiki:       wiki,
+		Pages:      pages,
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		logger.Errorf("Error marshalling hotspots respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(b))
+}
+
+func (f *Frontend) riskHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	res, ok := resolution(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	wiki := q.Get("wiki")
+	if wiki == "" {
+		logger.Info("Rejecting risk feed request without wiki")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, ok := topLimit(w, r)
+	if !ok {
+		return
+	}
+	n, ok := f.bucketIndex(w, r, res)
+	if !ok {
+		return
+	}
+
+	prefix := bucket.Prefix(res, n)
+	edits, err := f.getRiskyEdits(ctx, prefix+riskFeedKey+wiki, limit)
+	if err != nil {
+		logger.Errorf("Error retrieving risky edits from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	users, err := f.getRiskyUsers(ctx, prefix+riskyUsersKey+wiki, limit)
+	if err != nil {
+		logger.Errorf("Error retrieving risky users from Redis: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := &RiskFeed{
+		Since:      f.buckets.Start(res, n).Unix(),
+		Resolution: res.Name,
+		Bucket:     n,
+		Wiki:       wiki,
+		Edits:      edits,
+		Users:      users,
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		logger.Errorf("Error marshalling risk feed respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(b))
+}
+
+// bucketIndex returns the bucket requested with the bucket query parameter, the current bucket if none is given.
+// If it is invalid, it responds with an error and returns false.
+func (f *Frontend) bucketIndex(w http.ResponseWriter, r *http.Request, res bucket.Resolution) (int64, bool) {
+	b := r.URL.Query().Get("bucket")
+	if b == "" {
+		return f.buckets.Index(res, time.Now()), true
+	}
+	n, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		logger.Infof("Rejecting invalid bucket %s: %v", b, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+// bucketRange returns the range of buckets requested with the from and to query parameters, the current bucket if
+// neither is given. If the range is invalid, it responds with an error and returns false.
+func (f *Frontend) bucketRange(w http.ResponseWriter, r *http.Request, res bucket.Resolution) (int64, int64, bool) {
+	q := r.URL.Query()
+	now := f.buckets.Index(res, time.Now())
+	if q.Get("from") == "" && q.Get("to") == "" {
+		return now, now, true
+	}
+	from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+	if err != nil {
+		logger.Infof("Rejecting invalid range start %s: %v", q.Get("from"), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, 0, false
+	}
+	to := now
+	if q.Get("to") != "" {
+		to, err = strconv.ParseInt(q.Get("to"), 10, 64)
+		if err != nil {
+			logger.Infof("Rejecting invalid range end %s: %v", q.Get("to"), err)
+			w.WriteHeader(http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	if to < from || to-from >= maxRange {
+		logger.Infof("Rejecting invalid range %d to %d", from, to)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// resolution returns the resolution requested with the resolution query parameter, days if none is given.
+// If it is invalid, it responds with an error and returns false.
+func resolution(w http.ResponseWriter, r *http.Request) (bucket.Resolution, bool) {
+	name := r.URL.Query().Get("resolution")
+	if name == "" {
+		return bucket.Day, true
+	}
+	res, err := bucket.ParseResolution(name)
+	if err != nil {
+		logger.Infof("Rejecting invalid resolution: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return res, false
+	}
+	return res, true
+}
+
+// topLimit returns the number of entries requested with the limit query parameter, defaultTopLimit if none is given.
+// If it is invalid, it responds with an error and returns false.
+func topLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	l := r.URL.Query().Get("limit")
+	if l == "" {
+		return defaultTopLimit, true
+	}
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit < 1 || limit > maxTopLimit {
+		logger.Infof("Rejecting invalid limit %s", l)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+func (f *Frontend) getKeys(ctx context.Context, prefix string) ([]string, error) {
+	pattern := prefix + "pleiades*"
+	logger.Debugf("getting counters for pattern %s", pattern)
+	keys, err := f.r.Keys(ctx, pattern).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -134,71 +604,538 @@ func (f *Frontend) getKeys(ctx context.Context, day int64) ([]string, error) {
 	return keys, nil
 }
 
-func (f *Frontend) getAllCounters(ctx context.Context, julianDay int64) ([]Counter, error) {
-	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_counters"))
+// getCountersInRange returns the counters of buckets from to to of the resolution given, combined by readCounters
+func (f *Frontend) getCountersInRange(ctx context.Context, res bucket.Resolution, from, to int64) ([]Counter, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_counters_range"))
+	defer timer.ObserveDuration()
 
-	prefix := fmt.Sprintf("day_%d_", julianDay)
-	keys, err := f.getKeys(ctx, julianDay)
+	spans, err := f.spans(ctx, res, from, to)
 	if err != nil {
 		return nil, err
 	}
+	var keys []string
+	for _, s := range spans {
+		k, err := f.getKeysInRange(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
 	if len(keys) == 0 {
 		return nil, nil
 	}
-	out := make([]Counter, len(keys))
-	result, error := f.r.MGet(ctx, keys...).Result()
-	if error != nil {
-		return nil, error
+	return f.readCounters(ctx, keys, func(k string) string {
+		return strings.SplitN(k, "_", 3)[2]
+	})
+}
+
+// getKeysInRange returns the keys of the counters of the buckets of a span, listing each bucket's prefix in one pipeline
+func (f *Frontend) getKeysInRange(ctx context.Context, s span) ([]string, error) {
+	if s.from == s.to {
+		return f.getKeys(ctx, bucket.Prefix(s.res, s.from))
 	}
-	for i, k := range keys {
-		var val string
-		var ok bool
-		if val, ok = result[i].(string); !ok {
-			return nil, fmt.Errorf("invalid non-string type in Redis counter %s: %v ", k, result[i])
+	var cmds []*redis.StringSliceCmd
+	_, err := f.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for n := s.from; n <= s.to; n++ {
+			cmds = append(cmds, p.Keys(ctx, bucket.Prefix(s.res, n)+"pleiades*"))
 		}
-		parsedVal, err := strconv.ParseInt(val, 10, 64)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, c := range cmds {
+		keys = append(keys, c.Val()...)
+	}
+	return keys, nil
+}
+
+// spans returns the buckets holding the counters of buckets from to to of the resolution given. If the aggregator rolls
+// up the resolution, the buckets that have not been rolled up yet, like the current one, are read from the buckets of
+// the resolution they are rolled up from instead.
+func (f *Frontend) spans(ctx context.Context, res bucket.Resolution, from, to int64) ([]span, error) {
+	var source *redis.StringCmd
+	var last *redis.StringCmd
+	_, err := f.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		source = p.HGet(ctx, rollupSourcesKey, res.Name)
+		last = p.Get(ctx, rollupKey+res.Name)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if source.Err() == redis.Nil {
+		return []span{{res: res, from: from, to: to}}, nil
+	}
+	src, err := bucket.ParseResolution(source.Val())
+	if err != nil {
+		return nil, fmt.Errorf("invalid source of rolled up resolution %s: %v", res.Name, err)
+	}
+	rolledUp, err := last.Int64()
+	if err == redis.Nil {
+		rolledUp = from - 1
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid last bucket of rolled up resolution %s: %v", res.Name, err)
+	}
+	if rolledUp >= to {
+		return []span{{res: res, from: from, to: to}}, nil
+	}
+
+	var spans []span
+	start := from
+	if rolledUp >= from {
+		spans = append(spans, span{res: res, from: from, to: rolledUp})
+		start = rolledUp + 1
+	}
+	rest, err := f.spans(ctx, src, f.buckets.Index(src, f.buckets.Start(res, start)), f.buckets.Index(src, f.buckets.End(res, to))-1)
+	if err != nil {
+		return nil, err
+	}
+	return append(spans, rest...), nil
+}
+
+// readCounters returns the values of the keys given, combining keys of the same name: counters are summed, and
+// HyperLogLogs count the distinct members of their union. Other keys, like sorted sets, are skipped.
+func (f *Frontend) readCounters(ctx context.Context, keys []string, name func(string) string) ([]Counter, error) {
+	var names []string
+	values := make(map[string]int64)
+	hlls := make(map[string][]string)
+	var hllNames []string
+	for i := 0; i < len(keys); i += 1000 {
+		end := i + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		result, err := f.r.MGet(ctx, keys[i:end]...).Result()
 		if err != nil {
-			return nil, fmt.Errorf("redis value not parsable as number: %s - %v", val, err)
+			return nil, err
+		}
+		for j, k := range keys[i:end] {
+			n := name(k)
+			val, ok := result[j].(string)
+			if !ok || strings.HasPrefix(val, hllMagic) {
+				// a HyperLogLog, or a sorted set which PFMERGE rejects
+				if _, ok := hlls[n]; !ok {
+					hllNames = append(hllNames, n)
+				}
+				hlls[n] = append(hlls[n], k)
+				continue
+			}
+			parsedVal, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("redis value not parsable as number: %s - %v", val, err)
+			}
+			if _, ok := values[n]; !ok {
+				names = append(names, n)
+			}
+			values[n] += parsedVal
+		}
+	}
+
+	// HyperLogLogs of the same name are merged into mergeKey, counted and removed again in one transaction
+	merges := make(map[string]*redis.StatusCmd)
+	counts := make(map[string]*redis.IntCmd)
+	_, err := f.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for n, k := range hlls {
+			merges[n] = p.PFMerge(ctx, mergeKey, k...)
+			counts[n] = p.PFCount(ctx, mergeKey)
+			p.Del(ctx, mergeKey)
 		}
+		return nil
+	})
+	if err != nil && !isWrongType(err) {
+		return nil, err
+	}
+	for _, n := range hllNames {
+		if merges[n].Err() != nil {
+			continue
+		}
+		names = append(names, n)
+		values[n] = counts[n].Val()
+	}
+
+	out := make([]Counter, len(names))
+	for i, n := range names {
 		out[i] = Counter{
-			Name:        strings.SplitAfter(k, prefix)[1],
+			Name:        n,
 			Description: "",
-			Value:       parsedVal,
+			Value:       values[n],
 		}
 	}
-	timer.ObserveDuration()
 	return out, nil
 }
 
+// isWrongType returns whether err is Redis rejecting a command for the type of its key
+func isWrongType(err error) bool {
+	return strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+// getTopPages returns the highest scoring pages of a sorted set, at most limit of them
+func (f *Frontend) getTopPages(ctx context.Context, key string, limit int) ([]Page, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_top_pages"))
+	defer timer.ObserveDuration()
+
+	result, err := f.r.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Page, len(result))
+	for i, z := range result {
+		out[i] = Page{Title: fmt.Sprint(z.Member), Edits: int64(z.Score)}
+	}
+	return out, nil
+}
+
+// getRiskyUsers returns the users with the most risky edits in the sorted set key, at most limit of them
+func (f *Frontend) getRiskyUsers(ctx context.Context, key string, limit int) ([]RiskyUser, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_risky_users"))
+	defer timer.ObserveDuration()
+
+	result, err := f.r.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]RiskyUser, len(result))
+	for i, z := range result {
+		out[i] = RiskyUser{User: fmt.Sprint(z.Member), Edits: int64(z.Score)}
+	}
+	return out, nil
+}
+
+// getHotspots returns the most reverted pages of a wiki in the bucket with the prefix given, and the number of their
+// reverts made in edit wars
+func (f *Frontend) getHotspots(ctx context.Context, prefix string, wiki string, limit int) ([]Hotspot, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_hotspots"))
+	defer timer.ObserveDuration()
+
+	result, err := f.r.ZRevRangeWithScores(ctx, prefix+hotspotsKey+wiki, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	wars := make([]*redis.FloatCmd, len(result))
+	_, err = f.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, z := range result {
+			wars[i] = p.ZScore(ctx, prefix+editWarsKey+wiki, fmt.Sprint(z.Member))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	out := make([]Hotspot, len(result))
+	for i, z := range result {
+		out[i] = Hotspot{Title: fmt.Sprint(z.Member), Reverts: int64(z.Score), EditWarReverts: int64(wars[i].Val())}
+	}
+	return out, nil
+}
+
+// getRiskyEdits returns the riskiest edits in the sorted set key, riskiest first. Members that are not of the form
+// <revision>|<factors>|<user>|<title> are skipped.
+func (f *Frontend) getRiskyEdits(ctx context.Context, key string, limit int) ([]RiskyEdit, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_risky_edits"))
+	defer timer.ObserveDuration()
+
+	result, err := f.r.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]RiskyEdit, 0, len(result))
+	for _, z := range result {
+		parts := strings.SplitN(fmt.Sprint(z.Member), "|", 4)
+		if len(parts) < 4 {
+			continue
+		}
+		rev, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, RiskyEdit{
+			Revision: rev,
+			Factors:  strings.Split(parts[1], "+"),
+			User:     parts[2],
+			Title:    parts[3],
+			Risk:     int64(z.Score),
+		})
+	}
+	return out, nil
+}
+
+// getDecay returns the decay of the sorted sets with the key template given, as recorded by the aggregator.
+// It returns false if the aggregator has not recorded a half-life for them.
+func (f *Frontend) getDecay(ctx context.Context, template string) (bucket.Decay, bool, error) {
+	halfLife, err := f.r.HGet(ctx, halfLivesKey, template).Result()
+	if err == redis.Nil {
+		return bucket.Decay{}, false, nil
+	}
+	if err != nil {
+		return bucket.Decay{}, false, err
+	}
+	decay, err := bucket.ParseDecay(halfLife)
+	if err != nil {
+		return bucket.Decay{}, false, fmt.Errorf("invalid half-life of %s: %v", template, err)
+	}
+	return decay, true, nil
+}
+
+// getTrending returns the highest scoring members of the sorted set key decaying with decay, with their scores decayed
+// to now. The current and the previous generation are merged, so that scores do not drop when a new generation starts.
+func (f *Frontend) getTrending(ctx context.Context, now time.Time, decay bucket.Decay, key string, limit int) ([]TrendingPage, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_trending"))
+	defer timer.ObserveDuration()
+
+	gen := decay.Generation()
+	n := decay.Index(now)
+	merge := &redis.ZStore{
+		Keys:    []string{bucket.Prefix(gen, n) + key, bucket.Prefix(gen, n-1) + key},
+		Weights: []float64{1 / decay.Weight(n, now), 1 / decay.Weight(n-1, now)},
+	}
+	var result *redis.ZSliceCmd
+	_, err := f.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZUnionStore(ctx, mergeKey, merge)
+		result = p.ZRevRangeWithScores(ctx, mergeKey, 0, int64(limit-1))
+		p.Del(ctx, mergeKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TrendingPage, len(result.Val()))
+	for i, z := range result.Val() {
+		out[i] = TrendingPage{Title: fmt.Sprint(z.Member), Score: z.Score}
+	}
+	return out, nil
+}
+
+// getDistribution sums the edit size histograms and gross bytes of buckets from to to, of a wiki if suffix names one.
+// The percentiles of edit sizes are those the aggregator stored for a single bucket, and estimated from the summed
+// histogram otherwise.
+func (f *Frontend) getDistribution(ctx context.Context, res bucket.Resolution, from, to int64, suffix string) (*Distribution, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_distribution"))
+	defer timer.ObserveDuration()
+
+	var hists []*redis.StringStringMapCmd
+	var added, removed []*redis.StringCmd
+	var stored *redis.StringStringMapCmd
+	spans, err := f.spans(ctx, res, from, to)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		if len(spans) == 1 && spans[0].from == spans[0].to {
+			stored = p.HGetAll(ctx, bucket.Prefix(spans[0].res, spans[0].from)+editSizeKey+suffix+histogram.PercentilesSuffix)
+		}
+		for _, s := range spans {
+			for n := s.from; n <= s.to; n++ {
+				prefix := bucket.Prefix(s.res, n)
+				hists = append(hists, p.HGetAll(ctx, prefix+editSizeKey+suffix))
+				added = append(added, p.Get(ctx, prefix+bytesAddedKey+suffix))
+				removed = append(removed, p.Get(ctx, prefix+bytesRemovedKey+suffix))
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	d := &Distribution{}
+	counts := make(map[string]int64)
+	for i := range hists {
+		for _, c := range []redis.Cmder{hists[i], added[i], removed[i]} {
+			if c.Err() != nil && c.Err() != redis.Nil {
+				return nil, c.Err()
+			}
+		}
+		for bound, v := range hists[i].Val() {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("histogram count not parsable as number: %s - %v", v, err)
+			}
+			counts[bound] += n
+		}
+		a, _ := added[i].Int64()
+		d.BytesAdded += a
+		r, _ := removed[i].Int64()
+		d.BytesRemoved += r
+	}
+	d.Histogram = histogram.Bins(counts)
+	d.Percentiles = make(map[string]float64)
+	if stored != nil && len(stored.Val()) > 0 {
+		for name, v := range stored.Val() {
+			p, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("percentile not parsable as number: %s - %v", v, err)
+			}
+			d.Percentiles[name] = p
+		}
+		return d, nil
+	}
+	for name, v := range histogram.Percentiles(d.Histogram) {
+		d.Percentiles[name] = v
+	}
+	return d, nil
+}
+
+// getLogTypes sums the log action hashes key of buckets from to to, and groups the actions by log type.
+// Both are ordered by their count, most frequent first.
+func (f *Frontend) getLogTypes(ctx context.Context, res bucket.Resolution, from, to int64, key string) ([]LogType, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_log_types"))
+	defer timer.ObserveDuration()
+
+	spans, err := f.spans(ctx, res, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []*redis.StringStringMapCmd
+	_, err = f.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, s := range spans {
+			for n := s.from; n <= s.to; n++ {
+				hashes = append(hashes, p.HGetAll(ctx, bucket.Prefix(s.res, n)+key))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byType := make(map[string]*LogType)
+	types := []LogType{}
+	for _, h := range hashes {
+		for field, v := range h.Val() {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("log action count not parsable as number: %s - %v", v, err)
+			}
+			i := strings.Index(field, "/")
+			if i < 0 {
+				continue
+			}
+			t, ok := byType[field[:i]]
+			if !ok {
+				t = &LogType{Type: field[:i]}
+				byType[t.Type] = t
+			}
+			t.Count += n
+			found := false
+			for j := range t.Actions {
+				if t.Actions[j].Action == field[i+1:] {
+					t.Actions[j].Count += n
+					found = true
+				}
+			}
+			if !found {
+				t.Actions = append(t.Actions, LogAction{Action: field[i+1:], Count: n})
+			}
+		}
+	}
+	for _, t := range byType {
+		sort.Slice(t.Actions, func(i, j int) bool {
+			if t.Actions[i].Count != t.Actions[j].Count {
+				return t.Actions[i].Count > t.Actions[j].Count
+			}
+			return t.Actions[i].Action < t.Actions[j].Action
+		})
+		types = append(types, *t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Count != types[j].Count {
+			return types[i].Count > types[j].Count
+		}
+		return types[i].Type < types[j].Type
+	})
+	return types, nil
+}
+
+// getRates sums the rate slots of each of the bucket.RateWindows ending at now, overall and per wiki,
+// or for the wiki given only
+func (f *Frontend) getRates(ctx context.Context, now time.Time, wiki string) (*Rates, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_rates"))
+	defer timer.ObserveDuration()
+
+	first, last := bucket.RateRange(now, bucket.RateWindows[len(bucket.RateWindows)-1])
+	var totals []*redis.StringCmd
+	var wikis []*redis.StringStringMapCmd
+	_, err := f.r.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for n := first; n <= last; n++ {
+			prefix := bucket.Prefix(bucket.RateSlot, n)
+			totals = append(totals, p.Get(ctx, prefix+rateKey))
+			wikis = append(wikis, p.HGetAll(ctx, prefix+rateWikisKey))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	rates := &Rates{Time: now.Unix(), Wikis: make(map[string][]Rate)}
+	for _, window := range bucket.RateWindows {
+		from, _ := bucket.RateRange(now, window)
+		seconds := now.Sub(bucket.RateStart(from)).Seconds()
+		name := fmt.Sprintf("%dm", int(window.Minutes()))
+		total := int64(0)
+		perWiki := make(map[string]int64)
+		for i := int(from - first); i < len(totals); i++ {
+			if totals[i].Err() != nil && totals[i].Err() != redis.Nil {
+				return nil, totals[i].Err()
+			}
+			n, _ := totals[i].Int64()
+			total += n
+			for w, v := range wikis[i].Val() {
+				if wiki != "" && w != wiki {
+					continue
+				}
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("rate not parsable as number: %s - %v", v, err)
+				}
+				perWiki[w] += n
+			}
+		}
+		if wiki == "" {
+			rates.Rates = append(rates.Rates, Rate{Window: name, Events: total, PerSecond: float64(total) / seconds})
+		}
+		for w, n := range perWiki {
+			rates.Wikis[w] = append(rates.Wikis[w], Rate{Window: name, Events: n, PerSecond: float64(n) / seconds})
+		}
+	}
+	return rates, nil
+}
+
 func (f *Frontend) getCounter(ctx context.Context, name string) (Counter, error) {
 	c := Counter{}
 	return c, nil
 }
 
-func (f *Frontend) getDays(ctx context.Context) ([]Day, error) {
+// getDays returns the buckets of the resolution given that hold counters
+func (f *Frontend) getDays(ctx context.Context, res bucket.Resolution) ([]Day, error) {
 	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_days"))
 
-	keys, err := f.r.Keys(ctx, "day_*").Result()
+	keys, err := f.r.Keys(ctx, res.Prefix+"_*").Result()
 	if err != nil {
 		return nil, err
 	}
 
-	uniqueDays := make(map[string]bool)
+	uniqueDays := make(map[int64]bool)
 	for _, v := range keys {
 		d := strings.Split(v, "_")[1]
-		dNum, _ := strconv.Atoi(d)
-		if dNum > 18488 { // data before this date is spurious because the ingest wasn't running. All we have is events that arrived out of sequence
-			uniqueDays[d] = true
+		dNum, err := strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			continue
+		}
+		if !f.buckets.Start(res, dNum).Before(firstDay) {
+			uniqueDays[dNum] = true
 		}
 	}
-	d := []string{}
+	d := []int64{}
 	for k := range uniqueDays {
 		d = append(d, k)
 	}
-	sort.Strings(d)
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
 	out := make([]Day, len(d))
 	for i, v := range d {
-		out[i] = Day(v)
+		out[i] = Day(strconv.FormatInt(v, 10))
 	}
 	timer.ObserveDuration()
 	return out, nil
@@ -0,0 +1,231 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Frontend", func() {
+	// the hour and day of 2020-08-10T10:50:38Z
+	const (
+		hour = 443626
+		day  = 18484
+	)
+
+	var (
+		m *miniredis.Miniredis
+		f *Frontend
+	)
+
+	BeforeEach(func() {
+		var err error
+		m, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		f = &Frontend{r: redis.NewClient(&redis.Options{Addr: m.Addr()}), buckets: &bucket.Config{Location: time.UTC}}
+	})
+
+	AfterEach(func() {
+		m.Close()
+	})
+
+	counters := func(res bucket.Resolution, from, to int64) map[string]int64 {
+		c, err := f.getCountersInRange(context.Background(), res, from, to)
+		Expect(err).NotTo(HaveOccurred())
+		out := make(map[string]int64)
+		for _, v := range c {
+			out[v.Name] = v.Value
+		}
+		return out
+	}
+
+	Context("with rolled up resolutions", func() {
+		BeforeEach(func() {
+			m.HSet(rollupSourcesKey, "1h", "1m")
+			m.HSet(rollupSourcesKey, "1d", "1h")
+			Expect(m.Set(rollupKey+"1h", "443625")).To(Succeed())
+			Expect(m.Set(rollupKey+"1d", "18483")).To(Succeed())
+			Expect(m.Set(bucket.Prefix(bucket.Hour, hour-1)+"pleiades_total", "10")).To(Succeed())
+			Expect(m.Set(bucket.Prefix(bucket.Minute, hour*60)+"pleiades_total", "3")).To(Succeed())
+			Expect(m.Set(bucket.Prefix(bucket.Minute, hour*60+59)+"pleiades_total", "4")).To(Succeed())
+			Expect(m.Set(bucket.Prefix(bucket.Minute, hour*60+60)+"pleiades_total", "100")).To(Succeed())
+		})
+
+		It("reads the buckets that have not been rolled up from their source", func() {
+			Expect(counters(bucket.Day, day, day)).To(Equal(map[string]int64{"pleiades_total": 117}))
+			Expect(counters(bucket.Hour, hour, hour)).To(Equal(map[string]int64{"pleiades_total": 7}))
+		})
+
+		It("reads the buckets that have been rolled up", func() {
+			Expect(m.Set(bucket.Prefix(bucket.Day, day)+"pleiades_total", "20")).To(Succeed())
+			Expect(m.Set(rollupKey+"1d", "18484")).To(Succeed())
+			Expect(counters(bucket.Day, day, day)).To(Equal(map[string]int64{"pleiades_total": 20}))
+		})
+
+		It("combines rolled up buckets with their sources", func() {
+			Expect(counters(bucket.Hour, hour-1, hour)).To(Equal(map[string]int64{"pleiades_total": 17}))
+		})
+	})
+
+	It("sums counters and counts the distinct members of HyperLogLogs", func() {
+		r := f.r
+		ctx := context.Background()
+		Expect(m.Set("a_pleiades_total", "5")).To(Succeed())
+		Expect(m.Set("b_pleiades_total", "7")).To(Succeed())
+		Expect(r.PFAdd(ctx, "a_pleiades_users", "A", "B").Err()).To(Succeed())
+		Expect(r.PFAdd(ctx, "b_pleiades_users", "B", "C").Err()).To(Succeed())
+		_, err := m.ZAdd("a_pleiades_top", 1, "Berlin")
+		Expect(err).NotTo(HaveOccurred())
+		c, err := f.readCounters(ctx, []string{"a_pleiades_total", "a_pleiades_users", "a_pleiades_top", "b_pleiades_users", "b_pleiades_total"},
+			func(k string) string { return k[2:] })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal([]Counter{{Name: "pleiades_total", Value: 12}, {Name: "pleiades_users", Value: 3}}))
+		Expect(m.Exists(mergeKey)).To(BeFalse())
+	})
+
+	It("rejects counters that are not numbers", func() {
+		Expect(m.Set("a_pleiades_total", "many")).To(Succeed())
+		_, err := f.readCounters(context.Background(), []string{"a_pleiades_total"}, func(k string) string { return k })
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("computes rates over sliding windows", func() {
+		// 10:50:38, in the rate slot starting at 10:50:30
+		now := time.Date(2020, 8, 10, 10, 50, 38, 0, time.UTC)
+		n := bucket.RateIndex(now)
+		Expect(m.Set(bucket.Prefix(bucket.RateSlot, n)+rateKey, "29")).To(Succeed())
+		m.HSet(bucket.Prefix(bucket.RateSlot, n)+rateWikisKey, "enwiki", "20", "dewiki", "9")
+		// 10:48:50, within the last 5m but not the last 1m
+		Expect(m.Set(bucket.Prefix(bucket.RateSlot, n-10)+rateKey, "58")).To(Succeed())
+		m.HSet(bucket.Prefix(bucket.RateSlot, n-10)+rateWikisKey, "enwiki", "58")
+		// 10:30:30, outside all windows
+		Expect(m.Set(bucket.Prefix(bucket.RateSlot, n-120)+rateKey, "1000")).To(Succeed())
+
+		rates, err := f.getRates(context.Background(), now, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rates.Time).To(Equal(now.Unix()))
+		// the windows start with the first slot within them, at 10:49:40, 10:45:40 and 10:35:40
+		Expect(rates.Rates).To(Equal([]Rate{
+			{Window: "1m", Events: 29, PerSecond: 29.0 / 58},
+			{Window: "5m", Events: 87, PerSecond: 87.0 / 298},
+			{Window: "15m", Events: 87, PerSecond: 87.0 / 898},
+		}))
+		Expect(rates.Wikis).To(Equal(map[string][]Rate{
+			"enwiki": {{Window: "1m", Events: 20, PerSecond: 20.0 / 58}, {Window: "5m", Events: 78, PerSecond: 78.0 / 298}, {Window: "15m", Events: 78, PerSecond: 78.0 / 898}},
+			"dewiki": {{Window: "1m", Events: 9, PerSecond: 9.0 / 58}, {Window: "5m", Events: 9, PerSecond: 9.0 / 298}, {Window: "15m", Events: 9, PerSecond: 9.0 / 898}},
+		}))
+
+		rates, err = f.getRates(context.Background(), now, "dewiki")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rates.Rates).To(BeEmpty())
+		Expect(rates.Wikis).To(HaveKey("dewiki"))
+		Expect(rates.Wikis).To(HaveLen(1))
+	})
+
+	Context("with edit size histograms", func() {
+		BeforeEach(func() {
+			m.HSet(bucket.Prefix(bucket.Day, day)+editSizeKey, "0", "10", "10", "0", "50", "10", "+Inf", "0")
+			m.HSet(bucket.Prefix(bucket.Day, day)+editSizeKey+"_percentiles", "p50", "1", "p95", "2", "p99", "3")
+			m.HSet(bucket.Prefix(bucket.Day, day+1)+editSizeKey, "0", "0", "10", "0", "50", "20", "+Inf", "0")
+			Expect(m.Set(bucket.Prefix(bucket.Day, day)+bytesAddedKey, "100")).To(Succeed())
+			Expect(m.Set(bucket.Prefix(bucket.Day, day+1)+bytesRemovedKey, "30")).To(Succeed())
+		})
+
+		It("serves the percentiles stored for a bucket", func() {
+			d, err := f.getDistribution(context.Background(), bucket.Day, day, day, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Percentiles).To(Equal(map[string]float64{"p50": 1, "p95": 2, "p99": 3}))
+			Expect(d.BytesAdded).To(Equal(int64(100)))
+		})
+
+		It("estimates the percentiles of a range of buckets", func() {
+			d, err := f.getDistribution(context.Background(), bucket.Day, day, day+1, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Histogram).To(Equal([]Bin{{UpperBound: "0", Count: 10}, {UpperBound: "10", Count: 0}, {UpperBound: "50", Count: 30}, {UpperBound: "+Inf", Count: 0}}))
+			// the rank of p50 is 20, the 10th of the 30 edits between 10 and 50
+			Expect(d.Percentiles["p50"]).To(BeNumerically("~", 10+40.0/3, 1e-9))
+			Expect(d.BytesAdded).To(Equal(int64(100)))
+			Expect(d.BytesRemoved).To(Equal(int64(30)))
+		})
+
+		It("estimates the percentiles of a bucket without stored percentiles", func() {
+			d, err := f.getDistribution(context.Background(), bucket.Day, day+1, day+1, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Percentiles["p50"]).To(Equal(30.0))
+		})
+	})
+
+	It("reads the buckets of resolutions that are not rolled up", func() {
+		Expect(m.Set(bucket.Prefix(bucket.Day, day)+"pleiades_total", "5")).To(Succeed())
+		Expect(m.Set(bucket.Prefix(bucket.Day, day+1)+"pleiades_total", "6")).To(Succeed())
+		Expect(counters(bucket.Day, day, day)).To(Equal(map[string]int64{"pleiades_total": 5}))
+		Expect(counters(bucket.Day, day, day+1)).To(Equal(map[string]int64{"pleiades_total": 11}))
+		Expect(counters(bucket.Hour, hour, hour)).To(BeEmpty())
+	})
+	It("reads the users with the most risky edits", func() {
+		m.ZAdd("risky", 3, "Alice")
+		m.ZAdd("risky", 5, "Bob")
+		m.ZAdd("risky", 1, "Carol")
+		users, err := f.getRiskyUsers(context.Background(), "risky", 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(users).To(Equal([]RiskyUser{{User: "Bob", Edits: 5}, {User: "Alice", Edits: 3}}))
+	})
+
+	It("decays trending pages with the half-life recorded by the aggregator", func() {
+		_, ok, err := f.getDecay(context.Background(), trendingTemplate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		m.HSet(halfLivesKey, trendingTemplate, "1h0m0s")
+		decay, ok, err := f.getDecay(context.Background(), trendingTemplate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(decay.HalfLife).To(Equal(time.Hour))
+
+		now := time.Now()
+		n := decay.Index(now)
+		m.ZAdd(bucket.Prefix(decay.Generation(), n)+trendingKey+"enwiki", 10*decay.Weight(n, now), "Foo")
+		pages, err := f.getTrending(context.Background(), now, decay, trendingKey+"enwiki", 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pages).To(HaveLen(1))
+		Expect(pages[0].Title).To(Equal("Foo"))
+		Expect(pages[0].Score).To(BeNumerically("~", 10, 0.001))
+	})
+
+	It("reads the limit and bucket of a request", func() {
+		w := httptest.NewRecorder()
+		limit, ok := topLimit(w, httptest.NewRequest("GET", "/top?limit=5", nil))
+		Expect(ok).To(BeTrue())
+		Expect(limit).To(Equal(5))
+		limit, ok = topLimit(w, httptest.NewRequest("GET", "/top", nil))
+		Expect(ok).To(BeTrue())
+		Expect(limit).To(Equal(defaultTopLimit))
+		n, ok := f.bucketIndex(w, httptest.NewRequest("GET", "/top?bucket=17", nil), bucket.Day)
+		Expect(ok).To(BeTrue())
+		Expect(n).To(Equal(int64(17)))
+		Expect(w.Code).To(Equal(http.StatusOK))
+	})
+
+	It("rejects invalid limits and buckets", func() {
+		for _, l := range []string{"0", "x", strconv.Itoa(maxTopLimit + 1)} {
+			w := httptest.NewRecorder()
+			_, ok := topLimit(w, httptest.NewRequest("GET", "/top?limit="+l, nil))
+			Expect(ok).To(BeFalse())
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		}
+		w := httptest.NewRecorder()
+		_, ok := f.bucketIndex(w, httptest.NewRequest("GET", "/top?bucket=x", nil), bucket.Day)
+		Expect(ok).To(BeFalse())
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+})
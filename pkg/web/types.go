@@ -3,6 +3,8 @@ package web
 import (
 	"net/http"
 
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/histogram"
 	"github.com/gargath/pleiades/pkg/util"
 	"github.com/go-redis/redis/v8"
 )
@@ -13,26 +15,182 @@ type Frontend struct {
 	redis      *util.RedisOpts
 	s          *http.Server
 	r          *redis.Client
+	buckets    *bucket.Config
 }
 
 // Opts configure the frontend server
 type Opts struct {
 	Redis      *util.RedisOpts
 	ListenAddr string
+	// Timezone is the time zone the aggregator's buckets follow
+	Timezone string
+}
+
+// span is a range of buckets of a resolution
+type span struct {
+	res      bucket.Resolution
+	from, to int64
 }
 
 // Counters is the return type for the stats API
 type Counters struct {
-	Since    int64
+	// Since is the start of the bucket in seconds since the epoch
+	Since      int64
+	Resolution string
+	Bucket     int64
+	// Last is the last bucket the counters cover, which is Bucket unless a range was requested
+	Last     int64
 	Counters []Counter
 }
 
-// Counter is a single redis counter value
+// TopPages is the return type for the top pages API
+type TopPages struct {
+	// Since is the start of the bucket in seconds since the epoch
+	Since      int64
+	Resolution string
+	Bucket     int64
+	Wiki       string
+	// Pages are ordered by the number of edits, most edited first
+	Pages []Page
+}
+
+// Hotspots is the return type for the hotspots API
+type Hotspots struct {
+	// Since is the start of the bucket in seconds since the epoch
+	Since      int64
+	Resolution string
+	Bucket     int64
+	Wiki       string
+	// Pages are ordered by the number of reverts, most reverted first
+	Pages []Hotspot
+}
+
+// Hotspot is a contested page, the number of reverts it received and how many of them were made in edit wars
+type Hotspot struct {
+	Title          string
+	Reverts        int64
+	EditWarReverts int64
+}
+
+// RiskFeed is the return type for the risk feed API
+type RiskFeed struct {
+	// Since is the start of the bucket in seconds since the epoch
+	Since      int64
+	Resolution string
+	Bucket     int64
+	Wiki       string
+	// Edits are ordered by their risk, riskiest first
+	Edits []RiskyEdit
+	// Users are ordered by the number of risky edits they made, most first
+	Users []RiskyUser
+}
+
+// RiskyEdit is an edit with a high risk of being vandalism, and the factors making up its risk
+type RiskyEdit struct {
+	Revision int64
+	Title    string
+	User     string
+	Risk     int64
+	Factors  []string
+}
+
+// RiskyUser is a user and the number of risky edits they made
+type RiskyUser struct {
+	User  string
+	Edits int64
+}
+
+// Trending is the return type for the trending pages API
+type Trending struct {
+	// Time is the time the scores are decayed to, in seconds since the epoch
+	Time     int64
+	HalfLife string
+	Wiki     string
+	// Pages are ordered by their score, highest first
+	Pages []TrendingPage
+}
+
+// TrendingPage is a page and its trending score, the weighted number of edits it received decayed by their age
+type TrendingPage struct {
+	Title string
+	Score float64
+}
+
+// Page is a page and the number of edits it received
+type Page struct {
+	Title string
+	Edits int64
+}
+
+// Distribution is the return type for the edit size distribution API
+type Distribution struct {
+	// Since is the start of the first bucket in seconds since the epoch
+	Since      int64
+	Resolution string
+	Bucket     int64
+	Last       int64
+	// Wiki is the wiki the distribution is of, or empty for all wikis
+	Wiki         string
+	BytesAdded   int64
+	BytesRemoved int64
+	// Histogram counts edits by their change in length, in ascending bins
+	Histogram []Bin
+	// Percentiles are estimated from the histogram, e.g. p95
+	Percentiles map[string]float64
+}
+
+// Moderation is the return type for the moderation activity API
+type Moderation struct {
+	// Since is the start of the first bucket in seconds since the epoch
+	Since      int64
+	Resolution string
+	Bucket     int64
+	Last       int64
+	// Wiki is the wiki the log actions are of, or empty for all wikis
+	Wiki string
+	// LogTypes are ordered by the number of actions logged, most frequent first
+	LogTypes []LogType
+}
+
+// LogType counts the actions logged of a type, e.g. block or delete
+type LogType struct {
+	Type    string
+	Count   int64
+	Actions []LogAction
+}
+
+// LogAction counts an action logged, e.g. reblock
+type LogAction struct {
+	Action string
+	Count  int64
+}
+
+// Rates is the return type for the rates API
+type Rates struct {
+	// Time is the time the rates end at, in seconds since the epoch
+	Time int64
+	// Rates are the rates of events on all wikis, one per window. They are omitted if a wiki was requested.
+	Rates []Rate `json:",omitempty"`
+	// Wikis are the rates of events per wiki, for the windows they received events in
+	Wikis map[string][]Rate
+}
+
+// Rate is the number of events received within a sliding window up to now, e.g. the last 5m, and their rate
+type Rate struct {
+	Window    string
+	Events    int64
+	PerSecond float64
+}
+
+// Bin is a bin of a histogram, counting the values above the previous bin's upper bound up to its own
+type Bin = histogram.Bin
+
+// Counter is a single redis counter value, or the number of distinct members of a HyperLogLog
 type Counter struct {
 	Name        string
 	Description string
 	Value       int64
 }
 
-// Day is a single day we have stats for
+// Day is a single day (or bucket of another resolution) we have stats for
 type Day string